@@ -0,0 +1,468 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"vpc/pkg/audit"
+	"vpc/pkg/control"
+	"vpc/pkg/mesh"
+	"vpc/pkg/webhook"
+
+	"github.com/mdp/qrterminal/v3"
+)
+
+func agents(o *options, args []string) error {
+	if len(args) != 0 {
+		return usageError("agents takes no arguments")
+	}
+	var infos []control.AgentInfo
+	if err := o.client.Call("/control/agents", &control.Empty{}, &infos); err != nil {
+		return err
+	}
+	return o.print(infos, "NAME\tADDRESS\tREGISTERED", func() [][]string {
+		var rows [][]string
+		for _, a := range infos {
+			rows = append(rows, []string{a.Name, a.Address, a.Registered.Format(time.RFC3339)})
+		}
+		return rows
+	})
+}
+
+func printWireguards(o *options, infos []control.WireguardInfo) error {
+	return o.print(infos, "NAME\tPORT\tADDRESS\tENDPOINT\tPUBLIC KEY\tPEERS", func() [][]string {
+		var rows [][]string
+		for _, info := range infos {
+			rows = append(rows, []string{info.Name, fmt.Sprint(info.Port), info.Address, info.Endpoint, info.PublicKey, fmt.Sprint(info.Peers)})
+		}
+		return rows
+	})
+}
+
+func wg(o *options, args []string) error {
+	if len(args) != 2 {
+		return usageError("wg needs create or list and an agent")
+	}
+	agent := args[1]
+	switch args[0] {
+	case "create":
+		var info control.WireguardInfo
+		if err := o.client.CallAgent(agent, "/node/wg_create", &control.WireguardArgs{}, &info); err != nil {
+			return err
+		}
+		return printWireguards(o, []control.WireguardInfo{info})
+	case "list":
+		var infos []control.WireguardInfo
+		if err := o.client.CallAgent(agent, "/node/wg_list", &control.Empty{}, &infos); err != nil {
+			return err
+		}
+		return printWireguards(o, infos)
+	}
+	return usageError(fmt.Sprintf("unknown wg command %q", args[0]))
+}
+
+// printPeerConfig writes the config, or its QR code for the mobile apps.
+func printPeerConfig(o *options, conf control.PeerConfig, qr bool) error {
+	if o.json {
+		return o.print(conf, "", nil)
+	}
+	if qr {
+		qrterminal.GenerateHalfBlock(conf.Config, qrterminal.L, os.Stdout)
+		return nil
+	}
+	fmt.Println(conf.Config)
+	return nil
+}
+
+func listPeers(o *options, agent string, iface string) ([]control.PeerInfo, error) {
+	var peers []control.PeerInfo
+	err := o.client.CallAgent(agent, "/node/peer_list", &control.PeerArgs{Iface: iface}, &peers)
+	return peers, err
+}
+
+func handshake(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+func peer(o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError("peer needs add, config, list, profile, remove or routes")
+	}
+	flags := flag.NewFlagSet("peer "+args[0], flag.ContinueOnError)
+	qr := flags.Bool("qr", false, "print the config as a QR code")
+	routes := flags.String("routes", "", "comma separated LAN prefixes, makes the peer a site gateway")
+	profile := flags.String("profile", "", "split tunnel profile: full, vpc, custom or exclude")
+	cidrs := flags.String("cidrs", "", "comma separated CIDRs of the custom or exclude profile")
+	if err := flags.Parse(args[1:]); err != nil {
+		return usageError(err.Error())
+	}
+	pos := flags.Args()
+	switch {
+	case args[0] == "add" && len(pos) == 2:
+		var conf control.PeerConfig
+		if err := o.client.CallAgent(pos[0], "/node/peer_add", &control.PeerArgs{Iface: pos[1], Routes: splitList(*routes), Profile: *profile, CIDRs: splitList(*cidrs)}, &conf); err != nil {
+			return err
+		}
+		return printPeerConfig(o, conf, *qr)
+	case args[0] == "profile" && (len(pos) == 3 || len(pos) == 4):
+		arg := &control.PeerArgs{Iface: pos[1], PublicKey: pos[2], CIDRs: splitList(*cidrs)}
+		if len(pos) == 4 {
+			arg.Profile = pos[3]
+		}
+		var conf control.PeerConfig
+		if err := o.client.CallAgent(pos[0], "/node/peer_profile", arg, &conf); err != nil {
+			return err
+		}
+		return printPeerConfig(o, conf, *qr)
+	case args[0] == "routes" && (len(pos) == 3 || len(pos) == 4):
+		arg := &control.PeerArgs{Iface: pos[1], PublicKey: pos[2]}
+		if len(pos) == 4 {
+			arg.Routes = splitList(pos[3])
+		}
+		var info control.PeerInfo
+		if err := o.client.CallAgent(pos[0], "/node/peer_routes", arg, &info); err != nil {
+			return err
+		}
+		return o.print(info, "PUBLIC KEY\tALLOWED IPS", func() [][]string {
+			return [][]string{{info.PublicKey, strings.Join(info.AllowedIPs, ",")}}
+		})
+	case args[0] == "config" && len(pos) == 3:
+		var conf control.PeerConfig
+		if err := o.client.CallAgent(pos[0], "/node/peer_config", &control.PeerArgs{Iface: pos[1], PublicKey: pos[2]}, &conf); err != nil {
+			return err
+		}
+		return printPeerConfig(o, conf, *qr)
+	case args[0] == "remove" && len(pos) == 3:
+		return o.client.CallAgent(pos[0], "/node/peer_remove", &control.PeerArgs{Iface: pos[1], PublicKey: pos[2]}, new(bool))
+	case args[0] == "list" && len(pos) == 2:
+		peers, err := listPeers(o, pos[0], pos[1])
+		if err != nil {
+			return err
+		}
+		return o.print(peers, "PUBLIC KEY\tALLOWED IPS\tPROFILE\tENDPOINT\tHANDSHAKE\tRX\tTX", func() [][]string {
+			var rows [][]string
+			for _, p := range peers {
+				rows = append(rows, []string{p.PublicKey, strings.Join(p.AllowedIPs, ","), p.Profile, p.Endpoint, handshake(p.LastHandshake), fmt.Sprint(p.ReceiveBytes), fmt.Sprint(p.TransmitBytes)})
+			}
+			return rows
+		})
+	}
+	return usageError(fmt.Sprintf("wrong arguments for peer %s", args[0]))
+}
+
+// peerUsage is a peer with its transfer rates since the previous sample.
+type peerUsage struct {
+	control.PeerInfo
+	ReceiveRate  float64 `json:"receive_rate"`
+	TransmitRate float64 `json:"transmit_rate"`
+}
+
+// watch samples the peers of an interface until interrupted. With -o json
+// every sample is one line.
+func watch(o *options, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := flags.Duration("interval", 2*time.Second, "time between two samples")
+	if err := flags.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if flags.NArg() != 2 || *interval <= 0 {
+		return usageError("watch needs an agent and an interface")
+	}
+	agent, iface := flags.Arg(0), flags.Arg(1)
+
+	previous := map[string]control.PeerInfo{}
+	for {
+		peers, err := listPeers(o, agent, iface)
+		if err != nil {
+			return err
+		}
+		seconds := interval.Seconds()
+		usage := make([]peerUsage, 0, len(peers))
+		for _, p := range peers {
+			u := peerUsage{PeerInfo: p}
+			if prev, found := previous[p.PublicKey]; found {
+				u.ReceiveRate = float64(p.ReceiveBytes-prev.ReceiveBytes) / seconds
+				u.TransmitRate = float64(p.TransmitBytes-prev.TransmitBytes) / seconds
+			}
+			previous[p.PublicKey] = p
+			usage = append(usage, u)
+		}
+		if o.json {
+			if err := printJSONLine(usage); err != nil {
+				return err
+			}
+		} else {
+			// clear the screen so the table stays in place
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("%s on %s, every %s\n\n", iface, agent, interval)
+			err := o.print(usage, "PUBLIC KEY\tENDPOINT\tHANDSHAKE\tRX/s\tTX/s\tRX\tTX", func() [][]string {
+				var rows [][]string
+				for _, u := range usage {
+					rows = append(rows, []string{u.PublicKey, u.Endpoint, handshake(u.LastHandshake),
+						rate(u.ReceiveRate), rate(u.TransmitRate), fmt.Sprint(u.ReceiveBytes), fmt.Sprint(u.TransmitBytes)})
+				}
+				return rows
+			})
+			if err != nil {
+				return err
+			}
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func rate(bytesPerSecond float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for bytesPerSecond >= 1024 && i < len(units)-1 {
+		bytesPerSecond /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bytesPerSecond, units[i])
+}
+
+func relay(o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError("relay needs create, list or close")
+	}
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("relay create", flag.ContinueOnError)
+		arg := &control.RelayArgs{}
+		flags.StringVar(&arg.Name, "name", "", "relay name, generated when empty")
+		flags.StringVar(&arg.Iface, "iface", "", "put the relay in front of this Wireguard server")
+		flags.StringVar(&arg.Upstream, "upstream", "", "host:port to relay to when there is no -iface")
+		flags.StringVar(&arg.Transport, "transport", "udp", "udp, tcp or ws")
+		flags.StringVar(&arg.Backend, "backend", "userspace", "userspace or kernel, kernel only relays udp")
+		flags.IntVar(&arg.Port, "port", 0, "listen port, picked from the relay range when 0")
+		if err := flags.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		if flags.NArg() != 1 {
+			return usageError("relay create needs an agent")
+		}
+		var info control.RelayInfo
+		if err := o.client.CallAgent(flags.Arg(0), "/node/relay_create", arg, &info); err != nil {
+			return err
+		}
+		return printRelays(o, []control.RelayInfo{info})
+	case "list":
+		if len(args) != 2 {
+			return usageError("relay list needs an agent")
+		}
+		var relays []control.RelayInfo
+		if err := o.client.CallAgent(args[1], "/node/relay_list", &control.Empty{}, &relays); err != nil {
+			return err
+		}
+		return printRelays(o, relays)
+	case "close":
+		if len(args) != 3 {
+			return usageError("relay close needs an agent and a relay name")
+		}
+		return o.client.CallAgent(args[1], "/node/relay_close", &control.NameArgs{Name: args[2]}, new(bool))
+	}
+	return usageError(fmt.Sprintf("unknown relay command %q", args[0]))
+}
+
+func printRelays(o *options, relays []control.RelayInfo) error {
+	return o.print(relays, "NAME\tTRANSPORT\tPORT\tUPSTREAM\tDECLARED\tSESSIONS\tBYTES", func() [][]string {
+		var rows [][]string
+		for _, r := range relays {
+			rows = append(rows, []string{r.Name, r.Transport, fmt.Sprint(r.Port), r.Upstream, fmt.Sprint(r.Declared), fmt.Sprint(r.Sessions), fmt.Sprint(r.Bytes)})
+		}
+		return rows
+	})
+}
+
+func webhooks(o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError("webhook needs dead-letters or replay")
+	}
+	switch args[0] {
+	case "dead-letters":
+		if len(args) != 1 {
+			return usageError("webhook dead-letters takes no arguments")
+		}
+		var letters []webhook.DeadLetter
+		if err := o.client.Call("/control/webhook_dead_letters", &control.Empty{}, &letters); err != nil {
+			return err
+		}
+		return o.print(letters, "ID\tWEBHOOK\tEVENT\tSUBJECT\tATTEMPTS\tERROR", func() [][]string {
+			var rows [][]string
+			for _, l := range letters {
+				rows = append(rows, []string{l.ID, l.Hook, string(l.Event.Type), l.Event.Subject, fmt.Sprint(l.Attempts), l.Error})
+			}
+			return rows
+		})
+	case "replay":
+		flags := flag.NewFlagSet("webhook replay", flag.ContinueOnError)
+		all := flags.Bool("all", false, "replay every dead letter")
+		if err := flags.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		if *all == (flags.NArg() > 0) {
+			return usageError("webhook replay needs dead letter IDs or -all")
+		}
+		var n int
+		if err := o.client.Call("/control/webhook_replay", &control.ReplayArgs{IDs: flags.Args()}, &n); err != nil {
+			return err
+		}
+		fmt.Printf("replayed %d dead letters\n", n)
+		return nil
+	}
+	return usageError(fmt.Sprintf("unknown webhook command %q", args[0]))
+}
+
+func meshes(o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError("mesh needs nodes or paths")
+	}
+	switch args[0] {
+	case "nodes":
+		if len(args) != 1 {
+			return usageError("mesh nodes takes no arguments")
+		}
+		var nodes []mesh.Node
+		if err := o.client.Call("/control/mesh_nodes", &control.Empty{}, &nodes); err != nil {
+			return err
+		}
+		return o.print(nodes, "NAME\tADDRESS\tENDPOINT\tRELAY\tROUTES\tPUBLIC KEY", func() [][]string {
+			var rows [][]string
+			for _, n := range nodes {
+				rows = append(rows, []string{n.Name, n.Address, n.Endpoint, fmt.Sprint(n.Relay), strings.Join(n.Routes, ","), n.PublicKey})
+			}
+			return rows
+		})
+	case "paths":
+		if len(args) != 2 {
+			return usageError("mesh paths needs an agent")
+		}
+		var paths []mesh.Path
+		if err := o.client.CallAgent(args[1], "/node/mesh_paths", &control.Empty{}, &paths); err != nil {
+			return err
+		}
+		return o.print(paths, "NAME\tENDPOINT\tPATH\tLAST HANDSHAKE", func() [][]string {
+			var rows [][]string
+			for _, p := range paths {
+				path := "direct"
+				if p.Relayed {
+					path = "relay"
+				}
+				rows = append(rows, []string{p.Name, p.Endpoint, path, handshake(p.LastHandshake)})
+			}
+			return rows
+		})
+	}
+	return usageError(fmt.Sprintf("unknown mesh command %q", args[0]))
+}
+
+func logLevel(o *options, args []string) error {
+	flags := flag.NewFlagSet("log-level", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent to change, the control plane when empty")
+	if err := flags.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if flags.NArg() > 1 {
+		return usageError("log-level takes at most a level")
+	}
+	arg := &control.LogLevel{Level: flags.Arg(0)}
+	var level control.LogLevel
+	var err error
+	if *agent != "" {
+		err = o.client.CallAgent(*agent, "/node/log_level", arg, &level)
+	} else {
+		err = o.client.Call("/control/log_level", arg, &level)
+	}
+	if err != nil {
+		return err
+	}
+	return o.print(level, "LEVEL", func() [][]string {
+		return [][]string{{level.Level}}
+	})
+}
+
+func auditLog(o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError("audit needs list or verify")
+	}
+	flags := flag.NewFlagSet("audit "+args[0], flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent whose log to read, the control plane when empty")
+	switch args[0] {
+	case "list":
+		var filter audit.Filter
+		flags.StringVar(&filter.Action, "action", "", "only records of this action, e.g. peer.add")
+		flags.StringVar(&filter.Actor, "actor", "", "only records of this actor")
+		flags.StringVar(&filter.Target, "target", "", "only records of this target, e.g. wireguard/wg0")
+		since := flags.Duration("since", 0, "only records of this last period, e.g. 24h")
+		if err := flags.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		if flags.NArg() > 0 {
+			return usageError("audit list takes no arguments")
+		}
+		if *since > 0 {
+			filter.Since = time.Now().Add(-*since)
+		}
+		var records []audit.Record
+		if err := callAuditRoute(o, *agent, "audit_list", &filter, &records); err != nil {
+			return err
+		}
+		return o.print(records, "SEQ\tTIME\tACTOR\tACTION\tTARGET\tRESULT\tERROR", func() [][]string {
+			var rows [][]string
+			for _, r := range records {
+				rows = append(rows, []string{fmt.Sprint(r.Seq), r.Time.Format(time.RFC3339), r.Actor, r.Action, r.Target, r.Result, r.Error})
+			}
+			return rows
+		})
+	case "verify":
+		if err := flags.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		if flags.NArg() > 0 {
+			return usageError("audit verify takes no arguments")
+		}
+		var v audit.Verification
+		if err := callAuditRoute(o, *agent, "audit_verify", &control.Empty{}, &v); err != nil {
+			return err
+		}
+		if err := o.print(v, "OK\tRECORDS\tLAST HASH\tBROKEN AT\tERROR", func() [][]string {
+			brokenAt := ""
+			if !v.OK {
+				brokenAt = fmt.Sprint(v.Seq)
+			}
+			return [][]string{{fmt.Sprint(v.OK), fmt.Sprint(v.Records), v.LastHash, brokenAt, v.Error}}
+		}); err != nil {
+			return err
+		}
+		if !v.OK {
+			return fmt.Errorf("the audit chain is broken at record %d: %s", v.Seq, v.Error)
+		}
+		return nil
+	}
+	return usageError(fmt.Sprintf("unknown audit command %q", args[0]))
+}
+
+// callAuditRoute calls the audit route of agent, or of the control plane
+// when agent is empty.
+func callAuditRoute(o *options, agent string, route string, arg interface{}, result interface{}) error {
+	if agent != "" {
+		return o.client.CallAgent(agent, "/node/"+route, arg, result)
+	}
+	return o.client.Call("/control/"+route, arg, result)
+}
+
+// splitList splits a comma separated flag, empty is none.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
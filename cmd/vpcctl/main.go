@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"vpc/pkg/control"
+)
+
+//go:generate go build $GOFILE
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const usage = `usage: vpcctl [-server host:port] [-token token] [-o table|json] <command> [arguments]
+
+commands:
+  agents                                      list agents connected to the control plane
+  wg create|list <agent>                      manage Wireguard servers of an agent
+  peer add [-qr] [-routes cidr,...] [-profile name] [-cidrs cidr,...] <agent> <iface>
+                                              add a peer, a site gateway with routes,
+                                              and print its config
+  peer profile [-qr] [-cidrs cidr,...] <agent> <iface> <key> [full|vpc|custom|exclude]
+                                              change the split tunnel profile of a
+                                              peer and print its new config
+  peer config [-qr] <agent> <iface> <key>     print the config of a peer
+  peer list <agent> <iface>
+  peer remove <agent> <iface> <key>
+  peer routes <agent> <iface> <key> [cidr,...]
+                                              replace the LAN prefixes of a site gateway
+  watch [-interval 2s] <agent> <iface>        show live usage of the peers
+  relay create [flags] <agent>                start a relay, see relay create -h
+  relay list <agent>
+  relay close <agent> <name>
+  mesh nodes                                  list the nodes of the mesh
+  mesh paths <agent>                          show whether an agent reaches the other
+                                              nodes directly or through the relay
+  webhook dead-letters                        list webhook deliveries that failed
+  webhook replay -all|<id>...                 deliver dead letters again
+  log-level [-agent name] [level]             show or change the log level of the
+                                              control plane or an agent
+  audit list [-agent name] [flags]            list changes from the audit log of the
+                                              control plane or an agent
+  audit verify [-agent name]                  check the hash chain of an audit log
+
+The server and token default to $VPCCTL_SERVER and $VPCCTL_TOKEN.
+`
+
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// options are the global flags every command sees.
+type options struct {
+	client *control.Client
+	json   bool
+}
+
+type command func(o *options, args []string) error
+
+var commands = map[string]command{
+	"agents":    agents,
+	"wg":        wg,
+	"peer":      peer,
+	"watch":     watch,
+	"relay":     relay,
+	"mesh":      meshes,
+	"webhook":   webhooks,
+	"log-level": logLevel,
+	"audit":     auditLog,
+}
+
+func main() {
+	flags := flag.NewFlagSet("vpcctl", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	server := flags.String("server", envOr("VPCCTL_SERVER", "127.0.0.1:9090"), "control plane address")
+	token := flags.String("token", os.Getenv("VPCCTL_TOKEN"), "operator token")
+	output := flags.String("o", "table", "output format, table or json")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		os.Exit(exitUsage)
+	}
+	cmd, found := commands[flags.Arg(0)]
+	if !found || (*output != "table" && *output != "json") {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitUsage)
+	}
+
+	client, err := control.Dial(*server, *token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot reach the control plane at %s: %v\n", *server, err)
+		os.Exit(exitError)
+	}
+	err = cmd(&options{client: client, json: *output == "json"}, flags.Args()[1:])
+	client.Close()
+
+	var uerr usageError
+	switch {
+	case err == nil:
+		os.Exit(exitOK)
+	case errors.As(err, &uerr):
+		fmt.Fprintf(os.Stderr, "%v\n\n%s", err, usage)
+		os.Exit(exitUsage)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+}
+
+func envOr(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// print writes v as JSON, or as a table of header and the rows built from
+// it.
+func (o *options) print(v interface{}, header string, rows func() [][]string) error {
+	if o.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows() {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func printJSONLine(v interface{}) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"vpc/pkg/config"
+	"vpc/pkg/control"
+	"vpc/pkg/state"
+)
+
+// table prints rows aligned under header.
+func table(header string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+// callAgent makes one call to the local agent.
+func callAgent(cfg *config.Config, uri string, arg interface{}, result interface{}) error {
+	client, err := dialAgent(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call(uri, arg, result)
+}
+
+func wg(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return usageError("wg needs create, list or destroy")
+	}
+	switch args[0] {
+	case "create":
+		var info control.WireguardInfo
+		if err := callAgent(cfg, "/node/wg_create", &control.WireguardArgs{}, &info); err != nil {
+			return err
+		}
+		fmt.Println(info.Name)
+	case "list":
+		var infos []control.WireguardInfo
+		if err := callAgent(cfg, "/node/wg_list", &control.Empty{}, &infos); err != nil {
+			return err
+		}
+		var rows [][]string
+		for _, info := range infos {
+			rows = append(rows, []string{info.Name, fmt.Sprint(info.Port), info.Address, info.Endpoint, info.PublicKey, fmt.Sprint(info.Peers)})
+		}
+		table("NAME\tPORT\tADDRESS\tENDPOINT\tPUBLIC KEY\tPEERS", rows)
+	case "destroy":
+		if len(args) != 2 {
+			return usageError("wg destroy needs an interface name")
+		}
+		return callAgent(cfg, "/node/wg_destroy", &control.NameArgs{Name: args[1]}, new(bool))
+	default:
+		return usageError(fmt.Sprintf("unknown wg command %q", args[0]))
+	}
+	return nil
+}
+
+func peer(cfg *config.Config, args []string) error {
+	if len(args) < 2 {
+		return usageError("peer needs a command and an interface")
+	}
+	arg := &control.PeerArgs{Iface: args[1]}
+	switch args[0] {
+	case "add":
+		var conf control.PeerConfig
+		if err := callAgent(cfg, "/node/peer_add", arg, &conf); err != nil {
+			return err
+		}
+		fmt.Println(conf.Config)
+	case "list":
+		var peers []control.PeerInfo
+		if err := callAgent(cfg, "/node/peer_list", arg, &peers); err != nil {
+			return err
+		}
+		var rows [][]string
+		for _, p := range peers {
+			handshake := "never"
+			if !p.LastHandshake.IsZero() {
+				handshake = time.Since(p.LastHandshake).Round(time.Second).String() + " ago"
+			}
+			rows = append(rows, []string{p.PublicKey, strings.Join(p.AllowedIPs, ","), p.Endpoint, handshake, fmt.Sprint(p.ReceiveBytes), fmt.Sprint(p.TransmitBytes)})
+		}
+		table("PUBLIC KEY\tALLOWED IPS\tENDPOINT\tHANDSHAKE\tRX\tTX", rows)
+	case "remove", "config":
+		if len(args) != 3 {
+			return usageError(fmt.Sprintf("peer %s needs an interface and a public key", args[0]))
+		}
+		arg.PublicKey = args[2]
+		if args[0] == "remove" {
+			return callAgent(cfg, "/node/peer_remove", arg, new(bool))
+		}
+		var conf control.PeerConfig
+		if err := callAgent(cfg, "/node/peer_config", arg, &conf); err != nil {
+			return err
+		}
+		fmt.Println(conf.Config)
+	default:
+		return usageError(fmt.Sprintf("unknown peer command %q", args[0]))
+	}
+	return nil
+}
+
+func relay(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return usageError("relay needs create, list or close")
+	}
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("relay create", flag.ContinueOnError)
+		arg := &control.RelayArgs{}
+		flags.StringVar(&arg.Name, "name", "", "relay name, generated when empty")
+		flags.StringVar(&arg.Iface, "iface", "", "put the relay in front of this interface")
+		flags.StringVar(&arg.Upstream, "upstream", "", "host:port to relay to")
+		flags.StringVar(&arg.Transport, "transport", "udp", "udp, tcp or ws")
+		flags.StringVar(&arg.Backend, "backend", "userspace", "userspace or kernel, kernel only relays udp")
+		flags.IntVar(&arg.Port, "port", 0, "listen port, picked from the relay range when 0")
+		if err := flags.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		var info control.RelayInfo
+		if err := callAgent(cfg, "/node/relay_create", arg, &info); err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%d\n", info.Name, info.Port)
+	case "list":
+		var relays []control.RelayInfo
+		if err := callAgent(cfg, "/node/relay_list", &control.Empty{}, &relays); err != nil {
+			return err
+		}
+		var rows [][]string
+		for _, r := range relays {
+			rows = append(rows, []string{r.Name, r.Transport, fmt.Sprint(r.Port), r.Upstream, fmt.Sprint(r.Declared), fmt.Sprint(r.Sessions), fmt.Sprint(r.Bytes)})
+		}
+		table("NAME\tTRANSPORT\tPORT\tUPSTREAM\tDECLARED\tSESSIONS\tBYTES", rows)
+	case "close":
+		if len(args) != 2 {
+			return usageError("relay close needs a relay name")
+		}
+		return callAgent(cfg, "/node/relay_close", &control.NameArgs{Name: args[1]}, new(bool))
+	default:
+		return usageError(fmt.Sprintf("unknown relay command %q", args[0]))
+	}
+	return nil
+}
+
+// agentRunning reports whether the agent of cfg answers.
+func agentRunning(cfg *config.Config) bool {
+	client, err := control.Dial(cfg.Agent.Listen, cfg.Control.Token)
+	if err != nil {
+		return false
+	}
+	client.Close()
+	return true
+}
+
+// stateCommand works on the state file directly, so it runs without an
+// agent. Importing under a running agent would be overwritten by it.
+func stateCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return usageError("state needs export or import")
+	}
+	if cfg.StatePath == "" {
+		return usageError("state needs state_path in the config")
+	}
+	store, err := state.Open(cfg.StatePath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "export" && len(args) <= 2:
+		b, err := store.Export()
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			_, err = os.Stdout.Write(append(b, '\n'))
+			return err
+		}
+		return ioutil.WriteFile(args[1], b, 0600)
+	case args[0] == "import" && len(args) == 2:
+		if agentRunning(cfg) {
+			return fmt.Errorf("the agent at %s is running, stop it before importing", cfg.Agent.Listen)
+		}
+		b, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		return store.Import(b)
+	}
+	return usageError("state export [file] or state import <file>")
+}
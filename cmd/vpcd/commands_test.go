@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vpc/pkg/config"
+)
+
+func TestStateCommand(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "export.json")
+	tests := []struct {
+		name      string
+		statePath string
+		args      []string
+		wantUsage bool
+	}{
+		{name: "no subcommand", statePath: filepath.Join(dir, "state.json"), wantUsage: true},
+		{name: "no state path", args: []string{"export"}, wantUsage: true},
+		{name: "unknown subcommand", statePath: filepath.Join(dir, "state.json"), args: []string{"dump"}, wantUsage: true},
+		{name: "import without file", statePath: filepath.Join(dir, "state.json"), args: []string{"import"}, wantUsage: true},
+		{name: "export", statePath: filepath.Join(dir, "state.json"), args: []string{"export", out}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.StatePath = tt.statePath
+			err := stateCommand(cfg, tt.args)
+			var uerr usageError
+			if usage := errors.As(err, &uerr); usage != tt.wantUsage {
+				t.Fatalf("stateCommand(%v) = %v, want a usage error %v", tt.args, err, tt.wantUsage)
+			}
+			if !tt.wantUsage && err != nil {
+				t.Fatalf("stateCommand(%v) = %v", tt.args, err)
+			}
+		})
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil || !strings.Contains(string(b), `"ports"`) {
+		t.Errorf("export wrote %q, %v", b, err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+	"vpc/pkg/api"
+	"vpc/pkg/audit"
+	"vpc/pkg/broker"
+	"vpc/pkg/config"
+	"vpc/pkg/control"
+	"vpc/pkg/grpcapi"
+	"vpc/pkg/mesh"
+	"vpc/pkg/metrics"
+	"vpc/pkg/tenant"
+	"vpc/pkg/tracing"
+	"vpc/pkg/webhook"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// serve runs the control plane agents register with, and the HTTP and gRPC
+// APIs and webhooks when they are configured.
+func serve(cfg *config.Config, args []string) error {
+	if len(args) > 0 {
+		return usageError("serve takes no arguments")
+	}
+	stopTracing, err := startTracing(cfg, "control")
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	if err := requireOperatorToken(cfg); err != nil {
+		return err
+	}
+	auditLog, err := audit.Open(cfg.Audit.ControlPath, "control")
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+	srv, err := control.NewServer(broker.Logger, cfg.Control.Listen, cfg.Control.Token, cfg.Control.OperatorToken)
+	if err != nil {
+		return err
+	}
+	srv.Audit = auditLog
+	if len(cfg.Webhooks.Endpoints) > 0 {
+		hooks, err := webhook.NewDispatcher(broker.Logger, cfg.Webhooks)
+		if err != nil {
+			return err
+		}
+		hooks.Start(srv.Events)
+		defer hooks.Close()
+		srv.Webhooks = hooks
+	}
+	errs := make(chan error, 3)
+	go func() { errs <- srv.ListenAndServe() }()
+	broker.Logger.Info("control plane listening", zap.String("listen", cfg.Control.Listen))
+
+	token := cfg.Control.OperatorToken
+	var tenants *tenant.Manager
+	if cfg.API.Listen != "" || cfg.GRPC.Listen != "" {
+		tenants, err = tenant.NewManager(broker.Logger, srv, cfg.Tenancy.StatePath)
+		if err != nil {
+			srv.Close()
+			return err
+		}
+		tenants.Audit = srv.Audit
+		tenants.Start(time.Duration(cfg.Tenancy.ExpiryInterval))
+		defer tenants.Close()
+	}
+	var httpSrv *http.Server
+	if cfg.API.Listen != "" {
+		handler := api.NewServer(broker.Logger, srv, token)
+		handler.Webhooks = srv.Webhooks
+		handler.Level = &broker.Level
+		handler.Audit = srv.Audit
+		handler.Tenants = tenants
+		httpSrv = &http.Server{
+			Addr:              cfg.API.Listen,
+			Handler:           otelhttp.NewHandler(handler, "api"),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			var err error
+			if cfg.API.TLSCert != "" {
+				err = httpSrv.ListenAndServeTLS(cfg.API.TLSCert, cfg.API.TLSKey)
+			} else {
+				err = httpSrv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+		broker.Logger.Info("api listening", zap.String("listen", cfg.API.Listen))
+	}
+	var grpcSrv *grpc.Server
+	if cfg.GRPC.Listen != "" {
+		var opts []grpc.ServerOption
+		if cfg.GRPC.TLSCert != "" {
+			creds, err := credentials.NewServerTLSFromFile(cfg.GRPC.TLSCert, cfg.GRPC.TLSKey)
+			if err != nil {
+				srv.Close()
+				return err
+			}
+			opts = append(opts, grpc.Creds(creds))
+		}
+		lis, err := net.Listen("tcp", cfg.GRPC.Listen)
+		if err != nil {
+			srv.Close()
+			return err
+		}
+		grpcAPI := grpcapi.NewServer(broker.Logger, srv, token)
+		grpcAPI.Events = srv.Events
+		grpcAPI.Tenants = tenants
+		grpcSrv = grpcAPI.GRPCServer(opts...)
+		go func() { errs <- grpcSrv.Serve(lis) }()
+		broker.Logger.Info("grpc listening", zap.String("listen", cfg.GRPC.Listen))
+	}
+	metricsSrv, err := serveMetrics(cfg.Metrics.Listen, metrics.NewControlCollector(srv))
+	if err != nil {
+		if grpcSrv != nil {
+			grpcSrv.Stop()
+		}
+		shutdown(httpSrv)
+		srv.Close()
+		return err
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		waitForSignal(false)
+		close(stopped)
+	}()
+	select {
+	case err = <-errs:
+		return err
+	case <-stopped:
+		if grpcSrv != nil {
+			// streams never end on their own
+			grpcSrv.Stop()
+		}
+		shutdown(httpSrv)
+		shutdown(metricsSrv)
+		srv.Close()
+		return nil
+	}
+}
+
+// requireOperatorToken refuses the API listeners without an operator token,
+// they would only answer tenants.
+func requireOperatorToken(cfg *config.Config) error {
+	if cfg.Control.OperatorToken == "" && (cfg.API.Listen != "" || cfg.GRPC.Listen != "") {
+		return fmt.Errorf("the api and grpc listeners need control.operator_token")
+	}
+	return nil
+}
+
+// agent runs a node: it restores its interfaces and relays, serves the
+// local commands, registers with the control plane and joins the mesh.
+func agent(cfg *config.Config, args []string) error {
+	if len(args) > 0 {
+		return usageError("agent takes no arguments")
+	}
+	stopTracing, err := startTracing(cfg, "agent")
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	broker.Events.Node = cfg.Agent.Name
+	if err := broker.Init(cfg); err != nil {
+		return err
+	}
+	defer broker.Audit.Close()
+	a, err := control.NewAgent(broker.Logger, cfg.Agent.Name, cfg.Agent.Listen, cfg.Agent.Server, cfg.Control.Token)
+	if err != nil {
+		return err
+	}
+	a.Events = broker.Events
+	if cfg.Mesh.Address != "" {
+		m, err := mesh.New(broker.Logger, cfg.Agent.Name, cfg.Mesh, cfg.Wireguard.MTU, cfg.Firewall.Backend)
+		if err != nil {
+			broker.Controller.Close()
+			return err
+		}
+		defer m.Close()
+		if err := m.Up(); err != nil {
+			broker.Controller.Close()
+			return err
+		}
+		broker.Mesh = m
+		a.Mesh = m
+	}
+	a.Start()
+	broker.Logger.Info("agent listening", zap.String("listen", cfg.Agent.Listen))
+	metricsSrv, err := serveMetrics(cfg.Metrics.Listen, metrics.NewNodeCollector(broker.Logger, cfg.Metrics.PerPeer, a))
+	if err != nil {
+		a.Close()
+		broker.Controller.Close()
+		return err
+	}
+	waitForSignal(true)
+	shutdown(metricsSrv)
+	a.Close()
+	broker.Controller.Close()
+	return nil
+}
+
+// startTracing installs the exporter of the tracing section, the returned
+// function flushes the spans left.
+func startTracing(cfg *config.Config, role string) (func(), error) {
+	shutdownTracing, err := tracing.Setup(cfg.Tracing, role, cfg.Agent.Name)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			broker.Logger.Warn("failed to flush traces", zap.Error(err))
+		}
+	}, nil
+}
+
+// serveMetrics serves /metrics on listen, nothing when it is empty. Only
+// the bind is checked here, later failures are logged.
+func serveMetrics(listen string, collector prometheus.Collector) (*http.Server, error) {
+	if listen == "" {
+		return nil, nil
+	}
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Handler:           metrics.Handler(collector),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(lis); err != http.ErrServerClosed {
+			broker.Logger.Error("metrics listener stopped", zap.Error(err))
+		}
+	}()
+	broker.Logger.Info("metrics listening", zap.String("listen", listen))
+	return srv, nil
+}
+
+// shutdown stops srv, giving its requests a few seconds to complete.
+func shutdown(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	srv.Shutdown(ctx)
+	cancel()
+}
+
+// gc removes leftovers of crashed runs that are not in the state file. A
+// live agent may be creating an interface it has not saved yet, so only a
+// dry run is allowed next to one; kernel relay tables are only collected by
+// the agent itself at startup. Without a state file the interfaces of a
+// live agent look like leftovers, so only a dry run is allowed either.
+func gc(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+	if err := flags.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if cfg.StatePath == "" && !*dryRun {
+		return usageError("gc needs state_path to tell leftovers from live interfaces, use -dry-run")
+	}
+	if !*dryRun && agentRunning(cfg) {
+		return fmt.Errorf("the agent at %s is running, stop it before collecting or use -dry-run", cfg.Agent.Listen)
+	}
+	if err := broker.OpenState(cfg.StatePath); err != nil {
+		return err
+	}
+	found, err := broker.CollectGarbage(*dryRun, false)
+	for _, leftover := range found {
+		fmt.Println(leftover)
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"vpc/pkg/config"
+)
+
+func TestRequireOperatorToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *config.Config)
+		wantErr bool
+	}{
+		{name: "no api", modify: func(c *config.Config) {}},
+		{name: "api without token", modify: func(c *config.Config) { c.API.Listen = ":8080" }, wantErr: true},
+		{name: "api with only the agent token", modify: func(c *config.Config) {
+			c.API.Listen = ":8080"
+			c.Control.Token = "agents"
+		}, wantErr: true},
+		{name: "grpc without token", modify: func(c *config.Config) { c.GRPC.Listen = ":8443" }, wantErr: true},
+		{name: "grpc with token", modify: func(c *config.Config) {
+			c.GRPC.Listen = ":8443"
+			c.Control.OperatorToken = "operators"
+		}},
+		{name: "api with token", modify: func(c *config.Config) {
+			c.API.Listen = ":8080"
+			c.Control.OperatorToken = "operators"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			tt.modify(cfg)
+			if err := requireOperatorToken(cfg); (err != nil) != tt.wantErr {
+				t.Errorf("requireOperatorToken() = %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"vpc/pkg/broker"
+	"vpc/pkg/config"
+	"vpc/pkg/control"
+	"vpc/pkg/logging"
+
+	"go.uber.org/zap"
+)
+
+//go:generate go build $GOFILE
+
+// Exit codes of every command.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const usage = `usage: vpcd [-config file] <command> [arguments]
+
+commands:
+  serve                          run the control plane
+  agent                          run a Wireguard and relay node
+  wg create|list|destroy <name>  manage Wireguard interfaces of the local agent
+  peer add|list <iface>          manage peers of an interface
+  peer remove|config <iface> <public key>
+  relay create|list|close        manage relays of the local agent
+  state export [file]            write the state file to file or stdout
+  state import <file>            replace the state file, the agent must be stopped
+  gc [-dry-run]                  remove leftovers of crashed runs
+`
+
+// usageError makes main print the usage and exit with exitUsage.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+type command func(cfg *config.Config, args []string) error
+
+var commands = map[string]command{
+	"serve": serve,
+	"agent": agent,
+	"wg":    wg,
+	"peer":  peer,
+	"relay": relay,
+	"state": stateCommand,
+	"gc":    gc,
+}
+
+func main() {
+	flags := flag.NewFlagSet("vpcd", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	configPath := flags.String("config", os.Getenv("VPC_CONFIG"), "path to the config file")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		os.Exit(exitUsage)
+	}
+	cmd, found := commands[flags.Arg(0)]
+	if !found {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitUsage)
+	}
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	configFile = *configPath
+	logger, err := logging.New(cfg.Logging, broker.Level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	broker.SetLogger(logger)
+
+	err = cmd(cfg, flags.Args()[1:])
+	logger.Sync()
+	var uerr usageError
+	switch {
+	case err == nil:
+		os.Exit(exitOK)
+	case errors.As(err, &uerr):
+		fmt.Fprintf(os.Stderr, "%v\n\n%s", err, usage)
+		os.Exit(exitUsage)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+}
+
+// configFile is reloaded on SIGHUP.
+var configFile string
+
+// waitForSignal blocks until SIGINT or SIGTERM and reloads the config on
+// SIGHUP when reload is set. Running tunnels are kept on reload, a broken
+// file leaves the previous config in place.
+func waitForSignal(reload bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			broker.Logger.Info("shutting down", zap.String("signal", sig.String()))
+			return
+		}
+		if !reload {
+			continue
+		}
+		if err := broker.Reload(configFile); err != nil {
+			broker.Logger.Error("failed to reload config", zap.Error(err))
+			continue
+		}
+		broker.Logger.Info("reloaded config", zap.String("path", configFile))
+	}
+}
+
+// dialAgent connects to the agent running on this host.
+func dialAgent(cfg *config.Config) (*control.Client, error) {
+	client, err := control.Dial(cfg.Agent.Listen, cfg.Control.Token)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the agent at %s, is vpcd agent running? %v", cfg.Agent.Listen, err)
+	}
+	return client, nil
+}
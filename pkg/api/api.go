@@ -0,0 +1,454 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"vpc/pkg/audit"
+	"vpc/pkg/control"
+	"vpc/pkg/mesh"
+	"vpc/pkg/tenant"
+	"vpc/pkg/webhook"
+
+	"go.uber.org/zap"
+)
+
+// maxBodySize limits request bodies, every body of this API is small.
+const maxBodySize = 1 << 20
+
+//go:embed openapi.yaml
+var spec []byte
+
+// Backend is the part of the control plane the API works on.
+type Backend interface {
+	Agents() []control.AgentInfo
+	MeshNodes() []mesh.Node
+	CallAgentContext(ctx context.Context, agent string, uri string, arg interface{}, result interface{}) error
+}
+
+// Server is the HTTP API. It offers the operations of vpcctl to clients
+// that cannot speak teleport, see openapi.yaml.
+type Server struct {
+	Logger *zap.Logger
+	// Webhooks serves the dead letter routes, they answer 404 when nil.
+	Webhooks *webhook.Dispatcher
+	// Level is the log level of the control plane, /v1/logging/level
+	// answers 404 when nil.
+	Level *zap.AtomicLevel
+	// Audit is the audit log of the control plane, the changes made
+	// through the API on it are recorded there. /v1/audit answers 404 when
+	// nil.
+	Audit *audit.Log
+	// Tenants serves /v1/tenants and accepts the tokens of the tenants,
+	// which only reach their own resources. /v1/tenants answers 404 when
+	// nil.
+	Tenants     *tenant.Manager
+	backend     Backend
+	token       string
+	idempotency *idempotency
+}
+
+// NewServer serves backend to clients presenting token as bearer token.
+func NewServer(logger *zap.Logger, backend Backend, token string) *Server {
+	return &Server{
+		Logger:      logger,
+		backend:     backend,
+		token:       token,
+		idempotency: newIdempotency(),
+	}
+}
+
+// authenticate returns the tenant whose token a request carries, empty for
+// the operator token.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+		return "", true
+	}
+	if s.Tenants == nil {
+		return "", false
+	}
+	return s.Tenants.Authenticate(token)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, err := splitPath(r.URL.EscapedPath())
+	if err != nil {
+		writeError(w, newError(http.StatusBadRequest, "bad_request", err.Error()))
+		return
+	}
+	if len(path) == 2 && path[0] == "v1" && path[1] == "openapi.yaml" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(spec)
+		return
+	}
+	t, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, newError(http.StatusUnauthorized, "unauthorized", "a valid bearer token is required"))
+		return
+	}
+	if !inScope(path, t) {
+		writeError(w, newError(http.StatusForbidden, "forbidden", "a tenant token only reaches /v1/tenants/"+t))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	r = r.WithContext(withScope(r.Context(), t))
+	r = r.WithContext(control.WithActor(r.Context(), actor(r)))
+	s.idempotency.serve(w, r, func(w http.ResponseWriter, r *http.Request) {
+		if err := s.route(w, r, path); err != nil {
+			if err.Status >= 500 {
+				s.Logger.Warn("api request failed", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(err))
+			}
+			writeError(w, err)
+		}
+	})
+}
+
+// splitPath splits an escaped path and unescapes every segment, so public
+// keys can be sent with their slashes escaped.
+func splitPath(escaped string) ([]string, error) {
+	var path []string
+	for _, segment := range strings.Split(strings.Trim(escaped, "/"), "/") {
+		s, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, s)
+	}
+	return path, nil
+}
+
+var (
+	errNotFound         = newError(http.StatusNotFound, "not_found", "no such resource")
+	errMethodNotAllowed = newError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed on this resource")
+)
+
+// route dispatches /v1/agents/{agent}/... to the handlers.
+func (s *Server) route(w http.ResponseWriter, r *http.Request, path []string) *Error {
+	if len(path) >= 2 && path[0] == "v1" && path[1] == "webhooks" {
+		return s.routeWebhooks(w, r, path[2:])
+	}
+	if len(path) == 3 && path[0] == "v1" && path[1] == "logging" && path[2] == "level" {
+		return s.controlLogLevel(w, r)
+	}
+	if len(path) >= 2 && path[0] == "v1" && path[1] == "audit" {
+		return s.routeAudit(w, r, path[2:])
+	}
+	if len(path) >= 2 && path[0] == "v1" && path[1] == "tenants" {
+		return s.routeTenants(w, r, path[2:])
+	}
+	if len(path) == 2 && path[0] == "v1" && path[1] == "mesh" {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+		return s.listMeshNodes(w, r)
+	}
+	if len(path) < 2 || path[0] != "v1" || path[1] != "agents" {
+		return errNotFound
+	}
+	if len(path) == 2 {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+		return s.listAgents(w, r)
+	}
+	agent := path[2]
+	if !s.registered(agent) {
+		return newError(http.StatusNotFound, "not_found", "no agent "+agent)
+	}
+	rest := path[3:]
+	switch {
+	case len(rest) == 1 && rest[0] == "wireguards":
+		switch r.Method {
+		case http.MethodGet:
+			return s.listWireguards(w, r, agent)
+		case http.MethodPost:
+			return s.createWireguard(w, r, agent)
+		}
+	case len(rest) == 2 && rest[0] == "wireguards":
+		switch r.Method {
+		case http.MethodGet:
+			return s.getWireguard(w, r, agent, rest[1])
+		case http.MethodDelete:
+			return s.call(w, r, http.StatusNoContent, agent, "/node/wg_destroy", &control.NameArgs{Name: rest[1]}, new(bool))
+		}
+	case len(rest) == 3 && rest[0] == "wireguards" && rest[2] == "usage":
+		if r.Method == http.MethodGet {
+			return s.listUsage(w, r, agent, rest[1])
+		}
+	case len(rest) == 3 && rest[0] == "wireguards" && rest[2] == "peers":
+		switch r.Method {
+		case http.MethodGet:
+			return s.listPeers(w, r, agent, rest[1])
+		case http.MethodPost:
+			return s.addPeer(w, r, agent, rest[1])
+		}
+	case len(rest) == 4 && rest[0] == "wireguards" && rest[2] == "peers":
+		if r.Method == http.MethodDelete {
+			return s.call(w, r, http.StatusNoContent, agent, "/node/peer_remove", &control.PeerArgs{Iface: rest[1], PublicKey: rest[3]}, new(bool))
+		}
+	case len(rest) == 5 && rest[0] == "wireguards" && rest[2] == "peers" && rest[4] == "routes":
+		if r.Method == http.MethodPut {
+			return s.setRoutes(w, r, agent, rest[1], rest[3])
+		}
+	case len(rest) == 5 && rest[0] == "wireguards" && rest[2] == "peers" && rest[4] == "profile":
+		if r.Method == http.MethodPut {
+			return s.setProfile(w, r, agent, rest[1], rest[3])
+		}
+	case len(rest) == 5 && rest[0] == "wireguards" && rest[2] == "peers" && rest[4] == "config":
+		if r.Method == http.MethodGet {
+			return s.call(w, r, http.StatusOK, agent, "/node/peer_config", &control.PeerArgs{Iface: rest[1], PublicKey: rest[3]}, new(control.PeerConfig))
+		}
+	case len(rest) == 1 && rest[0] == "relays":
+		switch r.Method {
+		case http.MethodGet:
+			return s.listRelays(w, r, agent)
+		case http.MethodPost:
+			return s.createRelay(w, r, agent)
+		}
+	case len(rest) == 2 && rest[0] == "logging" && rest[1] == "level":
+		switch r.Method {
+		case http.MethodGet:
+			return s.call(w, r, http.StatusOK, agent, "/node/log_level", &control.LogLevel{}, new(control.LogLevel))
+		case http.MethodPut:
+			return s.agentLogLevel(w, r, agent)
+		}
+	case len(rest) >= 1 && rest[0] == "audit":
+		return s.routeAgentAudit(w, r, agent, rest[1:])
+	case len(rest) == 2 && rest[0] == "mesh" && rest[1] == "paths":
+		if r.Method == http.MethodGet {
+			return s.listMeshPaths(w, r, agent)
+		}
+	case len(rest) == 2 && rest[0] == "relays":
+		switch r.Method {
+		case http.MethodGet:
+			return s.getRelay(w, r, agent, rest[1])
+		case http.MethodDelete:
+			return s.call(w, r, http.StatusNoContent, agent, "/node/relay_close", &control.NameArgs{Name: rest[1]}, new(bool))
+		}
+	default:
+		return errNotFound
+	}
+	return errMethodNotAllowed
+}
+
+func (s *Server) registered(agent string) bool {
+	for _, a := range s.backend.Agents() {
+		if a.Name == agent {
+			return true
+		}
+	}
+	return false
+}
+
+// call makes one agent call and writes its result with status.
+func (s *Server) call(w http.ResponseWriter, r *http.Request, status int, agent string, uri string, arg interface{}, result interface{}) *Error {
+	if err := s.backend.CallAgentContext(r.Context(), agent, uri, arg, result); err != nil {
+		return agentError(err)
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return nil
+	}
+	writeJSON(w, status, result)
+	return nil
+}
+
+func (s *Server) listAgents(w http.ResponseWriter, r *http.Request) *Error {
+	agents := s.backend.Agents()
+	start, end, next, err := paginate(r, len(agents), func(i int) string { return agents[i].Name })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: agents[start:end], NextCursor: next})
+	return nil
+}
+
+func (s *Server) listMeshNodes(w http.ResponseWriter, r *http.Request) *Error {
+	nodes := s.backend.MeshNodes()
+	start, end, next, err := paginate(r, len(nodes), func(i int) string { return nodes[i].Name })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: nodes[start:end], NextCursor: next})
+	return nil
+}
+
+func (s *Server) listMeshPaths(w http.ResponseWriter, r *http.Request, agent string) *Error {
+	var paths []mesh.Path
+	if err := s.backend.CallAgentContext(r.Context(), agent, "/node/mesh_paths", &control.Empty{}, &paths); err != nil {
+		return agentError(err)
+	}
+	start, end, next, err := paginate(r, len(paths), func(i int) string { return paths[i].Name })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: paths[start:end], NextCursor: next})
+	return nil
+}
+
+func (s *Server) wireguards(r *http.Request, agent string) ([]control.WireguardInfo, *Error) {
+	var infos []control.WireguardInfo
+	if err := s.backend.CallAgentContext(r.Context(), agent, "/node/wg_list", &control.Empty{}, &infos); err != nil {
+		return nil, agentError(err)
+	}
+	return infos, nil
+}
+
+func (s *Server) listWireguards(w http.ResponseWriter, r *http.Request, agent string) *Error {
+	infos, err := s.wireguards(r, agent)
+	if err != nil {
+		return err
+	}
+	start, end, next, err := paginate(r, len(infos), func(i int) string { return infos[i].Name })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: infos[start:end], NextCursor: next})
+	return nil
+}
+
+func (s *Server) getWireguard(w http.ResponseWriter, r *http.Request, agent string, name string) *Error {
+	infos, err := s.wireguards(r, agent)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name == name {
+			writeJSON(w, http.StatusOK, info)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (s *Server) createWireguard(w http.ResponseWriter, r *http.Request, agent string) *Error {
+	return s.call(w, r, http.StatusCreated, agent, "/node/wg_create", &control.WireguardArgs{}, new(control.WireguardInfo))
+}
+
+func (s *Server) listPeers(w http.ResponseWriter, r *http.Request, agent string, iface string) *Error {
+	var peers []control.PeerInfo
+	if err := s.backend.CallAgentContext(r.Context(), agent, "/node/peer_list", &control.PeerArgs{Iface: iface}, &peers); err != nil {
+		return agentError(err)
+	}
+	sortPeers(peers)
+	start, end, next, err := paginate(r, len(peers), func(i int) string { return peers[i].PublicKey })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: peers[start:end], NextCursor: next})
+	return nil
+}
+
+// PeerRequest is the body of a peer add, optional, and of a routes or
+// profile change. A peer with routes is a site gateway, the profile is one
+// of full, vpc, custom or exclude, the last two with CIDRs.
+type PeerRequest struct {
+	Routes  []string `json:"routes,omitempty"`
+	Profile string   `json:"profile,omitempty"`
+	CIDRs   []string `json:"cidrs,omitempty"`
+}
+
+func decodePeer(r *http.Request) (PeerRequest, *Error) {
+	var req PeerRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && err != io.EOF {
+		return req, newError(http.StatusBadRequest, "bad_request", err.Error())
+	}
+	return req, nil
+}
+
+func (s *Server) addPeer(w http.ResponseWriter, r *http.Request, agent string, iface string) *Error {
+	req, err := decodePeer(r)
+	if err != nil {
+		return err
+	}
+	arg := &control.PeerArgs{Iface: iface, Routes: req.Routes, Profile: req.Profile, CIDRs: req.CIDRs}
+	return s.call(w, r, http.StatusCreated, agent, "/node/peer_add", arg, new(control.PeerConfig))
+}
+
+func (s *Server) setRoutes(w http.ResponseWriter, r *http.Request, agent string, iface string, key string) *Error {
+	req, err := decodePeer(r)
+	if err != nil {
+		return err
+	}
+	return s.call(w, r, http.StatusOK, agent, "/node/peer_routes", &control.PeerArgs{Iface: iface, PublicKey: key, Routes: req.Routes}, new(control.PeerInfo))
+}
+
+func (s *Server) setProfile(w http.ResponseWriter, r *http.Request, agent string, iface string, key string) *Error {
+	req, err := decodePeer(r)
+	if err != nil {
+		return err
+	}
+	arg := &control.PeerArgs{Iface: iface, PublicKey: key, Profile: req.Profile, CIDRs: req.CIDRs}
+	return s.call(w, r, http.StatusOK, agent, "/node/peer_profile", arg, new(control.PeerConfig))
+}
+
+func (s *Server) listUsage(w http.ResponseWriter, r *http.Request, agent string, iface string) *Error {
+	var usage []control.UsageInfo
+	if err := s.backend.CallAgentContext(r.Context(), agent, "/node/usage", &control.PeerArgs{Iface: iface}, &usage); err != nil {
+		return agentError(err)
+	}
+	start, end, next, err := paginate(r, len(usage), func(i int) string { return usage[i].PublicKey })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: usage[start:end], NextCursor: next})
+	return nil
+}
+
+func (s *Server) relays(r *http.Request, agent string) ([]control.RelayInfo, *Error) {
+	var relays []control.RelayInfo
+	if err := s.backend.CallAgentContext(r.Context(), agent, "/node/relay_list", &control.Empty{}, &relays); err != nil {
+		return nil, agentError(err)
+	}
+	return relays, nil
+}
+
+func (s *Server) listRelays(w http.ResponseWriter, r *http.Request, agent string) *Error {
+	relays, err := s.relays(r, agent)
+	if err != nil {
+		return err
+	}
+	start, end, next, err := paginate(r, len(relays), func(i int) string { return relays[i].Name })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: relays[start:end], NextCursor: next})
+	return nil
+}
+
+func (s *Server) getRelay(w http.ResponseWriter, r *http.Request, agent string, name string) *Error {
+	relays, err := s.relays(r, agent)
+	if err != nil {
+		return err
+	}
+	for _, relay := range relays {
+		if relay.Name == name {
+			writeJSON(w, http.StatusOK, relay)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (s *Server) createRelay(w http.ResponseWriter, r *http.Request, agent string) *Error {
+	var arg control.RelayArgs
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&arg); err != nil {
+		return newError(http.StatusBadRequest, "bad_request", err.Error())
+	}
+	return s.call(w, r, http.StatusCreated, agent, "/node/relay_create", &arg, new(control.RelayInfo))
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   bool
+	}{
+		{name: "operator token", token: "secret", header: "Bearer secret", want: true},
+		{name: "wrong token", token: "secret", header: "Bearer other"},
+		{name: "no header", token: "secret"},
+		{name: "not a bearer token", token: "secret", header: "Basic secret"},
+		{name: "no operator token", header: "Bearer "},
+		{name: "no operator token and no header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(zap.NewNop(), nil, tt.token)
+			r := httptest.NewRequest("GET", "/v1/agents", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tenant, ok := s.authenticate(r); ok != tt.want || tenant != "" {
+				t.Errorf("authenticate() = %q, %v, want %v", tenant, ok, tt.want)
+			}
+		})
+	}
+}
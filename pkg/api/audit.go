@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	"vpc/pkg/audit"
+	"vpc/pkg/control"
+
+	"go.uber.org/zap"
+)
+
+// actor names the API client in audit records. Operators share a token, so
+// they are told apart by their address.
+func actor(r *http.Request) string {
+	if t := scope(r); t != "" {
+		return "tenant:" + t + ":" + r.RemoteAddr
+	}
+	return "api:" + r.RemoteAddr
+}
+
+// record writes a change made on the control plane to its audit log.
+func (s *Server) record(r *http.Request, action string, target string, before interface{}, after interface{}, err error) {
+	if aerr := s.Audit.Change(actor(r), action, target, before, after, err); aerr != nil {
+		s.Logger.Error("failed to write audit record", zap.String("action", action), zap.Error(aerr))
+	}
+}
+
+// routeAudit dispatches /v1/audit[/verify], the log of the control plane.
+func (s *Server) routeAudit(w http.ResponseWriter, r *http.Request, rest []string) *Error {
+	if len(rest) > 1 || len(rest) == 1 && rest[0] != "verify" {
+		return errNotFound
+	}
+	if s.Audit == nil {
+		return newError(http.StatusNotFound, "not_found", "the audit log is not configured")
+	}
+	if r.Method != http.MethodGet {
+		return errMethodNotAllowed
+	}
+	if len(rest) == 1 {
+		v, err := s.Audit.Verify()
+		if err != nil {
+			return newError(http.StatusInternalServerError, "internal", err.Error())
+		}
+		writeJSON(w, http.StatusOK, v)
+		return nil
+	}
+	filter, aerr := auditFilter(r)
+	if aerr != nil {
+		return aerr
+	}
+	records, err := s.Audit.Query(filter)
+	if err != nil {
+		return newError(http.StatusInternalServerError, "internal", err.Error())
+	}
+	return writeRecords(w, r, records)
+}
+
+// routeAgentAudit dispatches /v1/agents/{agent}/audit[/verify].
+func (s *Server) routeAgentAudit(w http.ResponseWriter, r *http.Request, agent string, rest []string) *Error {
+	if len(rest) > 1 || len(rest) == 1 && rest[0] != "verify" {
+		return errNotFound
+	}
+	if r.Method != http.MethodGet {
+		return errMethodNotAllowed
+	}
+	if len(rest) == 1 {
+		return s.call(w, r, http.StatusOK, agent, "/node/audit_verify", &control.Empty{}, new(audit.Verification))
+	}
+	filter, aerr := auditFilter(r)
+	if aerr != nil {
+		return aerr
+	}
+	var records []audit.Record
+	if err := s.backend.CallAgentContext(r.Context(), agent, "/node/audit_list", &filter, &records); err != nil {
+		return agentError(err)
+	}
+	return writeRecords(w, r, records)
+}
+
+// auditFilter reads ?action=, ?actor=, ?target=, ?since= and ?until=, the
+// times in RFC 3339.
+func auditFilter(r *http.Request) (audit.Filter, *Error) {
+	q := r.URL.Query()
+	filter := audit.Filter{Action: q.Get("action"), Actor: q.Get("actor"), Target: q.Get("target")}
+	for _, t := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		s := q.Get(t.name)
+		if s == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return filter, newError(http.StatusBadRequest, "bad_request", fmt.Sprintf("%s must be an RFC 3339 time", t.name))
+		}
+		*t.value = v
+	}
+	return filter, nil
+}
+
+// writeRecords writes a page of records, which are in sequence order.
+func writeRecords(w http.ResponseWriter, r *http.Request, records []audit.Record) *Error {
+	start, end, next, err := paginate(r, len(records), func(i int) string { return fmt.Sprintf("%020d", records[i].Seq) })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: records[start:end], NextCursor: next})
+	return nil
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"vpc/pkg/control"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// Error is the body of every failed request:
+// {"error": {"code": "not_found", "message": "no interface wg123456"}}.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func writeError(w http.ResponseWriter, err *Error) {
+	writeJSON(w, err.Status, map[string]*Error{"error": err})
+}
+
+// agentError maps a failed agent call to an API error. Failures of the
+// agent itself are reported as a bad gateway.
+func agentError(err error) *Error {
+	serr, ok := err.(*control.StatusError)
+	if !ok {
+		return newError(http.StatusBadGateway, "agent_unavailable", err.Error())
+	}
+	switch serr.Code {
+	case tp.CodeBadMessage:
+		return newError(http.StatusBadRequest, "bad_request", serr.Msg)
+	case tp.CodeNotFound:
+		return newError(http.StatusNotFound, "not_found", serr.Msg)
+	}
+	return newError(http.StatusBadGateway, "agent_error", serr.Msg)
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL is how long the response to a key is replayed.
+const idempotencyTTL = 24 * time.Hour
+
+type idempotentResponse struct {
+	fingerprint string
+	created     time.Time
+	done        chan struct{}
+	status      int
+	body        []byte
+}
+
+// idempotency replays the response of a create call sent again with the
+// same Idempotency-Key, so a client can retry without creating twice.
+type idempotency struct {
+	lock      sync.Mutex
+	responses map[string]*idempotentResponse
+}
+
+func newIdempotency() *idempotency {
+	return &idempotency{responses: map[string]*idempotentResponse{}}
+}
+
+// recorder keeps what a handler wrote so it can be stored and replayed.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (i *idempotency) pruneLocked(now time.Time) {
+	for key, resp := range i.responses {
+		if now.Sub(resp.created) > idempotencyTTL {
+			delete(i.responses, key)
+		}
+	}
+}
+
+// serve runs next once per key. A key sent with a different request is
+// rejected, a key whose first request is still running gets a conflict.
+// Server errors and panics are not stored so the call can be retried.
+func (i *idempotency) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || r.Method != http.MethodPost {
+		next(w, r)
+		return
+	}
+	// every tenant has its own keys
+	key = scope(r) + "/" + key
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, newError(http.StatusBadRequest, "bad_request", err.Error()))
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	fingerprint := r.Method + " " + r.URL.Path + " " + hex.EncodeToString(sum[:])
+
+	now := time.Now()
+	i.lock.Lock()
+	i.pruneLocked(now)
+	if resp, found := i.responses[key]; found {
+		i.lock.Unlock()
+		if resp.fingerprint != fingerprint {
+			writeError(w, newError(http.StatusUnprocessableEntity, "idempotency_key_reused", "the key was used for a different request"))
+			return
+		}
+		select {
+		case <-resp.done:
+		default:
+			writeError(w, newError(http.StatusConflict, "request_in_progress", "a request with this key is still running"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(resp.status)
+		w.Write(resp.body)
+		return
+	}
+	resp := &idempotentResponse{fingerprint: fingerprint, created: now, done: make(chan struct{})}
+	i.responses[key] = resp
+	i.lock.Unlock()
+
+	defer func() {
+		// a handler that panicked stored nothing, free the key for a retry
+		// and leave the panic to net/http
+		if p := recover(); p != nil {
+			i.lock.Lock()
+			delete(i.responses, key)
+			i.lock.Unlock()
+			close(resp.done)
+			panic(p)
+		}
+	}()
+	rec := &recorder{header: w.Header()}
+	next(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	resp.status = rec.status
+	resp.body = rec.body.Bytes()
+	i.lock.Lock()
+	if rec.status >= 500 {
+		delete(i.responses, key)
+	}
+	i.lock.Unlock()
+	close(resp.done)
+
+	w.WriteHeader(rec.status)
+	w.Write(resp.body)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"vpc/pkg/control"
+	"vpc/pkg/logging"
+)
+
+func decodeLogLevel(r *http.Request) (control.LogLevel, *Error) {
+	var arg control.LogLevel
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&arg); err != nil {
+		return arg, newError(http.StatusBadRequest, "bad_request", err.Error())
+	}
+	if arg.Level == "" {
+		return arg, newError(http.StatusBadRequest, "bad_request", "level is required")
+	}
+	return arg, nil
+}
+
+// controlLogLevel serves /v1/logging/level, the level of the control plane.
+func (s *Server) controlLogLevel(w http.ResponseWriter, r *http.Request) *Error {
+	if s.Level == nil {
+		return errNotFound
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		arg, aerr := decodeLogLevel(r)
+		if aerr != nil {
+			return aerr
+		}
+		before := control.LogLevel{Level: s.Level.String()}
+		err := logging.SetLevel(*s.Level, arg.Level)
+		s.record(r, "logging.level", "logging", before, control.LogLevel{Level: s.Level.String()}, err)
+		if err != nil {
+			return newError(http.StatusBadRequest, "bad_request", err.Error())
+		}
+	default:
+		return errMethodNotAllowed
+	}
+	writeJSON(w, http.StatusOK, control.LogLevel{Level: s.Level.String()})
+	return nil
+}
+
+func (s *Server) agentLogLevel(w http.ResponseWriter, r *http.Request, agent string) *Error {
+	arg, err := decodeLogLevel(r)
+	if err != nil {
+		return err
+	}
+	return s.call(w, r, http.StatusOK, agent, "/node/log_level", &arg, new(control.LogLevel))
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"vpc/pkg/control"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// Page is the body of every list request. NextCursor is passed back as
+// ?cursor= to get the next page, it is empty on the last one.
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// paginate picks the page asked for by ?limit= and ?cursor= out of n items
+// sorted by key. The cursor is the key of the last item of the previous
+// page, so pages stay stable when items are added or removed.
+func paginate(r *http.Request, n int, key func(int) string) (int, int, string, *Error) {
+	limit := defaultLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 || l > maxLimit {
+			return 0, 0, "", newError(http.StatusBadRequest, "bad_request", "limit must be between 1 and 500")
+		}
+		limit = l
+	}
+	start := 0
+	if s := r.URL.Query().Get("cursor"); s != "" {
+		after, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return 0, 0, "", newError(http.StatusBadRequest, "bad_request", "invalid cursor")
+		}
+		start = sort.Search(n, func(i int) bool { return key(i) > string(after) })
+	}
+	end := start + limit
+	if end >= n {
+		return start, n, "", nil
+	}
+	return start, end, base64.RawURLEncoding.EncodeToString([]byte(key(end - 1))), nil
+}
+
+func sortPeers(peers []control.PeerInfo) {
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e"}
+	cursor := func(key string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(key))
+	}
+	tests := []struct {
+		name      string
+		query     string
+		start     int
+		end       int
+		next      string
+		errStatus int
+	}{
+		{name: "default limit", query: "", start: 0, end: 5},
+		{name: "first page", query: "?limit=2", start: 0, end: 2, next: cursor("b")},
+		{name: "middle page", query: "?limit=2&cursor=" + cursor("b"), start: 2, end: 4, next: cursor("d")},
+		{name: "last page", query: "?limit=2&cursor=" + cursor("d"), start: 4, end: 5},
+		{name: "exact fit", query: "?limit=5", start: 0, end: 5},
+		{name: "cursor of a removed item", query: "?limit=2&cursor=" + cursor("bb"), start: 2, end: 4, next: cursor("d")},
+		{name: "cursor past the end", query: "?cursor=" + cursor("z"), start: 5, end: 5},
+		{name: "zero limit", query: "?limit=0", errStatus: http.StatusBadRequest},
+		{name: "limit too large", query: "?limit=501", errStatus: http.StatusBadRequest},
+		{name: "limit not a number", query: "?limit=x", errStatus: http.StatusBadRequest},
+		{name: "bad cursor", query: "?cursor=%21%21", errStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/peers"+tt.query, nil)
+			start, end, next, err := paginate(r, len(keys), func(i int) string { return keys[i] })
+			if tt.errStatus != 0 {
+				if err == nil || err.Status != tt.errStatus {
+					t.Fatalf("paginate() error = %v, want status %d", err, tt.errStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("paginate() error = %v", err)
+			}
+			if start != tt.start || end != tt.end || next != tt.next {
+				t.Errorf("paginate() = %d, %d, %q, want %d, %d, %q", start, end, next, tt.start, tt.end, tt.next)
+			}
+		})
+	}
+}
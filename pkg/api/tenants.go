@@ -0,0 +1,369 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"vpc/pkg/control"
+	"vpc/pkg/tenant"
+)
+
+type scopeKey struct{}
+
+// withScope marks a request as made with the token of tenant t.
+func withScope(ctx context.Context, t string) context.Context {
+	return context.WithValue(ctx, scopeKey{}, t)
+}
+
+// scope returns the tenant a request is made for, empty for the operator.
+func scope(r *http.Request) string {
+	t, _ := r.Context().Value(scopeKey{}).(string)
+	return t
+}
+
+// inScope tells whether tenant t may request path, which is only its own
+// /v1/tenants/{tenant}/... The operator may request anything.
+func inScope(path []string, t string) bool {
+	return t == "" || len(path) >= 3 && path[0] == "v1" && path[1] == "tenants" && path[2] == t
+}
+
+var errForbidden = newError(http.StatusForbidden, "forbidden", "only the operator may do this")
+
+// tenantError maps a failed tenancy change to an API error.
+func tenantError(err error) *Error {
+	var lerr *tenant.LimitError
+	var serr *control.StatusError
+	switch {
+	case errors.As(err, &lerr):
+		return newError(http.StatusForbidden, "limit_exceeded", err.Error())
+	case errors.As(err, &serr):
+		return agentError(serr)
+	case errors.Is(err, tenant.ErrNotFound):
+		return newError(http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, tenant.ErrExists), errors.Is(err, tenant.ErrInUse):
+		return newError(http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, tenant.ErrInvalid):
+		return newError(http.StatusBadRequest, "bad_request", err.Error())
+	}
+	return newError(http.StatusInternalServerError, "internal", err.Error())
+}
+
+func decode(r *http.Request, v interface{}) *Error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return newError(http.StatusBadRequest, "bad_request", err.Error())
+	}
+	return nil
+}
+
+type TenantRequest struct {
+	Name   string        `json:"name"`
+	Limits tenant.Limits `json:"limits"`
+}
+
+// TenantCreated is a new tenant with its API token, which cannot be read
+// again.
+type TenantCreated struct {
+	tenant.Tenant
+	Token string `json:"token"`
+}
+
+type NetworkRequest struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type InterfaceRequest struct {
+	Agent string `json:"agent"`
+}
+
+// PeerCreated is a new peer with its wg-quick config.
+type PeerCreated struct {
+	tenant.Peer
+	Config string `json:"config"`
+}
+
+type ConfigResponse struct {
+	Config string `json:"config"`
+}
+
+// routeTenants dispatches /v1/tenants/... Listing, creating and deleting
+// tenants and changing their limits is left to the operator.
+func (s *Server) routeTenants(w http.ResponseWriter, r *http.Request, rest []string) *Error {
+	if s.Tenants == nil {
+		return newError(http.StatusNotFound, "not_found", "tenancy is not configured")
+	}
+	if len(rest) == 0 {
+		if scope(r) != "" {
+			return errForbidden
+		}
+		switch r.Method {
+		case http.MethodGet:
+			tenants := s.Tenants.Tenants()
+			start, end, next, err := paginate(r, len(tenants), func(i int) string { return tenants[i].Name })
+			if err != nil {
+				return err
+			}
+			writeJSON(w, http.StatusOK, Page{Items: tenants[start:end], NextCursor: next})
+			return nil
+		case http.MethodPost:
+			return s.createTenant(w, r)
+		}
+		return errMethodNotAllowed
+	}
+	name := rest[0]
+	switch {
+	case len(rest) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			t, err := s.Tenants.Tenant(name)
+			if err != nil {
+				return tenantError(err)
+			}
+			writeJSON(w, http.StatusOK, t)
+			return nil
+		case http.MethodDelete:
+			if scope(r) != "" {
+				return errForbidden
+			}
+			before, _ := s.Tenants.Tenant(name)
+			err := s.Tenants.DeleteTenant(name)
+			s.record(r, "tenant.delete", "tenant/"+name, before, nil, err)
+			if err != nil {
+				return tenantError(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	case len(rest) == 2 && rest[1] == "limits":
+		if r.Method == http.MethodPut {
+			return s.setLimits(w, r, name)
+		}
+	case len(rest) >= 2 && rest[1] == "networks":
+		return s.routeNetworks(w, r, name, rest[2:])
+	default:
+		return errNotFound
+	}
+	return errMethodNotAllowed
+}
+
+func (s *Server) createTenant(w http.ResponseWriter, r *http.Request) *Error {
+	var req TenantRequest
+	if err := decode(r, &req); err != nil {
+		return err
+	}
+	t, token, err := s.Tenants.CreateTenant(req.Name, req.Limits)
+	s.record(r, "tenant.create", "tenant/"+req.Name, nil, t, err)
+	if err != nil {
+		return tenantError(err)
+	}
+	writeJSON(w, http.StatusCreated, TenantCreated{Tenant: t, Token: token})
+	return nil
+}
+
+func (s *Server) setLimits(w http.ResponseWriter, r *http.Request, name string) *Error {
+	if scope(r) != "" {
+		return errForbidden
+	}
+	var limits tenant.Limits
+	if err := decode(r, &limits); err != nil {
+		return err
+	}
+	before, _ := s.Tenants.Tenant(name)
+	t, err := s.Tenants.SetLimits(r.Context(), name, limits)
+	s.record(r, "tenant.limits", "tenant/"+name, before.Limits, t.Limits, err)
+	if err != nil {
+		return tenantError(err)
+	}
+	writeJSON(w, http.StatusOK, t)
+	return nil
+}
+
+// routeNetworks dispatches /v1/tenants/{tenant}/networks/...
+func (s *Server) routeNetworks(w http.ResponseWriter, r *http.Request, t string, rest []string) *Error {
+	if len(rest) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			networks, err := s.Tenants.Networks(t)
+			if err != nil {
+				return tenantError(err)
+			}
+			start, end, next, aerr := paginate(r, len(networks), func(i int) string { return networks[i].Name })
+			if aerr != nil {
+				return aerr
+			}
+			writeJSON(w, http.StatusOK, Page{Items: networks[start:end], NextCursor: next})
+			return nil
+		case http.MethodPost:
+			var req NetworkRequest
+			if err := decode(r, &req); err != nil {
+				return err
+			}
+			n, err := s.Tenants.CreateNetwork(t, req.Name, req.Address)
+			s.record(r, "network.create", "tenant/"+t+"/network/"+req.Name, nil, n, err)
+			if err != nil {
+				return tenantError(err)
+			}
+			writeJSON(w, http.StatusCreated, n)
+			return nil
+		}
+		return errMethodNotAllowed
+	}
+	network := rest[0]
+	target := "tenant/" + t + "/network/" + network
+	switch {
+	case len(rest) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			n, err := s.Tenants.Network(t, network)
+			if err != nil {
+				return tenantError(err)
+			}
+			writeJSON(w, http.StatusOK, n)
+			return nil
+		case http.MethodDelete:
+			before, _ := s.Tenants.Network(t, network)
+			err := s.Tenants.DeleteNetwork(r.Context(), t, network)
+			s.record(r, "network.delete", target, before, nil, err)
+			if err != nil {
+				return tenantError(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	case len(rest) == 2 && rest[1] == "interfaces":
+		switch r.Method {
+		case http.MethodGet:
+			return s.listInterfaces(w, r, t, network)
+		case http.MethodPost:
+			var req InterfaceRequest
+			if err := decode(r, &req); err != nil {
+				return err
+			}
+			if !s.registered(req.Agent) {
+				return newError(http.StatusBadRequest, "bad_request", "no agent "+req.Agent)
+			}
+			iface, err := s.Tenants.AddInterface(r.Context(), t, network, req.Agent)
+			s.record(r, "interface.create", target+"/interface/"+iface.Name, nil, iface, err)
+			if err != nil {
+				return tenantError(err)
+			}
+			writeJSON(w, http.StatusCreated, iface)
+			return nil
+		}
+	case len(rest) == 3 && rest[1] == "interfaces":
+		if r.Method == http.MethodDelete {
+			err := s.Tenants.RemoveInterface(r.Context(), t, network, rest[2])
+			s.record(r, "interface.destroy", target+"/interface/"+rest[2], nil, nil, err)
+			if err != nil {
+				return tenantError(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	case len(rest) >= 2 && rest[1] == "peers":
+		return s.routeTenantPeers(w, r, t, network, rest[2:])
+	default:
+		return errNotFound
+	}
+	return errMethodNotAllowed
+}
+
+func (s *Server) listInterfaces(w http.ResponseWriter, r *http.Request, t string, network string) *Error {
+	n, err := s.Tenants.Network(t, network)
+	if err != nil {
+		return tenantError(err)
+	}
+	ifaces := append([]tenant.Interface{}, n.Interfaces...)
+	key := func(i int) string { return ifaces[i].Agent + "/" + ifaces[i].Name }
+	sort.Slice(ifaces, func(i, j int) bool { return key(i) < key(j) })
+	start, end, next, aerr := paginate(r, len(ifaces), key)
+	if aerr != nil {
+		return aerr
+	}
+	writeJSON(w, http.StatusOK, Page{Items: ifaces[start:end], NextCursor: next})
+	return nil
+}
+
+// routeTenantPeers dispatches /v1/tenants/{tenant}/networks/{network}/peers/...
+func (s *Server) routeTenantPeers(w http.ResponseWriter, r *http.Request, t string, network string, rest []string) *Error {
+	if len(rest) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			peers, err := s.Tenants.Peers(t, network)
+			if err != nil {
+				return tenantError(err)
+			}
+			start, end, next, aerr := paginate(r, len(peers), func(i int) string { return peers[i].Name })
+			if aerr != nil {
+				return aerr
+			}
+			writeJSON(w, http.StatusOK, Page{Items: peers[start:end], NextCursor: next})
+			return nil
+		case http.MethodPost:
+			var spec tenant.PeerSpec
+			if err := decode(r, &spec); err != nil {
+				return err
+			}
+			p, conf, err := s.Tenants.AddPeer(r.Context(), t, network, spec)
+			s.record(r, "peer.add", "tenant/"+t+"/network/"+network+"/peer/"+spec.Name, nil, p, err)
+			if err != nil {
+				return tenantError(err)
+			}
+			writeJSON(w, http.StatusCreated, PeerCreated{Peer: p, Config: conf})
+			return nil
+		}
+		return errMethodNotAllowed
+	}
+	name := rest[0]
+	target := "tenant/" + t + "/network/" + network + "/peer/" + name
+	switch {
+	case len(rest) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			p, err := s.Tenants.Peer(t, network, name)
+			if err != nil {
+				return tenantError(err)
+			}
+			writeJSON(w, http.StatusOK, p)
+			return nil
+		case http.MethodPut:
+			var spec tenant.PeerSpec
+			if err := decode(r, &spec); err != nil {
+				return err
+			}
+			before, _ := s.Tenants.Peer(t, network, name)
+			p, err := s.Tenants.UpdatePeer(t, network, name, spec)
+			s.record(r, "peer.update", target, before, p, err)
+			if err != nil {
+				return tenantError(err)
+			}
+			writeJSON(w, http.StatusOK, p)
+			return nil
+		case http.MethodDelete:
+			before, _ := s.Tenants.Peer(t, network, name)
+			err := s.Tenants.RemovePeer(r.Context(), t, network, name)
+			s.record(r, "peer.remove", target, before, nil, err)
+			if err != nil {
+				return tenantError(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	case len(rest) == 2 && rest[1] == "config":
+		if r.Method == http.MethodGet {
+			conf, err := s.Tenants.PeerConfig(r.Context(), t, network, name)
+			if err != nil {
+				return tenantError(err)
+			}
+			writeJSON(w, http.StatusOK, ConfigResponse{Config: conf})
+			return nil
+		}
+	default:
+		return errNotFound
+	}
+	return errMethodNotAllowed
+}
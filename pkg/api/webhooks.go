@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// ReplayRequest is the body of a dead letter replay, no IDs replays all of
+// them.
+type ReplayRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type ReplayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// routeWebhooks dispatches /v1/webhooks/dead-letters[/replay].
+func (s *Server) routeWebhooks(w http.ResponseWriter, r *http.Request, rest []string) *Error {
+	if len(rest) == 0 || rest[0] != "dead-letters" || len(rest) > 2 {
+		return errNotFound
+	}
+	if s.Webhooks == nil {
+		return newError(http.StatusNotFound, "not_found", "webhooks are not configured")
+	}
+	if len(rest) == 1 {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+		return s.listDeadLetters(w, r)
+	}
+	if rest[1] != "replay" {
+		return errNotFound
+	}
+	if r.Method != http.MethodPost {
+		return errMethodNotAllowed
+	}
+	return s.replayDeadLetters(w, r)
+}
+
+func (s *Server) listDeadLetters(w http.ResponseWriter, r *http.Request) *Error {
+	letters := s.Webhooks.DeadLetters()
+	sort.Slice(letters, func(i, j int) bool { return letters[i].ID < letters[j].ID })
+	start, end, next, err := paginate(r, len(letters), func(i int) string { return letters[i].ID })
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Page{Items: letters[start:end], NextCursor: next})
+	return nil
+}
+
+func (s *Server) replayDeadLetters(w http.ResponseWriter, r *http.Request) *Error {
+	var req ReplayRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && err != io.EOF {
+		return newError(http.StatusBadRequest, "bad_request", err.Error())
+	}
+	n, err := s.Webhooks.Replay(req.IDs...)
+	s.record(r, "webhook.replay", "webhooks", req, n, err)
+	if err != nil {
+		return newError(http.StatusInternalServerError, "internal", err.Error())
+	}
+	writeJSON(w, http.StatusOK, ReplayResponse{Replayed: n})
+	return nil
+}
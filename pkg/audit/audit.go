@@ -0,0 +1,209 @@
+// Package audit keeps the append-only record of administrative changes.
+// Records are written one JSON object per line and chained by hash, every
+// record hashing the previous one, so an edited or removed line shows up in
+// Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// maxMemoryRecords bounds a log without a file, the oldest records go.
+const maxMemoryRecords = 10000
+
+// Record is one change. Actor says who made it: "api:<addr>", "grpc:<addr>"
+// or "vpcctl:<addr>" for operators going through the control plane,
+// "local" for the commands of vpcd on the node, "config" for a reload.
+// Before and After hold the state of Target around the change, without
+// secrets.
+type Record struct {
+	Seq      uint64          `json:"seq"`
+	Time     time.Time       `json:"time"`
+	Node     string          `json:"node"`
+	Actor    string          `json:"actor"`
+	Action   string          `json:"action"`
+	Target   string          `json:"target"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+	Result   string          `json:"result"`
+	Error    string          `json:"error,omitempty"`
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash"`
+}
+
+// hash is the hash of r with its Hash field empty, chained to PrevHash.
+func (r Record) hash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	sum.Write([]byte(r.PrevHash))
+	sum.Write([]byte{'\n'})
+	sum.Write(b)
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// Log is an audit log file. Without a path the records only live in
+// memory. A nil Log drops every record.
+type Log struct {
+	Node string
+
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	seq     uint64
+	last    string
+	records []Record
+}
+
+// Open opens the log at path, creating it when missing, and continues its
+// chain. A log whose chain is broken is still opened, Verify tells where.
+func Open(path string, node string) (*Log, error) {
+	l := &Log{Node: node, path: path}
+	if path == "" {
+		return l, nil
+	}
+	err := l.scan(func(line int, r Record, err error) bool {
+		if err == nil {
+			l.seq, l.last = r.Seq, r.Hash
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Append chains r to the log and writes it. Seq, Time, Node and the hashes
+// are filled in.
+func (l *Log) Append(r Record) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	r.Seq = l.seq + 1
+	r.Time = time.Now().UTC()
+	r.Node = l.Node
+	r.PrevHash = l.last
+	hash, err := r.hash()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+	if l.file == nil {
+		if len(l.records) >= maxMemoryRecords {
+			l.records = l.records[1:]
+		}
+		l.records = append(l.records, r)
+	} else {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := l.file.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+	l.seq, l.last = r.Seq, r.Hash
+	return nil
+}
+
+// Change appends the change of target by actor. Before and after are
+// stored as JSON, nil leaves them out, and err is the failure of the change.
+func (l *Log) Change(actor string, action string, target string, before interface{}, after interface{}, err error) error {
+	r := Record{Actor: actor, Action: action, Target: target, Result: ResultOK}
+	if err != nil {
+		r.Result, r.Error = ResultError, err.Error()
+	}
+	var merr error
+	if r.Before, merr = state(before); merr != nil {
+		return merr
+	}
+	if r.After, merr = state(after); merr != nil {
+		return merr
+	}
+	return l.Append(r)
+}
+
+func state(v interface{}) (json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil || bytes.Equal(b, []byte("null")) {
+		return nil, err
+	}
+	return b, nil
+}
+
+// scan calls fn with every record in order, or with the error of a line
+// that does not parse, until it returns false.
+func (l *Log) scan(fn func(line int, r Record, err error) bool) error {
+	if l.path == "" {
+		l.lock.Lock()
+		records := l.records
+		l.lock.Unlock()
+		for i, r := range records {
+			if !fn(i+1, r, nil) {
+				return nil
+			}
+		}
+		return nil
+	}
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(b)) > 0 {
+			var r Record
+			perr := json.Unmarshal(b, &r)
+			if perr != nil {
+				perr = fmt.Errorf("line %d: %v", line, perr)
+			}
+			if !fn(line, r, perr) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
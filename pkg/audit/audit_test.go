@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(lines []string) []string
+		ok      bool
+		records int
+		seq     uint64
+		err     string
+	}{
+		{
+			name:    "untouched",
+			tamper:  func(lines []string) []string { return lines },
+			ok:      true,
+			records: 3,
+		},
+		{
+			name: "edited record",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"actor":"b"`, `"actor":"x"`, 1)
+				return lines
+			},
+			records: 1,
+			seq:     2,
+			err:     "hash does not match the record",
+		},
+		{
+			name: "edited record with its hash redone",
+			tamper: func(lines []string) []string {
+				lines[1] = rehash(t, strings.Replace(lines[1], `"actor":"b"`, `"actor":"x"`, 1))
+				return lines
+			},
+			records: 2,
+			seq:     3,
+			err:     "previous hash does not match",
+		},
+		{
+			name:    "removed record",
+			tamper:  func(lines []string) []string { return []string{lines[0], lines[2]} },
+			records: 1,
+			seq:     2,
+			err:     "expected record 2, found 3",
+		},
+		{
+			name:    "swapped records",
+			tamper:  func(lines []string) []string { return []string{lines[0], lines[2], lines[1]} },
+			records: 1,
+			seq:     2,
+			err:     "expected record 2, found 3",
+		},
+		{
+			name: "garbled line",
+			tamper: func(lines []string) []string {
+				lines[1] = "{"
+				return lines
+			},
+			records: 1,
+			seq:     2,
+			err:     "line 2: unexpected end of JSON input",
+		},
+		{
+			name:    "removed last record",
+			tamper:  func(lines []string) []string { return lines[:2] },
+			ok:      true,
+			records: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			l, err := Open(path, "node")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, actor := range []string{"a", "b", "c"} {
+				if err := l.Append(Record{Actor: actor, Action: "peer.add", Target: "wg0", Result: ResultOK}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			l.Close()
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := tt.tamper(strings.Split(strings.TrimSpace(string(b)), "\n"))
+			if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err = Open(path, "node")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			v, err := l.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.OK != tt.ok || v.Records != tt.records || v.Seq != tt.seq || v.Error != tt.err {
+				t.Errorf("Verify() = %+v, want ok %v, %d records, seq %d, error %q", v, tt.ok, tt.records, tt.seq, tt.err)
+			}
+		})
+	}
+}
+
+// rehash gives an edited record the hash matching its content.
+func rehash(t *testing.T, line string) string {
+	var r Record
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Hash = hash
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestVerifyInMemory(t *testing.T) {
+	l, err := Open("", "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		l.Append(Record{Actor: "a", Action: "peer.add", Target: "wg0", Result: ResultOK})
+	}
+	// the oldest record is dropped as when over maxMemoryRecords
+	l.records = l.records[1:]
+	v, err := l.Verify()
+	if err != nil || !v.OK || v.Records != 2 {
+		t.Errorf("Verify() = %+v, %v, want ok with 2 records", v, err)
+	}
+}
@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Filter selects records, empty fields match everything.
+type Filter struct {
+	Action string    `json:"action,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	Until  time.Time `json:"until,omitempty"`
+}
+
+func (f Filter) match(r Record) bool {
+	switch {
+	case f.Action != "" && r.Action != f.Action,
+		f.Actor != "" && r.Actor != f.Actor,
+		f.Target != "" && r.Target != f.Target,
+		!f.Since.IsZero() && r.Time.Before(f.Since),
+		!f.Until.IsZero() && !r.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Query returns the records matching f, oldest first. Lines that do not
+// parse are skipped, Verify reports them.
+func (l *Log) Query(f Filter) ([]Record, error) {
+	records := []Record{}
+	if l == nil {
+		return records, nil
+	}
+	err := l.scan(func(line int, r Record, err error) bool {
+		if err == nil && f.match(r) {
+			records = append(records, r)
+		}
+		return true
+	})
+	return records, err
+}
+
+// Verification is the outcome of Verify. When the chain is broken Seq is
+// the first record that does not follow from the previous one.
+type Verification struct {
+	OK       bool   `json:"ok"`
+	Records  int    `json:"records"`
+	LastHash string `json:"last_hash,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Verify walks the chain and checks the hash of every record. The last hash
+// can be kept elsewhere to also detect records removed from the end.
+func (l *Log) Verify() (Verification, error) {
+	v := Verification{OK: true}
+	if l == nil {
+		return v, nil
+	}
+	first := true
+	var seq uint64
+	prev := ""
+	err := l.scan(func(line int, r Record, err error) bool {
+		if err != nil {
+			v.OK, v.Seq, v.Error = false, seq+1, err.Error()
+			return false
+		}
+		// a log in memory may have dropped its oldest records
+		if first && l.path == "" {
+			seq, prev = r.Seq-1, r.PrevHash
+		}
+		first = false
+		hash, err := r.hash()
+		switch {
+		case err != nil:
+			v.Error = err.Error()
+		case r.Seq != seq+1:
+			v.Error = fmt.Sprintf("expected record %d, found %d", seq+1, r.Seq)
+		case r.PrevHash != prev:
+			v.Error = "previous hash does not match"
+		case r.Hash != hash:
+			v.Error = "hash does not match the record"
+		}
+		if v.Error != "" {
+			v.OK, v.Seq = false, seq+1
+			return false
+		}
+		v.Records++
+		seq, prev = r.Seq, r.Hash
+		v.LastHash = prev
+		return true
+	})
+	return v, err
+}
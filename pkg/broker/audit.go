@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"vpc/pkg/audit"
+	"vpc/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+// Audit records the administrative changes made on this node. It only
+// lives in memory until Init opens the audit log.
+var Audit, _ = audit.Open("", "")
+
+// auditedConfig is what a reload is recorded with, the settings that change
+// running relays and peers, without secrets.
+type auditedConfig struct {
+	LogLevel     string               `json:"log_level"`
+	PeerQuota    int64                `json:"peer_quota"`
+	AddressPools []string             `json:"address_pools"`
+	Ports        map[string][]string  `json:"ports"`
+	Relays       []config.RelayConfig `json:"relays"`
+}
+
+func auditConfig(cfg *config.Config) auditedConfig {
+	return auditedConfig{
+		LogLevel:     cfg.Logging.Level,
+		PeerQuota:    cfg.Wireguard.PeerQuota,
+		AddressPools: cfg.AddressPools,
+		Ports:        cfg.Ports,
+		Relays:       cfg.Relays,
+	}
+}
+
+// Reload loads the config file at path and applies it, recording the
+// change in Audit. A broken file leaves the previous config in place.
+func Reload(path string) error {
+	before := auditConfig(Current())
+	cfg, err := config.Load(path)
+	if err == nil {
+		err = Apply(cfg)
+	}
+	if aerr := Audit.Change("config", "config.reload", path, before, auditConfig(Current()), err); aerr != nil {
+		Logger.Error("failed to write audit record", zap.Error(aerr))
+	}
+	return err
+}
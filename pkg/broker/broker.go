@@ -1,64 +1,299 @@
 package broker
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"github.com/Denis101/freeport"
+	"github.com/c-robinson/iplib"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
-	"os"
-	"time"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"vpc/pkg/config"
+	"vpc/pkg/logging"
+	"vpc/pkg/mesh"
+	"vpc/pkg/ports"
 	"vpc/pkg/proxy"
 	"vpc/pkg/utils"
 	"vpc/pkg/wireguard"
 )
 
-var Logger = GetLogger(zap.DebugLevel)
+// Logger is the root logger of the daemon, every logger of the broker is
+// derived from it. It logs with the default config until SetLogger injects
+// the one built from the config file.
+var Logger = defaultLogger()
 
-func GetLogger(ll zapcore.Level) *zap.Logger {
-	l := zap.New(zapcore.NewCore(
-		zapcore.NewJSONEncoder(zap.NewDevelopmentEncoderConfig()),
-		zapcore.Lock(os.Stdout),
-		ll,
-	))
-	return l
+// defaultLogger builds the logger of the default config. It only fails on
+// a broken default config, nothing is logged then rather than panicking
+// at import.
+func defaultLogger() *zap.Logger {
+	logger, err := logging.New(config.Default().Logging, Level)
+	if err != nil {
+		return zap.NewNop()
+	}
+	return logger
+}
+
+// Ports hands out the listen ports of relays and Wireguard interfaces.
+var Ports = ports.NewAllocator(nil)
+
+// Mesh is the mesh interface of the node, nil when the node is not in the
+// mesh. vpcd agent sets it.
+var Mesh *mesh.Mesh
+
+// SetLogger replaces Logger, also in the controller and the event bus. It
+// has to be called before Init, what was created earlier keeps its logger.
+func SetLogger(logger *zap.Logger) {
+	Logger = logger
+	Controller.Logger = logger
+	Events.Logger = logger
+}
+
+// ephemeral holds the names allocate made up, nothing asks for them again
+// so their assignments are dropped when the relay closes.
+var (
+	ephemeral     = map[string]bool{}
+	ephemeralLock sync.Mutex
+)
+
+// allocate gets a port for name, or for a variant of name when name already
+// holds one, so several relays to the same destination can coexist.
+func allocate(service string, protocol string, name string, port int, opts *utils.SocketOptions) (*ports.Lease, error) {
+	lease, err := Ports.Allocate(service, protocol, name, port, opts)
+	if err == ports.ErrNameInUse {
+		lease, err = Ports.Allocate(service, protocol, name+"/"+utils.RandomString(4), port, opts)
+		if err == nil {
+			ephemeralLock.Lock()
+			ephemeral[lease.Name] = true
+			ephemeralLock.Unlock()
+		}
+	}
+	if err != nil {
+		Logger.Error("failed to allocate port", zap.String("name", name), zap.Error(err))
+	}
+	return lease, err
+}
+
+// trackProxy lists a started proxy of CreateProxy, CreateWireguardProxy or
+// CreateStreamProxy with the other relays, so Relays and the metrics
+// include it.
+func trackProxy(p *proxy.Proxy, lease *ports.Lease, dhost string, dport int) {
+	cfg := config.RelayConfig{
+		Name:      p.Name,
+		Transport: string(p.Transport),
+		Upstream:  net.JoinHostPort(dhost, strconv.Itoa(dport)),
+	}
+	relaysLock.Lock()
+	relays[p.Name] = &declaredRelay{cfg: cfg, relay: p, acl: p.ACL, bindPort: lease.Port, port: lease.Name, adhoc: true}
+	relaysLock.Unlock()
+}
+
+// CloseProxy stops a proxy of CreateProxy, CreateWireguardProxy or
+// CreateStreamProxy and frees its port.
+func CloseProxy(p *proxy.Proxy) error {
+	relaysLock.Lock()
+	if r, found := relays[p.Name]; found && r.relay == p {
+		delete(relays, p.Name)
+	}
+	relaysLock.Unlock()
+	p.Close()
+	name := "relay/" + p.Name
+	ephemeralLock.Lock()
+	forget := ephemeral[name]
+	delete(ephemeral, name)
+	ephemeralLock.Unlock()
+	if forget {
+		return Ports.Forget(name)
+	}
+	Ports.Release(name)
+	return nil
+}
+
+func relayName(transport proxy.Transport, dhost string, dport int) string {
+	return fmt.Sprintf("relay/%s/%s:%d", transport, dhost, dport)
+}
+
+// newProxy builds a user space proxy from the proxy section of the config.
+func newProxy(port int, dhost string, dport int) *proxy.Proxy {
+	cfg := Current()
+	connTimeout, resolveTTL := proxyTimeouts(cfg)
+	p := proxy.NewProxy(true, Logger, port, "0.0.0.0", dhost, dport, cfg.Proxy.BufferSize, connTimeout, resolveTTL)
+	p.SocketOptions = &cfg.Proxy.Socket
+	p.Events = Events
+	return p
 }
 
 func CreateProxy(dhost string, dport int) (*proxy.Proxy, error) {
-	port, err := freeport.GetFreePortForProtocol("udp")
+	lease, err := allocate(ports.ServiceRelay, "udp", relayName(proxy.TransportUDP, dhost, dport), 0, &Current().Proxy.Socket)
 	if err != nil {
 		return nil, err
 	}
+	port := lease.Port
 
-	proxy := proxy.NewProxy(true, Logger, port, "0.0.0.0", dhost, dport, 4096, time.Second, time.Second*30)
+	proxy := newProxy(port, dhost, dport)
+	proxy.Name = strings.TrimPrefix(lease.Name, "relay/")
+	proxy.UseListener(lease.UDP)
 	err = proxy.Start()
 	if err != nil {
 		proxy.Logger.Error("failed to start proxy", zap.Int("source port", port), zap.String("dest", fmt.Sprintf("%s:%d", dhost, dport)))
+	} else {
+		trackProxy(proxy, lease, dhost, dport)
 	}
 	return proxy, err
 }
 
+// ReportSessions feeds relay session events into the endpoint map of the
+// Wireguard server behind the relay. The map is read by the peer list and
+// the handshake events. Only relays of this daemon report to it, a relay on
+// another node publishes its sessions as relay events instead.
+func ReportSessions(endpoints *wireguard.EndpointMap) func(proxy.SessionEvent) {
+	return func(ev proxy.SessionEvent) {
+		if ev.Open {
+			endpoints.Set(ev.Relay, ev.Client)
+		} else {
+			endpoints.Delete(ev.Relay)
+		}
+	}
+}
 
-func CreateWireguard(pubkey string) (*wireguard.Wireguard, error) {
-	port, err := freeport.GetFreePortForProtocol("udp")
+// CreateWireguardProxy starts a UDP relay in front of wg that only opens
+// sessions for handshakes addressed to wg's public key.
+func CreateWireguardProxy(wg *wireguard.Wireguard, dhost string) (*proxy.Proxy, error) {
+	dev, err := wg.Client.Device(wg.Iface)
 	if err != nil {
 		return nil, err
 	}
-	iface := utils.RandomString(6)
-	ipnet, err := utils.RandomPrivateNet()
+	lease, err := allocate(ports.ServiceRelay, "udp", relayName(proxy.TransportUDP, dhost, wg.Port), 0, &Current().Proxy.Socket)
 	if err != nil {
-		Logger.Error("failed to find subnet", zap.Error(err))
+		return nil, err
+	}
+	port := lease.Port
+
+	proxy := newProxy(port, dhost, wg.Port)
+	proxy.Name = strings.TrimPrefix(lease.Name, "relay/")
+	proxy.UseListener(lease.UDP)
+	proxy.SetUpstreamPublicKey(dev.PublicKey)
+	proxy.OnSession = ReportSessions(wg.Endpoints)
+	err = proxy.Start()
+	if err != nil {
+		proxy.Logger.Error("failed to start proxy", zap.Int("source port", port), zap.String("dest", fmt.Sprintf("%s:%d", dhost, wg.Port)))
+	} else {
+		trackProxy(proxy, lease, dhost, wg.Port)
+	}
+	return proxy, err
+}
+
+// CreateStreamProxy starts a relay that accepts Wireguard packets framed over
+// TCP, TLS or WebSocket and forwards them as UDP. A zero port picks one from
+// the relay range.
+func CreateStreamProxy(transport proxy.Transport, tlsConfig *tls.Config, port int, dhost string, dport int) (*proxy.Proxy, error) {
+	lease, err := allocate(ports.ServiceRelay, "tcp", relayName(transport, dhost, dport), port, Current().Proxy.Socket.Ephemeral())
+	if err != nil {
+		return nil, err
+	}
+	port = lease.Port
+
+	proxy := newProxy(port, dhost, dport)
+	proxy.Name = strings.TrimPrefix(lease.Name, "relay/")
+	proxy.UseStreamListener(lease.TCP)
+	proxy.Transport = transport
+	proxy.TLSConfig = tlsConfig
+	err = proxy.Start()
+	if err != nil {
+		proxy.Logger.Error("failed to start proxy", zap.Int("source port", port), zap.String("transport", string(transport)), zap.String("dest", fmt.Sprintf("%s:%d", dhost, dport)))
+	} else {
+		trackProxy(proxy, lease, dhost, dport)
+	}
+	return proxy, err
+}
+
+// WireguardOptions places a new interface. Subnet is the /24 of the
+// interface, a random one of the address pools when empty. RateLimit is in
+// bits per second, zero means none.
+type WireguardOptions struct {
+	Subnet    string
+	RateLimit int64
+}
+
+func CreateWireguard(opts WireguardOptions) (*wireguard.Wireguard, error) {
+	cfg := Current()
+	var ipnet iplib.Net
+	if opts.Subnet != "" {
+		var err error
+		if _, ipnet, err = iplib.ParseCIDR(opts.Subnet); err != nil {
+			return nil, err
+		}
+		if ones, bits := ipnet.Mask.Size(); ones != 24 || bits != 32 {
+			return nil, fmt.Errorf("subnet %s is not an IPv4 /24", opts.Subnet)
+		}
+	}
+	iface := cfg.Wireguard.NamePrefix + utils.RandomString(6)
+	// the lease is named after the interface, DeleteWireguard forgets it
+	lease, err := Ports.Allocate(ports.ServiceWireguard, "udp", iface, 0, nil)
+	if err != nil {
+		Logger.Error("failed to allocate port", zap.String("name", iface), zap.Error(err))
+		return nil, err
+	}
+	port := lease.Port
+	if opts.Subnet == "" {
+		pool := cfg.AddressPools[rand.Intn(len(cfg.AddressPools))]
+		if ipnet, err = utils.RandomNet(pool); err != nil {
+			Logger.Error("failed to find subnet", zap.Error(err))
+		}
 	}
 	wg, err := wireguard.NewWireguard(Logger, iface, port, ipnet.FirstAddress(), ipnet.IPNet)
+	if err != nil {
+		Ports.Release(lease.Name)
+		return wg, err
+	}
+	wg.MTU = cfg.Wireguard.MTU
+	wg.Firewall = cfg.Firewall.Backend
+	wg.SocketOptions = &cfg.Wireguard.Socket
+	wg.PublicIPURL = cfg.Endpoint.URL
+	wg.Events = Events
+	wg.Quota = cfg.Wireguard.PeerQuota
+	wg.RateLimit = opts.RateLimit
+	if cfg.Endpoint.Resolver == "static" {
+		wg.PublicHost = cfg.Endpoint.Address
+	}
 	err = wg.Init()
 	if err != nil {
 		wg.Logger.Error("failed to init wg", zap.Error(err))
 	}
 
-	err = wg.Start()
+	err = startWireguard(wg, lease)
 	if err != nil {
 		wg.Logger.Error("failed to start wg", zap.Error(err))
 	} else {
 		wg.Logger.Debug("successfully started wireguard", zap.Error(err))
+		manage(wg)
 	}
 	return wg, err
 }
+
+// startAttempts bounds how often startWireguard moves to another port.
+const startAttempts = 3
+
+// startWireguard hands the port of lease over to wg. The device binds the
+// port itself, so the lease has to let go of it first and another socket
+// can take it in between; the device then gets the port of a new lease.
+func startWireguard(wg *wireguard.Wireguard, lease *ports.Lease) error {
+	for attempt := 1; ; attempt++ {
+		lease.Unbind()
+		err := wg.Start()
+		if !errors.Is(err, syscall.EADDRINUSE) || attempt == startAttempts {
+			return err
+		}
+		wg.Logger.Warn("listen port taken, trying another", zap.Int("port", lease.Port))
+		if err := Ports.Forget(lease.Name); err != nil {
+			return err
+		}
+		if lease, err = Ports.Allocate(ports.ServiceWireguard, "udp", wg.Iface, 0, nil); err != nil {
+			return err
+		}
+		wg.SetPort(lease.Port)
+	}
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"vpc/pkg/proxy"
+	"vpc/pkg/wireguard"
+)
+
+func TestReportSessions(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	upstream, listener, client := listen(), listen(), listen()
+	endpoints := wireguard.NewEndpointMap()
+	p := proxy.NewProxy(false, zap.NewNop(), 0, "127.0.0.1", "127.0.0.1", upstream.LocalAddr().(*net.UDPAddr).Port, 2048, time.Minute, 0)
+	p.UseListener(listener)
+	p.OnSession = ReportSessions(endpoints)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	client.WriteTo([]byte("hello"), listener.LocalAddr())
+	upstream.SetReadDeadline(time.Now().Add(time.Second))
+	_, relay, err := upstream.ReadFromUDP(make([]byte, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer the server sees at the relay socket shows the client
+	want := client.LocalAddr().String()
+	deadline := time.Now().Add(time.Second)
+	for endpoints.Resolve(relay) != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := endpoints.Resolve(relay); got != want {
+		t.Errorf("Resolve(%s) = %s, want %s", relay, got, want)
+	}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	if got := endpoints.Resolve(other); got != other.String() {
+		t.Errorf("Resolve(%s) = %s, want the address itself", other, got)
+	}
+}
@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"vpc/pkg/audit"
+	"vpc/pkg/config"
+	"vpc/pkg/logging"
+	"vpc/pkg/ports"
+	"vpc/pkg/state"
+
+	"go.uber.org/zap"
+)
+
+// Level is the level of Logger, it follows logging.level on every Apply and
+// can be changed in between through the log level routes.
+var Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+
+// State persists port assignments and everything else that has to survive
+// a restart. It only lives in memory until Init opens the state file.
+var State, _ = state.Open("")
+
+var (
+	configLock sync.RWMutex
+	current    = config.Default()
+)
+
+// Current returns the configuration applied last.
+func Current() *config.Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return current
+}
+
+// OpenState switches State and the port allocator to the state file at path.
+func OpenState(path string) error {
+	store, err := state.Open(path)
+	if err != nil {
+		return err
+	}
+	State = store
+	Ports = ports.NewAllocator(store)
+	return nil
+}
+
+// Init opens the state file and the audit log, applies cfg for the first time, removes what
+// an earlier crashed run left behind and starts reconciling the interfaces
+// found in the state file.
+func Init(cfg *config.Config) error {
+	if err := OpenState(cfg.StatePath); err != nil {
+		return err
+	}
+	log, err := audit.Open(cfg.Audit.Path, cfg.Agent.Name)
+	if err != nil {
+		return err
+	}
+	Audit = log
+	if err := Apply(cfg); err != nil {
+		return err
+	}
+	if _, err := CollectGarbage(false, true); err != nil {
+		Logger.Error("failed to remove leftovers", zap.Error(err))
+	}
+	restoreInterfaces()
+	Controller.Start()
+	go observePeers()
+	return nil
+}
+
+// Apply switches to cfg without touching running Wireguard interfaces.
+// Logging, port ranges and the templates for new interfaces and proxies
+// change immediately, declared relays are started, updated or closed. When
+// a relay fails the previous config is put back.
+func Apply(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	ranges, err := portRanges(cfg)
+	if err != nil {
+		return err
+	}
+	previous := Current()
+	use(cfg, ranges)
+	if err := applyRelays(cfg.Relays); err != nil {
+		// the previous config was applied before, its ranges parse
+		previousRanges, _ := portRanges(previous)
+		use(previous, previousRanges)
+		if rerr := applyRelays(previous.Relays); rerr != nil {
+			Logger.Error("failed to restore the relays", zap.Error(rerr))
+		}
+		return err
+	}
+	Logger.Info("applied config")
+	return nil
+}
+
+func portRanges(cfg *config.Config) (map[string][]ports.Range, error) {
+	ranges := map[string][]ports.Range{}
+	for service, specs := range cfg.Ports {
+		for _, spec := range specs {
+			min, max, err := config.ParsePortRange(spec)
+			if err != nil {
+				return nil, fmt.Errorf("ports.%s: %v", service, err)
+			}
+			ranges[service] = append(ranges[service], ports.Range{Min: min, Max: max})
+		}
+	}
+	return ranges, nil
+}
+
+// use makes cfg the current config, everything but the relays.
+func use(cfg *config.Config, ranges map[string][]ports.Range) {
+	logging.SetLevel(Level, cfg.Logging.Level)
+	for service, r := range ranges {
+		Ports.SetRanges(service, r...)
+	}
+	reserved := cfg.ReservedPort
+	if cfg.Mesh.Address != "" {
+		reserved = append(append([]int{}, reserved...), cfg.Mesh.Port)
+	}
+	Ports.SetReserved(reserved...)
+	Controller.SetInterval(time.Duration(cfg.Wireguard.ReconcileInterval))
+
+	configLock.Lock()
+	current = cfg
+	configLock.Unlock()
+}
+
+func proxyTimeouts(cfg *config.Config) (time.Duration, time.Duration) {
+	return time.Duration(cfg.Proxy.ConnTimeout), time.Duration(cfg.Proxy.ResolveTTL)
+}
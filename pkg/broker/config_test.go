@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+	"vpc/pkg/config"
+)
+
+func TestApplyRollsBack(t *testing.T) {
+	before := Current()
+	// a relay opened at runtime holds the name the config declares
+	relaysLock.Lock()
+	relays["edge"] = &declaredRelay{cfg: config.RelayConfig{Name: "edge"}, adhoc: true}
+	relaysLock.Unlock()
+	defer func() {
+		relaysLock.Lock()
+		delete(relays, "edge")
+		relaysLock.Unlock()
+	}()
+
+	cfg := config.Default()
+	cfg.Logging.Level = "error"
+	cfg.Relays = []config.RelayConfig{{Name: "edge", Upstream: "127.0.0.1:51820"}}
+	if err := Apply(cfg); err == nil {
+		t.Fatal("Apply() succeeded with a relay name in use")
+	}
+	if Current() != before {
+		t.Error("the config was switched")
+	}
+	if got := Level.Level(); got != zapcore.DebugLevel {
+		t.Errorf("log level = %v, want it restored", got)
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	before := Current()
+	cfg := config.Default()
+	cfg.Ports["relay"] = []string{"100-99"}
+	cfg.Logging.Level = "error"
+	if err := Apply(cfg); err == nil {
+		t.Fatal("Apply() succeeded with a bad port range")
+	}
+	if Current() != before || Level.Level() != zapcore.DebugLevel {
+		t.Error("an invalid config was partly applied")
+	}
+}
@@ -0,0 +1,24 @@
+package broker
+
+import (
+	"time"
+	"vpc/pkg/events"
+
+	"go.uber.org/zap"
+)
+
+// Events is the bus the interfaces and relays of this node report to.
+var Events = events.NewBus(Logger)
+
+// observePeers publishes the handshakes, expiries and quota crossings of
+// the peers of every managed interface.
+func observePeers() {
+	for {
+		time.Sleep(time.Duration(Current().Wireguard.PeerCheckInterval))
+		for _, wg := range Wireguards() {
+			if err := wg.ObservePeers(); err != nil {
+				Logger.Debug("failed to check peers", zap.String("iface", wg.Iface), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"fmt"
+	"vpc/pkg/proxy"
+	"vpc/pkg/state"
+	"vpc/pkg/wireguard"
+
+	"go.uber.org/zap"
+)
+
+// CollectGarbage removes interfaces, firewall rules and nft tables tagged by
+// an earlier run that are not in the state file, and returns what it found.
+// Interfaces in the state file are left alone, restoreInterfaces adopts
+// them. Kernel relays are not persisted, so their tables are only collected
+// when relays is set, which is safe while no relay of this run exists.
+func CollectGarbage(dryRun bool, relays bool) ([]string, error) {
+	known := map[string]bool{}
+	State.View(func(d *state.Data) {
+		for name := range d.Interfaces {
+			known[name] = true
+		}
+	})
+
+	leftovers, err := wireguard.Leftovers()
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	var errs []error
+	for _, l := range leftovers {
+		if known[l.Iface] {
+			continue
+		}
+		found = append(found, l.String())
+		if dryRun {
+			continue
+		}
+		if err := l.Remove(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		Logger.Info("removed leftover", zap.String("leftover", l.String()))
+	}
+
+	if relays {
+		// no nft means no kernel relays
+		tables, _ := proxy.KernelTables()
+		for _, table := range tables {
+			found = append(found, "nftables relay: table ip "+table)
+			if dryRun {
+				continue
+			}
+			if err := proxy.DeleteKernelTable(table); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			Logger.Info("removed leftover relay", zap.String("table", table))
+		}
+	}
+	if len(errs) > 0 {
+		return found, fmt.Errorf("%v", errs)
+	}
+	return found, nil
+}
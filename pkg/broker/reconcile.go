@@ -0,0 +1,127 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"vpc/pkg/controller"
+	"vpc/pkg/ports"
+	"vpc/pkg/state"
+	"vpc/pkg/wireguard"
+
+	"go.uber.org/zap"
+)
+
+// Controller keeps every Wireguard interface the broker created in line
+// with the state file.
+var Controller = controller.NewController(Logger, time.Duration(current.Wireguard.ReconcileInterval))
+
+var (
+	interfacesLock sync.RWMutex
+	interfaces     = map[string]*wireguard.Wireguard{}
+)
+
+// Wireguards returns the managed interfaces sorted by name.
+func Wireguards() []*wireguard.Wireguard {
+	interfacesLock.RLock()
+	defer interfacesLock.RUnlock()
+	wgs := make([]*wireguard.Wireguard, 0, len(interfaces))
+	for _, wg := range interfaces {
+		wgs = append(wgs, wg)
+	}
+	sort.Slice(wgs, func(i, j int) bool { return wgs[i].Iface < wgs[j].Iface })
+	return wgs
+}
+
+// GetWireguard returns the managed interface called name.
+func GetWireguard(name string) (*wireguard.Wireguard, error) {
+	interfacesLock.RLock()
+	defer interfacesLock.RUnlock()
+	wg, found := interfaces[name]
+	if !found {
+		return nil, fmt.Errorf("no interface %s", name)
+	}
+	return wg, nil
+}
+
+func register(wg *wireguard.Wireguard) {
+	interfacesLock.Lock()
+	interfaces[wg.Iface] = wg
+	interfacesLock.Unlock()
+	Controller.Add(wg.Iface, wg)
+}
+
+// saveInterface is the OnChange hook of managed interfaces.
+func saveInterface(spec state.Interface) {
+	err := State.Update(func(d *state.Data) error {
+		d.Interfaces[spec.Name] = spec
+		return nil
+	})
+	if err != nil {
+		Logger.Error("failed to save interface", zap.String("iface", spec.Name), zap.Error(err))
+	}
+}
+
+// manage persists wg and hands it to the reconcile loop.
+func manage(wg *wireguard.Wireguard) {
+	wg.OnChange = saveInterface
+	saveInterface(wg.Spec())
+	register(wg)
+}
+
+// restoreInterfaces brings back the interfaces of the state file. Ports of
+// devices that survived the restart are claimed, the others are bound again
+// and released to the device when Reconcile recreates it.
+func restoreInterfaces() {
+	var specs []state.Interface
+	State.View(func(d *state.Data) {
+		for _, spec := range d.Interfaces {
+			specs = append(specs, spec)
+		}
+	})
+	for _, spec := range specs {
+		wg, err := wireguard.NewWireguardFromSpec(Logger, spec)
+		if err != nil {
+			Logger.Error("failed to restore interface", zap.String("iface", spec.Name), zap.Error(err))
+			continue
+		}
+		if _, err := net.InterfaceByName(spec.Name); err == nil {
+			_, err = Ports.Claim(ports.ServiceWireguard, "udp", spec.Name, spec.Port)
+		} else {
+			var lease *ports.Lease
+			if lease, err = Ports.Allocate(ports.ServiceWireguard, "udp", spec.Name, spec.Port, nil); err == nil {
+				lease.Unbind()
+			}
+		}
+		if err != nil {
+			Logger.Error("failed to restore interface port", zap.String("iface", spec.Name), zap.Int("port", spec.Port), zap.Error(err))
+			continue
+		}
+		wg.OnChange = saveInterface
+		wg.Events = Events
+		wg.Quota = Current().Wireguard.PeerQuota
+		register(wg)
+		Logger.Info("restored interface", zap.String("iface", spec.Name))
+	}
+}
+
+// DeleteWireguard tears wg down and forgets it, so it is not restored.
+func DeleteWireguard(wg *wireguard.Wireguard) error {
+	Controller.Remove(wg.Iface)
+	interfacesLock.Lock()
+	delete(interfaces, wg.Iface)
+	interfacesLock.Unlock()
+	err := wg.Stop()
+	if serr := State.Update(func(d *state.Data) error {
+		delete(d.Interfaces, wg.Iface)
+		return nil
+	}); serr != nil && err == nil {
+		err = serr
+	}
+	if ferr := Ports.Forget(wg.Iface); ferr != nil && err == nil {
+		err = ferr
+	}
+	return err
+}
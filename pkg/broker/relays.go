@@ -0,0 +1,300 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"vpc/pkg/config"
+	"vpc/pkg/events"
+	"vpc/pkg/ports"
+	"vpc/pkg/proxy"
+	"vpc/pkg/utils"
+	"vpc/pkg/wireguard"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type declaredRelay struct {
+	cfg   config.RelayConfig
+	relay proxy.Relay
+	// acl is the ACL of a user space relay, kernel relays have none
+	acl      *proxy.ACL
+	bindPort int
+	port     string
+	// adhoc relays were opened at runtime and are left alone by Apply
+	adhoc bool
+}
+
+// RelayStatus describes a running relay.
+type RelayStatus struct {
+	Config   config.RelayConfig
+	Port     int
+	Declared bool
+	Sessions int
+	Stats    proxy.Stats
+}
+
+var (
+	relaysLock sync.Mutex
+	relays     = map[string]*declaredRelay{}
+)
+
+// sameRelay reports whether two relay configs differ at most in their ACL,
+// which can be changed on a running proxy.
+func sameRelay(a, b config.RelayConfig) bool {
+	for _, c := range []*config.RelayConfig{&a, &b} {
+		c.Allow, c.Deny = nil, nil
+		c.MaxSessions, c.MaxSessionsPerIP, c.NewSessionRate = 0, 0, 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func applyACL(acl *proxy.ACL, cfg config.RelayConfig) error {
+	if err := acl.SetAllow(cfg.Allow); err != nil {
+		return err
+	}
+	if err := acl.SetDeny(cfg.Deny); err != nil {
+		return err
+	}
+	acl.SetMaxSessions(cfg.MaxSessions)
+	acl.SetMaxSessionsPerIP(cfg.MaxSessionsPerIP)
+	acl.SetNewSessionRate(cfg.NewSessionRate, int(cfg.NewSessionRate)+1)
+	return nil
+}
+
+// applyRelays brings the declared relays in line with cfgs.
+func applyRelays(cfgs []config.RelayConfig) error {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+
+	wanted := map[string]bool{}
+	var errs []error
+	for _, cfg := range cfgs {
+		wanted[cfg.Name] = true
+		if r, found := relays[cfg.Name]; found && r.adhoc {
+			errs = append(errs, fmt.Errorf("relay %s: name is used by a relay opened at runtime", cfg.Name))
+			continue
+		} else if found {
+			if sameRelay(r.cfg, cfg) && r.acl != nil {
+				if err := applyACL(r.acl, cfg); err != nil {
+					errs = append(errs, fmt.Errorf("relay %s: %v", cfg.Name, err))
+					continue
+				}
+				r.cfg = cfg
+				continue
+			}
+			closeRelay(r)
+			delete(relays, cfg.Name)
+		}
+		r, err := startRelay(cfg, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("relay %s: %v", cfg.Name, err))
+			continue
+		}
+		relays[cfg.Name] = r
+	}
+	for name, r := range relays {
+		if !wanted[name] && !r.adhoc {
+			closeRelay(r)
+			delete(relays, name)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+func closeRelay(r *declaredRelay) {
+	r.relay.Close()
+	Ports.Release(r.port)
+	Events.Publish(events.RelayEvent(events.RelayClosed, r.cfg.Name))
+}
+
+// OpenRelay starts a relay that is not in the config file. With wg set, the
+// relay sits in front of that interface: the upstream is its listen port,
+// only handshakes for its key open sessions and the sessions are reported
+// to its endpoint map.
+func OpenRelay(cfg config.RelayConfig, wg *wireguard.Wireguard) (RelayStatus, error) {
+	switch cfg.Backend {
+	case "", "userspace":
+	case "kernel":
+		if wg != nil {
+			return RelayStatus{}, fmt.Errorf("a kernel relay cannot report the sessions of an interface")
+		}
+		if cfg.Transport != "" && cfg.Transport != string(proxy.TransportUDP) {
+			return RelayStatus{}, fmt.Errorf("the kernel backend only relays udp")
+		}
+	default:
+		return RelayStatus{}, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+	switch proxy.Transport(cfg.Transport) {
+	case "", proxy.TransportUDP, proxy.TransportTCP, proxy.TransportWebSocket:
+	case proxy.TransportTLS:
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			return RelayStatus{}, fmt.Errorf("tls transport requires a certificate and key")
+		}
+	default:
+		return RelayStatus{}, fmt.Errorf("unknown transport %q", cfg.Transport)
+	}
+	var onSession func(proxy.SessionEvent)
+	if wg != nil {
+		dev, err := wg.Client.Device(wg.Iface)
+		if err != nil {
+			return RelayStatus{}, err
+		}
+		if cfg.Upstream == "" {
+			cfg.Upstream = net.JoinHostPort("127.0.0.1", strconv.Itoa(wg.Port))
+		}
+		cfg.UpstreamKey = dev.PublicKey.String()
+		onSession = ReportSessions(wg.Endpoints)
+	}
+	if cfg.Name == "" {
+		cfg.Name = utils.RandomString(8)
+	}
+
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	if _, found := relays[cfg.Name]; found {
+		return RelayStatus{}, fmt.Errorf("relay %s already exists", cfg.Name)
+	}
+	r, err := startRelay(cfg, onSession)
+	if err != nil {
+		return RelayStatus{}, err
+	}
+	r.adhoc = true
+	relays[cfg.Name] = r
+	return r.status(), nil
+}
+
+// CloseRelay stops a relay opened by OpenRelay. Relays of the config file
+// are closed by removing them from it.
+func CloseRelay(name string) error {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	r, found := relays[name]
+	if !found {
+		return fmt.Errorf("no relay %s", name)
+	}
+	if !r.adhoc {
+		return fmt.Errorf("relay %s is declared in the config file", name)
+	}
+	closeRelay(r)
+	delete(relays, name)
+	return Ports.Forget(r.port)
+}
+
+// Relays returns every running relay sorted by name.
+func Relays() []RelayStatus {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	statuses := make([]RelayStatus, 0, len(relays))
+	for _, r := range relays {
+		statuses = append(statuses, r.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Config.Name < statuses[j].Config.Name })
+	return statuses
+}
+
+func (r *declaredRelay) status() RelayStatus {
+	return RelayStatus{
+		Config:   r.cfg,
+		Port:     r.bindPort,
+		Declared: !r.adhoc,
+		Sessions: r.relay.ActiveSessions(),
+		Stats:    r.relay.Stats(),
+	}
+}
+
+func startRelay(cfg config.RelayConfig, onSession func(proxy.SessionEvent)) (*declaredRelay, error) {
+	host, portString, err := net.SplitHostPort(cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	dport, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	transport := proxy.Transport(cfg.Transport)
+	if transport == "" {
+		transport = proxy.TransportUDP
+	}
+	protocol := "udp"
+	if transport != proxy.TransportUDP {
+		protocol = "tcp"
+	}
+	opts := &Current().Proxy.Socket
+	if protocol == "tcp" {
+		opts = opts.Ephemeral()
+	}
+	lease, err := Ports.Allocate(ports.ServiceRelay, protocol, "relay/"+cfg.Name, cfg.Port, opts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backend == "kernel" {
+		return startKernelRelay(cfg, lease, host, dport)
+	}
+
+	c := Current()
+	connTimeout, resolveTTL := proxyTimeouts(c)
+	p := proxy.NewProxy(true, Logger, lease.Port, "0.0.0.0", host, dport, c.Proxy.BufferSize, connTimeout, resolveTTL)
+	p.Transport = transport
+	p.SocketOptions = &c.Proxy.Socket
+	if lease.UDP != nil {
+		p.UseListener(lease.UDP)
+	} else {
+		p.UseStreamListener(lease.TCP)
+	}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			Ports.Release(lease.Name)
+			return nil, err
+		}
+		p.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if cfg.UpstreamKey != "" {
+		key, err := wgtypes.ParseKey(cfg.UpstreamKey)
+		if err != nil {
+			Ports.Release(lease.Name)
+			return nil, err
+		}
+		p.SetUpstreamPublicKey(key)
+	}
+	if err := applyACL(p.ACL, cfg); err != nil {
+		Ports.Release(lease.Name)
+		return nil, err
+	}
+	p.OnSession = onSession
+	p.Name = cfg.Name
+	p.Events = Events
+	if err := p.Start(); err != nil {
+		Ports.Release(lease.Name)
+		return nil, err
+	}
+	Logger.Info("started declared relay", zap.String("relay", cfg.Name), zap.Int("port", lease.Port))
+	Events.Publish(events.RelayEvent(events.RelayOpened, cfg.Name))
+	return &declaredRelay{cfg: cfg, relay: p, acl: p.ACL, bindPort: lease.Port, port: lease.Name}, nil
+}
+
+// startKernelRelay forwards the port of lease with nftables. Packets are
+// redirected before they reach a socket, the socket of the lease stays
+// bound so nothing else takes the port.
+func startKernelRelay(cfg config.RelayConfig, lease *ports.Lease, host string, dport int) (*declaredRelay, error) {
+	_, resolveTTL := proxyTimeouts(Current())
+	kp := proxy.NewKernelProxy(Logger, lease.Port, "0.0.0.0", host, dport, resolveTTL)
+	kp.Name = cfg.Name
+	kp.Events = Events
+	if err := kp.Start(); err != nil {
+		Ports.Release(lease.Name)
+		return nil, err
+	}
+	Logger.Info("started kernel relay", zap.String("relay", cfg.Name), zap.Int("port", lease.Port))
+	Events.Publish(events.RelayEvent(events.RelayOpened, cfg.Name))
+	return &declaredRelay{cfg: cfg, relay: kp, bindPort: lease.Port, port: lease.Name}, nil
+}
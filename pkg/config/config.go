@@ -0,0 +1,665 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"vpc/pkg/events"
+	"vpc/pkg/utils"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix starts the environment variables that override config values,
+// e.g. VPC_CONTROL_LISTEN overrides control.listen.
+const EnvPrefix = "VPC"
+
+// Duration is a time.Duration written as "30s" in the config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// ControlConfig is the control plane run by vpcd serve. Token is shared by
+// the control plane, its agents and the local commands, an empty token
+// turns authentication off. OperatorToken is what vpcctl, the HTTP API and
+// the gRPC API take to manage nodes. It never falls back to Token, which
+// every agent holds: with Token set and no OperatorToken operator calls
+// are refused. Without OperatorToken the HTTP and gRPC APIs do not start.
+type ControlConfig struct {
+	Listen        string `yaml:"listen"`
+	Token         string `yaml:"token"`
+	OperatorToken string `yaml:"operator_token"`
+}
+
+// APIConfig is the HTTP API served next to the control plane, an empty
+// Listen turns it off. It accepts the operator token as bearer token.
+type APIConfig struct {
+	Listen  string `yaml:"listen"`
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+}
+
+// GRPCConfig is the gRPC API served next to the control plane, an empty
+// Listen turns it off. Like the HTTP API it takes the operator token.
+type GRPCConfig struct {
+	Listen  string `yaml:"listen"`
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+}
+
+// MetricsConfig is the Prometheus endpoint, served on Listen under /metrics
+// by vpcd agent with the interfaces and relays of the node and by vpcd
+// serve with the control plane sessions. When both run from one file set
+// VPC_METRICS_LISTEN for one of them. PerPeer adds series labelled by peer
+// public key, one set per peer.
+type MetricsConfig struct {
+	Listen  string `yaml:"listen"`
+	PerPeer bool   `yaml:"per_peer"`
+}
+
+// AgentConfig is the node run by vpcd agent. Listen serves the local wg,
+// peer and relay commands, Server is the control plane to register with.
+type AgentConfig struct {
+	Name   string `yaml:"name"`
+	Listen string `yaml:"listen"`
+	Server string `yaml:"server"`
+}
+
+// WireguardConfig is the template of every interface the daemon creates.
+type WireguardConfig struct {
+	NamePrefix string `yaml:"name_prefix"`
+	MTU        int    `yaml:"mtu"`
+	// Socket only takes mark, the listen socket belongs to the kernel
+	// module which has no other option to set.
+	Socket utils.SocketOptions `yaml:"socket"`
+	// ReconcileInterval is how often interfaces are checked against the
+	// state file, link changes trigger a check right away.
+	ReconcileInterval Duration `yaml:"reconcile_interval"`
+	// PeerCheckInterval is how often peers are checked for handshakes,
+	// expiry and quota to publish events.
+	PeerCheckInterval Duration `yaml:"peer_check_interval"`
+	// PeerQuota is the traffic in bytes after which a peer is reported,
+	// zero means no quota.
+	PeerQuota int64 `yaml:"peer_quota"`
+}
+
+type FirewallConfig struct {
+	// Backend is "iptables" or "nftables".
+	Backend string `yaml:"backend"`
+}
+
+// EndpointConfig decides the public host put in client configs.
+type EndpointConfig struct {
+	// Resolver is "ipify" to look the address up or "static" to use Address.
+	Resolver string `yaml:"resolver"`
+	URL      string `yaml:"url"`
+	Address  string `yaml:"address"`
+}
+
+type ProxyConfig struct {
+	BufferSize  int                 `yaml:"buffer_size"`
+	ConnTimeout Duration            `yaml:"conn_timeout"`
+	ResolveTTL  Duration            `yaml:"resolve_ttl"`
+	Socket      utils.SocketOptions `yaml:"socket"`
+}
+
+// RelayConfig declares a relay the daemon keeps running. Backend is
+// "userspace", the default, or "kernel" to forward UDP with nftables DNAT;
+// a kernel relay has no stream transports, ACL, session limits or upstream
+// key check.
+type RelayConfig struct {
+	Name             string   `yaml:"name"`
+	Backend          string   `yaml:"backend"`
+	Transport        string   `yaml:"transport"`
+	Port             int      `yaml:"port"`
+	Upstream         string   `yaml:"upstream"`
+	UpstreamKey      string   `yaml:"upstream_public_key"`
+	TLSCert          string   `yaml:"tls_cert"`
+	TLSKey           string   `yaml:"tls_key"`
+	Allow            []string `yaml:"allow"`
+	Deny             []string `yaml:"deny"`
+	MaxSessions      int      `yaml:"max_sessions"`
+	MaxSessionsPerIP int      `yaml:"max_sessions_per_ip"`
+	NewSessionRate   float64  `yaml:"new_session_rate"`
+}
+
+// WebhookConfig is an endpoint events are posted to. Events lists the
+// event types it wants, all of them when empty. With a Secret the requests
+// are signed.
+type WebhookConfig struct {
+	Name   string   `yaml:"name"`
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+// WebhooksConfig is where and how events are delivered. vpcd serve delivers
+// the events of all its agents. A delivery failing MaxAttempts times is
+// kept in the dead letters at DeadLetterPath, in memory only when it is
+// empty, until it is replayed.
+type WebhooksConfig struct {
+	Endpoints      []WebhookConfig `yaml:"endpoints"`
+	Timeout        Duration        `yaml:"timeout"`
+	MaxAttempts    int             `yaml:"max_attempts"`
+	BackoffMin     Duration        `yaml:"backoff_min"`
+	BackoffMax     Duration        `yaml:"backoff_max"`
+	DeadLetterPath string          `yaml:"dead_letter_path"`
+}
+
+// TracingConfig sends OpenTelemetry spans of the control plane and node
+// operations to Exporter: "stdout", "otlp" for a collector at Endpoint
+// over gRPC, or nothing when empty. SampleRatio is the share of traces
+// kept.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// LoggingConfig is where the daemon logs. Format is "json" or "console",
+// Output "stdout", "stderr", "file" with rotation as set in File, or
+// "journald". Level follows reloads and can be changed at runtime, the
+// rest needs a restart. Redact hides peer public keys and packet payloads,
+// private keys, tokens and client configs are never logged.
+type LoggingConfig struct {
+	Level  string        `yaml:"level"`
+	Format string        `yaml:"format"`
+	Output string        `yaml:"output"`
+	File   LogFileConfig `yaml:"file"`
+	Redact bool          `yaml:"redact"`
+}
+
+// LogFileConfig is the log file of the "file" output, rotated when it
+// reaches MaxSizeMB. Rotated files are removed after MaxAgeDays or beyond
+// MaxBackups, zero keeps them.
+type LogFileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+	Compress   bool   `yaml:"compress"`
+}
+
+// AuditConfig is where the audit logs of administrative changes are kept,
+// Path for the node run by vpcd agent and ControlPath for vpcd serve. A log
+// lives in memory only when its path is empty.
+type AuditConfig struct {
+	Path        string `yaml:"path"`
+	ControlPath string `yaml:"control_path"`
+}
+
+// TenancyConfig is where vpcd serve keeps its tenants, networks and peers,
+// in memory only when StatePath is empty. Expired peers are removed every
+// ExpiryInterval.
+type TenancyConfig struct {
+	StatePath      string   `yaml:"state_path"`
+	ExpiryInterval Duration `yaml:"expiry_interval"`
+}
+
+// MeshConfig puts the node run by vpcd agent in the mesh, off when Address
+// is empty. Address is the address of the node with the prefix of the whole
+// mesh, e.g. 10.99.0.5/16. The control plane hands every node the others,
+// which it reaches directly at their Endpoint; a node without Endpoint
+// waits to be dialed. A node with Relay forwards for the nodes that cannot
+// reach each other, it needs an Endpoint. Routes are the LAN prefixes behind
+// the node. The private key is kept at KeyPath, a new one is made on every
+// start when it is empty. Changes need a restart.
+type MeshConfig struct {
+	Address          string   `yaml:"address"`
+	Iface            string   `yaml:"iface"`
+	Port             int      `yaml:"port"`
+	Endpoint         string   `yaml:"endpoint"`
+	Routes           []string `yaml:"routes"`
+	Relay            bool     `yaml:"relay"`
+	KeyPath          string   `yaml:"key_path"`
+	SyncInterval     Duration `yaml:"sync_interval"`
+	HandshakeTimeout Duration `yaml:"handshake_timeout"`
+}
+
+type Config struct {
+	Control      ControlConfig       `yaml:"control"`
+	Agent        AgentConfig         `yaml:"agent"`
+	API          APIConfig           `yaml:"api"`
+	GRPC         GRPCConfig          `yaml:"grpc"`
+	Metrics      MetricsConfig       `yaml:"metrics"`
+	Wireguard    WireguardConfig     `yaml:"wireguard"`
+	AddressPools []string            `yaml:"address_pools"`
+	Ports        map[string][]string `yaml:"ports"`
+	ReservedPort []int               `yaml:"reserved_ports"`
+	Firewall     FirewallConfig      `yaml:"firewall"`
+	Endpoint     EndpointConfig      `yaml:"endpoint"`
+	Proxy        ProxyConfig         `yaml:"proxy"`
+	Relays       []RelayConfig       `yaml:"relays"`
+	Webhooks     WebhooksConfig      `yaml:"webhooks"`
+	Tracing      TracingConfig       `yaml:"tracing"`
+	Logging      LoggingConfig       `yaml:"logging"`
+	Audit        AuditConfig         `yaml:"audit"`
+	Tenancy      TenancyConfig       `yaml:"tenancy"`
+	Mesh         MeshConfig          `yaml:"mesh"`
+	// StatePath is the state file of vpcd agent. It holds the private keys
+	// of the interfaces and of generated client key pairs and is written
+	// with mode 0600.
+	StatePath string `yaml:"state_path"`
+}
+
+// Default is the configuration used when no file is given. It matches what
+// the daemon used to hardcode.
+func Default() *Config {
+	return &Config{
+		Control:      ControlConfig{Listen: ":9090"},
+		Agent:        AgentConfig{Listen: "127.0.0.1:9091"},
+		Wireguard:    WireguardConfig{MTU: 1420, ReconcileInterval: Duration(30 * time.Second), PeerCheckInterval: Duration(10 * time.Second)},
+		AddressPools: []string{"10.0.0.0/8"},
+		Ports: map[string][]string{
+			"wireguard": {"51820-52819"},
+			"relay":     {"40000-40999"},
+		},
+		Firewall: FirewallConfig{Backend: "iptables"},
+		Endpoint: EndpointConfig{Resolver: "ipify", URL: "https://api.ipify.org/?format=json"},
+		Proxy: ProxyConfig{
+			BufferSize:  4096,
+			ConnTimeout: Duration(time.Minute),
+			ResolveTTL:  Duration(30 * time.Second),
+		},
+		Webhooks: WebhooksConfig{
+			Timeout:     Duration(10 * time.Second),
+			MaxAttempts: 10,
+			BackoffMin:  Duration(time.Second),
+			BackoffMax:  Duration(10 * time.Minute),
+		},
+		Tenancy: TenancyConfig{ExpiryInterval: Duration(time.Minute)},
+		Mesh: MeshConfig{
+			Iface:            "vpcmesh",
+			Port:             51810,
+			SyncInterval:     Duration(15 * time.Second),
+			HandshakeTimeout: Duration(3 * time.Minute),
+		},
+		Tracing: TracingConfig{Endpoint: "localhost:4317", Insecure: true, SampleRatio: 1},
+		Logging: LoggingConfig{
+			Level:  "debug",
+			Format: "json",
+			Output: "stdout",
+			File:   LogFileConfig{MaxSizeMB: 100},
+			Redact: true,
+		},
+	}
+}
+
+// Load reads the file at path over the defaults, applies environment
+// overrides and validates the result. An empty path only uses defaults and
+// the environment.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// strict mode rejects keys already present in a map, so the
+		// default port ranges are only filled in for missing services
+		defaults := cfg.Ports
+		cfg.Ports = nil
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if cfg.Ports == nil {
+			cfg.Ports = map[string][]string{}
+		}
+		for service, ranges := range defaults {
+			if _, found := cfg.Ports[service]; !found {
+				cfg.Ports[service] = ranges
+			}
+		}
+	}
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		return nil, err
+	}
+	if cfg.Agent.Name == "" {
+		cfg.Agent.Name, _ = os.Hostname()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ParsePortRange reads "51820-51899" or a single port.
+func ParsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return 0, 0, err
+		}
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return min, max, nil
+}
+
+// ValidationError lists every problem found in a config.
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(v, "\n  ")
+}
+
+// validateSocket checks the options the kernel would only reject when a
+// socket is bound.
+func validateSocket(field string, o utils.SocketOptions, add func(string, string, ...interface{})) {
+	if o.RecvBuffer < 0 || o.SendBuffer < 0 {
+		add(field, "buffer sizes cannot be negative")
+	}
+	if o.Listeners < 0 {
+		add(field+".listeners", "cannot be negative")
+	}
+	if o.TOS < 0 || o.TOS > 255 {
+		add(field+".tos", "must be between 0 and 255, got %d", o.TOS)
+	}
+	switch o.PMTUDisc {
+	case "", "do", "dont", "want", "probe":
+	default:
+		add(field+".pmtu_discovery", "must be do, dont, want or probe, got %q", o.PMTUDisc)
+	}
+}
+
+// validCIDR accepts what the relay ACL does, a CIDR or a bare address.
+func validCIDR(s string) bool {
+	if !strings.Contains(s, "/") {
+		return net.ParseIP(s) != nil
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+func (c *Config) Validate() error {
+	var errs ValidationError
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Control.Listen); err != nil {
+		add("control.listen", "%v", err)
+	}
+	if c.API.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.API.Listen); err != nil {
+			add("api.listen", "%v", err)
+		}
+	}
+	if (c.API.TLSCert == "") != (c.API.TLSKey == "") {
+		add("api", "tls_cert and tls_key go together")
+	}
+	if c.GRPC.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.GRPC.Listen); err != nil {
+			add("grpc.listen", "%v", err)
+		}
+	}
+	if (c.GRPC.TLSCert == "") != (c.GRPC.TLSKey == "") {
+		add("grpc", "tls_cert and tls_key go together")
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			add("metrics.listen", "%v", err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.Agent.Listen); err != nil {
+		add("agent.listen", "%v", err)
+	}
+	if c.Agent.Server != "" {
+		if _, _, err := net.SplitHostPort(c.Agent.Server); err != nil {
+			add("agent.server", "%v", err)
+		}
+	}
+	if c.Wireguard.MTU < 1280 || c.Wireguard.MTU > 9000 {
+		add("wireguard.mtu", "must be between 1280 and 9000, got %d", c.Wireguard.MTU)
+	}
+	if c.Wireguard.ReconcileInterval < Duration(time.Second) {
+		add("wireguard.reconcile_interval", "must be at least 1s")
+	}
+	if c.Wireguard.PeerCheckInterval < Duration(time.Second) {
+		add("wireguard.peer_check_interval", "must be at least 1s")
+	}
+	if c.Wireguard.PeerQuota < 0 {
+		add("wireguard.peer_quota", "cannot be negative")
+	}
+	if c.Wireguard.Socket != (utils.SocketOptions{Mark: c.Wireguard.Socket.Mark}) {
+		add("wireguard.socket", "only mark applies to the wireguard listen port")
+	}
+	if len(c.Wireguard.NamePrefix) > 8 {
+		add("wireguard.name_prefix", "must be at most 8 characters so names fit IFNAMSIZ")
+	}
+	if len(c.AddressPools) == 0 {
+		add("address_pools", "at least one pool is required")
+	}
+	for i, pool := range c.AddressPools {
+		ip, ipnet, err := net.ParseCIDR(pool)
+		if err != nil || ip.To4() == nil {
+			add(fmt.Sprintf("address_pools[%d]", i), "%q is not an IPv4 CIDR", pool)
+		} else if ones, _ := ipnet.Mask.Size(); ones > 24 {
+			add(fmt.Sprintf("address_pools[%d]", i), "%q is smaller than a /24", pool)
+		}
+	}
+	for service, ranges := range c.Ports {
+		if service != "wireguard" && service != "relay" {
+			add("ports."+service, "unknown service")
+		}
+		for _, r := range ranges {
+			if _, _, err := ParsePortRange(r); err != nil {
+				add("ports."+service, "%v", err)
+			}
+		}
+	}
+	if c.Firewall.Backend != "iptables" && c.Firewall.Backend != "nftables" {
+		add("firewall.backend", "must be iptables or nftables, got %q", c.Firewall.Backend)
+	}
+	switch c.Endpoint.Resolver {
+	case "ipify":
+		if c.Endpoint.URL == "" {
+			add("endpoint.url", "required for the ipify resolver")
+		}
+	case "static":
+		if c.Endpoint.Address == "" {
+			add("endpoint.address", "required for the static resolver")
+		}
+	default:
+		add("endpoint.resolver", "must be ipify or static, got %q", c.Endpoint.Resolver)
+	}
+	if c.Proxy.BufferSize < 1500 {
+		add("proxy.buffer_size", "must be at least 1500, got %d", c.Proxy.BufferSize)
+	}
+	if c.Proxy.ConnTimeout < Duration(time.Second) {
+		add("proxy.conn_timeout", "must be at least 1s")
+	}
+	if c.Proxy.ResolveTTL < 0 {
+		add("proxy.resolve_ttl", "cannot be negative")
+	}
+	validateSocket("proxy.socket", c.Proxy.Socket, add)
+	names := map[string]bool{}
+	for i, r := range c.Relays {
+		field := fmt.Sprintf("relays[%d]", i)
+		if r.Name == "" {
+			add(field+".name", "required")
+		} else if names[r.Name] {
+			add(field+".name", "duplicate relay %q", r.Name)
+		}
+		names[r.Name] = true
+		switch r.Transport {
+		case "", "udp", "tcp", "ws":
+		case "tls":
+			if r.TLSCert == "" || r.TLSKey == "" {
+				add(field, "tls transport requires tls_cert and tls_key")
+			}
+		default:
+			add(field+".transport", "unknown transport %q", r.Transport)
+		}
+		if _, _, err := net.SplitHostPort(r.Upstream); err != nil {
+			add(field+".upstream", "%v", err)
+		}
+		if r.Port < 0 || r.Port > 65535 {
+			add(field+".port", "out of range")
+		}
+		for _, cidr := range r.Allow {
+			if !validCIDR(cidr) {
+				add(field+".allow", "%q is not an address or CIDR", cidr)
+			}
+		}
+		for _, cidr := range r.Deny {
+			if !validCIDR(cidr) {
+				add(field+".deny", "%q is not an address or CIDR", cidr)
+			}
+		}
+		switch r.Backend {
+		case "", "userspace":
+		case "kernel":
+			if r.Transport != "" && r.Transport != "udp" {
+				add(field+".transport", "the kernel backend only relays udp")
+			}
+			if len(r.Allow) > 0 || len(r.Deny) > 0 || r.MaxSessions != 0 || r.MaxSessionsPerIP != 0 || r.NewSessionRate != 0 {
+				add(field, "the kernel backend has no ACL or session limits")
+			}
+			if r.UpstreamKey != "" {
+				add(field+".upstream_public_key", "the kernel backend does not check handshakes")
+			}
+		default:
+			add(field+".backend", "must be userspace or kernel, got %q", r.Backend)
+		}
+	}
+	switch c.Tracing.Exporter {
+	case "", "stdout":
+	case "otlp":
+		if _, _, err := net.SplitHostPort(c.Tracing.Endpoint); err != nil {
+			add("tracing.endpoint", "%v", err)
+		}
+	default:
+		add("tracing.exporter", "must be stdout or otlp, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio", "must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	}
+	if c.Webhooks.Timeout <= 0 {
+		add("webhooks.timeout", "must be positive")
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		add("webhooks.max_attempts", "must be at least 1")
+	}
+	if c.Webhooks.BackoffMin <= 0 || c.Webhooks.BackoffMax < c.Webhooks.BackoffMin {
+		add("webhooks", "backoff_min must be positive and at most backoff_max")
+	}
+	types := map[string]bool{}
+	for _, t := range events.Types {
+		types[string(t)] = true
+	}
+	hooks := map[string]bool{}
+	for i, w := range c.Webhooks.Endpoints {
+		field := fmt.Sprintf("webhooks.endpoints[%d]", i)
+		if w.Name == "" {
+			add(field+".name", "required")
+		} else if hooks[w.Name] {
+			add(field+".name", "duplicate webhook %q", w.Name)
+		}
+		hooks[w.Name] = true
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add(field+".url", "must be an http or https URL")
+		}
+		for _, t := range w.Events {
+			if !types[t] {
+				add(field+".events", "unknown event type %q", t)
+			}
+		}
+	}
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		add("logging.level", "must be debug, info, warn or error, got %q", c.Logging.Level)
+	}
+	switch c.Logging.Format {
+	case "json", "console":
+	default:
+		add("logging.format", "must be json or console, got %q", c.Logging.Format)
+	}
+	switch c.Logging.Output {
+	case "stdout", "stderr", "journald":
+	case "file":
+		if c.Logging.File.Path == "" {
+			add("logging.file.path", "is required with the file output")
+		}
+	default:
+		add("logging.output", "must be stdout, stderr, file or journald, got %q", c.Logging.Output)
+	}
+	if c.Logging.File.MaxSizeMB < 1 {
+		add("logging.file.max_size_mb", "must be at least 1, got %d", c.Logging.File.MaxSizeMB)
+	}
+	if c.Logging.File.MaxBackups < 0 || c.Logging.File.MaxAgeDays < 0 {
+		add("logging.file", "max_backups and max_age_days cannot be negative")
+	}
+	if c.Tenancy.ExpiryInterval <= 0 {
+		add("tenancy.expiry_interval", "must be positive")
+	}
+	if c.Mesh.Address != "" {
+		if ip, _, err := net.ParseCIDR(c.Mesh.Address); err != nil || ip.To4() == nil {
+			add("mesh.address", "%q is not an IPv4 CIDR", c.Mesh.Address)
+		}
+		if c.Mesh.Iface == "" || len(c.Mesh.Iface) > 15 {
+			add("mesh.iface", "must be 1 to 15 characters")
+		}
+		if c.Mesh.Port < 1 || c.Mesh.Port > 65535 {
+			add("mesh.port", "out of range")
+		}
+		if c.Mesh.Endpoint != "" {
+			if _, _, err := net.SplitHostPort(c.Mesh.Endpoint); err != nil {
+				add("mesh.endpoint", "%v", err)
+			}
+		} else if c.Mesh.Relay {
+			add("mesh.endpoint", "required for a relay")
+		}
+		for i, r := range c.Mesh.Routes {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				add(fmt.Sprintf("mesh.routes[%d]", i), "%v", err)
+			}
+		}
+		if c.Agent.Server == "" {
+			add("mesh", "needs agent.server, the control plane hands out the nodes")
+		}
+		if c.Mesh.SyncInterval < Duration(time.Second) {
+			add("mesh.sync_interval", "must be at least 1s")
+		}
+		// an idle direct path renews its handshake every two minutes
+		if c.Mesh.HandshakeTimeout < Duration(150*time.Second) {
+			add("mesh.handshake_timeout", "must be at least 2m30s")
+		}
+	}
+	if c.Audit.Path != "" && c.Audit.Path == c.Audit.ControlPath {
+		add("audit.control_path", "must differ from audit.path, each log has its own chain")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
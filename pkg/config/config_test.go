@@ -0,0 +1,191 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		check   func(cfg *Config) interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:    "string",
+			environ: []string{"VPC_CONTROL_LISTEN=:9000"},
+			check:   func(cfg *Config) interface{} { return cfg.Control.Listen },
+			want:    ":9000",
+		},
+		{
+			name:    "value with an equal sign",
+			environ: []string{"VPC_CONTROL_TOKEN=a=b"},
+			check:   func(cfg *Config) interface{} { return cfg.Control.Token },
+			want:    "a=b",
+		},
+		{
+			name:    "int",
+			environ: []string{"VPC_WIREGUARD_MTU=1380"},
+			check:   func(cfg *Config) interface{} { return cfg.Wireguard.MTU },
+			want:    1380,
+		},
+		{
+			name:    "int64",
+			environ: []string{"VPC_WIREGUARD_PEER_QUOTA=1073741824"},
+			check:   func(cfg *Config) interface{} { return cfg.Wireguard.PeerQuota },
+			want:    int64(1 << 30),
+		},
+		{
+			name:    "bool",
+			environ: []string{"VPC_METRICS_PER_PEER=true"},
+			check:   func(cfg *Config) interface{} { return cfg.Metrics.PerPeer },
+			want:    true,
+		},
+		{
+			name:    "float",
+			environ: []string{"VPC_TRACING_SAMPLE_RATIO=0.25"},
+			check:   func(cfg *Config) interface{} { return cfg.Tracing.SampleRatio },
+			want:    0.25,
+		},
+		{
+			name:    "duration",
+			environ: []string{"VPC_PROXY_CONN_TIMEOUT=90s"},
+			check:   func(cfg *Config) interface{} { return cfg.Proxy.ConnTimeout },
+			want:    Duration(90 * time.Second),
+		},
+		{
+			name:    "list",
+			environ: []string{"VPC_ADDRESS_POOLS=10.1.0.0/16, 10.2.0.0/16,"},
+			check:   func(cfg *Config) interface{} { return cfg.AddressPools },
+			want:    []string{"10.1.0.0/16", "10.2.0.0/16"},
+		},
+		{
+			name:    "other prefixes are ignored",
+			environ: []string{"CONTROL_LISTEN=:1", "VPCX_CONTROL_LISTEN=:2", "VPC_CONTROL_LISTEN"},
+			check:   func(cfg *Config) interface{} { return cfg.Control.Listen },
+			want:    Default().Control.Listen,
+		},
+		{
+			name:    "bad int",
+			environ: []string{"VPC_WIREGUARD_MTU=large"},
+			wantErr: true,
+		},
+		{
+			name:    "bad duration",
+			environ: []string{"VPC_PROXY_CONN_TIMEOUT=90"},
+			wantErr: true,
+		},
+		{
+			name:    "map",
+			environ: []string{"VPC_PORTS=udp"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			err := applyEnv(cfg, tt.environ)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("applyEnv() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyEnv() error = %v", err)
+			}
+			if got := tt.check(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		min     int
+		max     int
+		wantErr bool
+	}{
+		{in: "51820", min: 51820, max: 51820},
+		{in: "51820-51899", min: 51820, max: 51899},
+		{in: " 1 - 65535 ", min: 1, max: 65535},
+		{in: "0", wantErr: true},
+		{in: "65536", wantErr: true},
+		{in: "100-99", wantErr: true},
+		{in: "1-70000", wantErr: true},
+		{in: "a-b", wantErr: true},
+		{in: "10-", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			min, max, err := ParsePortRange(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePortRange(%q) = %d, %d", tt.in, min, max)
+				}
+				return
+			}
+			if err != nil || min != tt.min || max != tt.max {
+				t.Errorf("ParsePortRange(%q) = %d, %d, %v, want %d, %d", tt.in, min, max, err, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		// field is the field the error names, empty when the config is valid
+		field string
+	}{
+		{name: "default", modify: func(c *Config) {}},
+		{name: "wireguard mark", modify: func(c *Config) { c.Wireguard.Socket.Mark = 7 }},
+		{name: "wireguard tos", modify: func(c *Config) { c.Wireguard.Socket.TOS = 0x10 }, field: "wireguard.socket"},
+		{name: "wireguard buffer", modify: func(c *Config) { c.Wireguard.Socket.RecvBuffer = 1 << 20 }, field: "wireguard.socket"},
+		{name: "proxy options", modify: func(c *Config) {
+			c.Proxy.Socket.TOS = 0x10
+			c.Proxy.Socket.RecvBuffer = 1 << 20
+			c.Proxy.Socket.BindToDevice = "eth0"
+		}},
+		{name: "proxy pmtu discovery", modify: func(c *Config) { c.Proxy.Socket.PMTUDisc = "probe" }},
+		{name: "unknown pmtu discovery", modify: func(c *Config) { c.Proxy.Socket.PMTUDisc = "always" }, field: "proxy.socket.pmtu_discovery"},
+		{name: "tos out of range", modify: func(c *Config) { c.Proxy.Socket.TOS = 256 }, field: "proxy.socket.tos"},
+		{name: "negative buffer", modify: func(c *Config) { c.Proxy.Socket.SendBuffer = -1 }, field: "proxy.socket"},
+		{name: "no conn timeout", modify: func(c *Config) { c.Proxy.ConnTimeout = 0 }, field: "proxy.conn_timeout"},
+		{name: "negative resolve ttl", modify: func(c *Config) { c.Proxy.ResolveTTL = -1 }, field: "proxy.resolve_ttl"},
+		{name: "relay acl", modify: func(c *Config) {
+			c.Relays = []RelayConfig{{Name: "edge", Upstream: "127.0.0.1:51820", Allow: []string{"10.0.0.0/8", "192.0.2.1"}, Deny: []string{"fd00::/8"}}}
+		}},
+		{name: "relay allow", modify: func(c *Config) {
+			c.Relays = []RelayConfig{{Name: "edge", Upstream: "127.0.0.1:51820", Allow: []string{"10.0.0.0/33"}}}
+		}, field: "relays[0].allow"},
+		{name: "relay deny", modify: func(c *Config) {
+			c.Relays = []RelayConfig{{Name: "edge", Upstream: "127.0.0.1:51820", Deny: []string{"example.com"}}}
+		}, field: "relays[0].deny"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(c)
+			err := c.Validate()
+			if tt.field == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v", err)
+				}
+				return
+			}
+			errs, ok := err.(ValidationError)
+			if !ok || len(errs) != 1 || !strings.HasPrefix(errs[0], tt.field+": ") {
+				t.Errorf("Validate() = %v, want an error on %s", err, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package control
+
+import (
+	"context"
+	"sync"
+	"time"
+	"vpc/pkg/events"
+	"vpc/pkg/mesh"
+
+	tp "github.com/henrylee2cn/teleport"
+	"go.uber.org/zap"
+)
+
+// redialInterval is the pause between two attempts to reach the control
+// plane.
+const redialInterval = 5 * time.Second
+
+const (
+	// eventBacklog is how many events wait for the control plane before
+	// new ones are dropped.
+	eventBacklog = 4096
+	eventBatch   = 64
+)
+
+// Agent serves the Node routes on its listen address for the local commands
+// and, when a control plane is set, keeps a registered session to it and
+// forwards it what is published on Events.
+type Agent struct {
+	Logger *zap.Logger
+	Name   string
+	Server string
+	Events *events.Bus
+	// Mesh is synced with the control plane when set.
+	Mesh  *mesh.Mesh
+	token string
+	peer  tp.Peer
+	done  chan struct{}
+
+	lock    sync.Mutex
+	session tp.Session
+	queue   chan events.Event
+}
+
+func NewAgent(logger *zap.Logger, name string, listen string, server string, token string) (*Agent, error) {
+	host, port, err := splitListen(listen)
+	if err != nil {
+		return nil, err
+	}
+	a := &Agent{
+		Logger: logger.With(zap.String("agent", name)),
+		Name:   name,
+		Server: server,
+		token:  token,
+		done:   make(chan struct{}),
+	}
+	a.peer = tp.NewPeer(tp.PeerConfig{
+		ListenIP:   host,
+		ListenPort: port,
+	}, newTokenAuth(token))
+	a.peer.RouteCall(new(Node))
+	return a, nil
+}
+
+// Start serves the local listener and connects to the control plane.
+func (a *Agent) Start() {
+	go func() {
+		if err := a.peer.ListenAndServe(); err != nil {
+			a.Logger.Error("agent listener stopped", zap.Error(err))
+		}
+	}()
+	if a.Server != "" {
+		go a.connectLoop()
+		if a.Mesh != nil {
+			go a.syncMesh()
+		}
+		if a.Events != nil {
+			a.queue = make(chan events.Event, eventBacklog)
+			a.Events.Subscribe("control plane", a.enqueue)
+			go a.forwardEvents()
+		}
+	}
+}
+
+func (a *Agent) setSession(sess tp.Session) {
+	a.lock.Lock()
+	a.session = sess
+	a.lock.Unlock()
+}
+
+func (a *Agent) currentSession() tp.Session {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.session
+}
+
+// Connected reports whether the agent is registered with the control plane.
+func (a *Agent) Connected() bool {
+	sess := a.currentSession()
+	return sess != nil && sess.Health()
+}
+
+// Sessions is the number of open sessions of the agent, the local commands
+// and the control plane.
+func (a *Agent) Sessions() int {
+	return a.peer.CountSession()
+}
+
+func (a *Agent) enqueue(ev events.Event) {
+	select {
+	case a.queue <- ev:
+	default:
+		a.Logger.Warn("control plane event dropped", zap.String("type", string(ev.Type)), zap.String("subject", ev.Subject))
+	}
+}
+
+// forwardEvents sends the queued events to the control plane in batches,
+// in the order they were queued. A batch that fails is sent again once the
+// session is back.
+func (a *Agent) forwardEvents() {
+	var batch []events.Event
+	for {
+		if len(batch) == 0 {
+			select {
+			case <-a.done:
+				return
+			case ev := <-a.queue:
+				batch = append(batch, ev)
+			}
+		}
+	fill:
+		for len(batch) < eventBatch {
+			select {
+			case ev := <-a.queue:
+				batch = append(batch, ev)
+			default:
+				break fill
+			}
+		}
+		sess := a.currentSession()
+		if sess != nil {
+			err := call(context.Background(), sess, a.token, "/control/publish", batch, new(bool))
+			if err == nil {
+				batch = nil
+				continue
+			}
+			a.Logger.Warn("failed to forward events", zap.Int("events", len(batch)), zap.Error(err))
+		}
+		select {
+		case <-a.done:
+			return
+		case <-time.After(redialInterval):
+		}
+	}
+}
+
+// syncMesh announces the mesh node of the agent to the control plane and
+// applies the nodes it answers with, every sync interval.
+func (a *Agent) syncMesh() {
+	for {
+		if sess := a.currentSession(); sess != nil {
+			var nodes []mesh.Node
+			if err := call(context.Background(), sess, a.token, "/control/mesh_sync", a.Mesh.Self(), &nodes); err != nil {
+				a.Logger.Warn("failed to sync the mesh", zap.Error(err))
+			} else if err := a.Mesh.Apply(nodes); err != nil {
+				a.Logger.Error("failed to apply the mesh", zap.Error(err))
+			}
+		}
+		select {
+		case <-a.done:
+			return
+		case <-time.After(a.Mesh.SyncInterval):
+		}
+	}
+}
+
+func (a *Agent) connectLoop() {
+	for {
+		if sess, stat := a.peer.Dial(a.Server); !stat.OK() {
+			a.Logger.Warn("cannot reach control plane", zap.String("server", a.Server), zap.String("status", stat.String()))
+		} else if err := call(context.Background(), sess, a.token, "/control/register", &RegisterArgs{Name: a.Name}, new(AgentInfo)); err != nil {
+			a.Logger.Error("failed to register", zap.Error(err))
+			sess.Close()
+		} else {
+			a.Logger.Info("registered with control plane", zap.String("server", a.Server))
+			a.setSession(sess)
+			for sess.Health() {
+				select {
+				case <-a.done:
+					sess.Close()
+					return
+				case <-time.After(redialInterval):
+				}
+			}
+			a.setSession(nil)
+			a.Logger.Warn("lost control plane session")
+		}
+		select {
+		case <-a.done:
+			return
+		case <-time.After(redialInterval):
+		}
+	}
+}
+
+func (a *Agent) Close() {
+	close(a.done)
+	a.peer.Close()
+}
@@ -0,0 +1,64 @@
+package control
+
+import (
+	"vpc/pkg/audit"
+	"vpc/pkg/broker"
+	"vpc/pkg/wireguard"
+
+	tp "github.com/henrylee2cn/teleport"
+	"go.uber.org/zap"
+)
+
+// record writes a change to log. The change already happened, so a record
+// that cannot be written is only logged.
+func record(log *audit.Log, actor string, action string, target string, before interface{}, after interface{}, err error) {
+	if aerr := log.Change(actor, action, target, before, after, err); aerr != nil {
+		broker.Logger.Error("failed to write audit record", zap.String("action", action), zap.String("target", target), zap.Error(aerr))
+	}
+}
+
+// actor is who the call is made for, "local" for the commands of vpcd.
+func (n *Node) actor() string {
+	if actor := string(n.PeekMeta(MetaActor)); actor != "" {
+		return actor
+	}
+	return "local"
+}
+
+func (n *Node) audit(action string, target string, before interface{}, after interface{}, err error) {
+	record(broker.Audit, n.actor(), action, target, before, after, err)
+}
+
+// peerInfo returns the peer of wg with publicKey, nil when there is none.
+func peerInfo(wg *wireguard.Wireguard, publicKey string) *PeerInfo {
+	dev, err := wg.Client.Device(wg.Iface)
+	if err != nil {
+		return nil
+	}
+	for _, peer := range dev.Peers {
+		if peer.PublicKey.String() == publicKey {
+			info := newPeerInfo(wg, peer)
+			return &info
+		}
+	}
+	return nil
+}
+
+// AuditList returns the records of the audit log of the node matching arg,
+// oldest first.
+func (n *Node) AuditList(arg *audit.Filter) ([]audit.Record, *tp.Status) {
+	records, err := broker.Audit.Query(*arg)
+	if err != nil {
+		return nil, statusOf(tp.CodeInternalServerError, err)
+	}
+	return records, nil
+}
+
+// AuditVerify checks the hash chain of the audit log of the node.
+func (n *Node) AuditVerify(arg *Empty) (audit.Verification, *tp.Status) {
+	v, err := broker.Audit.Verify()
+	if err != nil {
+		return v, statusOf(tp.CodeInternalServerError, err)
+	}
+	return v, nil
+}
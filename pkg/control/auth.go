@@ -0,0 +1,43 @@
+package control
+
+import (
+	"crypto/subtle"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// tokenAuth rejects calls that do not carry one of the tokens. Without
+// tokens every call is accepted.
+type tokenAuth struct {
+	tokens []string
+}
+
+func newTokenAuth(tokens ...string) *tokenAuth {
+	a := &tokenAuth{}
+	for _, token := range tokens {
+		if token != "" {
+			a.tokens = append(a.tokens, token)
+		}
+	}
+	return a
+}
+
+func validToken(got []byte, token string) bool {
+	return subtle.ConstantTimeCompare(got, []byte(token)) == 1
+}
+
+func (a *tokenAuth) Name() string {
+	return "token-auth"
+}
+
+func (a *tokenAuth) PostReadCallHeader(ctx tp.ReadCtx) *tp.Status {
+	if len(a.tokens) == 0 {
+		return nil
+	}
+	for _, token := range a.tokens {
+		if validToken(ctx.PeekMeta(MetaToken), token) {
+			return nil
+		}
+	}
+	return tp.NewStatus(tp.CodeUnauthorized, "invalid token", nil)
+}
@@ -0,0 +1,110 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"vpc/pkg/tracing"
+
+	tp "github.com/henrylee2cn/teleport"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Client calls the routes of an agent or of the control plane.
+type Client struct {
+	peer  tp.Peer
+	sess  tp.Session
+	token string
+}
+
+// Dial connects to addr, every call carries token.
+func Dial(addr string, token string) (*Client, error) {
+	peer := tp.NewPeer(tp.PeerConfig{})
+	sess, stat := peer.Dial(addr)
+	if !stat.OK() {
+		peer.Close()
+		return nil, errors.New(stat.Msg())
+	}
+	return &Client{peer: peer, sess: sess, token: token}, nil
+}
+
+// Call calls uri and decodes the reply into result.
+func (c *Client) Call(uri string, arg interface{}, result interface{}) error {
+	return call(context.Background(), c.sess, c.token, uri, arg, result)
+}
+
+// CallAgent calls a Node route of agent through the control plane.
+func (c *Client) CallAgent(agent string, uri string, arg interface{}, result interface{}) error {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	var reply json.RawMessage
+	if err := c.Call("/control/forward", &ForwardArgs{Agent: agent, URI: uri, Arg: b}, &reply); err != nil {
+		return err
+	}
+	return json.Unmarshal(reply, result)
+}
+
+func (c *Client) Close() {
+	c.peer.Close()
+}
+
+// StatusError is a call that failed on the remote side, Code is the
+// teleport status code.
+type StatusError struct {
+	Code int32
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
+type actorKey struct{}
+
+// WithActor returns ctx with actor as the one the calls made with it are
+// made for, see audit.Record for the formats.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorOf(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// call calls uri over sess. When ctx carries a span the call gets one too
+// and the callee continues the trace, the actor of ctx is passed along.
+func call(ctx context.Context, sess tp.Session, token string, uri string, arg interface{}, result interface{}) error {
+	ctx, span := tracing.Child(ctx, "teleport "+uri, attribute.String("peer", sess.RemoteAddr().String()))
+	defer span.End()
+	opts := []tp.MessageSetting{tp.WithAddMeta(MetaToken, token)}
+	if traceparent := tracing.Inject(ctx); traceparent != "" {
+		opts = append(opts, tp.WithAddMeta(MetaTraceparent, traceparent))
+	}
+	if actor := actorOf(ctx); actor != "" {
+		opts = append(opts, tp.WithAddMeta(MetaActor, actor))
+	}
+	stat := sess.Call(uri, arg, result, opts...).Status()
+	if !stat.OK() {
+		err := &StatusError{Code: stat.Code(), Msg: stat.Msg()}
+		tracing.Fail(span, err)
+		return err
+	}
+	return nil
+}
+
+func splitListen(addr string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(p), nil
+}
@@ -0,0 +1,398 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"vpc/pkg/audit"
+	"vpc/pkg/broker"
+	"vpc/pkg/config"
+	"vpc/pkg/logging"
+	"vpc/pkg/mesh"
+	"vpc/pkg/tracing"
+	"vpc/pkg/wireguard"
+
+	tp "github.com/henrylee2cn/teleport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Node is the route group served by agents, "/node/...". The control plane
+// calls it over the agent's session and the local commands over the agent
+// listen address.
+type Node struct {
+	tp.CallCtx
+}
+
+func statusOf(code int32, err error) *tp.Status {
+	return tp.NewStatus(code, err.Error(), nil)
+}
+
+// startSpan opens the span of a route, continuing the trace of the caller.
+func (n *Node) startSpan(name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := tracing.Extract(context.Background(), string(n.PeekMeta(MetaTraceparent)))
+	return tracing.Start(ctx, name, attrs...)
+}
+
+// failed records err on span and returns it as a status.
+func failed(span trace.Span, code int32, err error) *tp.Status {
+	tracing.Fail(span, err)
+	return statusOf(code, err)
+}
+
+func wireguardInfo(wg *wireguard.Wireguard) (WireguardInfo, error) {
+	dev, err := wg.Client.Device(wg.Iface)
+	if err != nil {
+		return WireguardInfo{}, err
+	}
+	return WireguardInfo{
+		Name:      wg.Iface,
+		Port:      wg.Port,
+		Address:   wg.Spec().Address,
+		PublicKey: dev.PublicKey.String(),
+		Endpoint:  wg.Endpoint(),
+		Peers:     len(dev.Peers),
+		RateLimit: wg.RateLimit,
+	}, nil
+}
+
+func relayInfo(r broker.RelayStatus) RelayInfo {
+	transport := r.Config.Transport
+	if transport == "" {
+		transport = "udp"
+	}
+	backend := r.Config.Backend
+	if backend == "" {
+		backend = "userspace"
+	}
+	return RelayInfo{
+		Name:      r.Config.Name,
+		Transport: transport,
+		Port:      r.Port,
+		Upstream:  r.Config.Upstream,
+		Backend:   backend,
+		Declared:  r.Declared,
+		Sessions:  r.Sessions,
+		Packets:   r.Stats.Packets,
+		Bytes:     r.Stats.Bytes,
+	}
+}
+
+// WgCreate creates a Wireguard interface from the wireguard section of the
+// config.
+func (n *Node) WgCreate(arg *WireguardArgs) (WireguardInfo, *tp.Status) {
+	_, span := n.startSpan("node.wg_create", attribute.String("subnet", arg.Subnet))
+	defer span.End()
+	wg, err := broker.CreateWireguard(broker.WireguardOptions{Subnet: arg.Subnet, RateLimit: arg.RateLimit})
+	if err != nil {
+		target := ""
+		if wg != nil {
+			target = "wireguard/" + wg.Iface
+		}
+		n.audit("wireguard.create", target, nil, nil, err)
+		return WireguardInfo{}, failed(span, tp.CodeInternalServerError, err)
+	}
+	span.SetAttributes(attribute.String("iface", wg.Iface))
+	info, err := wireguardInfo(wg)
+	n.audit("wireguard.create", "wireguard/"+wg.Iface, nil, info, err)
+	if err != nil {
+		return WireguardInfo{}, failed(span, tp.CodeInternalServerError, err)
+	}
+	return info, nil
+}
+
+func (n *Node) WgList(arg *Empty) ([]WireguardInfo, *tp.Status) {
+	infos := []WireguardInfo{}
+	for _, wg := range broker.Wireguards() {
+		info, err := wireguardInfo(wg)
+		if err != nil {
+			return nil, statusOf(tp.CodeInternalServerError, err)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// WgRateLimit changes the rate limit of an interface.
+func (n *Node) WgRateLimit(arg *RateLimitArgs) (WireguardInfo, *tp.Status) {
+	if arg.RateLimit < 0 {
+		return WireguardInfo{}, tp.NewStatus(tp.CodeBadMessage, "rate limit cannot be negative", nil)
+	}
+	wg, err := broker.GetWireguard(arg.Name)
+	if err != nil {
+		return WireguardInfo{}, statusOf(tp.CodeNotFound, err)
+	}
+	before, _ := wireguardInfo(wg)
+	err = wg.SetRateLimit(arg.RateLimit)
+	after, _ := wireguardInfo(wg)
+	n.audit("wireguard.rate_limit", "wireguard/"+arg.Name, before, after, err)
+	if err != nil {
+		return WireguardInfo{}, statusOf(tp.CodeInternalServerError, err)
+	}
+	return after, nil
+}
+
+func (n *Node) WgDestroy(arg *NameArgs) (bool, *tp.Status) {
+	_, span := n.startSpan("node.wg_destroy", attribute.String("iface", arg.Name))
+	defer span.End()
+	wg, err := broker.GetWireguard(arg.Name)
+	if err != nil {
+		return false, failed(span, tp.CodeNotFound, err)
+	}
+	before, _ := wireguardInfo(wg)
+	err = broker.DeleteWireguard(wg)
+	n.audit("wireguard.destroy", "wireguard/"+arg.Name, before, nil, err)
+	if err != nil {
+		return false, failed(span, tp.CodeInternalServerError, err)
+	}
+	return true, nil
+}
+
+// PeerAdd generates a key pair for a new peer and returns its config.
+func (n *Node) PeerAdd(arg *PeerArgs) (PeerConfig, *tp.Status) {
+	ctx, span := n.startSpan("node.peer_add", attribute.String("iface", arg.Iface))
+	defer span.End()
+	wg, err := broker.GetWireguard(arg.Iface)
+	if err != nil {
+		return PeerConfig{}, failed(span, tp.CodeNotFound, err)
+	}
+	routes, err := wireguard.ParseRoutes(arg.Routes)
+	if err != nil {
+		return PeerConfig{}, failed(span, tp.CodeBadMessage, err)
+	}
+	profile, err := wireguard.ParseProfile(arg.Profile, arg.CIDRs)
+	if err != nil {
+		return PeerConfig{}, failed(span, tp.CodeBadMessage, err)
+	}
+	publicKey, conf, err := wg.AddPeerContext(ctx, routes, profile)
+	if err != nil {
+		n.audit("peer.add", "peer/"+arg.Iface, nil, nil, err)
+		return PeerConfig{}, failed(span, routeErrorCode(err), err)
+	}
+	n.audit("peer.add", "peer/"+arg.Iface+"/"+publicKey, nil, peerInfo(wg, publicKey), nil)
+	span.SetAttributes(attribute.String("public_key", publicKey))
+	return PeerConfig{PublicKey: publicKey, Config: string(conf)}, nil
+}
+
+func (n *Node) PeerRemove(arg *PeerArgs) (bool, *tp.Status) {
+	ctx, span := n.startSpan("node.peer_remove", attribute.String("iface", arg.Iface), attribute.String("public_key", arg.PublicKey))
+	defer span.End()
+	wg, err := broker.GetWireguard(arg.Iface)
+	if err != nil {
+		return false, failed(span, tp.CodeNotFound, err)
+	}
+	before := peerInfo(wg, arg.PublicKey)
+	err = wg.DisconnectClientContext(ctx, arg.PublicKey)
+	n.audit("peer.remove", "peer/"+arg.Iface+"/"+arg.PublicKey, before, nil, err)
+	if err != nil {
+		return false, failed(span, tp.CodeInternalServerError, err)
+	}
+	return true, nil
+}
+
+// PeerRoutes replaces the routes of a site gateway, none turns it into a
+// plain peer.
+func (n *Node) PeerRoutes(arg *PeerArgs) (PeerInfo, *tp.Status) {
+	ctx, span := n.startSpan("node.peer_routes", attribute.String("iface", arg.Iface), attribute.String("public_key", arg.PublicKey))
+	defer span.End()
+	wg, err := broker.GetWireguard(arg.Iface)
+	if err != nil {
+		return PeerInfo{}, failed(span, tp.CodeNotFound, err)
+	}
+	routes, err := wireguard.ParseRoutes(arg.Routes)
+	if err != nil {
+		return PeerInfo{}, failed(span, tp.CodeBadMessage, err)
+	}
+	before := peerInfo(wg, arg.PublicKey)
+	if before == nil {
+		return PeerInfo{}, failed(span, tp.CodeNotFound, fmt.Errorf("no peer %s", arg.PublicKey))
+	}
+	err = wg.SetRoutesContext(ctx, arg.PublicKey, routes)
+	after := peerInfo(wg, arg.PublicKey)
+	n.audit("peer.routes", "peer/"+arg.Iface+"/"+arg.PublicKey, before, after, err)
+	if err != nil {
+		return PeerInfo{}, failed(span, routeErrorCode(err), err)
+	}
+	if after == nil {
+		return PeerInfo{}, failed(span, tp.CodeInternalServerError, fmt.Errorf("peer %s is gone", arg.PublicKey))
+	}
+	return *after, nil
+}
+
+// PeerProfile changes the split tunnel profile of a peer and returns its
+// new config, an empty profile is the default one.
+func (n *Node) PeerProfile(arg *PeerArgs) (PeerConfig, *tp.Status) {
+	ctx, span := n.startSpan("node.peer_profile", attribute.String("iface", arg.Iface), attribute.String("public_key", arg.PublicKey), attribute.String("profile", arg.Profile))
+	defer span.End()
+	wg, err := broker.GetWireguard(arg.Iface)
+	if err != nil {
+		return PeerConfig{}, failed(span, tp.CodeNotFound, err)
+	}
+	profile, err := wireguard.ParseProfile(arg.Profile, arg.CIDRs)
+	if err != nil {
+		return PeerConfig{}, failed(span, tp.CodeBadMessage, err)
+	}
+	before := peerInfo(wg, arg.PublicKey)
+	if before == nil {
+		return PeerConfig{}, failed(span, tp.CodeNotFound, fmt.Errorf("no peer %s", arg.PublicKey))
+	}
+	conf, err := wg.SetProfileContext(ctx, arg.PublicKey, profile)
+	n.audit("peer.profile", "peer/"+arg.Iface+"/"+arg.PublicKey, before, peerInfo(wg, arg.PublicKey), err)
+	if err != nil {
+		return PeerConfig{}, failed(span, tp.CodeInternalServerError, err)
+	}
+	return PeerConfig{PublicKey: arg.PublicKey, Config: string(conf)}, nil
+}
+
+// routeErrorCode tells refused routes apart from failures of the device.
+func routeErrorCode(err error) int32 {
+	if errors.Is(err, wireguard.ErrRouteConflict) {
+		return tp.CodeBadMessage
+	}
+	return tp.CodeInternalServerError
+}
+
+func (n *Node) PeerList(arg *PeerArgs) ([]PeerInfo, *tp.Status) {
+	wg, err := broker.GetWireguard(arg.Iface)
+	if err != nil {
+		return nil, statusOf(tp.CodeNotFound, err)
+	}
+	dev, err := wg.Client.Device(wg.Iface)
+	if err != nil {
+		return nil, statusOf(tp.CodeInternalServerError, err)
+	}
+	peers := []PeerInfo{}
+	for _, peer := range dev.Peers {
+		peers = append(peers, newPeerInfo(wg, peer))
+	}
+	return peers, nil
+}
+
+func newPeerInfo(wg *wireguard.Wireguard, peer wgtypes.Peer) PeerInfo {
+	var allowedIPs []string
+	for _, ipnet := range peer.AllowedIPs {
+		allowedIPs = append(allowedIPs, ipnet.String())
+	}
+	return PeerInfo{
+		PublicKey:     peer.PublicKey.String(),
+		AllowedIPs:    allowedIPs,
+		Profile:       wg.Profile(peer.PublicKey).Mode,
+		Endpoint:      wg.Endpoints.Resolve(peer.Endpoint),
+		LastHandshake: peer.LastHandshakeTime,
+		ReceiveBytes:  peer.ReceiveBytes,
+		TransmitBytes: peer.TransmitBytes,
+	}
+}
+
+func (n *Node) Usage(arg *PeerArgs) ([]UsageInfo, *tp.Status) {
+	wg, err := broker.GetWireguard(arg.Iface)
+	if err != nil {
+		return nil, statusOf(tp.CodeNotFound, err)
+	}
+	usage, err := wg.Usage()
+	if err != nil {
+		return nil, statusOf(tp.CodeInternalServerError, err)
+	}
+	infos := []UsageInfo{}
+	for key, u := range usage {
+		infos = append(infos, UsageInfo{PublicKey: key, Upload: u.Upload, Download: u.Download, LastHandshake: u.LastHandshake})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].PublicKey < infos[j].PublicKey })
+	return infos, nil
+}
+
+func (n *Node) PeerConfig(arg *PeerArgs) (PeerConfig, *tp.Status) {
+	wg, err := broker.GetWireguard(arg.Iface)
+	if err != nil {
+		return PeerConfig{}, statusOf(tp.CodeNotFound, err)
+	}
+	conf, err := wg.ClientConfig(arg.PublicKey)
+	if err != nil {
+		return PeerConfig{}, statusOf(tp.CodeNotFound, err)
+	}
+	return PeerConfig{PublicKey: arg.PublicKey, Config: string(conf)}, nil
+}
+
+func (n *Node) RelayCreate(arg *RelayArgs) (RelayInfo, *tp.Status) {
+	var wg *wireguard.Wireguard
+	if arg.Iface != "" {
+		var err error
+		if wg, err = broker.GetWireguard(arg.Iface); err != nil {
+			return RelayInfo{}, statusOf(tp.CodeNotFound, err)
+		}
+	} else if arg.Upstream == "" {
+		return RelayInfo{}, tp.NewStatus(tp.CodeBadMessage, "either iface or upstream is required", nil)
+	}
+	r, err := broker.OpenRelay(config.RelayConfig{
+		Name:      arg.Name,
+		Transport: arg.Transport,
+		Port:      arg.Port,
+		Upstream:  arg.Upstream,
+		Backend:   arg.Backend,
+	}, wg)
+	if err != nil {
+		n.audit("relay.create", "relay/"+arg.Name, nil, arg, err)
+		return RelayInfo{}, statusOf(tp.CodeInternalServerError, err)
+	}
+	info := relayInfo(r)
+	n.audit("relay.create", "relay/"+info.Name, nil, info, nil)
+	return info, nil
+}
+
+func (n *Node) RelayList(arg *Empty) ([]RelayInfo, *tp.Status) {
+	relays := []RelayInfo{}
+	for _, r := range broker.Relays() {
+		relays = append(relays, relayInfo(r))
+	}
+	return relays, nil
+}
+
+func (n *Node) RelayClose(arg *NameArgs) (bool, *tp.Status) {
+	var before interface{}
+	for _, r := range broker.Relays() {
+		if r.Config.Name == arg.Name {
+			before = relayInfo(r)
+		}
+	}
+	err := broker.CloseRelay(arg.Name)
+	n.audit("relay.close", "relay/"+arg.Name, before, nil, err)
+	if err != nil {
+		return false, statusOf(tp.CodeBadMessage, err)
+	}
+	return true, nil
+}
+
+// MeshPaths lists how the agent reaches the other nodes of the mesh.
+func (n *Node) MeshPaths(arg *Empty) ([]mesh.Path, *tp.Status) {
+	if broker.Mesh == nil {
+		return nil, tp.NewStatus(tp.CodeNotFound, "the node is not in the mesh", nil)
+	}
+	paths, err := broker.Mesh.Paths()
+	if err != nil {
+		return nil, statusOf(tp.CodeInternalServerError, err)
+	}
+	return paths, nil
+}
+
+// LogLevel returns the log level of the agent after setting it to the one
+// of arg, if any. The change lasts until the config is reloaded.
+func (n *Node) LogLevel(arg *LogLevel) (LogLevel, *tp.Status) {
+	return logLevel(arg, broker.Audit, n.actor())
+}
+
+// logLevel changes the level of broker.Level and records it in log.
+func logLevel(arg *LogLevel, log *audit.Log, actor string) (LogLevel, *tp.Status) {
+	if arg.Level != "" {
+		before := LogLevel{Level: broker.Level.String()}
+		err := logging.SetLevel(broker.Level, arg.Level)
+		record(log, actor, "logging.level", "logging", before, LogLevel{Level: broker.Level.String()}, err)
+		if err != nil {
+			return LogLevel{}, statusOf(tp.CodeBadMessage, err)
+		}
+		broker.Logger.Info("log level changed", zap.String("level", arg.Level))
+	}
+	return LogLevel{Level: broker.Level.String()}, nil
+}
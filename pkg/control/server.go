@@ -0,0 +1,384 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vpc/pkg/audit"
+	"vpc/pkg/events"
+	"vpc/pkg/mesh"
+	"vpc/pkg/tracing"
+	"vpc/pkg/webhook"
+
+	tp "github.com/henrylee2cn/teleport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+type agent struct {
+	info    AgentInfo
+	session string
+}
+
+// Server is the control plane. Agents dial it and register under their
+// name, the server then calls their Node routes over that session.
+type Server struct {
+	Logger *zap.Logger
+	// Events gets the events the agents forward, with their node set to
+	// the name they registered under.
+	Events *events.Bus
+	// Webhooks serves the dead letter routes, they fail when it is nil.
+	Webhooks *webhook.Dispatcher
+	// Audit records the changes made on the control plane itself, the
+	// agents keep their own.
+	Audit         *audit.Log
+	token         string
+	operatorToken string
+	peer          tp.Peer
+
+	lock   sync.RWMutex
+	agents map[string]*agent
+	// mesh holds the mesh node of the agents in the mesh, by agent name
+	mesh map[string]mesh.Node
+}
+
+// server is the Server the Control routes work on, teleport creates the
+// route structs itself so they cannot carry it.
+var server *Server
+
+// NewServer builds the control plane. Agents authenticate with token,
+// operators with operatorToken. With token set and no operatorToken no
+// operator call is accepted, the agent token does not stand in for it.
+func NewServer(logger *zap.Logger, listen string, token string, operatorToken string) (*Server, error) {
+	host, port, err := splitListen(listen)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Logger:        logger,
+		Events:        events.NewBus(logger),
+		token:         token,
+		operatorToken: operatorToken,
+		agents:        map[string]*agent{},
+		mesh:          map[string]mesh.Node{},
+	}
+	s.peer = tp.NewPeer(tp.PeerConfig{
+		ListenIP:   host,
+		ListenPort: port,
+	}, newTokenAuth(token, operatorToken))
+	s.peer.RouteCall(new(Control))
+	server = s
+	return s, nil
+}
+
+// ListenAndServe serves until Close.
+func (s *Server) ListenAndServe() error {
+	return s.peer.ListenAndServe()
+}
+
+func (s *Server) Close() {
+	s.peer.Close()
+}
+
+// Agents lists the agents with a live session, dropping the others.
+func (s *Server) Agents() []AgentInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	infos := []AgentInfo{}
+	for name, a := range s.agents {
+		if sess, found := s.peer.GetSession(a.session); !found || !sess.Health() {
+			delete(s.agents, name)
+			continue
+		}
+		infos = append(infos, a.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Sessions is the number of open sessions, agents and operators.
+func (s *Server) Sessions() int {
+	return s.peer.CountSession()
+}
+
+// CallAgent calls a Node route of the agent called name.
+func (s *Server) CallAgent(name string, uri string, arg interface{}, result interface{}) error {
+	return s.CallAgentContext(context.Background(), name, uri, arg, result)
+}
+
+// CallAgentContext is CallAgent continuing the trace of ctx on the agent,
+// which records the actor of ctx for its changes.
+func (s *Server) CallAgentContext(ctx context.Context, name string, uri string, arg interface{}, result interface{}) error {
+	s.lock.RLock()
+	a, found := s.agents[name]
+	s.lock.RUnlock()
+	if !found {
+		return fmt.Errorf("no agent %s", name)
+	}
+	sess, found := s.peer.GetSession(a.session)
+	if !found {
+		return fmt.Errorf("agent %s is not connected", name)
+	}
+	return call(ctx, sess, s.token, uri, arg, result)
+}
+
+// agentOf returns the name of the agent registered over session.
+func (s *Server) agentOf(session string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for name, a := range s.agents {
+		if a.session == session {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// register records the agent called name on session. A name held by
+// another healthy session is refused, an agent that reconnects takes it over
+// once its old session is gone.
+func (s *Server) register(name string, session string, address string) (AgentInfo, error) {
+	info := AgentInfo{Name: name, Address: address, Registered: time.Now()}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if a, found := s.agents[name]; found && a.session != session {
+		if sess, found := s.peer.GetSession(a.session); found && sess.Health() {
+			s.Logger.Warn("agent name in use", zap.String("agent", name), zap.String("address", address))
+			return AgentInfo{}, fmt.Errorf("agent %s is already registered from %s", name, a.info.Address)
+		}
+	}
+	s.agents[name] = &agent{info: info, session: session}
+	s.Logger.Info("agent registered", zap.String("agent", name), zap.String("address", address))
+	return info, nil
+}
+
+// MeshNodes lists the nodes of the mesh whose agent has a live session,
+// dropping the others.
+func (s *Server) MeshNodes() []mesh.Node {
+	live := map[string]bool{}
+	for _, a := range s.Agents() {
+		live[a.Name] = true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.meshNodesLocked(live)
+}
+
+func (s *Server) meshNodesLocked(live map[string]bool) []mesh.Node {
+	nodes := []mesh.Node{}
+	for name, n := range s.mesh {
+		if !live[name] {
+			delete(s.mesh, name)
+			s.Logger.Info("mesh node left", zap.String("agent", name))
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+// meshSync records node as the mesh node of its agent, unless it conflicts
+// with another node, and returns every node of the mesh.
+func (s *Server) meshSync(node mesh.Node) ([]mesh.Node, error) {
+	live := map[string]bool{}
+	for _, a := range s.Agents() {
+		live[a.Name] = true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	nodes := s.meshNodesLocked(live)
+	for _, other := range nodes {
+		if other.Name == node.Name {
+			continue
+		}
+		if err := node.Conflicts(other); err != nil {
+			return nil, err
+		}
+	}
+	if _, found := s.mesh[node.Name]; !found {
+		s.Logger.Info("mesh node joined", zap.String("agent", node.Name), zap.String("address", node.Address), zap.String("endpoint", node.Endpoint))
+	}
+	s.mesh[node.Name] = node
+	return s.meshNodesLocked(live), nil
+}
+
+// Control is the route group of the control plane, "/control/...".
+type Control struct {
+	tp.CallCtx
+}
+
+// operator fails unless the call carries the operator token. Only a server
+// without any token lets every call through.
+func (c *Control) operator() *tp.Status {
+	if server.operatorToken == "" && server.token == "" {
+		return nil
+	}
+	if server.operatorToken == "" {
+		return tp.NewStatus(tp.CodeUnauthorized, "no operator token configured", nil)
+	}
+	if !validToken(c.PeekMeta(MetaToken), server.operatorToken) {
+		return tp.NewStatus(tp.CodeUnauthorized, "operator token required", nil)
+	}
+	return nil
+}
+
+// actor is the operator making the call.
+func (c *Control) actor() string {
+	return "vpcctl:" + c.Session().RemoteAddr().String()
+}
+
+// Register is called by an agent right after it connects.
+func (c *Control) Register(arg *RegisterArgs) (AgentInfo, *tp.Status) {
+	if server.token != "" && !validToken(c.PeekMeta(MetaToken), server.token) {
+		return AgentInfo{}, tp.NewStatus(tp.CodeUnauthorized, "agent token required", nil)
+	}
+	if arg.Name == "" {
+		return AgentInfo{}, tp.NewStatus(tp.CodeBadMessage, "name is required", nil)
+	}
+	info, err := server.register(arg.Name, c.Session().ID(), c.Session().RemoteAddr().String())
+	if err != nil {
+		return AgentInfo{}, tp.NewStatus(tp.CodeUnauthorized, err.Error(), nil)
+	}
+	return info, nil
+}
+
+// Publish is called by agents with the events of their node, in order.
+func (c *Control) Publish(arg *[]events.Event) (bool, *tp.Status) {
+	if server.token != "" && !validToken(c.PeekMeta(MetaToken), server.token) {
+		return false, tp.NewStatus(tp.CodeUnauthorized, "agent token required", nil)
+	}
+	name, found := server.agentOf(c.Session().ID())
+	if !found {
+		return false, tp.NewStatus(tp.CodeNotFound, "agent is not registered", nil)
+	}
+	for _, ev := range *arg {
+		ev.Node = name
+		server.Events.Publish(ev)
+	}
+	return true, nil
+}
+
+// MeshSync is called by the agents in the mesh with their own node, on
+// every sync. They get every node of the mesh back, themselves included.
+func (c *Control) MeshSync(arg *mesh.Node) ([]mesh.Node, *tp.Status) {
+	if server.token != "" && !validToken(c.PeekMeta(MetaToken), server.token) {
+		return nil, tp.NewStatus(tp.CodeUnauthorized, "agent token required", nil)
+	}
+	name, found := server.agentOf(c.Session().ID())
+	if !found {
+		return nil, tp.NewStatus(tp.CodeNotFound, "agent is not registered", nil)
+	}
+	arg.Name = name
+	if err := arg.Check(); err != nil {
+		return nil, statusOf(tp.CodeBadMessage, err)
+	}
+	nodes, err := server.meshSync(*arg)
+	if err != nil {
+		return nil, statusOf(tp.CodeBadMessage, err)
+	}
+	return nodes, nil
+}
+
+// MeshNodes lists the nodes of the mesh.
+func (c *Control) MeshNodes(arg *Empty) ([]mesh.Node, *tp.Status) {
+	if stat := c.operator(); stat != nil {
+		return nil, stat
+	}
+	return server.MeshNodes(), nil
+}
+
+// WebhookDeadLetters lists the webhook deliveries that failed every
+// attempt.
+func (c *Control) WebhookDeadLetters(arg *Empty) ([]webhook.DeadLetter, *tp.Status) {
+	if stat := c.operator(); stat != nil {
+		return nil, stat
+	}
+	if server.Webhooks == nil {
+		return nil, tp.NewStatus(tp.CodeNotFound, "webhooks are not configured", nil)
+	}
+	return server.Webhooks.DeadLetters(), nil
+}
+
+// WebhookReplay delivers dead letters again and returns how many.
+func (c *Control) WebhookReplay(arg *ReplayArgs) (int, *tp.Status) {
+	if stat := c.operator(); stat != nil {
+		return 0, stat
+	}
+	if server.Webhooks == nil {
+		return 0, tp.NewStatus(tp.CodeNotFound, "webhooks are not configured", nil)
+	}
+	n, err := server.Webhooks.Replay(arg.IDs...)
+	record(server.Audit, c.actor(), "webhook.replay", "webhooks", arg, n, err)
+	if err != nil {
+		return n, statusOf(tp.CodeInternalServerError, err)
+	}
+	return n, nil
+}
+
+// LogLevel is the Node route of the same name for the control plane.
+func (c *Control) LogLevel(arg *LogLevel) (LogLevel, *tp.Status) {
+	if stat := c.operator(); stat != nil {
+		return LogLevel{}, stat
+	}
+	return logLevel(arg, server.Audit, c.actor())
+}
+
+// AuditList is the Node route of the same name for the control plane.
+func (c *Control) AuditList(arg *audit.Filter) ([]audit.Record, *tp.Status) {
+	if stat := c.operator(); stat != nil {
+		return nil, stat
+	}
+	records, err := server.Audit.Query(*arg)
+	if err != nil {
+		return nil, statusOf(tp.CodeInternalServerError, err)
+	}
+	return records, nil
+}
+
+// AuditVerify is the Node route of the same name for the control plane.
+func (c *Control) AuditVerify(arg *Empty) (audit.Verification, *tp.Status) {
+	if stat := c.operator(); stat != nil {
+		return audit.Verification{}, stat
+	}
+	v, err := server.Audit.Verify()
+	if err != nil {
+		return v, statusOf(tp.CodeInternalServerError, err)
+	}
+	return v, nil
+}
+
+// Agents lists the connected agents.
+func (c *Control) Agents(arg *Empty) ([]AgentInfo, *tp.Status) {
+	if stat := c.operator(); stat != nil {
+		return nil, stat
+	}
+	return server.Agents(), nil
+}
+
+// Forward calls a Node route of an agent on behalf of an operator.
+func (c *Control) Forward(arg *ForwardArgs) (json.RawMessage, *tp.Status) {
+	if stat := c.operator(); stat != nil {
+		return nil, stat
+	}
+	if !strings.HasPrefix(arg.URI, "/node/") {
+		return nil, tp.NewStatus(tp.CodeBadMessage, "only node routes can be forwarded", nil)
+	}
+	ctx := tracing.Extract(context.Background(), string(c.PeekMeta(MetaTraceparent)))
+	ctx = WithActor(ctx, c.actor())
+	ctx, span := tracing.Start(ctx, "control.forward", attribute.String("agent", arg.Agent), attribute.String("uri", arg.URI))
+	defer span.End()
+	var result json.RawMessage
+	if err := server.CallAgentContext(ctx, arg.Agent, arg.URI, arg.Arg, &result); err != nil {
+		tracing.Fail(span, err)
+		if serr, ok := err.(*StatusError); ok {
+			return nil, tp.NewStatus(serr.Code, serr.Msg, nil)
+		}
+		return nil, statusOf(tp.CodeNotFound, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,62 @@
+package control
+
+import (
+	"testing"
+
+	tp "github.com/henrylee2cn/teleport"
+	"go.uber.org/zap"
+)
+
+// fakePeer knows the sessions in health, by id.
+type fakePeer struct {
+	tp.Peer
+	health map[string]bool
+}
+
+func (p fakePeer) GetSession(id string) (tp.Session, bool) {
+	healthy, found := p.health[id]
+	return fakeSession{healthy: healthy}, found
+}
+
+type fakeSession struct {
+	tp.Session
+	healthy bool
+}
+
+func (s fakeSession) Health() bool {
+	return s.healthy
+}
+
+func TestRegister(t *testing.T) {
+	peer := fakePeer{health: map[string]bool{"first": true, "second": true}}
+	s := &Server{Logger: zap.NewNop(), peer: peer, agents: map[string]*agent{}}
+	steps := []struct {
+		name        string
+		session     string
+		kill        string
+		gone        string
+		wantErr     bool
+		wantSession string
+	}{
+		{name: "new name", session: "first", wantSession: "first"},
+		{name: "same session again", session: "first", wantSession: "first"},
+		{name: "other live session", session: "second", wantErr: true, wantSession: "first"},
+		{name: "old session unhealthy", session: "second", kill: "first", wantSession: "second"},
+		{name: "old session gone", session: "third", gone: "second", wantSession: "third"},
+	}
+	for _, step := range steps {
+		if step.kill != "" {
+			peer.health[step.kill] = false
+		}
+		if step.gone != "" {
+			delete(peer.health, step.gone)
+		}
+		_, err := s.register("node-1", step.session, "192.0.2.1:1000")
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: register() error = %v", step.name, err)
+		}
+		if got := s.agents["node-1"].session; got != step.wantSession {
+			t.Fatalf("%s: node-1 is on session %s, want %s", step.name, got, step.wantSession)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package control
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// MetaToken is the call metadata carrying the control token.
+const MetaToken = "token"
+
+// MetaTraceparent is the call metadata carrying the W3C traceparent of the
+// caller's span.
+const MetaTraceparent = "traceparent"
+
+// MetaActor is the call metadata naming who the call is made for, the
+// agent records it in its audit log.
+const MetaActor = "actor"
+
+type Empty struct{}
+
+type NameArgs struct {
+	Name string `json:"name"`
+}
+
+// WireguardInfo describes a Wireguard interface of a node.
+type WireguardInfo struct {
+	Name      string `json:"name"`
+	Port      int    `json:"port"`
+	Address   string `json:"address"`
+	PublicKey string `json:"public_key"`
+	Endpoint  string `json:"endpoint"`
+	Peers     int    `json:"peers"`
+	RateLimit int64  `json:"rate_limit,omitempty"`
+}
+
+// WireguardArgs creates a Wireguard interface in Subnet, a /24, or in a
+// random subnet of the address pools when empty. RateLimit is in bits per
+// second, zero means none.
+type WireguardArgs struct {
+	Subnet    string `json:"subnet,omitempty"`
+	RateLimit int64  `json:"rate_limit,omitempty"`
+}
+
+// RateLimitArgs changes the rate limit of the interface called Name.
+type RateLimitArgs struct {
+	Name      string `json:"name"`
+	RateLimit int64  `json:"rate_limit"`
+}
+
+// PeerArgs names a peer of an interface. Routes are the LAN prefixes of a
+// site gateway, for peer_add and peer_routes. Profile is the split tunnel
+// profile, full, vpc, custom or exclude with CIDRs, for peer_add and
+// peer_profile.
+type PeerArgs struct {
+	Iface     string   `json:"iface"`
+	PublicKey string   `json:"public_key,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+	Profile   string   `json:"profile,omitempty"`
+	CIDRs     []string `json:"cidrs,omitempty"`
+}
+
+// PeerInfo describes a peer of a Wireguard interface, Endpoint is the real
+// client address even when it connects through a relay.
+type PeerInfo struct {
+	PublicKey     string    `json:"public_key"`
+	AllowedIPs    []string  `json:"allowed_ips"`
+	Profile       string    `json:"profile"`
+	Endpoint      string    `json:"endpoint"`
+	LastHandshake time.Time `json:"last_handshake"`
+	ReceiveBytes  int64     `json:"receive_bytes"`
+	TransmitBytes int64     `json:"transmit_bytes"`
+}
+
+// UsageInfo is the traffic of a peer, Upload is what the server received
+// from it.
+type UsageInfo struct {
+	PublicKey     string    `json:"public_key"`
+	Upload        int64     `json:"upload"`
+	Download      int64     `json:"download"`
+	LastHandshake time.Time `json:"last_handshake"`
+}
+
+// PeerConfig is the wg-quick config of a peer.
+type PeerConfig struct {
+	PublicKey string `json:"public_key"`
+	Config    string `json:"config"`
+}
+
+// RelayArgs opens a relay. With Iface set, the relay is put in front of that
+// interface and Upstream may be empty.
+type RelayArgs struct {
+	Name      string `json:"name"`
+	Iface     string `json:"iface,omitempty"`
+	Transport string `json:"transport"`
+	Port      int    `json:"port"`
+	Upstream  string `json:"upstream,omitempty"`
+	Backend   string `json:"backend,omitempty"`
+}
+
+// RelayInfo describes a running relay.
+type RelayInfo struct {
+	Name      string `json:"name"`
+	Transport string `json:"transport"`
+	Port      int    `json:"port"`
+	Upstream  string `json:"upstream"`
+	Backend   string `json:"backend"`
+	Declared  bool   `json:"declared"`
+	Sessions  int    `json:"sessions"`
+	Packets   uint64 `json:"packets"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+type RegisterArgs struct {
+	Name string `json:"name"`
+}
+
+// AgentInfo describes an agent registered with the control plane.
+type AgentInfo struct {
+	Name       string    `json:"name"`
+	Address    string    `json:"address"`
+	Registered time.Time `json:"registered"`
+}
+
+// ReplayArgs replays the dead letters with IDs, all of them when empty.
+type ReplayArgs struct {
+	IDs []string `json:"ids"`
+}
+
+// LogLevel is the log level of a daemon, as argument it changes the level
+// unless empty.
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// ForwardArgs is a call to the Node route URI of an agent.
+type ForwardArgs struct {
+	Agent string          `json:"agent"`
+	URI   string          `json:"uri"`
+	Arg   json.RawMessage `json:"arg"`
+}
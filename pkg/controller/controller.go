@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"bufio"
+	"os/exec"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Reconciler brings one piece of kernel state back in line with what it
+// should be.
+type Reconciler interface {
+	Reconcile() error
+}
+
+// Controller runs every registered Reconciler on a timer and whenever a
+// link changes, so interfaces deleted or reconfigured by hand are put back.
+type Controller struct {
+	Logger   *zap.Logger
+	interval time.Duration
+
+	lock    sync.Mutex
+	targets map[string]Reconciler
+	trigger chan struct{}
+	reset   chan time.Duration
+	done    chan struct{}
+	closed  bool
+	monitor *exec.Cmd
+	// errors counts the failed passes of every target since the start
+	errors map[string]uint64
+}
+
+func NewController(logger *zap.Logger, interval time.Duration) *Controller {
+	return &Controller{
+		Logger:   logger,
+		interval: interval,
+		targets:  map[string]Reconciler{},
+		trigger:  make(chan struct{}, 1),
+		reset:    make(chan time.Duration, 1),
+		done:     make(chan struct{}),
+		errors:   map[string]uint64{},
+	}
+}
+
+// Add registers r under name and reconciles it on the next pass.
+func (c *Controller) Add(name string, r Reconciler) {
+	c.lock.Lock()
+	c.targets[name] = r
+	c.lock.Unlock()
+	c.Trigger()
+}
+
+// Remove stops reconciling name, it has to be done before tearing the
+// interface down or it is recreated.
+func (c *Controller) Remove(name string) {
+	c.lock.Lock()
+	delete(c.targets, name)
+	c.lock.Unlock()
+}
+
+// Trigger asks for a pass as soon as possible. Triggers that arrive while a
+// pass is pending are merged.
+func (c *Controller) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// SetInterval changes the time between two periodic passes.
+func (c *Controller) SetInterval(interval time.Duration) {
+	select {
+	case <-c.reset:
+	default:
+	}
+	c.reset <- interval
+}
+
+// Reconcile runs every target once and returns the number that failed.
+func (c *Controller) Reconcile() int {
+	c.lock.Lock()
+	targets := make(map[string]Reconciler, len(c.targets))
+	for name, r := range c.targets {
+		targets[name] = r
+	}
+	c.lock.Unlock()
+
+	failed := 0
+	for name, r := range targets {
+		if err := r.Reconcile(); err != nil {
+			c.Logger.Error("failed to reconcile", zap.String("target", name), zap.Error(err))
+			c.lock.Lock()
+			c.errors[name]++
+			c.lock.Unlock()
+			failed++
+		}
+	}
+	return failed
+}
+
+// Errors returns the number of failed passes of every target that failed
+// at least once, removed targets included.
+func (c *Controller) Errors() map[string]uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	errors := make(map[string]uint64, len(c.errors))
+	for name, n := range c.errors {
+		errors[name] = n
+	}
+	return errors
+}
+
+// Start runs the reconcile loop and watches link changes until Close.
+func (c *Controller) Start() {
+	go c.loop()
+	go c.watchLinks()
+}
+
+func (c *Controller) loop() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case interval := <-c.reset:
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
+			continue
+		case <-ticker.C:
+		case <-c.trigger:
+		}
+		c.Reconcile()
+	}
+}
+
+// watchLinks triggers a pass on every line of `ip monitor link`, it is
+// restarted when it exits.
+func (c *Controller) watchLinks() {
+	for {
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return
+		}
+		cmd := exec.Command("ip", "-o", "monitor", "link")
+		c.monitor = cmd
+		c.lock.Unlock()
+
+		out, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			c.Logger.Warn("cannot watch links, only reconciling on the timer", zap.Error(err))
+			return
+		}
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			c.Trigger()
+		}
+		cmd.Wait()
+
+		select {
+		case <-c.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (c *Controller) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.done)
+	if c.monitor != nil && c.monitor.Process != nil {
+		c.monitor.Process.Kill()
+	}
+}
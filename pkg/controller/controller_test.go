@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type reconcileFunc func() error
+
+func (f reconcileFunc) Reconcile() error {
+	return f()
+}
+
+func TestReconcileCountsFailures(t *testing.T) {
+	c := NewController(zap.NewNop(), time.Minute)
+	c.Add("ok", reconcileFunc(func() error { return nil }))
+	c.Add("broken", reconcileFunc(func() error { return errors.New("no routed interface") }))
+	for i := 0; i < 2; i++ {
+		if failed := c.Reconcile(); failed != 1 {
+			t.Errorf("Reconcile() = %d failed, want 1", failed)
+		}
+	}
+	c.Remove("broken")
+	if failed := c.Reconcile(); failed != 0 {
+		t.Errorf("Reconcile() after Remove = %d failed, want 0", failed)
+	}
+	if got, want := c.Errors(), map[string]uint64{"broken": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Errors() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package events
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// shards is how many events of different subjects a subscriber
+	// handles at once.
+	shards = 4
+	// backlog is how many events a shard queues before dropping.
+	backlog = 1024
+)
+
+// Bus hands published events to its subscribers. Publish never blocks, a
+// subscriber that falls behind loses events instead of slowing down the
+// interfaces and relays, they are handed to its overflow handler if it has
+// one.
+type Bus struct {
+	Logger *zap.Logger
+	// Node is set on the events published without one.
+	Node string
+	lock sync.RWMutex
+	subs []*Subscription
+}
+
+func NewBus(logger *zap.Logger) *Bus {
+	return &Bus{Logger: logger}
+}
+
+// Subscription is a handler registered on a bus.
+type Subscription struct {
+	Name    string
+	bus     *Bus
+	types   map[Type]bool
+	queues  [shards]chan Event
+	dropped uint64
+	wg      sync.WaitGroup
+	// overflow gets the events that did not fit in a queue, it may be nil
+	overflow func(Event)
+}
+
+// Subscribe calls handler with the events of the given types, or of every
+// type when none is given. Events of a subject reach handler one at a time
+// and in order, events of different subjects may be handled concurrently.
+func (b *Bus) Subscribe(name string, handler func(Event), types ...Type) *Subscription {
+	return b.SubscribeOverflow(name, handler, nil, types...)
+}
+
+// SubscribeOverflow is Subscribe with overflow called, from Publish, with
+// every event dropped because the subscriber fell behind. overflow must
+// not block.
+func (b *Bus) SubscribeOverflow(name string, handler func(Event), overflow func(Event), types ...Type) *Subscription {
+	s := &Subscription{Name: name, bus: b, overflow: overflow}
+	if len(types) > 0 {
+		s.types = map[Type]bool{}
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	for i := range s.queues {
+		queue := make(chan Event, backlog)
+		s.queues[i] = queue
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for ev := range queue {
+				handler(ev)
+			}
+		}()
+	}
+	b.lock.Lock()
+	b.subs = append(b.subs, s)
+	b.lock.Unlock()
+	return s
+}
+
+// Close unsubscribes and waits for the queued events to be handled.
+func (s *Subscription) Close() {
+	b := s.bus
+	b.lock.Lock()
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			for _, queue := range s.queues {
+				close(queue)
+			}
+			break
+		}
+	}
+	b.lock.Unlock()
+	s.wg.Wait()
+}
+
+// Dropped counts the events lost because the subscriber fell behind.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func shard(subject string) int {
+	h := fnv.New32a()
+	h.Write([]byte(subject))
+	return int(h.Sum32() % shards)
+}
+
+// Publish fills in the ID, time and node of ev and queues it for every
+// subscriber of its type. Publishing on a nil bus does nothing, so the
+// packages reporting events work without one.
+func (b *Bus) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+	if ev.ID == "" {
+		ev.ID = newID()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Node == "" {
+		ev.Node = b.Node
+	}
+	i := shard(ev.Subject)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, s := range b.subs {
+		if s.types != nil && !s.types[ev.Type] {
+			continue
+		}
+		select {
+		case s.queues[i] <- ev:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			b.Logger.Warn("event dropped", zap.String("subscriber", s.Name), zap.String("type", string(ev.Type)), zap.String("subject", ev.Subject))
+			if s.overflow != nil {
+				s.overflow(ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestBusOrderPerSubject(t *testing.T) {
+	b := NewBus(zap.NewNop())
+	var lock sync.Mutex
+	got := map[string][]string{}
+	s := b.Subscribe("order", func(ev Event) {
+		lock.Lock()
+		got[ev.Subject] = append(got[ev.Subject], ev.Data["n"])
+		lock.Unlock()
+	})
+	subjects := []string{"wg0", "wg1", "wg2", "relay/edge", "peer/a", "peer/b"}
+	for n := 0; n < 100; n++ {
+		for _, subject := range subjects {
+			b.Publish(Event{Type: PeerAdded, Subject: subject, Data: map[string]string{"n": strconv.Itoa(n)}})
+		}
+	}
+	s.Close()
+	for _, subject := range subjects {
+		if len(got[subject]) != 100 {
+			t.Fatalf("%s got %d events, want 100", subject, len(got[subject]))
+		}
+		for n, value := range got[subject] {
+			if value != strconv.Itoa(n) {
+				t.Fatalf("%s event %d is %s", subject, n, value)
+			}
+		}
+	}
+}
+
+func TestBusDrops(t *testing.T) {
+	b := NewBus(zap.NewNop())
+	started, release := make(chan struct{}), make(chan struct{})
+	var overflow []Event
+	s := b.SubscribeOverflow("slow", func(ev Event) {
+		if ev.Data["n"] == "first" {
+			close(started)
+			<-release
+		}
+	}, func(ev Event) {
+		overflow = append(overflow, ev)
+	}, PeerAdded)
+
+	// the handler holds the first event, the queue then takes backlog
+	b.Publish(Event{Type: PeerAdded, Subject: "wg0", Data: map[string]string{"n": "first"}})
+	<-started
+	for n := 0; n < backlog+5; n++ {
+		b.Publish(Event{Type: PeerAdded, Subject: "wg0", Data: map[string]string{"n": fmt.Sprint(n)}})
+	}
+	// other types are not queued and not dropped
+	b.Publish(Event{Type: PeerRemoved, Subject: "wg0"})
+	close(release)
+	s.Close()
+
+	if s.Dropped() != 5 || len(overflow) != 5 {
+		t.Fatalf("dropped %d, overflow got %d, want 5", s.Dropped(), len(overflow))
+	}
+	for i, ev := range overflow {
+		if want := fmt.Sprint(backlog + i); ev.Data["n"] != want || ev.ID == "" {
+			t.Errorf("overflow event %d = %+v, want n %s with an ID", i, ev, want)
+		}
+	}
+}
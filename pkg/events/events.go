@@ -0,0 +1,83 @@
+// Package events is the bus the daemon reports what happens on: interfaces
+// going up and down, peers coming and going, relay sessions. Subscribers
+// get the events of one subject in the order they were published.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Type says what happened, the names are stable as they reach webhooks.
+type Type string
+
+const (
+	InterfaceUp   Type = "interface.up"
+	InterfaceDown Type = "interface.down"
+
+	PeerAdded   Type = "peer.added"
+	PeerRemoved Type = "peer.removed"
+	// PeerHandshake is the first handshake of a peer, or the first one
+	// after it expired. Data["endpoint"] is where it connects from.
+	PeerHandshake Type = "peer.handshake"
+	// PeerExpired is a peer without a handshake for three minutes,
+	// Wireguard then considers its session dead.
+	PeerExpired Type = "peer.expired"
+	// QuotaCrossed is a peer whose traffic reached its quota,
+	// Data["bytes"] and Data["quota"] are in bytes.
+	QuotaCrossed Type = "peer.quota_crossed"
+
+	RelayOpened   Type = "relay.opened"
+	RelayClosed   Type = "relay.closed"
+	SessionOpened Type = "relay.session_opened"
+	SessionClosed Type = "relay.session_closed"
+	// UpstreamHealth is a relay whose upstream became reachable or not,
+	// Data["healthy"] is "true" or "false" and Data["error"] says why.
+	UpstreamHealth Type = "relay.upstream_health"
+)
+
+// Types lists every event type.
+var Types = []Type{
+	InterfaceUp, InterfaceDown,
+	PeerAdded, PeerRemoved, PeerHandshake, PeerExpired, QuotaCrossed,
+	RelayOpened, RelayClosed, SessionOpened, SessionClosed, UpstreamHealth,
+}
+
+// Event is one thing that happened. Subject is what it happened to,
+// "wireguard/<iface>" or "relay/<name>", events of one subject are
+// delivered in order.
+type Event struct {
+	ID        string            `json:"id"`
+	Type      Type              `json:"type"`
+	Time      time.Time         `json:"time"`
+	Node      string            `json:"node,omitempty"`
+	Subject   string            `json:"subject"`
+	Iface     string            `json:"iface,omitempty"`
+	PublicKey string            `json:"public_key,omitempty"`
+	Relay     string            `json:"relay,omitempty"`
+	Client    string            `json:"client,omitempty"`
+	Upstream  string            `json:"upstream,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// InterfaceEvent is an event of a Wireguard interface.
+func InterfaceEvent(t Type, iface string) Event {
+	return Event{Type: t, Subject: "wireguard/" + iface, Iface: iface}
+}
+
+// PeerEvent is an event of a peer, it shares the subject of its interface.
+func PeerEvent(t Type, iface string, publicKey string) Event {
+	return Event{Type: t, Subject: "wireguard/" + iface, Iface: iface, PublicKey: publicKey}
+}
+
+// RelayEvent is an event of a relay.
+func RelayEvent(t Type, relay string) Event {
+	return Event{Type: t, Subject: "relay/" + relay, Relay: relay}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
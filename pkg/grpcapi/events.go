@@ -0,0 +1,74 @@
+package grpcapi
+
+import (
+	"vpc/pkg/events"
+	"vpc/pkg/grpcapi/vpcpb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// eventTypes maps the bus events WatchEvents sends to their gRPC type.
+var eventTypes = map[events.Type]vpcpb.Event_Type{
+	events.InterfaceUp:   vpcpb.Event_WIREGUARD_CREATED,
+	events.InterfaceDown: vpcpb.Event_WIREGUARD_DELETED,
+	events.PeerAdded:     vpcpb.Event_PEER_ADDED,
+	events.PeerRemoved:   vpcpb.Event_PEER_REMOVED,
+	events.PeerHandshake: vpcpb.Event_HANDSHAKE,
+	events.PeerExpired:   vpcpb.Event_EXPIRED,
+	events.RelayOpened:   vpcpb.Event_RELAY_OPENED,
+	events.RelayClosed:   vpcpb.Event_RELAY_CLOSED,
+}
+
+func eventOf(ev events.Event) *vpcpb.Event {
+	return &vpcpb.Event{
+		Type:      eventTypes[ev.Type],
+		Time:      timestamppb.New(ev.Time),
+		Agent:     ev.Node,
+		Iface:     ev.Iface,
+		PublicKey: ev.PublicKey,
+		Relay:     ev.Relay,
+	}
+}
+
+// WatchEvents sends the events the agents forward to the control plane,
+// those of req.Agent only when it is set. What exists when the stream
+// starts is not reported. A client that falls behind loses events, as any
+// other subscriber of the bus.
+func (s *Server) WatchEvents(req *vpcpb.WatchEventsRequest, stream vpcpb.VPC_WatchEventsServer) error {
+	if s.Events == nil {
+		return status.Error(codes.Unavailable, "events are not available")
+	}
+	if req.Agent != "" && !s.registered(req.Agent) {
+		return status.Errorf(codes.NotFound, "no agent %s", req.Agent)
+	}
+	types := make([]events.Type, 0, len(eventTypes))
+	for t := range eventTypes {
+		types = append(types, t)
+	}
+	evs := make(chan *vpcpb.Event)
+	done := make(chan struct{})
+	sub := s.Events.Subscribe("grpc watch", func(ev events.Event) {
+		if req.Agent != "" && ev.Node != req.Agent {
+			return
+		}
+		select {
+		case evs <- eventOf(ev):
+		case <-done:
+		}
+	}, types...)
+	// done unblocks the handlers before Close waits for them
+	defer sub.Close()
+	defer close(done)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-evs:
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
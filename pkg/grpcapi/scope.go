@@ -0,0 +1,88 @@
+package grpcapi
+
+import (
+	"vpc/pkg/grpcapi/vpcpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tenants authenticates the tenants and tells who owns an interface.
+type Tenants interface {
+	Authenticate(token string) (string, bool)
+	Owner(agent string, iface string) (string, bool)
+}
+
+// tenantMethods are the calls a tenant may make, on its own interfaces.
+// Everything else changes or shows the agents and is for the operator.
+var tenantMethods = map[string]bool{
+	vpcpb.VPC_ListWireguards_FullMethodName: true,
+	vpcpb.VPC_ListPeers_FullMethodName:      true,
+	vpcpb.VPC_GetPeerConfig_FullMethodName:  true,
+	vpcpb.VPC_WatchUsage_FullMethodName:     true,
+	vpcpb.VPC_WatchEvents_FullMethodName:    true,
+}
+
+// interfaceRequest is a request about one interface of an agent.
+type interfaceRequest interface {
+	GetAgent() string
+	GetIface() string
+}
+
+func (s *Server) owns(tenant string, agent string, iface string) bool {
+	owner, ok := s.Tenants.Owner(agent, iface)
+	return ok && owner == tenant
+}
+
+// checkScope refuses a request of tenant about an interface it does not
+// own. Requests about a whole agent are filtered by filterScope instead.
+func (s *Server) checkScope(tenant string, req interface{}) error {
+	r, ok := req.(interfaceRequest)
+	if !ok {
+		return nil
+	}
+	if !s.owns(tenant, r.GetAgent(), r.GetIface()) {
+		// the same as a missing interface, so tenants cannot probe others
+		return status.Errorf(codes.NotFound, "no interface %s on %s", r.GetIface(), r.GetAgent())
+	}
+	return nil
+}
+
+// filterScope drops from the response to req what tenant does not own.
+func (s *Server) filterScope(tenant string, req interface{}, resp interface{}) {
+	list, ok := resp.(*vpcpb.ListWireguardsResponse)
+	if !ok {
+		return
+	}
+	agent := req.(*vpcpb.ListWireguardsRequest).Agent
+	kept := list.Wireguards[:0]
+	for _, wg := range list.Wireguards {
+		if s.owns(tenant, agent, wg.Name) {
+			kept = append(kept, wg)
+		}
+	}
+	list.Wireguards = kept
+}
+
+// scopedStream checks the request of a tenant's stream and drops the
+// events of interfaces it does not own.
+type scopedStream struct {
+	grpc.ServerStream
+	server *Server
+	tenant string
+}
+
+func (ss *scopedStream) RecvMsg(m interface{}) error {
+	if err := ss.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return ss.server.checkScope(ss.tenant, m)
+}
+
+func (ss *scopedStream) SendMsg(m interface{}) error {
+	if ev, ok := m.(*vpcpb.Event); ok && !ss.server.owns(ss.tenant, ev.Agent, ev.Iface) {
+		return nil
+	}
+	return ss.ServerStream.SendMsg(m)
+}
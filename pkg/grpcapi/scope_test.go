@@ -0,0 +1,138 @@
+package grpcapi
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"vpc/pkg/grpcapi/vpcpb"
+)
+
+// fakeTenants has tenant t with token "t-token", owning wg0 and wg1 of a1.
+type fakeTenants struct{}
+
+func (fakeTenants) Authenticate(token string) (string, bool) {
+	if token == "t-token" {
+		return "t", true
+	}
+	return "", false
+}
+
+func (fakeTenants) Owner(agent string, iface string) (string, bool) {
+	switch agent + "/" + iface {
+	case "a1/wg0", "a1/wg1":
+		return "t", true
+	case "a1/wg2":
+		return "u", true
+	}
+	return "", false
+}
+
+func bearer(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.MD{"authorization": []string{"Bearer " + token}})
+}
+
+func TestAuthorizeTenant(t *testing.T) {
+	tests := []struct {
+		name       string
+		tenants    Tenants
+		token      string
+		method     string
+		wantTenant string
+		want       codes.Code
+	}{
+		{name: "tenant method", tenants: fakeTenants{}, token: "t-token", method: vpcpb.VPC_ListPeers_FullMethodName, wantTenant: "t", want: codes.OK},
+		{name: "tenant stream", tenants: fakeTenants{}, token: "t-token", method: vpcpb.VPC_WatchEvents_FullMethodName, wantTenant: "t", want: codes.OK},
+		{name: "operator method", tenants: fakeTenants{}, token: "t-token", method: vpcpb.VPC_ListAgents_FullMethodName, want: codes.PermissionDenied},
+		{name: "operator", tenants: fakeTenants{}, token: "secret", method: vpcpb.VPC_ListAgents_FullMethodName, want: codes.OK},
+		{name: "unknown token", tenants: fakeTenants{}, token: "other", method: vpcpb.VPC_ListPeers_FullMethodName, want: codes.Unauthenticated},
+		{name: "no tenants", token: "t-token", method: vpcpb.VPC_ListPeers_FullMethodName, want: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(zap.NewNop(), nil, "secret")
+			s.Tenants = tt.tenants
+			tenant, err := s.authorize(bearer(tt.token), tt.method)
+			if got := status.Code(err); got != tt.want || tenant != tt.wantTenant {
+				t.Errorf("authorize() = %q, %v, want %q, %v", tenant, err, tt.wantTenant, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckScope(t *testing.T) {
+	s := NewServer(zap.NewNop(), nil, "secret")
+	s.Tenants = fakeTenants{}
+	tests := []struct {
+		name string
+		req  interface{}
+		want codes.Code
+	}{
+		{name: "own interface", req: &vpcpb.ListPeersRequest{Agent: "a1", Iface: "wg0"}, want: codes.OK},
+		{name: "other tenant", req: &vpcpb.ListPeersRequest{Agent: "a1", Iface: "wg2"}, want: codes.NotFound},
+		{name: "no owner", req: &vpcpb.GetPeerConfigRequest{Agent: "a1", Iface: "wg9"}, want: codes.NotFound},
+		{name: "other agent", req: &vpcpb.WatchUsageRequest{Agent: "a2", Iface: "wg0"}, want: codes.NotFound},
+		{name: "whole agent", req: &vpcpb.ListWireguardsRequest{Agent: "a1"}, want: codes.OK},
+	}
+	for _, tt := range tests {
+		if got := status.Code(s.checkScope("t", tt.req)); got != tt.want {
+			t.Errorf("%s: checkScope() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterScope(t *testing.T) {
+	s := NewServer(zap.NewNop(), nil, "secret")
+	s.Tenants = fakeTenants{}
+	resp := &vpcpb.ListWireguardsResponse{Wireguards: []*vpcpb.Wireguard{{Name: "wg0"}, {Name: "wg2"}, {Name: "wg1"}, {Name: "wg9"}}}
+	s.filterScope("t", &vpcpb.ListWireguardsRequest{Agent: "a1"}, resp)
+	if len(resp.Wireguards) != 2 || resp.Wireguards[0].Name != "wg0" || resp.Wireguards[1].Name != "wg1" {
+		t.Errorf("filterScope() kept %v", resp.Wireguards)
+	}
+}
+
+// fakeStream receives req and records what is sent.
+type fakeStream struct {
+	grpc.ServerStream
+	req  *vpcpb.WatchUsageRequest
+	sent []interface{}
+}
+
+func (fs *fakeStream) RecvMsg(m interface{}) error {
+	r := m.(*vpcpb.WatchUsageRequest)
+	r.Agent, r.Iface = fs.req.Agent, fs.req.Iface
+	return nil
+}
+
+func (fs *fakeStream) SendMsg(m interface{}) error {
+	fs.sent = append(fs.sent, m)
+	return nil
+}
+
+func TestScopedStream(t *testing.T) {
+	s := NewServer(zap.NewNop(), nil, "secret")
+	s.Tenants = fakeTenants{}
+
+	fs := &fakeStream{req: &vpcpb.WatchUsageRequest{Agent: "a1", Iface: "wg2"}}
+	ss := &scopedStream{ServerStream: fs, server: s, tenant: "t"}
+	if err := ss.RecvMsg(new(vpcpb.WatchUsageRequest)); status.Code(err) != codes.NotFound {
+		t.Errorf("RecvMsg() of another tenant's interface: error = %v", err)
+	}
+	fs.req.Iface = "wg1"
+	if err := ss.RecvMsg(new(vpcpb.WatchUsageRequest)); err != nil {
+		t.Errorf("RecvMsg() of an own interface: error = %v", err)
+	}
+
+	for _, ev := range []*vpcpb.Event{{Agent: "a1", Iface: "wg0"}, {Agent: "a1", Iface: "wg2"}, {Agent: "a1"}, {Agent: "a1", Iface: "wg1"}} {
+		if err := ss.SendMsg(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fs.sent) != 2 || fs.sent[0].(*vpcpb.Event).Iface != "wg0" || fs.sent[1].(*vpcpb.Event).Iface != "wg1" {
+		t.Errorf("sent events = %v", fs.sent)
+	}
+}
@@ -0,0 +1,332 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+	"time"
+	"vpc/pkg/control"
+	"vpc/pkg/events"
+	"vpc/pkg/grpcapi/vpcpb"
+
+	tp "github.com/henrylee2cn/teleport"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultUsageInterval = 5 * time.Second
+	minUsageInterval     = time.Second
+)
+
+// Backend is the part of the control plane the service works on.
+type Backend interface {
+	Agents() []control.AgentInfo
+	CallAgentContext(ctx context.Context, agent string, uri string, arg interface{}, result interface{}) error
+}
+
+// Server implements the VPC service of vpc.proto on top of the control
+// plane.
+type Server struct {
+	vpcpb.UnimplementedVPCServer
+	Logger *zap.Logger
+	// Events is the bus the agents forward their events to, WatchEvents
+	// fails without it.
+	Events *events.Bus
+	// Tenants lets the tenants in with their own token, to the calls on
+	// their interfaces only. Without it only the operator token is taken.
+	Tenants Tenants
+	backend Backend
+	token   string
+}
+
+// NewServer serves backend to clients presenting token as bearer token.
+func NewServer(logger *zap.Logger, backend Backend, token string) *Server {
+	return &Server{
+		Logger:  logger,
+		backend: backend,
+		token:   token,
+	}
+}
+
+// GRPCServer returns a gRPC server with s registered, a server span around
+// every call and the token checked on every call. The calls of a tenant
+// are checked and filtered to its interfaces.
+func (s *Server) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			tenant, err := s.authorize(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			if tenant == "" {
+				return handler(ctx, req)
+			}
+			if err := s.checkScope(tenant, req); err != nil {
+				return nil, err
+			}
+			resp, err := handler(ctx, req)
+			if err == nil {
+				s.filterScope(tenant, req, resp)
+			}
+			return resp, err
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			tenant, err := s.authorize(ss.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			if tenant != "" {
+				ss = &scopedStream{ServerStream: ss, server: s, tenant: tenant}
+			}
+			return handler(srv, ss)
+		}),
+	)
+	g := grpc.NewServer(opts...)
+	vpcpb.RegisterVPCServer(g, s)
+	return g
+}
+
+// authorize checks the bearer token of a call to method. It returns the
+// tenant the token belongs to, empty for the operator.
+func (s *Server) authorize(ctx context.Context, method string) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			continue
+		}
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+			return "", nil
+		}
+		if s.Tenants == nil {
+			continue
+		}
+		if tenant, ok := s.Tenants.Authenticate(token); ok {
+			if !tenantMethods[method] {
+				return "", status.Error(codes.PermissionDenied, "only the operator may do this")
+			}
+			return tenant, nil
+		}
+	}
+	return "", status.Error(codes.Unauthenticated, "a valid bearer token is required")
+}
+
+// call makes one agent call and maps its failure to a gRPC status. The
+// agent records the client as "grpc:<addr>" for its changes.
+func (s *Server) call(ctx context.Context, agent string, uri string, arg interface{}, result interface{}) error {
+	if !s.registered(agent) {
+		return status.Errorf(codes.NotFound, "no agent %s", agent)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		ctx = control.WithActor(ctx, "grpc:"+p.Addr.String())
+	}
+	err := s.backend.CallAgentContext(ctx, agent, uri, arg, result)
+	if err == nil {
+		return nil
+	}
+	serr, ok := err.(*control.StatusError)
+	if !ok {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	switch serr.Code {
+	case tp.CodeBadMessage:
+		return status.Error(codes.InvalidArgument, serr.Msg)
+	case tp.CodeNotFound:
+		return status.Error(codes.NotFound, serr.Msg)
+	}
+	return status.Error(codes.Internal, serr.Msg)
+}
+
+func (s *Server) registered(agent string) bool {
+	for _, a := range s.backend.Agents() {
+		if a.Name == agent {
+			return true
+		}
+	}
+	return false
+}
+
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func wireguardOf(info control.WireguardInfo) *vpcpb.Wireguard {
+	return &vpcpb.Wireguard{
+		Name:      info.Name,
+		Port:      int32(info.Port),
+		Address:   info.Address,
+		PublicKey: info.PublicKey,
+		Endpoint:  info.Endpoint,
+		Peers:     int32(info.Peers),
+	}
+}
+
+func relayOf(info control.RelayInfo) *vpcpb.Relay {
+	return &vpcpb.Relay{
+		Name:      info.Name,
+		Transport: info.Transport,
+		Port:      int32(info.Port),
+		Upstream:  info.Upstream,
+		Declared:  info.Declared,
+		Sessions:  int32(info.Sessions),
+		Packets:   info.Packets,
+		Bytes:     info.Bytes,
+	}
+}
+
+func (s *Server) ListAgents(ctx context.Context, req *vpcpb.ListAgentsRequest) (*vpcpb.ListAgentsResponse, error) {
+	resp := &vpcpb.ListAgentsResponse{}
+	for _, a := range s.backend.Agents() {
+		resp.Agents = append(resp.Agents, &vpcpb.Agent{Name: a.Name, Address: a.Address, Registered: timestamp(a.Registered)})
+	}
+	return resp, nil
+}
+
+func (s *Server) CreateWireguard(ctx context.Context, req *vpcpb.CreateWireguardRequest) (*vpcpb.Wireguard, error) {
+	var info control.WireguardInfo
+	if err := s.call(ctx, req.Agent, "/node/wg_create", &control.WireguardArgs{}, &info); err != nil {
+		return nil, err
+	}
+	return wireguardOf(info), nil
+}
+
+func (s *Server) ListWireguards(ctx context.Context, req *vpcpb.ListWireguardsRequest) (*vpcpb.ListWireguardsResponse, error) {
+	var infos []control.WireguardInfo
+	if err := s.call(ctx, req.Agent, "/node/wg_list", &control.Empty{}, &infos); err != nil {
+		return nil, err
+	}
+	resp := &vpcpb.ListWireguardsResponse{}
+	for _, info := range infos {
+		resp.Wireguards = append(resp.Wireguards, wireguardOf(info))
+	}
+	return resp, nil
+}
+
+func (s *Server) DeleteWireguard(ctx context.Context, req *vpcpb.DeleteWireguardRequest) (*vpcpb.DeleteWireguardResponse, error) {
+	if err := s.call(ctx, req.Agent, "/node/wg_destroy", &control.NameArgs{Name: req.Name}, new(bool)); err != nil {
+		return nil, err
+	}
+	return &vpcpb.DeleteWireguardResponse{}, nil
+}
+
+func (s *Server) AddPeer(ctx context.Context, req *vpcpb.AddPeerRequest) (*vpcpb.PeerConfig, error) {
+	var peer control.PeerConfig
+	if err := s.call(ctx, req.Agent, "/node/peer_add", &control.PeerArgs{Iface: req.Iface}, &peer); err != nil {
+		return nil, err
+	}
+	return &vpcpb.PeerConfig{PublicKey: peer.PublicKey, Config: peer.Config}, nil
+}
+
+func (s *Server) RemovePeer(ctx context.Context, req *vpcpb.RemovePeerRequest) (*vpcpb.RemovePeerResponse, error) {
+	if err := s.call(ctx, req.Agent, "/node/peer_remove", &control.PeerArgs{Iface: req.Iface, PublicKey: req.PublicKey}, new(bool)); err != nil {
+		return nil, err
+	}
+	return &vpcpb.RemovePeerResponse{}, nil
+}
+
+func (s *Server) ListPeers(ctx context.Context, req *vpcpb.ListPeersRequest) (*vpcpb.ListPeersResponse, error) {
+	var peers []control.PeerInfo
+	if err := s.call(ctx, req.Agent, "/node/peer_list", &control.PeerArgs{Iface: req.Iface}, &peers); err != nil {
+		return nil, err
+	}
+	resp := &vpcpb.ListPeersResponse{}
+	for _, p := range peers {
+		resp.Peers = append(resp.Peers, &vpcpb.Peer{
+			PublicKey:     p.PublicKey,
+			AllowedIps:    p.AllowedIPs,
+			Endpoint:      p.Endpoint,
+			LastHandshake: timestamp(p.LastHandshake),
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) GetPeerConfig(ctx context.Context, req *vpcpb.GetPeerConfigRequest) (*vpcpb.PeerConfig, error) {
+	var peer control.PeerConfig
+	if err := s.call(ctx, req.Agent, "/node/peer_config", &control.PeerArgs{Iface: req.Iface, PublicKey: req.PublicKey}, &peer); err != nil {
+		return nil, err
+	}
+	return &vpcpb.PeerConfig{PublicKey: peer.PublicKey, Config: peer.Config}, nil
+}
+
+func (s *Server) CreateRelay(ctx context.Context, req *vpcpb.CreateRelayRequest) (*vpcpb.Relay, error) {
+	arg := &control.RelayArgs{
+		Name:      req.Name,
+		Iface:     req.Iface,
+		Transport: req.Transport,
+		Port:      int(req.Port),
+		Upstream:  req.Upstream,
+	}
+	var info control.RelayInfo
+	if err := s.call(ctx, req.Agent, "/node/relay_create", arg, &info); err != nil {
+		return nil, err
+	}
+	return relayOf(info), nil
+}
+
+func (s *Server) ListRelays(ctx context.Context, req *vpcpb.ListRelaysRequest) (*vpcpb.ListRelaysResponse, error) {
+	var infos []control.RelayInfo
+	if err := s.call(ctx, req.Agent, "/node/relay_list", &control.Empty{}, &infos); err != nil {
+		return nil, err
+	}
+	resp := &vpcpb.ListRelaysResponse{}
+	for _, info := range infos {
+		resp.Relays = append(resp.Relays, relayOf(info))
+	}
+	return resp, nil
+}
+
+func (s *Server) CloseRelay(ctx context.Context, req *vpcpb.CloseRelayRequest) (*vpcpb.CloseRelayResponse, error) {
+	if err := s.call(ctx, req.Agent, "/node/relay_close", &control.NameArgs{Name: req.Name}, new(bool)); err != nil {
+		return nil, err
+	}
+	return &vpcpb.CloseRelayResponse{}, nil
+}
+
+func (s *Server) WatchUsage(req *vpcpb.WatchUsageRequest, stream vpcpb.VPC_WatchUsageServer) error {
+	interval := defaultUsageInterval
+	if req.Interval != nil {
+		interval = req.Interval.AsDuration()
+		if interval < minUsageInterval {
+			return status.Errorf(codes.InvalidArgument, "interval cannot be below %s", minUsageInterval)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var usage []control.UsageInfo
+		if err := s.call(stream.Context(), req.Agent, "/node/usage", &control.PeerArgs{Iface: req.Iface}, &usage); err != nil {
+			return err
+		}
+		update := &vpcpb.UsageUpdate{Time: timestamppb.Now()}
+		for _, u := range usage {
+			update.Usage = append(update.Usage, &vpcpb.Usage{
+				PublicKey:     u.PublicKey,
+				Upload:        u.Upload,
+				Download:      u.Download,
+				LastHandshake: timestamp(u.LastHandshake),
+			})
+		}
+		if err := stream.Send(update); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package grpcapi
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"vpc/pkg/grpcapi/vpcpb"
+)
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		auth  []string
+		want  codes.Code
+	}{
+		{name: "operator token", token: "secret", auth: []string{"Bearer secret"}, want: codes.OK},
+		{name: "second header", token: "secret", auth: []string{"Bearer other", "Bearer secret"}, want: codes.OK},
+		{name: "wrong token", token: "secret", auth: []string{"Bearer other"}, want: codes.Unauthenticated},
+		{name: "no metadata", token: "secret", want: codes.Unauthenticated},
+		{name: "no operator token", auth: []string{"Bearer "}, want: codes.Unauthenticated},
+		{name: "no operator token and no metadata", want: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(zap.NewNop(), nil, tt.token)
+			ctx := context.Background()
+			if tt.auth != nil {
+				ctx = metadata.NewIncomingContext(ctx, metadata.MD{"authorization": tt.auth})
+			}
+			tenant, err := s.authorize(ctx, vpcpb.VPC_ListAgents_FullMethodName)
+			if got := status.Code(err); got != tt.want || tenant != "" {
+				t.Errorf("authorize() = %q, %v, want %v", tenant, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package vpcpb holds the code generated from vpc.proto.
+package vpcpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative vpc.proto
@@ -0,0 +1,599 @@
+// The gRPC API of the vpc control plane. It offers the operations of the
+// REST API and streams the usage of peers and the lifecycle events of the
+// agents, so services can subscribe instead of polling.
+//
+// Every call carries the operator token as "authorization: Bearer <token>"
+// metadata.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: vpc.proto
+
+package vpcpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	VPC_ListAgents_FullMethodName      = "/vpc.v1.VPC/ListAgents"
+	VPC_CreateWireguard_FullMethodName = "/vpc.v1.VPC/CreateWireguard"
+	VPC_ListWireguards_FullMethodName  = "/vpc.v1.VPC/ListWireguards"
+	VPC_DeleteWireguard_FullMethodName = "/vpc.v1.VPC/DeleteWireguard"
+	VPC_AddPeer_FullMethodName         = "/vpc.v1.VPC/AddPeer"
+	VPC_RemovePeer_FullMethodName      = "/vpc.v1.VPC/RemovePeer"
+	VPC_ListPeers_FullMethodName       = "/vpc.v1.VPC/ListPeers"
+	VPC_GetPeerConfig_FullMethodName   = "/vpc.v1.VPC/GetPeerConfig"
+	VPC_CreateRelay_FullMethodName     = "/vpc.v1.VPC/CreateRelay"
+	VPC_ListRelays_FullMethodName      = "/vpc.v1.VPC/ListRelays"
+	VPC_CloseRelay_FullMethodName      = "/vpc.v1.VPC/CloseRelay"
+	VPC_WatchUsage_FullMethodName      = "/vpc.v1.VPC/WatchUsage"
+	VPC_WatchEvents_FullMethodName     = "/vpc.v1.VPC/WatchEvents"
+)
+
+// VPCClient is the client API for VPC service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type VPCClient interface {
+	ListAgents(ctx context.Context, in *ListAgentsRequest, opts ...grpc.CallOption) (*ListAgentsResponse, error)
+	CreateWireguard(ctx context.Context, in *CreateWireguardRequest, opts ...grpc.CallOption) (*Wireguard, error)
+	ListWireguards(ctx context.Context, in *ListWireguardsRequest, opts ...grpc.CallOption) (*ListWireguardsResponse, error)
+	DeleteWireguard(ctx context.Context, in *DeleteWireguardRequest, opts ...grpc.CallOption) (*DeleteWireguardResponse, error)
+	AddPeer(ctx context.Context, in *AddPeerRequest, opts ...grpc.CallOption) (*PeerConfig, error)
+	RemovePeer(ctx context.Context, in *RemovePeerRequest, opts ...grpc.CallOption) (*RemovePeerResponse, error)
+	ListPeers(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*ListPeersResponse, error)
+	GetPeerConfig(ctx context.Context, in *GetPeerConfigRequest, opts ...grpc.CallOption) (*PeerConfig, error)
+	CreateRelay(ctx context.Context, in *CreateRelayRequest, opts ...grpc.CallOption) (*Relay, error)
+	ListRelays(ctx context.Context, in *ListRelaysRequest, opts ...grpc.CallOption) (*ListRelaysResponse, error)
+	CloseRelay(ctx context.Context, in *CloseRelayRequest, opts ...grpc.CallOption) (*CloseRelayResponse, error)
+	// WatchUsage sends the traffic of every peer of an interface, once right
+	// away and then every interval.
+	WatchUsage(ctx context.Context, in *WatchUsageRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[UsageUpdate], error)
+	// WatchEvents sends the lifecycle events of one agent, or of all of them
+	// when agent is empty.
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type vPCClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewVPCClient(cc grpc.ClientConnInterface) VPCClient {
+	return &vPCClient{cc}
+}
+
+func (c *vPCClient) ListAgents(ctx context.Context, in *ListAgentsRequest, opts ...grpc.CallOption) (*ListAgentsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListAgentsResponse)
+	err := c.cc.Invoke(ctx, VPC_ListAgents_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) CreateWireguard(ctx context.Context, in *CreateWireguardRequest, opts ...grpc.CallOption) (*Wireguard, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Wireguard)
+	err := c.cc.Invoke(ctx, VPC_CreateWireguard_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) ListWireguards(ctx context.Context, in *ListWireguardsRequest, opts ...grpc.CallOption) (*ListWireguardsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListWireguardsResponse)
+	err := c.cc.Invoke(ctx, VPC_ListWireguards_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) DeleteWireguard(ctx context.Context, in *DeleteWireguardRequest, opts ...grpc.CallOption) (*DeleteWireguardResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteWireguardResponse)
+	err := c.cc.Invoke(ctx, VPC_DeleteWireguard_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) AddPeer(ctx context.Context, in *AddPeerRequest, opts ...grpc.CallOption) (*PeerConfig, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PeerConfig)
+	err := c.cc.Invoke(ctx, VPC_AddPeer_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) RemovePeer(ctx context.Context, in *RemovePeerRequest, opts ...grpc.CallOption) (*RemovePeerResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RemovePeerResponse)
+	err := c.cc.Invoke(ctx, VPC_RemovePeer_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) ListPeers(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*ListPeersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListPeersResponse)
+	err := c.cc.Invoke(ctx, VPC_ListPeers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) GetPeerConfig(ctx context.Context, in *GetPeerConfigRequest, opts ...grpc.CallOption) (*PeerConfig, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PeerConfig)
+	err := c.cc.Invoke(ctx, VPC_GetPeerConfig_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) CreateRelay(ctx context.Context, in *CreateRelayRequest, opts ...grpc.CallOption) (*Relay, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Relay)
+	err := c.cc.Invoke(ctx, VPC_CreateRelay_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) ListRelays(ctx context.Context, in *ListRelaysRequest, opts ...grpc.CallOption) (*ListRelaysResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListRelaysResponse)
+	err := c.cc.Invoke(ctx, VPC_ListRelays_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) CloseRelay(ctx context.Context, in *CloseRelayRequest, opts ...grpc.CallOption) (*CloseRelayResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CloseRelayResponse)
+	err := c.cc.Invoke(ctx, VPC_CloseRelay_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vPCClient) WatchUsage(ctx context.Context, in *WatchUsageRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[UsageUpdate], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &VPC_ServiceDesc.Streams[0], VPC_WatchUsage_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchUsageRequest, UsageUpdate]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type VPC_WatchUsageClient = grpc.ServerStreamingClient[UsageUpdate]
+
+func (c *vPCClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &VPC_ServiceDesc.Streams[1], VPC_WatchEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchEventsRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type VPC_WatchEventsClient = grpc.ServerStreamingClient[Event]
+
+// VPCServer is the server API for VPC service.
+// All implementations must embed UnimplementedVPCServer
+// for forward compatibility.
+type VPCServer interface {
+	ListAgents(context.Context, *ListAgentsRequest) (*ListAgentsResponse, error)
+	CreateWireguard(context.Context, *CreateWireguardRequest) (*Wireguard, error)
+	ListWireguards(context.Context, *ListWireguardsRequest) (*ListWireguardsResponse, error)
+	DeleteWireguard(context.Context, *DeleteWireguardRequest) (*DeleteWireguardResponse, error)
+	AddPeer(context.Context, *AddPeerRequest) (*PeerConfig, error)
+	RemovePeer(context.Context, *RemovePeerRequest) (*RemovePeerResponse, error)
+	ListPeers(context.Context, *ListPeersRequest) (*ListPeersResponse, error)
+	GetPeerConfig(context.Context, *GetPeerConfigRequest) (*PeerConfig, error)
+	CreateRelay(context.Context, *CreateRelayRequest) (*Relay, error)
+	ListRelays(context.Context, *ListRelaysRequest) (*ListRelaysResponse, error)
+	CloseRelay(context.Context, *CloseRelayRequest) (*CloseRelayResponse, error)
+	// WatchUsage sends the traffic of every peer of an interface, once right
+	// away and then every interval.
+	WatchUsage(*WatchUsageRequest, grpc.ServerStreamingServer[UsageUpdate]) error
+	// WatchEvents sends the lifecycle events of one agent, or of all of them
+	// when agent is empty.
+	WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedVPCServer()
+}
+
+// UnimplementedVPCServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedVPCServer struct{}
+
+func (UnimplementedVPCServer) ListAgents(context.Context, *ListAgentsRequest) (*ListAgentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAgents not implemented")
+}
+func (UnimplementedVPCServer) CreateWireguard(context.Context, *CreateWireguardRequest) (*Wireguard, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateWireguard not implemented")
+}
+func (UnimplementedVPCServer) ListWireguards(context.Context, *ListWireguardsRequest) (*ListWireguardsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListWireguards not implemented")
+}
+func (UnimplementedVPCServer) DeleteWireguard(context.Context, *DeleteWireguardRequest) (*DeleteWireguardResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteWireguard not implemented")
+}
+func (UnimplementedVPCServer) AddPeer(context.Context, *AddPeerRequest) (*PeerConfig, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddPeer not implemented")
+}
+func (UnimplementedVPCServer) RemovePeer(context.Context, *RemovePeerRequest) (*RemovePeerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemovePeer not implemented")
+}
+func (UnimplementedVPCServer) ListPeers(context.Context, *ListPeersRequest) (*ListPeersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPeers not implemented")
+}
+func (UnimplementedVPCServer) GetPeerConfig(context.Context, *GetPeerConfigRequest) (*PeerConfig, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPeerConfig not implemented")
+}
+func (UnimplementedVPCServer) CreateRelay(context.Context, *CreateRelayRequest) (*Relay, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateRelay not implemented")
+}
+func (UnimplementedVPCServer) ListRelays(context.Context, *ListRelaysRequest) (*ListRelaysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRelays not implemented")
+}
+func (UnimplementedVPCServer) CloseRelay(context.Context, *CloseRelayRequest) (*CloseRelayResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CloseRelay not implemented")
+}
+func (UnimplementedVPCServer) WatchUsage(*WatchUsageRequest, grpc.ServerStreamingServer[UsageUpdate]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchUsage not implemented")
+}
+func (UnimplementedVPCServer) WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedVPCServer) mustEmbedUnimplementedVPCServer() {}
+func (UnimplementedVPCServer) testEmbeddedByValue()             {}
+
+// UnsafeVPCServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to VPCServer will
+// result in compilation errors.
+type UnsafeVPCServer interface {
+	mustEmbedUnimplementedVPCServer()
+}
+
+func RegisterVPCServer(s grpc.ServiceRegistrar, srv VPCServer) {
+	// If the following call pancis, it indicates UnimplementedVPCServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&VPC_ServiceDesc, srv)
+}
+
+func _VPC_ListAgents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAgentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).ListAgents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_ListAgents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).ListAgents(ctx, req.(*ListAgentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_CreateWireguard_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateWireguardRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).CreateWireguard(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_CreateWireguard_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).CreateWireguard(ctx, req.(*CreateWireguardRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_ListWireguards_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListWireguardsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).ListWireguards(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_ListWireguards_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).ListWireguards(ctx, req.(*ListWireguardsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_DeleteWireguard_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteWireguardRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).DeleteWireguard(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_DeleteWireguard_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).DeleteWireguard(ctx, req.(*DeleteWireguardRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_AddPeer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddPeerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).AddPeer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_AddPeer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).AddPeer(ctx, req.(*AddPeerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_RemovePeer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemovePeerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).RemovePeer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_RemovePeer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).RemovePeer(ctx, req.(*RemovePeerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_ListPeers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPeersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).ListPeers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_ListPeers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).ListPeers(ctx, req.(*ListPeersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_GetPeerConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPeerConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).GetPeerConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_GetPeerConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).GetPeerConfig(ctx, req.(*GetPeerConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_CreateRelay_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateRelayRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).CreateRelay(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_CreateRelay_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).CreateRelay(ctx, req.(*CreateRelayRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_ListRelays_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRelaysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).ListRelays(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_ListRelays_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).ListRelays(ctx, req.(*ListRelaysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_CloseRelay_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CloseRelayRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VPCServer).CloseRelay(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VPC_CloseRelay_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VPCServer).CloseRelay(ctx, req.(*CloseRelayRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VPC_WatchUsage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchUsageRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VPCServer).WatchUsage(m, &grpc.GenericServerStream[WatchUsageRequest, UsageUpdate]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type VPC_WatchUsageServer = grpc.ServerStreamingServer[UsageUpdate]
+
+func _VPC_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VPCServer).WatchEvents(m, &grpc.GenericServerStream[WatchEventsRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type VPC_WatchEventsServer = grpc.ServerStreamingServer[Event]
+
+// VPC_ServiceDesc is the grpc.ServiceDesc for VPC service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var VPC_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "vpc.v1.VPC",
+	HandlerType: (*VPCServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListAgents",
+			Handler:    _VPC_ListAgents_Handler,
+		},
+		{
+			MethodName: "CreateWireguard",
+			Handler:    _VPC_CreateWireguard_Handler,
+		},
+		{
+			MethodName: "ListWireguards",
+			Handler:    _VPC_ListWireguards_Handler,
+		},
+		{
+			MethodName: "DeleteWireguard",
+			Handler:    _VPC_DeleteWireguard_Handler,
+		},
+		{
+			MethodName: "AddPeer",
+			Handler:    _VPC_AddPeer_Handler,
+		},
+		{
+			MethodName: "RemovePeer",
+			Handler:    _VPC_RemovePeer_Handler,
+		},
+		{
+			MethodName: "ListPeers",
+			Handler:    _VPC_ListPeers_Handler,
+		},
+		{
+			MethodName: "GetPeerConfig",
+			Handler:    _VPC_GetPeerConfig_Handler,
+		},
+		{
+			MethodName: "CreateRelay",
+			Handler:    _VPC_CreateRelay_Handler,
+		},
+		{
+			MethodName: "ListRelays",
+			Handler:    _VPC_ListRelays_Handler,
+		},
+		{
+			MethodName: "CloseRelay",
+			Handler:    _VPC_CloseRelay_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchUsage",
+			Handler:       _VPC_WatchUsage_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _VPC_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "vpc.proto",
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"go.uber.org/zap/zapcore"
+)
+
+const syslogIdentifier = "vpcd"
+
+// journalCore sends every entry to journald with its fields as journal
+// fields, so they can be matched with journalctl FIELD=value.
+type journalCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+}
+
+func newJournalCore(level zapcore.LevelEnabler) zapcore.Core {
+	return &journalCore{LevelEnabler: level}
+}
+
+func (c *journalCore) With(fields []zapcore.Field) zapcore.Core {
+	all := make([]zapcore.Field, 0, len(c.fields)+len(fields))
+	all = append(all, c.fields...)
+	return &journalCore{LevelEnabler: c.LevelEnabler, fields: append(all, fields...)}
+}
+
+func (c *journalCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *journalCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	vars := map[string]string{"SYSLOG_IDENTIFIER": syslogIdentifier}
+	for key, value := range enc.Fields {
+		vars[journalField(key)] = fmt.Sprint(value)
+	}
+	if entry.LoggerName != "" {
+		vars["LOGGER"] = entry.LoggerName
+	}
+	if entry.Caller.Defined {
+		vars["CODE_FILE"] = entry.Caller.File
+		vars["CODE_LINE"] = strconv.Itoa(entry.Caller.Line)
+	}
+	return journal.Send(entry.Message, priority(entry.Level), vars)
+}
+
+func (c *journalCore) Sync() error {
+	return nil
+}
+
+// journalField turns a zap key into a journal field name, which only has
+// upper case letters, digits and underscores and cannot start with an
+// underscore or a digit. Keys clashing with the fields set by Write are
+// prefixed.
+func journalField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	switch name {
+	case "", "MESSAGE", "PRIORITY", "SYSLOG_IDENTIFIER", "LOGGER", "CODE_FILE", "CODE_LINE":
+		return "FIELD_" + name
+	}
+	return name
+}
+
+func priority(level zapcore.Level) journal.Priority {
+	switch level {
+	case zapcore.DebugLevel:
+		return journal.PriDebug
+	case zapcore.InfoLevel:
+		return journal.PriInfo
+	case zapcore.WarnLevel:
+		return journal.PriWarning
+	case zapcore.ErrorLevel:
+		return journal.PriErr
+	}
+	return journal.PriCrit
+}
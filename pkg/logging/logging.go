@@ -0,0 +1,73 @@
+// Package logging builds the logger of the daemon from the logging config
+// section. Every logger it returns redacts secrets, and with redact set
+// peer public keys and packet payloads as well.
+package logging
+
+import (
+	"fmt"
+	"os"
+	"vpc/pkg/config"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// New builds a logger writing to the output of cfg in its format. The
+// level is read from level on every entry, so it can be changed while the
+// logger is in use.
+func New(cfg config.LoggingConfig, level zap.AtomicLevel) (*zap.Logger, error) {
+	if err := SetLevel(level, cfg.Level); err != nil {
+		return nil, err
+	}
+	var core zapcore.Core
+	if cfg.Output == "journald" {
+		core = newJournalCore(level)
+	} else {
+		sink, err := output(cfg)
+		if err != nil {
+			return nil, err
+		}
+		core = zapcore.NewCore(encoder(cfg.Format), sink, level)
+	}
+	return zap.New(newRedactCore(core, cfg.Redact)), nil
+}
+
+func encoder(format string) zapcore.Encoder {
+	if format == "console" {
+		encoderConfig := zap.NewDevelopmentEncoderConfig()
+		encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		return zapcore.NewConsoleEncoder(encoderConfig)
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	return zapcore.NewJSONEncoder(encoderConfig)
+}
+
+func output(cfg config.LoggingConfig) (zapcore.WriteSyncer, error) {
+	switch cfg.Output {
+	case "stdout":
+		return zapcore.Lock(os.Stdout), nil
+	case "stderr":
+		return zapcore.Lock(os.Stderr), nil
+	case "file":
+		return zapcore.AddSync(&lumberjack.Logger{
+			Filename:   cfg.File.Path,
+			MaxSize:    cfg.File.MaxSizeMB,
+			MaxBackups: cfg.File.MaxBackups,
+			MaxAge:     cfg.File.MaxAgeDays,
+			Compress:   cfg.File.Compress,
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown log output %q", cfg.Output)
+}
+
+// SetLevel switches level to name, one of debug, info, warn and error.
+func SetLevel(level zap.AtomicLevel, name string) error {
+	var l zapcore.Level
+	if err := l.Set(name); err != nil || l < zapcore.DebugLevel || l > zapcore.ErrorLevel {
+		return fmt.Errorf("log level must be debug, info, warn or error, got %q", name)
+	}
+	level.SetLevel(l)
+	return nil
+}
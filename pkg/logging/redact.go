@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[redacted]"
+
+// secretFields are never logged.
+var secretFields = map[string]bool{
+	"private_key": true,
+	"token":       true,
+	"secret":      true,
+	"password":    true,
+	"config":      true,
+}
+
+// keyFields carry peer public keys, they are shortened when redacting.
+// Values that are not a single string, like a list of keys, are dropped.
+var keyFields = map[string]bool{
+	"peer":       true,
+	"public_key": true,
+	"pubkey":     true,
+}
+
+// payloadFields carry packet contents, they are dropped when redacting.
+var payloadFields = map[string]bool{
+	"data":    true,
+	"packet":  true,
+	"payload": true,
+}
+
+// redactCore rewrites the fields of sensitive keys before they reach the
+// wrapped core, the fields given to With included.
+type redactCore struct {
+	zapcore.Core
+	redact bool
+}
+
+func newRedactCore(core zapcore.Core, redact bool) zapcore.Core {
+	return &redactCore{Core: core, redact: redact}
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(c.fields(fields)), redact: c.redact}
+}
+
+func (c *redactCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, c.fields(fields))
+}
+
+// fields returns fields with the sensitive ones replaced, it only copies
+// when there is one.
+func (c *redactCore) fields(fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for i, f := range fields {
+		replaced, ok := c.field(f)
+		if !ok {
+			if out != nil {
+				out = append(out, f)
+			}
+			continue
+		}
+		if out == nil {
+			out = make([]zapcore.Field, i, len(fields))
+			copy(out, fields[:i])
+		}
+		out = append(out, replaced)
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+func (c *redactCore) field(f zapcore.Field) (zapcore.Field, bool) {
+	key := strings.ToLower(f.Key)
+	switch {
+	case secretFields[key]:
+		return zap.String(f.Key, redacted), true
+	case !c.redact:
+		return f, false
+	case payloadFields[key]:
+		return zap.String(f.Key, redacted), true
+	case keyFields[key]:
+		if s, ok := fieldString(f); ok {
+			return zap.String(f.Key, shortKey(s)), true
+		}
+		return zap.String(f.Key, redacted), true
+	}
+	return f, false
+}
+
+// fieldString returns the text f would be logged as, for the field types
+// that hold a single value. A Stringer that panics is not a string.
+func fieldString(f zapcore.Field) (s string, ok bool) {
+	defer func() {
+		if recover() != nil {
+			s, ok = "", false
+		}
+	}()
+	switch f.Type {
+	case zapcore.StringType:
+		return f.String, true
+	case zapcore.ByteStringType:
+		return string(f.Interface.([]byte)), true
+	case zapcore.StringerType:
+		return f.Interface.(fmt.Stringer).String(), true
+	case zapcore.ReflectType:
+		switch v := f.Interface.(type) {
+		case string:
+			return v, true
+		case []byte:
+			return string(v), true
+		case fmt.Stringer:
+			return v.String(), true
+		}
+	}
+	return "", false
+}
+
+// shortKey keeps enough of a public key to tell peers apart in the logs.
+func shortKey(key string) string {
+	if len(key) <= 8 {
+		return redacted
+	}
+	return key[:8] + "..."
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const testKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+type panicStringer struct{}
+
+func (*panicStringer) String() string { panic("nil") }
+
+func TestRedact(t *testing.T) {
+	short := testKey[:8] + "..."
+	tests := []struct {
+		name   string
+		redact bool
+		field  zap.Field
+		want   interface{}
+	}{
+		{name: "secret", field: zap.String("private_key", testKey), want: redacted},
+		{name: "secret of any type", field: zap.Any("config", map[string]string{"token": "t"}), want: redacted},
+		{name: "secret key case", field: zap.String("Token", "t"), want: redacted},
+		{name: "key kept", field: zap.String("peer", testKey), want: testKey},
+		{name: "payload kept", field: zap.Binary("data", []byte{1}), want: []byte{1}},
+		{name: "key", redact: true, field: zap.String("public_key", testKey), want: short},
+		{name: "short key", redact: true, field: zap.String("peer", "abc"), want: redacted},
+		{name: "key stringer", redact: true, field: zap.Stringer("peer", stringer(testKey)), want: short},
+		{name: "key any", redact: true, field: zap.Any("pubkey", stringer(testKey)), want: short},
+		{name: "key bytes", redact: true, field: zap.ByteString("peer", []byte(testKey)), want: short},
+		{name: "key reflect", redact: true, field: zap.Reflect("peer", testKey), want: short},
+		{name: "key list", redact: true, field: zap.Strings("peer", []string{testKey}), want: redacted},
+		{name: "key nil stringer", redact: true, field: zap.Stringer("peer", (*panicStringer)(nil)), want: redacted},
+		{name: "payload", redact: true, field: zap.Binary("packet", []byte{1}), want: redacted},
+		{name: "payload string", redact: true, field: zap.String("payload", "hello"), want: redacted},
+		{name: "other", redact: true, field: zap.Error(errors.New("failed")), want: "failed"},
+	}
+	for _, tt := range tests {
+		for _, with := range []bool{false, true} {
+			core, logs := observer.New(zapcore.DebugLevel)
+			logger := zap.New(newRedactCore(core, tt.redact))
+			if with {
+				logger.With(tt.field).Info("entry")
+			} else {
+				logger.Info("entry", tt.field)
+			}
+			entries := logs.All()
+			if len(entries) != 1 {
+				t.Fatalf("%s: %d entries", tt.name, len(entries))
+			}
+			got := entries[0].ContextMap()[tt.field.Key]
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("%s (with %v): %s = %v, want %v", tt.name, with, tt.field.Key, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRedactKeepsOtherFields(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newRedactCore(core, true)).With(zap.String("iface", "wg0"), zap.String("token", "t"))
+	logger.Info("entry", zap.Int("port", 51820), zap.String("peer", testKey), zap.String("relay", "r1"))
+
+	got := logs.All()[0].ContextMap()
+	want := map[string]interface{}{"iface": "wg0", "token": redacted, "port": int64(51820), "peer": testKey[:8] + "...", "relay": "r1"}
+	if len(got) != len(want) {
+		t.Fatalf("fields = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package mesh
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// The forwarding rules of a relay are not tagged like the ones of the
+// Wireguard interfaces, gc must leave them alone.
+func ruleComment(_interface string) string {
+	return "mesh:" + _interface
+}
+
+func nftTable(_interface string) string {
+	return "mesh_" + _interface
+}
+
+// cmdSetForwarding lets a relay forward between the nodes of the mesh, it
+// can be run again without adding the rule twice.
+func cmdSetForwarding(_interface string, backend string) *exec.Cmd {
+	sysctl := "sysctl -qw net.ipv4.ip_forward=1"
+	if backend == "nftables" {
+		return exec.Command("sh", "-c", fmt.Sprintf(`%[1]s && nft -f - <<EOF
+table ip %[3]s
+delete table ip %[3]s
+table ip %[3]s {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		iifname "%[2]s" oifname "%[2]s" accept
+	}
+}
+EOF`, sysctl, _interface, nftTable(_interface)))
+	}
+	rule := fmt.Sprintf("FORWARD -i %[1]s -o %[1]s -m comment --comment %[2]s -j ACCEPT", _interface, ruleComment(_interface))
+	return exec.Command("sh", "-c", fmt.Sprintf("%s && { iptables -C %s 2>/dev/null || iptables -A %s; }", sysctl, rule, rule))
+}
@@ -0,0 +1,373 @@
+package mesh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vpc/pkg/config"
+	"vpc/pkg/wireguard"
+
+	"github.com/my-network/wgcreate"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keepalive keeps the direct paths through NAT open, and every sync sets
+// it again so a path that fell back to the relay is tried again.
+const keepalive = 25 * time.Second
+
+// Mesh is the interface of a node in the mesh. Every other node is a peer
+// of it, reached directly at its endpoint. When a direct path has had no
+// handshake for HandshakeTimeout, the allowed IPs of that node move to the
+// relay, which forwards between the nodes, until the direct path is back.
+type Mesh struct {
+	Logger           *zap.Logger
+	Client           *wgctrl.Client
+	Name             string
+	Iface            string
+	Port             int
+	MTU              int
+	IP               net.IP
+	IPNet            net.IPNet
+	Endpoint         string
+	Routes           []string
+	Relay            bool
+	Firewall         string
+	SyncInterval     time.Duration
+	HandshakeTimeout time.Duration
+	key              wgtypes.Key
+
+	lock   sync.Mutex
+	paths  map[wgtypes.Key]*path
+	routes map[string]bool
+	// addRoute and delRoute change the kernel routes through an interface.
+	addRoute func(iface string, route string) error
+	delRoute func(iface string, route string) error
+}
+
+// path is how a node is reached, since is when it was first applied so a
+// new node gets HandshakeTimeout for its first handshake.
+type path struct {
+	node    Node
+	since   time.Time
+	relayed bool
+}
+
+// Path describes how a node is reached.
+type Path struct {
+	Name          string    `json:"name"`
+	PublicKey     string    `json:"public_key"`
+	Endpoint      string    `json:"endpoint"`
+	Relay         bool      `json:"relay"`
+	Relayed       bool      `json:"relayed"`
+	LastHandshake time.Time `json:"last_handshake"`
+}
+
+// New builds the mesh interface of node name from the mesh section of the
+// config, Up creates it.
+func New(logger *zap.Logger, name string, cfg config.MeshConfig, mtu int, firewall string) (*Mesh, error) {
+	ip, ipnet, err := net.ParseCIDR(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadKey(cfg.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	return &Mesh{
+		Logger:           logger.With(zap.String("iface", cfg.Iface)),
+		Client:           client,
+		Name:             name,
+		Iface:            cfg.Iface,
+		Port:             cfg.Port,
+		MTU:              mtu,
+		IP:               ip,
+		IPNet:            *ipnet,
+		Endpoint:         cfg.Endpoint,
+		Routes:           cfg.Routes,
+		Relay:            cfg.Relay,
+		Firewall:         firewall,
+		SyncInterval:     time.Duration(cfg.SyncInterval),
+		HandshakeTimeout: time.Duration(cfg.HandshakeTimeout),
+		key:              key,
+		paths:            map[wgtypes.Key]*path{},
+		routes:           map[string]bool{},
+		addRoute:         wireguard.AddRoute,
+		delRoute:         wireguard.DelRoute,
+	}, nil
+}
+
+// loadKey reads the private key at path, writing a new one when the file
+// does not exist yet. Without a path the key lives as long as the daemon.
+func loadKey(path string) (wgtypes.Key, error) {
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			return wgtypes.ParseKey(strings.TrimSpace(string(b)))
+		}
+		if !os.IsNotExist(err) {
+			return wgtypes.Key{}, err
+		}
+	}
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return key, err
+	}
+	if path != "" {
+		if err := ioutil.WriteFile(path, []byte(key.String()+"\n"), 0600); err != nil {
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+// Self is the node as announced to the control plane, which fills in the
+// name the agent registered under.
+func (m *Mesh) Self() Node {
+	return Node{
+		Name:      m.Name,
+		PublicKey: m.key.PublicKey().String(),
+		Endpoint:  m.Endpoint,
+		Address:   m.IP.String(),
+		Subnet:    m.IPNet.String(),
+		Routes:    m.Routes,
+		Relay:     m.Relay,
+	}
+}
+
+// Up creates the interface, or takes over the one a previous run left, and
+// sets its key and port. The peers are left to Apply.
+func (m *Mesh) Up() error {
+	iface, err := net.InterfaceByName(m.Iface)
+	if err != nil {
+		if _, err := wgcreate.Create(m.Iface, uint32(m.MTU), true, wireguard.DeviceLogger(m.Logger)); err != nil {
+			return err
+		}
+		if iface, err = net.InterfaceByName(m.Iface); err != nil {
+			return err
+		}
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(m.IP) {
+			found = true
+		}
+	}
+	if !found {
+		if err := wgcreate.AddIP(m.Iface, m.IP, m.IPNet); err != nil {
+			return err
+		}
+	}
+	if err := wireguard.SetLinkUp(m.Iface); err != nil {
+		return err
+	}
+	if err := m.Client.ConfigureDevice(m.Iface, wgtypes.Config{PrivateKey: &m.key, ListenPort: &m.Port}); err != nil {
+		return err
+	}
+	if m.Relay {
+		if o, err := cmdSetForwarding(m.Iface, m.Firewall).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, o)
+		}
+	}
+	m.Logger.Info("mesh interface up", zap.String("address", m.IP.String()), zap.Int("port", m.Port), zap.Bool("relay", m.Relay))
+	return nil
+}
+
+// Apply makes nodes the peers of the interface, the node itself is skipped
+// and the peers of nodes that are gone are removed. The first relay in
+// nodes carries the nodes whose direct path failed.
+func (m *Mesh) Apply(nodes []Node) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	dev, err := m.Client.Device(m.Iface)
+	if err != nil {
+		return err
+	}
+	return m.apply(dev.Peers, nodes, time.Now(), func(cfg wgtypes.Config) error {
+		return m.Client.ConfigureDevice(m.Iface, cfg)
+	})
+}
+
+// apply is Apply on the interface with peers at now, configure sets the
+// new peers. It is called with the lock held.
+func (m *Mesh) apply(peers []wgtypes.Peer, nodes []Node, now time.Time, configure func(wgtypes.Config) error) error {
+	handshakes := map[wgtypes.Key]time.Time{}
+	for _, p := range peers {
+		handshakes[p.PublicKey] = p.LastHandshakeTime
+	}
+	self := m.key.PublicKey()
+	var relay *wgtypes.Key
+	paths := map[wgtypes.Key]*path{}
+	allowedIPs := map[wgtypes.Key][]net.IPNet{}
+	moved := map[wgtypes.Key]bool{}
+	for _, n := range nodes {
+		key, err := wgtypes.ParseKey(n.PublicKey)
+		if err != nil {
+			return err
+		}
+		if key == self {
+			continue
+		}
+		if allowedIPs[key], err = n.AllowedIPs(); err != nil {
+			return err
+		}
+		if n.Relay && relay == nil {
+			relay = &key
+		}
+		// a copy, so nothing changes when the device cannot be configured
+		p := &path{since: now}
+		if old := m.paths[key]; old != nil {
+			*p = *old
+		}
+		moved[key] = p.node.Endpoint != n.Endpoint
+		p.node = n
+		paths[key] = p
+	}
+	for key, p := range paths {
+		if m.Relay || relay == nil || key == *relay {
+			p.relayed = false
+			continue
+		}
+		last := handshakes[key]
+		switch {
+		case !last.IsZero() && now.Sub(last) < m.HandshakeTimeout:
+			if p.relayed {
+				m.Logger.Info("direct path back", zap.String("node", p.node.Name))
+			}
+			p.relayed = false
+		case now.Sub(p.since) >= m.HandshakeTimeout && !p.relayed:
+			m.Logger.Warn("no handshake on the direct path, going through the relay", zap.String("node", p.node.Name))
+			p.relayed = true
+		}
+	}
+
+	interval := keepalive
+	cfg := wgtypes.Config{}
+	var relayed []net.IPNet
+	for key, p := range paths {
+		if p.relayed {
+			relayed = append(relayed, allowedIPs[key]...)
+		}
+	}
+	configured := map[wgtypes.Key]bool{}
+	for _, p := range peers {
+		configured[p.PublicKey] = true
+	}
+	for key, p := range paths {
+		peer := wgtypes.PeerConfig{
+			PublicKey:                   key,
+			ReplaceAllowedIPs:           true,
+			PersistentKeepaliveInterval: &interval,
+		}
+		if !p.relayed {
+			peer.AllowedIPs = allowedIPs[key]
+		}
+		if relay != nil && key == *relay {
+			peer.AllowedIPs = append(peer.AllowedIPs, relayed...)
+		}
+		// the endpoint is only set when it changes, setting it again would
+		// undo the roaming of a peer that moved since
+		if p.node.Endpoint != "" && (moved[key] || !configured[key]) {
+			endpoint, err := net.ResolveUDPAddr("udp", p.node.Endpoint)
+			if err != nil {
+				m.Logger.Warn("cannot resolve endpoint", zap.String("node", p.node.Name), zap.Error(err))
+			}
+			peer.Endpoint = endpoint
+		}
+		cfg.Peers = append(cfg.Peers, peer)
+	}
+	for _, p := range peers {
+		if _, found := paths[p.PublicKey]; !found {
+			cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+		}
+	}
+	if err := configure(cfg); err != nil {
+		return err
+	}
+	for key, p := range m.paths {
+		if _, found := paths[key]; !found {
+			m.Logger.Info("node left the mesh", zap.String("node", p.node.Name))
+		}
+	}
+	for key, p := range paths {
+		if _, found := m.paths[key]; !found {
+			m.Logger.Info("node joined the mesh", zap.String("node", p.node.Name), zap.String("endpoint", p.node.Endpoint))
+		}
+	}
+	m.paths = paths
+	m.applyRoutes(allowedIPs)
+	return nil
+}
+
+// applyRoutes gives the routes of the nodes a kernel route through the
+// interface, their addresses are in the subnet of the interface already.
+func (m *Mesh) applyRoutes(allowedIPs map[wgtypes.Key][]net.IPNet) {
+	routes := map[string]bool{}
+	for _, ips := range allowedIPs {
+		for _, route := range ips[1:] {
+			routes[route.String()] = true
+		}
+	}
+	for route := range routes {
+		if err := m.addRoute(m.Iface, route); err != nil {
+			m.Logger.Warn("failed to add route", zap.String("route", route), zap.Error(err))
+			delete(routes, route)
+		}
+	}
+	for route := range m.routes {
+		if routes[route] {
+			continue
+		}
+		if err := m.delRoute(m.Iface, route); err != nil {
+			m.Logger.Warn("failed to delete route", zap.String("route", route), zap.Error(err))
+		}
+	}
+	m.routes = routes
+}
+
+// Paths lists how the nodes of the mesh are reached, by name.
+func (m *Mesh) Paths() ([]Path, error) {
+	dev, err := m.Client.Device(m.Iface)
+	if err != nil {
+		return nil, err
+	}
+	handshakes := map[wgtypes.Key]time.Time{}
+	for _, p := range dev.Peers {
+		handshakes[p.PublicKey] = p.LastHandshakeTime
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	paths := []Path{}
+	for key, p := range m.paths {
+		paths = append(paths, Path{
+			Name:          p.node.Name,
+			PublicKey:     key.String(),
+			Endpoint:      p.node.Endpoint,
+			Relay:         p.node.Relay,
+			Relayed:       p.relayed,
+			LastHandshake: handshakes[key],
+		})
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Name < paths[j].Name })
+	return paths, nil
+}
+
+// Close releases the Wireguard client. The interface and its peers stay
+// up, the next run takes them over.
+func (m *Mesh) Close() {
+	m.Client.Close()
+}
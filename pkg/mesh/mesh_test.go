@@ -0,0 +1,220 @@
+package mesh
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const testTimeout = 3 * time.Minute
+
+// kernelRoutes stands in for the routes of the interface.
+type kernelRoutes struct {
+	routes map[string]bool
+	fail   map[string]bool
+}
+
+func (k *kernelRoutes) add(iface string, route string) error {
+	if k.fail[route] {
+		return errors.New("ip route failed")
+	}
+	k.routes[route] = true
+	return nil
+}
+
+func (k *kernelRoutes) del(iface string, route string) error {
+	delete(k.routes, route)
+	return nil
+}
+
+func newTestMesh(t *testing.T, relay bool) (*Mesh, *kernelRoutes) {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ipnet, _ := net.ParseCIDR("10.99.0.0/16")
+	kernel := &kernelRoutes{routes: map[string]bool{}, fail: map[string]bool{}}
+	m := &Mesh{
+		Logger:           zap.NewNop(),
+		Name:             "self",
+		Iface:            "mesh0",
+		IP:               net.ParseIP("10.99.0.9"),
+		IPNet:            *ipnet,
+		Relay:            relay,
+		HandshakeTimeout: testTimeout,
+		key:              key,
+		paths:            map[wgtypes.Key]*path{},
+		routes:           map[string]bool{},
+		addRoute:         kernel.add,
+		delRoute:         kernel.del,
+	}
+	return m, kernel
+}
+
+// applyAt runs apply and returns the config it set by public key.
+func applyAt(t *testing.T, m *Mesh, peers []wgtypes.Peer, nodes []Node, now time.Time) map[string]wgtypes.PeerConfig {
+	t.Helper()
+	set := map[string]wgtypes.PeerConfig{}
+	err := m.apply(peers, nodes, now, func(cfg wgtypes.Config) error {
+		for _, p := range cfg.Peers {
+			set[p.PublicKey.String()] = p
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func cidrs(ips []net.IPNet) []string {
+	s := []string{}
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+func sameCIDRs(ips []net.IPNet, want ...string) bool {
+	got := cidrs(ips)
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func devicePeer(t *testing.T, key string, handshake time.Time) wgtypes.Peer {
+	return wgtypes.Peer{PublicKey: mustKey(t, key), LastHandshakeTime: handshake}
+}
+
+func TestApplyRelayFallback(t *testing.T) {
+	m, kernel := newTestMesh(t, false)
+	self := m.Self()
+	relay := Node{Name: "relay", PublicKey: newPublicKey(t), Endpoint: "192.0.2.1:51820", Address: "10.99.0.1", Subnet: "10.99.0.0/16", Relay: true}
+	b := Node{Name: "b", PublicKey: newPublicKey(t), Endpoint: "192.0.2.2:51820", Address: "10.99.0.2", Subnet: "10.99.0.0/16", Routes: []string{"192.168.2.0/24"}}
+	nodes := []Node{self, relay, b}
+	start := time.Now()
+
+	// a new node is dialed directly
+	set := applyAt(t, m, nil, nodes, start)
+	if _, found := set[self.PublicKey]; found || len(set) != 2 {
+		t.Fatalf("first apply set %v", set)
+	}
+	if p := set[b.PublicKey]; !sameCIDRs(p.AllowedIPs, "10.99.0.2/32", "192.168.2.0/24") || p.Endpoint.String() != b.Endpoint {
+		t.Errorf("b = %v via %v, want direct", cidrs(p.AllowedIPs), p.Endpoint)
+	}
+	if p := set[relay.PublicKey]; !sameCIDRs(p.AllowedIPs, "10.99.0.1/32") || p.Endpoint.String() != relay.Endpoint {
+		t.Errorf("relay = %v via %v", cidrs(p.AllowedIPs), p.Endpoint)
+	}
+	if !kernel.routes["192.168.2.0/24"] {
+		t.Errorf("kernel routes = %v", kernel.routes)
+	}
+
+	// no handshake within the timeout moves b to the relay, unless the
+	// device cannot be configured
+	now := start.Add(testTimeout + time.Second)
+	peers := []wgtypes.Peer{devicePeer(t, relay.PublicKey, now.Add(-time.Second)), devicePeer(t, b.PublicKey, time.Time{})}
+	if err := m.apply(peers, nodes, now, func(wgtypes.Config) error { return errors.New("device gone") }); err == nil {
+		t.Fatal("apply() with a failing device succeeded")
+	}
+	if p := m.paths[mustKey(t, b.PublicKey)]; p.relayed {
+		t.Error("b relayed although the device was not configured")
+	}
+	set = applyAt(t, m, peers, nodes, now)
+	if p := set[b.PublicKey]; len(p.AllowedIPs) != 0 || p.Endpoint != nil {
+		t.Errorf("relayed b = %v via %v, want no allowed IPs and its endpoint kept", cidrs(p.AllowedIPs), p.Endpoint)
+	}
+	if p := set[relay.PublicKey]; !sameCIDRs(p.AllowedIPs, "10.99.0.1/32", "10.99.0.2/32", "192.168.2.0/24") || p.Endpoint != nil {
+		t.Errorf("relay = %v via %v, want b behind it", cidrs(p.AllowedIPs), p.Endpoint)
+	}
+	if p := m.paths[mustKey(t, b.PublicKey)]; !p.relayed {
+		t.Error("b not marked relayed")
+	}
+
+	// the keepalive gets a handshake through, the direct path is back
+	now = now.Add(time.Minute)
+	peers[1].LastHandshakeTime = now.Add(-10 * time.Second)
+	set = applyAt(t, m, peers, nodes, now)
+	if p := set[b.PublicKey]; !sameCIDRs(p.AllowedIPs, "10.99.0.2/32", "192.168.2.0/24") {
+		t.Errorf("b = %v, want direct again", cidrs(p.AllowedIPs))
+	}
+	if p := set[relay.PublicKey]; !sameCIDRs(p.AllowedIPs, "10.99.0.1/32") {
+		t.Errorf("relay = %v, want b off it", cidrs(p.AllowedIPs))
+	}
+
+	// a new endpoint is set, the unchanged ones are left to roaming
+	b.Endpoint = "192.0.2.22:51820"
+	nodes = []Node{self, relay, b}
+	set = applyAt(t, m, peers, nodes, now)
+	if p := set[b.PublicKey]; p.Endpoint.String() != b.Endpoint || set[relay.PublicKey].Endpoint != nil {
+		t.Errorf("endpoints b = %v, relay = %v", p.Endpoint, set[relay.PublicKey].Endpoint)
+	}
+
+	// a node that leaves is removed with its routes
+	set = applyAt(t, m, peers, []Node{self, relay}, now)
+	if p, found := set[b.PublicKey]; !found || !p.Remove {
+		t.Errorf("b after leaving = %+v, want removed", p)
+	}
+	if len(kernel.routes) != 0 {
+		t.Errorf("kernel routes = %v, want none", kernel.routes)
+	}
+}
+
+func TestApplyNoFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		isRelay bool
+		since   time.Duration
+		noRelay bool
+	}{
+		{name: "new node", since: testTimeout - time.Second},
+		{name: "relay itself", isRelay: true, since: testTimeout + time.Second},
+		{name: "no relay in the mesh", noRelay: true, since: testTimeout + time.Second},
+	}
+	for _, tt := range tests {
+		m, _ := newTestMesh(t, tt.isRelay)
+		relay := Node{Name: "relay", PublicKey: newPublicKey(t), Endpoint: "192.0.2.1:51820", Address: "10.99.0.1", Subnet: "10.99.0.0/16", Relay: !tt.noRelay}
+		b := Node{Name: "b", PublicKey: newPublicKey(t), Endpoint: "192.0.2.2:51820", Address: "10.99.0.2", Subnet: "10.99.0.0/16"}
+		start := time.Now()
+		applyAt(t, m, nil, []Node{relay, b}, start)
+		peers := []wgtypes.Peer{devicePeer(t, relay.PublicKey, start), devicePeer(t, b.PublicKey, time.Time{})}
+		set := applyAt(t, m, peers, []Node{relay, b}, start.Add(tt.since))
+		if p := set[b.PublicKey]; !sameCIDRs(p.AllowedIPs, "10.99.0.2/32") {
+			t.Errorf("%s: b = %v, want direct", tt.name, cidrs(p.AllowedIPs))
+		}
+	}
+}
+
+func TestApplyRoutesRetried(t *testing.T) {
+	m, kernel := newTestMesh(t, false)
+	b := Node{Name: "b", PublicKey: newPublicKey(t), Address: "10.99.0.2", Subnet: "10.99.0.0/16", Routes: []string{"192.168.2.0/24", "192.168.3.0/24"}}
+	kernel.fail["192.168.3.0/24"] = true
+	applyAt(t, m, nil, []Node{b}, time.Now())
+	if !m.routes["192.168.2.0/24"] || m.routes["192.168.3.0/24"] {
+		t.Fatalf("routes = %v, want the failed one left out", m.routes)
+	}
+	delete(kernel.fail, "192.168.3.0/24")
+	applyAt(t, m, nil, []Node{b}, time.Now())
+	if !kernel.routes["192.168.3.0/24"] || !m.routes["192.168.3.0/24"] {
+		t.Errorf("routes = %v after the retry", m.routes)
+	}
+}
+
+func mustKey(t *testing.T, s string) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.ParseKey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
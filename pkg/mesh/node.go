@@ -0,0 +1,106 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Node is a member of the mesh as the control plane hands it out. Address
+// is its address in the mesh, Subnet the network of the mesh the address
+// is in, Routes the LAN prefixes behind it. A node
+// without Endpoint cannot be dialed, it is reached once it dials or through
+// the relay.
+type Node struct {
+	Name      string   `json:"name"`
+	PublicKey string   `json:"public_key"`
+	Endpoint  string   `json:"endpoint,omitempty"`
+	Address   string   `json:"address"`
+	Subnet    string   `json:"subnet"`
+	Routes    []string `json:"routes,omitempty"`
+	Relay     bool     `json:"relay,omitempty"`
+}
+
+// ErrConflict is a node announcing the key, address or a route of another
+// node, or another mesh subnet.
+var ErrConflict = errors.New("mesh conflict")
+
+// AllowedIPs returns the address of the node as a /32 followed by its
+// routes.
+func (n Node) AllowedIPs() ([]net.IPNet, error) {
+	ip := net.ParseIP(n.Address).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("node %s: address %q is not an IPv4 address", n.Name, n.Address)
+	}
+	allowedIPs := []net.IPNet{{IP: ip, Mask: net.CIDRMask(32, 32)}}
+	for _, r := range n.Routes {
+		_, route, err := net.ParseCIDR(strings.TrimSpace(r))
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %v", n.Name, err)
+		}
+		allowedIPs = append(allowedIPs, *route)
+	}
+	return allowedIPs, nil
+}
+
+// Check validates what an agent announces about itself.
+func (n Node) Check() error {
+	if _, err := wgtypes.ParseKey(n.PublicKey); err != nil {
+		return fmt.Errorf("node %s: %v", n.Name, err)
+	}
+	if n.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(n.Endpoint); err != nil {
+			return fmt.Errorf("node %s: %v", n.Name, err)
+		}
+	}
+	if n.Relay && n.Endpoint == "" {
+		return fmt.Errorf("node %s: a relay needs an endpoint", n.Name)
+	}
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return fmt.Errorf("node %s: subnet: %v", n.Name, err)
+	}
+	// written the same way by every node, Conflicts compares them as is
+	if subnet.String() != n.Subnet {
+		return fmt.Errorf("node %s: subnet %s must be written %s", n.Name, n.Subnet, subnet.String())
+	}
+	allowedIPs, err := n.AllowedIPs()
+	if err != nil {
+		return err
+	}
+	if !subnet.Contains(allowedIPs[0].IP) {
+		return fmt.Errorf("node %s: address %s is not in the mesh subnet %s", n.Name, n.Address, n.Subnet)
+	}
+	return nil
+}
+
+// Conflicts fails when n announces the key, address or a route of other,
+// Wireguard would silently move them from one peer to the other, or when
+// they are not in the same mesh subnet.
+func (n Node) Conflicts(other Node) error {
+	if n.PublicKey == other.PublicKey {
+		return fmt.Errorf("%w: node %s has the public key of %s", ErrConflict, n.Name, other.Name)
+	}
+	if n.Subnet != other.Subnet {
+		return fmt.Errorf("%w: node %s is in the mesh subnet %s, %s in %s", ErrConflict, n.Name, n.Subnet, other.Name, other.Subnet)
+	}
+	mine, err := n.AllowedIPs()
+	if err != nil {
+		return err
+	}
+	theirs, err := other.AllowedIPs()
+	if err != nil {
+		return err
+	}
+	for _, a := range mine {
+		for _, b := range theirs {
+			if a.Contains(b.IP) || b.Contains(a.IP) {
+				return fmt.Errorf("%w: %s of node %s overlaps %s of %s", ErrConflict, a.String(), n.Name, b.String(), other.Name)
+			}
+		}
+	}
+	return nil
+}
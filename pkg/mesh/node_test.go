@@ -0,0 +1,73 @@
+package mesh
+
+import (
+	"errors"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func newPublicKey(t *testing.T) string {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey().String()
+}
+
+func TestConflicts(t *testing.T) {
+	a := Node{Name: "a", PublicKey: newPublicKey(t), Address: "10.99.0.1", Subnet: "10.99.0.0/16", Routes: []string{"192.168.1.0/24"}}
+	other := newPublicKey(t)
+	tests := []struct {
+		name     string
+		node     Node
+		conflict bool
+		invalid  bool
+	}{
+		{name: "apart", node: Node{Name: "b", PublicKey: other, Address: "10.99.0.2", Subnet: "10.99.0.0/16", Routes: []string{"192.168.2.0/24"}}},
+		{name: "same key", node: Node{Name: "b", PublicKey: a.PublicKey, Address: "10.99.0.2", Subnet: "10.99.0.0/16"}, conflict: true},
+		{name: "same address", node: Node{Name: "b", PublicKey: other, Address: "10.99.0.1", Subnet: "10.99.0.0/16"}, conflict: true},
+		{name: "address in a route", node: Node{Name: "b", PublicKey: other, Address: "192.168.1.9", Subnet: "10.99.0.0/16"}, conflict: true},
+		{name: "same route", node: Node{Name: "b", PublicKey: other, Address: "10.99.0.2", Subnet: "10.99.0.0/16", Routes: []string{"192.168.1.0/24"}}, conflict: true},
+		{name: "route inside", node: Node{Name: "b", PublicKey: other, Address: "10.99.0.2", Subnet: "10.99.0.0/16", Routes: []string{"192.168.1.128/25"}}, conflict: true},
+		{name: "route around", node: Node{Name: "b", PublicKey: other, Address: "10.99.0.2", Subnet: "10.99.0.0/16", Routes: []string{"192.168.0.0/16"}}, conflict: true},
+		{name: "route over the address", node: Node{Name: "b", PublicKey: other, Address: "10.99.0.2", Subnet: "10.99.0.0/16", Routes: []string{"10.99.0.0/24"}}, conflict: true},
+		{name: "other mesh", node: Node{Name: "b", PublicKey: other, Address: "10.98.0.2", Subnet: "10.98.0.0/16"}, conflict: true},
+		{name: "bad route", node: Node{Name: "b", PublicKey: other, Address: "10.99.0.2", Subnet: "10.99.0.0/16", Routes: []string{"192.168.2.0"}}, invalid: true},
+		{name: "bad address", node: Node{Name: "b", PublicKey: other, Address: "fd00::1", Subnet: "10.99.0.0/16"}, invalid: true},
+	}
+	for _, tt := range tests {
+		for _, err := range []error{a.Conflicts(tt.node), tt.node.Conflicts(a)} {
+			if got := errors.Is(err, ErrConflict); got != tt.conflict || (err != nil) != (tt.conflict || tt.invalid) {
+				t.Errorf("%s: Conflicts() = %v, want conflict %v", tt.name, err, tt.conflict)
+			}
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	key := newPublicKey(t)
+	tests := []struct {
+		name  string
+		node  Node
+		valid bool
+	}{
+		{name: "valid", node: Node{PublicKey: key, Address: "10.99.0.1", Subnet: "10.99.0.0/16", Endpoint: "192.0.2.1:51820"}, valid: true},
+		{name: "relay", node: Node{PublicKey: key, Address: "10.99.0.1", Subnet: "10.99.0.0/16", Endpoint: "192.0.2.1:51820", Relay: true}, valid: true},
+		{name: "no endpoint", node: Node{PublicKey: key, Address: "10.99.0.1", Subnet: "10.99.0.0/16"}, valid: true},
+		{name: "relay without endpoint", node: Node{PublicKey: key, Address: "10.99.0.1", Subnet: "10.99.0.0/16", Relay: true}},
+		{name: "bad key", node: Node{PublicKey: "key", Address: "10.99.0.1", Subnet: "10.99.0.0/16"}},
+		{name: "bad endpoint", node: Node{PublicKey: key, Address: "10.99.0.1", Subnet: "10.99.0.0/16", Endpoint: "192.0.2.1"}},
+		{name: "address outside the subnet", node: Node{PublicKey: key, Address: "10.98.0.1", Subnet: "10.99.0.0/16"}},
+		{name: "no subnet", node: Node{PublicKey: key, Address: "10.99.0.1"}},
+		{name: "subnet with host bits", node: Node{PublicKey: key, Address: "10.99.0.1", Subnet: "10.99.0.1/16"}},
+		{name: "bad address", node: Node{PublicKey: key, Address: "10.99.0", Subnet: "10.99.0.0/16"}},
+		{name: "bad route", node: Node{PublicKey: key, Address: "10.99.0.1", Subnet: "10.99.0.0/16", Routes: []string{"192.168.1.0"}}},
+	}
+	for _, tt := range tests {
+		if err := tt.node.Check(); (err == nil) != tt.valid {
+			t.Errorf("%s: Check() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"vpc/pkg/control"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	controlSessionsDesc = newDesc("control_plane", "sessions", "Open sessions of the control plane, agents and operators.")
+	controlAgentsDesc   = newDesc("control_plane", "agents", "Agents registered with a live session.")
+)
+
+// ControlCollector reports the sessions of the control plane.
+type ControlCollector struct {
+	Server *control.Server
+}
+
+func NewControlCollector(server *control.Server) *ControlCollector {
+	return &ControlCollector{Server: server}
+}
+
+func (c *ControlCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- controlSessionsDesc
+	ch <- controlAgentsDesc
+}
+
+func (c *ControlCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(controlSessionsDesc, prometheus.GaugeValue, float64(c.Server.Sessions()))
+	ch <- prometheus.MustNewConstMetric(controlAgentsDesc, prometheus.GaugeValue, float64(len(c.Server.Agents())))
+}
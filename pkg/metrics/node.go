@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"net"
+	"time"
+	"vpc/pkg/broker"
+	"vpc/pkg/control"
+	"vpc/pkg/wireguard"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	ifaceReceiveDesc  = newDesc("wireguard", "receive_bytes", "Bytes received from the current peers of the interface, it drops when a peer is removed.", "iface")
+	ifaceTransmitDesc = newDesc("wireguard", "transmit_bytes", "Bytes sent to the current peers of the interface, it drops when a peer is removed.", "iface")
+	ifacePeersDesc    = newDesc("wireguard", "peers", "Peers configured on the interface.", "iface")
+	ifaceLiveDesc     = newDesc("wireguard", "peers_live", "Peers with a handshake in the last 180 seconds.", "iface")
+	ifaceAddressDesc  = newDesc("wireguard", "peer_address_utilization", "Share of the peer addresses of the interface in use.", "iface")
+	firewallDesc      = newDesc("wireguard", "firewall_errors_total", "Failures to restore the NAT rules of the interface.", "iface")
+
+	peerReceiveDesc   = newDesc("wireguard", "peer_receive_bytes_total", "Bytes received from the peer.", "iface", "public_key")
+	peerTransmitDesc  = newDesc("wireguard", "peer_transmit_bytes_total", "Bytes sent to the peer.", "iface", "public_key")
+	peerHandshakeDesc = newDesc("wireguard", "peer_last_handshake_age_seconds", "Time since the last handshake of the peer, absent before the first one.", "iface", "public_key")
+
+	poolSubnetsDesc = newDesc("address_pool", "subnets", "Interface subnets the address pool can hold.", "pool")
+	poolUsedDesc    = newDesc("address_pool", "subnets_used", "Interface subnets taken from the address pool.", "pool")
+
+	relaySessionsDesc      = newDesc("relay", "sessions", "Open client sessions of the relay.", "relay", "transport")
+	relaySessionsTotalDesc = newDesc("relay", "sessions_total", "Client sessions opened by the relay.", "relay", "transport")
+	relayPacketsDesc       = newDesc("relay", "packets_total", "Packets forwarded by the relay.", "relay", "transport")
+	relayBytesDesc         = newDesc("relay", "bytes_total", "Bytes forwarded by the relay.", "relay", "transport")
+	relayDeniedDesc        = newDesc("relay", "denied_total", "Packets refused by the ACL or the session limits of the relay.", "relay", "transport")
+	relayDroppedDesc       = newDesc("relay", "dropped_total", "Packets the relay could not forward.", "relay", "transport")
+
+	reconcileDesc = newDesc("reconcile", "errors_total", "Failed reconcile passes.", "target")
+
+	agentConnectedDesc = newDesc("agent", "control_plane_connected", "Whether the agent is registered with the control plane.")
+	agentSessionsDesc  = newDesc("agent", "sessions", "Open sessions of the agent, local commands and control plane.")
+)
+
+// NodeCollector reports the interfaces, peers, address pools and relays
+// managed by the broker.
+type NodeCollector struct {
+	Logger *zap.Logger
+	// PerPeer adds the series of every peer, labelled by public key.
+	PerPeer bool
+	// Agent adds the control plane connection, it may be nil.
+	Agent *control.Agent
+}
+
+func NewNodeCollector(logger *zap.Logger, perPeer bool, agent *control.Agent) *NodeCollector {
+	return &NodeCollector{Logger: logger, PerPeer: perPeer, Agent: agent}
+}
+
+func (c *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		ifaceReceiveDesc, ifaceTransmitDesc, ifacePeersDesc, ifaceLiveDesc, ifaceAddressDesc, firewallDesc,
+		poolSubnetsDesc, poolUsedDesc,
+		relaySessionsDesc, relaySessionsTotalDesc, relayPacketsDesc, relayBytesDesc, relayDeniedDesc, relayDroppedDesc,
+		reconcileDesc,
+	} {
+		ch <- desc
+	}
+	if c.PerPeer {
+		ch <- peerReceiveDesc
+		ch <- peerTransmitDesc
+		ch <- peerHandshakeDesc
+	}
+	if c.Agent != nil {
+		ch <- agentConnectedDesc
+		ch <- agentSessionsDesc
+	}
+}
+
+func (c *NodeCollector) Collect(ch chan<- prometheus.Metric) {
+	wgs := broker.Wireguards()
+	for _, wg := range wgs {
+		c.collectWireguard(ch, wg)
+	}
+	collectPools(ch, wgs)
+	collectRelays(ch)
+	for target, n := range broker.Controller.Errors() {
+		ch <- prometheus.MustNewConstMetric(reconcileDesc, prometheus.CounterValue, float64(n), target)
+	}
+	if c.Agent != nil {
+		ch <- prometheus.MustNewConstMetric(agentConnectedDesc, prometheus.GaugeValue, boolValue(c.Agent.Connected()))
+		ch <- prometheus.MustNewConstMetric(agentSessionsDesc, prometheus.GaugeValue, float64(c.Agent.Sessions()))
+	}
+}
+
+func (c *NodeCollector) collectWireguard(ch chan<- prometheus.Metric, wg *wireguard.Wireguard) {
+	ch <- prometheus.MustNewConstMetric(firewallDesc, prometheus.CounterValue, float64(wg.FirewallErrors()), wg.Iface)
+	dev, err := wg.Client.Device(wg.Iface)
+	if err != nil {
+		c.Logger.Debug("failed to read device", zap.String("iface", wg.Iface), zap.Error(err))
+		return
+	}
+	c.collectDevice(ch, wg.Iface, dev, time.Now())
+}
+
+// collectDevice reports the peers of the device. The interface byte counts
+// are sums over the current peers, so they are gauges: a removed peer takes
+// its bytes with it.
+func (c *NodeCollector) collectDevice(ch chan<- prometheus.Metric, iface string, dev *wgtypes.Device, now time.Time) {
+	var rx, tx int64
+	live := 0
+	for _, peer := range dev.Peers {
+		rx += peer.ReceiveBytes
+		tx += peer.TransmitBytes
+		handshake := !peer.LastHandshakeTime.IsZero()
+		if handshake && now.Sub(peer.LastHandshakeTime) < wireguard.HandshakeTimeout {
+			live++
+		}
+		if !c.PerPeer {
+			continue
+		}
+		key := peer.PublicKey.String()
+		ch <- prometheus.MustNewConstMetric(peerReceiveDesc, prometheus.CounterValue, float64(peer.ReceiveBytes), iface, key)
+		ch <- prometheus.MustNewConstMetric(peerTransmitDesc, prometheus.CounterValue, float64(peer.TransmitBytes), iface, key)
+		if handshake {
+			ch <- prometheus.MustNewConstMetric(peerHandshakeDesc, prometheus.GaugeValue, now.Sub(peer.LastHandshakeTime).Seconds(), iface, key)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(ifaceReceiveDesc, prometheus.GaugeValue, float64(rx), iface)
+	ch <- prometheus.MustNewConstMetric(ifaceTransmitDesc, prometheus.GaugeValue, float64(tx), iface)
+	ch <- prometheus.MustNewConstMetric(ifacePeersDesc, prometheus.GaugeValue, float64(len(dev.Peers)), iface)
+	ch <- prometheus.MustNewConstMetric(ifaceLiveDesc, prometheus.GaugeValue, float64(live), iface)
+	ch <- prometheus.MustNewConstMetric(ifaceAddressDesc, prometheus.GaugeValue, float64(len(dev.Peers))/wireguard.MaxPeers, iface)
+}
+
+// collectPools reports how many of the /24 interface subnets of every
+// address pool are taken.
+func collectPools(ch chan<- prometheus.Metric, wgs []*wireguard.Wireguard) {
+	for _, pool := range broker.Current().AddressPools {
+		_, ipnet, err := net.ParseCIDR(pool)
+		if err != nil {
+			continue
+		}
+		subnets := 1
+		if ones, _ := ipnet.Mask.Size(); ones < 24 {
+			subnets = 1 << (24 - ones)
+		}
+		used := 0
+		for _, wg := range wgs {
+			if ipnet.Contains(wg.IP) {
+				used++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(poolSubnetsDesc, prometheus.GaugeValue, float64(subnets), pool)
+		ch <- prometheus.MustNewConstMetric(poolUsedDesc, prometheus.GaugeValue, float64(used), pool)
+	}
+}
+
+// collectRelays reports every relay of broker.Relays: declared, opened at
+// runtime and created by the proxy helpers, on either backend.
+func collectRelays(ch chan<- prometheus.Metric) {
+	for _, r := range broker.Relays() {
+		transport := r.Config.Transport
+		if transport == "" {
+			transport = "udp"
+		}
+		labels := []string{r.Config.Name, transport}
+		ch <- prometheus.MustNewConstMetric(relaySessionsDesc, prometheus.GaugeValue, float64(r.Sessions), labels...)
+		ch <- prometheus.MustNewConstMetric(relaySessionsTotalDesc, prometheus.CounterValue, float64(r.Stats.Sessions), labels...)
+		ch <- prometheus.MustNewConstMetric(relayPacketsDesc, prometheus.CounterValue, float64(r.Stats.Packets), labels...)
+		ch <- prometheus.MustNewConstMetric(relayBytesDesc, prometheus.CounterValue, float64(r.Stats.Bytes), labels...)
+		ch <- prometheus.MustNewConstMetric(relayDeniedDesc, prometheus.CounterValue, float64(r.Stats.Denied), labels...)
+		ch <- prometheus.MustNewConstMetric(relayDroppedDesc, prometheus.CounterValue, float64(r.Stats.Dropped), labels...)
+	}
+}
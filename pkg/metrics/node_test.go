@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// collectValues runs collectDevice and returns the interface series by
+// descriptor.
+func collectValues(t *testing.T, dev *wgtypes.Device, now time.Time) map[*prometheus.Desc]*dto.Metric {
+	t.Helper()
+	c := NewNodeCollector(zap.NewNop(), false, nil)
+	ch := make(chan prometheus.Metric, 16)
+	c.collectDevice(ch, "wg0", dev, now)
+	close(ch)
+	values := make(map[*prometheus.Desc]*dto.Metric)
+	for m := range ch {
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		values[m.Desc()] = &out
+	}
+	return values
+}
+
+func TestCollectDeviceBytes(t *testing.T) {
+	now := time.Now()
+	peer := func(rx, tx int64, handshake time.Time) wgtypes.Peer {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wgtypes.Peer{PublicKey: key.PublicKey(), ReceiveBytes: rx, TransmitBytes: tx, LastHandshakeTime: handshake}
+	}
+	a, b := peer(100, 10, now), peer(50, 5, now.Add(-time.Hour))
+
+	tests := []struct {
+		name   string
+		peers  []wgtypes.Peer
+		rx, tx float64
+		live   float64
+	}{
+		{name: "two peers", peers: []wgtypes.Peer{a, b}, rx: 150, tx: 15, live: 1},
+		{name: "peer removed", peers: []wgtypes.Peer{a}, rx: 100, tx: 10, live: 1},
+		{name: "no peers", rx: 0, tx: 0, live: 0},
+	}
+	for _, tt := range tests {
+		values := collectValues(t, &wgtypes.Device{Peers: tt.peers}, now)
+		for desc, want := range map[*prometheus.Desc]float64{
+			ifaceReceiveDesc:  tt.rx,
+			ifaceTransmitDesc: tt.tx,
+			ifaceLiveDesc:     tt.live,
+		} {
+			m := values[desc]
+			if m == nil || m.Gauge == nil {
+				t.Errorf("%s: %v is not a gauge: %v", tt.name, desc, m)
+				continue
+			}
+			if got := m.Gauge.GetValue(); got != want {
+				t.Errorf("%s: %v = %v, want %v", tt.name, desc, got, want)
+			}
+		}
+	}
+}
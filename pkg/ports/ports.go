@@ -0,0 +1,283 @@
+package ports
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+	"vpc/pkg/state"
+	"vpc/pkg/utils"
+)
+
+// Services that get ports from the allocator.
+const (
+	ServiceWireguard = "wireguard"
+	ServiceRelay     = "relay"
+)
+
+var (
+	errNoRange     = errors.New("no port range configured for service")
+	errNoFreePort  = errors.New("no free port in range")
+	errPortInUse   = errors.New("port is in use")
+	errPortTaken   = errors.New("port is assigned to another name")
+	ErrNameInUse   = errors.New("name already holds a port")
+	errBadProtocol = errors.New("protocol must be udp or tcp")
+	seededRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Range is an inclusive port range.
+type Range struct {
+	Min int
+	Max int
+}
+
+func (r Range) size() int {
+	return r.Max - r.Min + 1
+}
+
+// Lease is a port bound at allocation time, so nothing else can take it
+// between the allocation and its use.
+type Lease struct {
+	Name     string
+	Service  string
+	Protocol string
+	Port     int
+	UDP      *net.UDPConn
+	TCP      net.Listener
+}
+
+// Unbind closes the socket held by the lease, for consumers such as the
+// Wireguard device that bind the port themselves. The port stays allocated.
+func (l *Lease) Unbind() {
+	if l.UDP != nil {
+		l.UDP.Close()
+		l.UDP = nil
+	}
+	if l.TCP != nil {
+		l.TCP.Close()
+		l.TCP = nil
+	}
+}
+
+// Allocator hands out ports from per service ranges and remembers which name
+// got which port, so a restored interface or relay gets its port back.
+type Allocator struct {
+	lock     sync.Mutex
+	ranges   map[string][]Range
+	reserved map[int]bool
+	inUse    map[string]*Lease
+	store    *state.Store
+}
+
+// NewAllocator returns an allocator with the default ranges. store may be
+// nil, assignments are then forgotten on restart.
+func NewAllocator(store *state.Store) *Allocator {
+	if store == nil {
+		store, _ = state.Open("")
+	}
+	return &Allocator{
+		ranges: map[string][]Range{
+			ServiceWireguard: {{Min: 51820, Max: 52819}},
+			ServiceRelay:     {{Min: 40000, Max: 40999}},
+		},
+		reserved: map[int]bool{},
+		inUse:    map[string]*Lease{},
+		store:    store,
+	}
+}
+
+// SetRanges replaces the ranges of a service.
+func (a *Allocator) SetRanges(service string, ranges ...Range) {
+	a.lock.Lock()
+	a.ranges[service] = ranges
+	a.lock.Unlock()
+}
+
+// SetReserved replaces the ports that are only allocated when asked for
+// explicitly.
+func (a *Allocator) SetReserved(ports ...int) {
+	a.lock.Lock()
+	a.reserved = make(map[int]bool, len(ports))
+	for _, port := range ports {
+		a.reserved[port] = true
+	}
+	a.lock.Unlock()
+}
+
+func (a *Allocator) portInUseLocked(port int, protocol string) bool {
+	for _, lease := range a.inUse {
+		if lease.Port == port && lease.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// assignedLocked returns the stored ports of protocol assigned to other
+// names than name, and the assignment of name.
+func (a *Allocator) assignedLocked(protocol string, name string) (map[int]bool, state.PortAssignment) {
+	var previous state.PortAssignment
+	var assigned map[int]bool
+	a.store.View(func(d *state.Data) {
+		previous = d.Ports[name]
+		assigned = make(map[int]bool, len(d.Ports))
+		for n, p := range d.Ports {
+			if n != name && p.Protocol == protocol {
+				assigned[p.Port] = true
+			}
+		}
+	})
+	return assigned, previous
+}
+
+// bind binds port with opts, so the socket a consumer takes over from the
+// lease has the options it would have set itself. opts may be nil.
+func bind(protocol string, port int, opts *utils.SocketOptions) (*Lease, error) {
+	switch protocol {
+	case "udp":
+		conn, err := opts.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			return nil, err
+		}
+		return &Lease{Protocol: protocol, Port: port, UDP: conn}, nil
+	case "tcp":
+		ln, err := opts.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return nil, err
+		}
+		return &Lease{Protocol: protocol, Port: port, TCP: ln}, nil
+	}
+	return nil, errBadProtocol
+}
+
+// Allocate binds a port for name with opts. An explicit port is used unless
+// it is held or assigned to another name, otherwise the port name had before is preferred and then a free one from
+// the service ranges.
+func (a *Allocator) Allocate(service string, protocol string, name string, port int, opts *utils.SocketOptions) (*Lease, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, found := a.inUse[name]; found {
+		return nil, ErrNameInUse
+	}
+
+	var lease *Lease
+	var err error
+	if port != 0 {
+		if a.portInUseLocked(port, protocol) {
+			return nil, errPortInUse
+		}
+		if assigned, _ := a.assignedLocked(protocol, name); assigned[port] {
+			return nil, errPortTaken
+		}
+		lease, err = bind(protocol, port, opts)
+	} else {
+		lease, err = a.allocateLocked(service, protocol, name, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lease.Name = name
+	lease.Service = service
+	a.inUse[name] = lease
+
+	err = a.store.Update(func(d *state.Data) error {
+		d.Ports[name] = state.PortAssignment{Service: service, Protocol: protocol, Port: lease.Port}
+		return nil
+	})
+	if err != nil {
+		lease.Unbind()
+		delete(a.inUse, name)
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Claim records port as allocated to name without binding it, for ports
+// already owned by something that outlived the daemon, such as a kernel
+// Wireguard device.
+func (a *Allocator) Claim(service string, protocol string, name string, port int) (*Lease, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, found := a.inUse[name]; found {
+		return nil, ErrNameInUse
+	}
+	if a.portInUseLocked(port, protocol) {
+		return nil, errPortInUse
+	}
+	lease := &Lease{Name: name, Service: service, Protocol: protocol, Port: port}
+	a.inUse[name] = lease
+	return lease, nil
+}
+
+func (a *Allocator) allocateLocked(service string, protocol string, name string, opts *utils.SocketOptions) (*Lease, error) {
+	assigned, previous := a.assignedLocked(protocol, name)
+	if previous.Port != 0 && previous.Protocol == protocol && !a.portInUseLocked(previous.Port, protocol) {
+		if lease, err := bind(protocol, previous.Port, opts); err == nil {
+			return lease, nil
+		}
+	}
+
+	ranges, found := a.ranges[service]
+	if !found || len(ranges) == 0 {
+		return nil, errNoRange
+	}
+	total := 0
+	for _, r := range ranges {
+		total += r.size()
+	}
+	// start at a random offset so restarts do not all probe the same ports
+	offset := seededRand.Intn(total)
+	for i := 0; i < total; i++ {
+		port := portAt(ranges, (offset+i)%total)
+		if a.reserved[port] || assigned[port] || a.portInUseLocked(port, protocol) {
+			continue
+		}
+		if lease, err := bind(protocol, port, opts); err == nil {
+			return lease, nil
+		}
+	}
+	return nil, errNoFreePort
+}
+
+func portAt(ranges []Range, n int) int {
+	for _, r := range ranges {
+		if n < r.size() {
+			return r.Min + n
+		}
+		n -= r.size()
+	}
+	return 0
+}
+
+// Release frees the port held by name but keeps the assignment, so the
+// next allocation for name gets the same port.
+func (a *Allocator) Release(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if lease, found := a.inUse[name]; found {
+		lease.Unbind()
+		delete(a.inUse, name)
+	}
+}
+
+// Forget releases name and drops its assignment.
+func (a *Allocator) Forget(name string) error {
+	a.Release(name)
+	return a.store.Update(func(d *state.Data) error {
+		delete(d.Ports, name)
+		return nil
+	})
+}
+
+// InUse returns the ports currently allocated by name.
+func (a *Allocator) InUse() map[string]int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ports := make(map[string]int, len(a.inUse))
+	for name, lease := range a.inUse {
+		ports[name] = lease.Port
+	}
+	return ports
+}
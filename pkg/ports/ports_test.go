@@ -0,0 +1,162 @@
+package ports
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"vpc/pkg/state"
+)
+
+// freePort returns a port nothing listens on right now, for UDP and TCP.
+func freePort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+		if ln, err := net.Listen("tcp", ":"+strconv.Itoa(port)); err == nil {
+			ln.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+func openStore(t *testing.T, path string) *state.Store {
+	t.Helper()
+	store, err := state.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestAllocate(t *testing.T) {
+	first, second := freePort(t), freePort(t)
+	a := NewAllocator(openStore(t, ""))
+	a.SetRanges(ServiceRelay, Range{Min: first, Max: first})
+	defer a.Release("a")
+	defer a.Release("b")
+
+	steps := []struct {
+		name     string
+		protocol string
+		alloc    string
+		port     int
+		wantPort int
+		wantErr  error
+	}{
+		{name: "from the range", protocol: "udp", alloc: "a", wantPort: first},
+		{name: "range exhausted", protocol: "udp", alloc: "b", wantErr: errNoFreePort},
+		{name: "name twice", protocol: "udp", alloc: "a", wantErr: ErrNameInUse},
+		{name: "explicit port held", protocol: "udp", alloc: "b", port: first, wantErr: errPortInUse},
+		{name: "other protocol", protocol: "tcp", alloc: "b", port: first, wantPort: first},
+		{name: "explicit port", protocol: "udp", alloc: "c", port: second, wantPort: second},
+		{name: "bad protocol", protocol: "sctp", alloc: "d", port: freePort(t), wantErr: errBadProtocol},
+	}
+	for _, step := range steps {
+		lease, err := a.Allocate(ServiceRelay, step.protocol, step.alloc, step.port, nil)
+		if err != step.wantErr {
+			t.Fatalf("%s: Allocate() error = %v, want %v", step.name, err, step.wantErr)
+		}
+		if err == nil && lease.Port != step.wantPort {
+			t.Fatalf("%s: Allocate() port = %d, want %d", step.name, lease.Port, step.wantPort)
+		}
+	}
+	a.Release("c")
+}
+
+func TestAllocateAssigned(t *testing.T) {
+	first, second := freePort(t), freePort(t)
+	a := NewAllocator(openStore(t, ""))
+	a.SetRanges(ServiceRelay, Range{Min: first, Max: first})
+	if _, err := a.Allocate(ServiceRelay, "udp", "a", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Release("a")
+
+	// the port stays assigned to a after the release
+	if _, err := a.Allocate(ServiceRelay, "udp", "b", first, nil); err != errPortTaken {
+		t.Errorf("explicit port assigned to a: error = %v, want %v", err, errPortTaken)
+	}
+	if _, err := a.Allocate(ServiceRelay, "udp", "b", 0, nil); err != errNoFreePort {
+		t.Errorf("range port assigned to a: error = %v, want %v", err, errNoFreePort)
+	}
+	// a gets its port back even outside the new range
+	a.SetRanges(ServiceRelay, Range{Min: second, Max: second})
+	lease, err := a.Allocate(ServiceRelay, "udp", "a", 0, nil)
+	if err != nil || lease.Port != first {
+		t.Fatalf("Allocate() = %v, %v, want port %d", lease, err, first)
+	}
+
+	if err := a.Forget("a"); err != nil {
+		t.Fatal(err)
+	}
+	lease, err = a.Allocate(ServiceRelay, "udp", "b", first, nil)
+	if err != nil {
+		t.Fatalf("explicit port after Forget: error = %v", err)
+	}
+	a.Release("b")
+}
+
+func TestClaim(t *testing.T) {
+	port := freePort(t)
+	a := NewAllocator(nil)
+	lease, err := a.Claim(ServiceWireguard, "udp", "wg0", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.UDP != nil {
+		t.Error("Claim() bound the port")
+	}
+	if _, err := a.Claim(ServiceWireguard, "udp", "wg0", port+1); err != ErrNameInUse {
+		t.Errorf("Claim() same name: error = %v, want %v", err, ErrNameInUse)
+	}
+	if _, err := a.Claim(ServiceWireguard, "udp", "wg1", port); err != errPortInUse {
+		t.Errorf("Claim() same port: error = %v, want %v", err, errPortInUse)
+	}
+	if _, err := a.Allocate(ServiceWireguard, "udp", "wg1", port, nil); err != errPortInUse {
+		t.Errorf("Allocate() claimed port: error = %v, want %v", err, errPortInUse)
+	}
+	if got := a.InUse(); got["wg0"] != port || len(got) != 1 {
+		t.Errorf("InUse() = %v", got)
+	}
+}
+
+func TestAllocatePersisted(t *testing.T) {
+	first, second := freePort(t), freePort(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+	a := NewAllocator(openStore(t, path))
+	a.SetRanges(ServiceRelay, Range{Min: first, Max: first})
+	if _, err := a.Allocate(ServiceRelay, "udp", "a", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Allocate(ServiceRelay, "udp", "gone", second, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Release("a")
+	if err := a.Forget("gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted daemon hands the same port to the same name
+	store := openStore(t, path)
+	store.View(func(d *state.Data) {
+		if _, found := d.Ports["gone"]; found || d.Ports["a"].Port != first {
+			t.Errorf("stored ports = %v", d.Ports)
+		}
+	})
+	b := NewAllocator(store)
+	b.SetRanges(ServiceRelay, Range{Min: second, Max: second})
+	lease, err := b.Allocate(ServiceRelay, "udp", "a", 0, nil)
+	if err != nil || lease.Port != first {
+		t.Fatalf("Allocate() after restart = %v, %v, want port %d", lease, err, first)
+	}
+	b.Release("a")
+}
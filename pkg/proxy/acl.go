@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	errTooManySessions      = errors.New("too many sessions")
+	errTooManySessionsForIP = errors.New("too many sessions for source")
+	errSessionRateExceeded  = errors.New("new session rate exceeded")
+)
+
+// ACL decides which sources may use a proxy and how many sessions they may
+// open. Every setting can be changed while the proxy is running. A zero
+// limit means unlimited and an empty allow list allows every source that is
+// not denied.
+type ACL struct {
+	lock             sync.RWMutex
+	allow            []*net.IPNet
+	deny             []*net.IPNet
+	maxSessions      int
+	maxSessionsPerIP int
+	limiter          *rate.Limiter
+}
+
+func NewACL() *ACL {
+	return &ACL{}
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// SetAllow replaces the allow list. Bare addresses are treated as host routes.
+func (a *ACL) SetAllow(cidrs []string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	a.allow = nets
+	a.lock.Unlock()
+	return nil
+}
+
+// SetDeny replaces the deny list. Deny entries win over allow entries.
+func (a *ACL) SetDeny(cidrs []string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	a.deny = nets
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *ACL) SetMaxSessions(n int) {
+	a.lock.Lock()
+	a.maxSessions = n
+	a.lock.Unlock()
+}
+
+func (a *ACL) SetMaxSessionsPerIP(n int) {
+	a.lock.Lock()
+	a.maxSessionsPerIP = n
+	a.lock.Unlock()
+}
+
+// SetNewSessionRate limits how many sessions may be opened per second across
+// all sources. A zero rate removes the limit.
+func (a *ACL) SetNewSessionRate(perSecond float64, burst int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if perSecond <= 0 {
+		a.limiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if a.limiter == nil {
+		a.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+		return
+	}
+	a.limiter.SetLimit(rate.Limit(perSecond))
+	a.limiter.SetBurst(burst)
+}
+
+// Permit reports whether packets from ip are accepted at all.
+func (a *ACL) Permit(ip net.IP) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit checks the session limits before a new session is opened for a
+// source that already holds perIP of the total sessions.
+func (a *ACL) admit(total int, perIP int) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.maxSessions > 0 && total >= a.maxSessions {
+		return errTooManySessions
+	}
+	if a.maxSessionsPerIP > 0 && perIP >= a.maxSessionsPerIP {
+		return errTooManySessionsForIP
+	}
+	if a.limiter != nil && !a.limiter.Allow() {
+		return errSessionRateExceeded
+	}
+	return nil
+}
+
+// admitRoam checks the per source limit before a session roams to a source
+// that already holds perIP sessions. The session exists already, so the
+// total and the new session rate do not apply.
+func (a *ACL) admitRoam(perIP int) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.maxSessionsPerIP > 0 && perIP >= a.maxSessionsPerIP {
+		return errTooManySessionsForIP
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACLPermit(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{name: "no lists", ip: "1.2.3.4", want: true},
+		{name: "allowed network", allow: []string{"10.0.0.0/8"}, ip: "10.1.2.3", want: true},
+		{name: "outside the allow list", allow: []string{"10.0.0.0/8"}, ip: "11.0.0.1", want: false},
+		{name: "bare allowed address", allow: []string{"1.2.3.4"}, ip: "1.2.3.4", want: true},
+		{name: "bare address is a host route", allow: []string{"1.2.3.4"}, ip: "1.2.3.5", want: false},
+		{name: "denied", deny: []string{"1.2.3.0/24"}, ip: "1.2.3.4", want: false},
+		{name: "not denied", deny: []string{"1.2.3.0/24"}, ip: "1.2.4.1", want: true},
+		{name: "deny wins over allow", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, ip: "10.1.2.3", want: false},
+		{name: "allowed next to a denied network", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, ip: "10.2.0.1", want: true},
+		{name: "bare IPv6 address", allow: []string{"2001:db8::1"}, ip: "2001:db8::1", want: true},
+		{name: "IPv6 outside the allow list", allow: []string{"2001:db8::/32"}, ip: "2001:db9::1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := NewACL()
+			if err := acl.SetAllow(tt.allow); err != nil {
+				t.Fatalf("SetAllow() error = %v", err)
+			}
+			if err := acl.SetDeny(tt.deny); err != nil {
+				t.Fatalf("SetDeny() error = %v", err)
+			}
+			if got := acl.Permit(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Permit(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLInvalidCIDR(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/33", "not an address", "1.2.3.4/x"} {
+		if err := NewACL().SetAllow([]string{cidr}); err == nil {
+			t.Errorf("SetAllow(%q) succeeded", cidr)
+		}
+	}
+}
+
+func TestACLAdmit(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxSessions int
+		maxPerIP    int
+		total       int
+		perIP       int
+		want        error
+	}{
+		{name: "unlimited", total: 1000, perIP: 1000},
+		{name: "below the limits", maxSessions: 10, maxPerIP: 2, total: 9, perIP: 1},
+		{name: "total reached", maxSessions: 10, total: 10, want: errTooManySessions},
+		{name: "per source reached", maxPerIP: 2, total: 2, perIP: 2, want: errTooManySessionsForIP},
+		{name: "total checked first", maxSessions: 1, maxPerIP: 1, total: 1, perIP: 1, want: errTooManySessions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := NewACL()
+			acl.SetMaxSessions(tt.maxSessions)
+			acl.SetMaxSessionsPerIP(tt.maxPerIP)
+			if got := acl.admit(tt.total, tt.perIP); got != tt.want {
+				t.Errorf("admit(%d, %d) = %v, want %v", tt.total, tt.perIP, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLNewSessionRate(t *testing.T) {
+	acl := NewACL()
+	acl.SetNewSessionRate(0.001, 2)
+	for i := 0; i < 2; i++ {
+		if err := acl.admit(0, 0); err != nil {
+			t.Fatalf("admit() within the burst = %v", err)
+		}
+	}
+	if err := acl.admit(0, 0); err != errSessionRateExceeded {
+		t.Errorf("admit() over the burst = %v, want %v", err, errSessionRateExceeded)
+	}
+	acl.SetNewSessionRate(0, 0)
+	if err := acl.admit(0, 0); err != nil {
+		t.Errorf("admit() without a rate = %v", err)
+	}
+}
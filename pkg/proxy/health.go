@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"vpc/pkg/events"
+)
+
+// upstreamHealth remembers whether the upstream of a relay resolved the
+// last time, so only changes are published.
+type upstreamHealth struct {
+	failing int32
+}
+
+func (h *upstreamHealth) report(bus *events.Bus, relay string, upstream string, err error) {
+	var failing int32
+	if err != nil {
+		failing = 1
+	}
+	if atomic.SwapInt32(&h.failing, failing) == failing {
+		return
+	}
+	ev := events.RelayEvent(events.UpstreamHealth, relay)
+	ev.Upstream = upstream
+	ev.Data = map[string]string{"healthy": strconv.FormatBool(err == nil)}
+	if err != nil {
+		ev.Data["error"] = err.Error()
+	}
+	bus.Publish(ev)
+}
+
+// relayName is the name events report for a relay without one.
+func relayName(name string, port int) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("port/%d", port)
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"vpc/pkg/events"
+)
+
+// Relay is implemented by every proxy backend.
+type Relay interface {
+	Start() error
+	Close()
+	Stats() Stats
+	Sessions() []SessionStats
+	ActiveSessions() int
+}
+
+// KernelProxy forwards a UDP port to a single upstream with nftables DNAT and
+// masquerading, so packets never reach user space. Session counters are read
+// back from conntrack, which needs net.netfilter.nf_conntrack_acct enabled.
+// Every read folds the sessions that expired since the previous one into
+// the totals, a session opened and expired between two reads is missed.
+type KernelProxy struct {
+	Logger *zap.Logger
+	// Name is the relay name events report, Events gets the upstream
+	// health events and may be nil.
+	Name            string
+	Events          *events.Bus
+	health          upstreamHealth
+	BindPort        int
+	BindAddress     string
+	UpstreamAddress string
+	UpstreamPort    int
+	ResolveTTL      time.Duration
+	upstream        *net.UDPAddr
+	lock            *sync.Mutex
+	closed          bool
+	// seen holds the last counters of the sessions found in conntrack,
+	// expired the totals of the ones gone since
+	seen    map[string]SessionStats
+	expired Stats
+	// listed is when conntrack was read last, sessions what it returned.
+	// Reads closer than conntrackInterval share the result.
+	listed    time.Time
+	sessions  []SessionStats
+	conntrack func() ([]byte, error)
+}
+
+// conntrackInterval is how often conntrack is read at most, a scrape calls
+// both Stats and ActiveSessions and the listing walks the whole table.
+const conntrackInterval = time.Second
+
+func NewKernelProxy(logger *zap.Logger, bindPort int, bindAddress string, upstreamAddress string, upstreamPort int, resolveTTL time.Duration) *KernelProxy {
+	k := &KernelProxy{
+		Logger:          logger,
+		BindPort:        bindPort,
+		BindAddress:     bindAddress,
+		UpstreamAddress: upstreamAddress,
+		UpstreamPort:    upstreamPort,
+		ResolveTTL:      resolveTTL,
+		lock:            new(sync.Mutex),
+		seen:            map[string]SessionStats{},
+	}
+	k.conntrack = k.listConntrack
+	return k
+}
+
+const kernelTablePrefix = "vpc_relay_"
+
+func (k *KernelProxy) table() string {
+	return fmt.Sprintf("%s%d", kernelTablePrefix, k.BindPort)
+}
+
+// KernelTables lists the nft tables of kernel relays, including the ones a
+// crashed daemon left behind.
+func KernelTables() ([]string, error) {
+	o, err := exec.Command("nft", "list", "tables").Output()
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for _, line := range strings.Split(string(o), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "table" && fields[1] == "ip" && strings.HasPrefix(fields[2], kernelTablePrefix) {
+			tables = append(tables, fields[2])
+		}
+	}
+	return tables, nil
+}
+
+// DeleteKernelTable removes a table listed by KernelTables, as Close does
+// for the table of a running relay.
+func DeleteKernelTable(table string) error {
+	if o, err := exec.Command("nft", "delete", "table", "ip", table).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(o)))
+	}
+	return nil
+}
+
+func (k *KernelProxy) ruleset() string {
+	match := fmt.Sprintf("udp dport %d", k.BindPort)
+	if ip := net.ParseIP(k.BindAddress); ip != nil && !ip.IsUnspecified() {
+		match = fmt.Sprintf("ip daddr %s %s", ip, match)
+	}
+	return fmt.Sprintf(`table ip %[1]s {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		%[2]s dnat to %[3]s:%[4]d
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip daddr %[3]s udp dport %[4]d ct status dnat masquerade
+	}
+}
+`, k.table(), match, k.upstream.IP, k.upstream.Port)
+}
+
+func (k *KernelProxy) apply() error {
+	script := fmt.Sprintf("add table ip %[1]s\ndelete table ip %[1]s\n%[2]s", k.table(), k.ruleset())
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if o, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %v: %s", err, bytes.TrimSpace(o))
+	}
+	return nil
+}
+
+func (k *KernelProxy) resolve() (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", k.UpstreamAddress, k.UpstreamPort))
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+func (k *KernelProxy) isClosed() bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.closed
+}
+
+func (k *KernelProxy) resolveUpstreamLoop() {
+	for !k.isClosed() {
+		time.Sleep(k.ResolveTTL)
+		upstreamAddr, err := k.resolve()
+		k.health.report(k.Events, relayName(k.Name, k.BindPort), fmt.Sprintf("%s:%d", k.UpstreamAddress, k.UpstreamPort), err)
+		if err != nil {
+			k.Logger.Error("resolve error", zap.Error(err))
+			continue
+		}
+		k.lock.Lock()
+		if !k.closed && k.upstream.String() != upstreamAddr.String() {
+			k.upstream = upstreamAddr
+			if err := k.apply(); err != nil {
+				k.Logger.Error("failed to update forwarding rules", zap.Error(err))
+			} else {
+				k.Logger.Info("upstream addr changed", zap.String("upstreamAddr", k.upstream.String()))
+			}
+		}
+		k.lock.Unlock()
+	}
+}
+
+func (k *KernelProxy) Start() error {
+	k.Logger.Info("starting kernel udp proxy")
+	var err error
+	k.upstream, err = k.resolve()
+	if err != nil {
+		k.Logger.Error("error resolving upstream address", zap.Error(err))
+		return err
+	}
+	if err := exec.Command("sysctl", "-qw", "net.ipv4.ip_forward=1", "net.netfilter.nf_conntrack_acct=1").Run(); err != nil {
+		k.Logger.Warn("failed to set sysctls", zap.Error(err))
+	}
+	if err := k.apply(); err != nil {
+		k.Logger.Error("error programming forwarding rules", zap.Error(err))
+		return err
+	}
+	k.Logger.Info("kernel udp proxy started", zap.String("table", k.table()))
+	if k.ResolveTTL.Nanoseconds() > 0 {
+		go k.resolveUpstreamLoop()
+	}
+	return nil
+}
+
+func (k *KernelProxy) Close() {
+	k.Logger.Warn("Closing kernel proxy")
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.closed = true
+	if err := DeleteKernelTable(k.table()); err != nil {
+		k.Logger.Error("failed to remove forwarding rules", zap.Error(err))
+	}
+}
+
+func (k *KernelProxy) listConntrack() ([]byte, error) {
+	return exec.Command("conntrack", "-L", "-p", "udp", "--orig-port-dst", strconv.Itoa(k.BindPort), "-o", "extended").Output()
+}
+
+// Sessions lists the conntrack entries of the relayed port. conntrack is
+// read at most once per conntrackInterval.
+func (k *KernelProxy) Sessions() []SessionStats {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if time.Since(k.listed) < conntrackInterval {
+		return append([]SessionStats(nil), k.sessions...)
+	}
+	o, err := k.conntrack()
+	if err != nil {
+		k.Logger.Error("failed to list conntrack entries", zap.Error(err))
+		return nil
+	}
+	k.listed = time.Now()
+	k.sessions = parseConntrack(o)
+	k.track(k.sessions)
+	return append([]SessionStats(nil), k.sessions...)
+}
+
+// track updates the totals with the sessions currently in conntrack, the
+// caller holds the lock.
+func (k *KernelProxy) track(sessions []SessionStats) {
+	current := make(map[string]SessionStats, len(sessions))
+	for _, s := range sessions {
+		if _, found := k.seen[s.Client]; !found {
+			k.expired.Sessions++
+		}
+		current[s.Client] = s
+	}
+	for client, s := range k.seen {
+		if _, found := current[client]; !found {
+			k.expired.Packets += s.Packets
+			k.expired.Bytes += s.Bytes
+		}
+	}
+	k.seen = current
+}
+
+// ActiveSessions returns the number of sessions in conntrack.
+func (k *KernelProxy) ActiveSessions() int {
+	return len(k.Sessions())
+}
+
+// Stats are the counters since the relay started, as Proxy.Stats. Sessions
+// counts the sessions ever seen in conntrack, the traffic of expired ones
+// is kept.
+func (k *KernelProxy) Stats() Stats {
+	sessions := k.Sessions()
+	k.lock.Lock()
+	stats := k.expired
+	k.lock.Unlock()
+	for _, s := range sessions {
+		stats.Packets += s.Packets
+		stats.Bytes += s.Bytes
+	}
+	return stats
+}
+
+// parseConntrack reads entries such as
+//
+//	ipv4 2 udp 17 29 src=1.2.3.4 dst=5.6.7.8 sport=1 dport=2 packets=3 bytes=300 src=... packets=2 bytes=200 ...
+//
+// where the first tuple is the client side and the second one the reply.
+func parseConntrack(o []byte) []SessionStats {
+	var sessions []SessionStats
+	scanner := bufio.NewScanner(bytes.NewReader(o))
+	for scanner.Scan() {
+		var s SessionStats
+		var src, sport, relay, relayPort string
+		tuple := 0
+		for _, field := range strings.Fields(scanner.Text()) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "src":
+				tuple++
+				if tuple == 1 {
+					src = kv[1]
+				}
+			case "dst":
+				if tuple == 2 {
+					relay = kv[1]
+				}
+			case "sport":
+				if tuple == 1 {
+					sport = kv[1]
+				}
+			case "dport":
+				if tuple == 2 {
+					relayPort = kv[1]
+				}
+			case "packets":
+				n, _ := strconv.ParseUint(kv[1], 10, 64)
+				s.Packets += n
+			case "bytes":
+				n, _ := strconv.ParseUint(kv[1], 10, 64)
+				s.Bytes += n
+			}
+		}
+		if src == "" {
+			continue
+		}
+		s.Client = net.JoinHostPort(src, sport)
+		s.Relay = net.JoinHostPort(relay, relayPort)
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
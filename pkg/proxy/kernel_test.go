@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseConntrack(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []SessionStats
+	}{
+		{
+			name:   "empty",
+			output: "",
+			want:   nil,
+		},
+		{
+			name:   "one session",
+			output: "ipv4 2 udp 17 29 src=1.2.3.4 dst=10.0.0.1 sport=5000 dport=51820 packets=3 bytes=300 src=10.8.0.2 dst=10.0.0.1 sport=51821 dport=40000 packets=2 bytes=200 mark=0 use=1\n",
+			want:   []SessionStats{{Client: "1.2.3.4:5000", Relay: "10.0.0.1:40000", Packets: 5, Bytes: 500}},
+		},
+		{
+			name: "two sessions",
+			output: "ipv4 2 udp 17 29 src=1.2.3.4 dst=10.0.0.1 sport=5000 dport=51820 packets=1 bytes=100 src=10.8.0.2 dst=10.0.0.1 sport=51821 dport=40000 packets=1 bytes=100\n" +
+				"ipv4 2 udp 17 12 src=5.6.7.8 dst=10.0.0.1 sport=6000 dport=51820 packets=4 bytes=400 [UNREPLIED] src=10.8.0.2 dst=10.0.0.1 sport=51821 dport=40001 packets=0 bytes=0\n",
+			want: []SessionStats{
+				{Client: "1.2.3.4:5000", Relay: "10.0.0.1:40000", Packets: 2, Bytes: 200},
+				{Client: "5.6.7.8:6000", Relay: "10.0.0.1:40001", Packets: 4, Bytes: 400},
+			},
+		},
+		{
+			name:   "without counters",
+			output: "ipv4 2 udp 17 29 src=1.2.3.4 dst=10.0.0.1 sport=5000 dport=51820 src=10.8.0.2 dst=10.0.0.1 sport=51821 dport=40000\n",
+			want:   []SessionStats{{Client: "1.2.3.4:5000", Relay: "10.0.0.1:40000"}},
+		},
+		{
+			name:   "not an entry",
+			output: "conntrack v1.4.6 (conntrack-tools): 1 flow entries have been shown.\n",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseConntrack([]byte(tt.output)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConntrack() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKernelProxyStats(t *testing.T) {
+	k := NewKernelProxy(zap.NewNop(), 51820, "", "", 0, 0)
+	reads := 0
+	outputs := []string{
+		"ipv4 2 udp 17 29 src=1.2.3.4 dst=10.0.0.1 sport=5000 dport=51820 packets=3 bytes=300 src=10.8.0.2 dst=10.0.0.1 sport=51821 dport=40000 packets=2 bytes=200\n",
+		"ipv4 2 udp 17 29 src=5.6.7.8 dst=10.0.0.1 sport=6000 dport=51820 packets=1 bytes=100 src=10.8.0.2 dst=10.0.0.1 sport=51821 dport=40001 packets=1 bytes=100\n",
+	}
+	k.conntrack = func() ([]byte, error) {
+		o := outputs[reads]
+		reads++
+		return []byte(o), nil
+	}
+
+	if got, want := k.Stats(), (Stats{Sessions: 1, Packets: 5, Bytes: 500}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	// a scrape right after reads the same listing
+	if got := k.ActiveSessions(); got != 1 || reads != 1 {
+		t.Errorf("ActiveSessions() = %d after %d reads, want 1 after 1", got, reads)
+	}
+
+	// the first session expired, its traffic stays in the totals
+	k.lock.Lock()
+	k.listed = time.Time{}
+	k.lock.Unlock()
+	if got, want := k.Stats(), (Stats{Sessions: 2, Packets: 7, Bytes: 700}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if reads != 2 {
+		t.Errorf("conntrack read %d times, want 2", reads)
+	}
+}
@@ -1,17 +1,40 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
+	"vpc/pkg/events"
+	"vpc/pkg/utils"
 )
 
 type connection struct {
 	udp          *net.UDPConn
+	stream       packetStream
+	client       *net.UDPAddr
+	clientIP     string
+	indexes      []uint32
+	packets      uint64
+	bytes        uint64
 	lastActivity time.Time
+	// roamTo is the source a transport message of the session came from
+	// lately, roaming is set once it sent the initiation with roamIndex
+	roamTo    *net.UDPAddr
+	roamIndex uint32
+	roaming   bool
+}
+
+func (c *connection) close() {
+	c.udp.Close()
+	if c.stream != nil {
+		c.stream.Close()
+	}
 }
 
 type packet struct {
@@ -20,20 +43,44 @@ type packet struct {
 }
 
 type Proxy struct {
-	Logger                 *zap.Logger
-	BindPort               int
-	BindAddress            string
-	UpstreamAddress        string
-	UpstreamPort           int
-	Debug                  bool
-	listenerConn           *net.UDPConn
-	client                 *net.UDPAddr
-	upstream               *net.UDPAddr
-	BufferSize             int
-	ConnTimeout            time.Duration
-	ResolveTTL             time.Duration
-	connsMap               map[string]connection
-	connectionsLock        *sync.RWMutex
+	Logger *zap.Logger
+	// Name is the relay name events report, Events gets the session and
+	// upstream health events and may be nil.
+	Name            string
+	Events          *events.Bus
+	health          upstreamHealth
+	BindPort        int
+	BindAddress     string
+	UpstreamAddress string
+	UpstreamPort    int
+	Debug           bool
+	WireguardAware  bool
+	mac1Key         [32]byte
+	Transport       Transport
+	TLSConfig       *tls.Config
+	WebSocketPath   string
+	SocketOptions   *utils.SocketOptions
+	listenerConn    *net.UDPConn
+	listenerConns   []*net.UDPConn
+	streamListener  net.Listener
+	httpServer      *http.Server
+	client          *net.UDPAddr
+	upstream        *net.UDPAddr
+	BufferSize      int
+	ConnTimeout     time.Duration
+	ResolveTTL      time.Duration
+	ACL             *ACL
+	OnSession       func(SessionEvent)
+	sessionEvents   chan SessionEvent
+	relayIP         net.IP
+	connsMap        map[string]*connection
+	sessionsPerIP   map[string]int
+	reserved        int
+	indexes         map[uint32]*connection
+	roams           map[string]*connection
+	connectionsLock *sync.RWMutex
+	counters        counters
+	// closed is guarded by connectionsLock
 	closed                 bool
 	clientMessageChannel   chan (packet)
 	upstreamMessageChannel chan (packet)
@@ -43,6 +90,7 @@ func NewProxy(debug bool, logger *zap.Logger, bindPort int, bindAddress string,
 	proxy := &Proxy{
 		Debug:                  debug,
 		Logger:                 logger,
+		Transport:              TransportUDP,
 		BindPort:               bindPort,
 		BindAddress:            bindAddress,
 		BufferSize:             bufferSize,
@@ -50,40 +98,117 @@ func NewProxy(debug bool, logger *zap.Logger, bindPort int, bindAddress string,
 		UpstreamAddress:        upstreamAddress,
 		UpstreamPort:           upstreamPort,
 		connectionsLock:        new(sync.RWMutex),
-		connsMap:               make(map[string]connection),
+		ACL:                    NewACL(),
+		connsMap:               make(map[string]*connection),
+		sessionsPerIP:          make(map[string]int),
+		indexes:                make(map[uint32]*connection),
+		roams:                  make(map[string]*connection),
 		closed:                 false,
 		ResolveTTL:             resolveTTL,
 		clientMessageChannel:   make(chan packet),
 		upstreamMessageChannel: make(chan packet),
+		sessionEvents:          make(chan SessionEvent, sessionEventBacklog),
 	}
 
 	return proxy
 }
 
+// storeSessionLocked and deleteSessionLocked must be called with
+// connectionsLock held. The source of a stored session was already counted
+// by reserveSession.
+func (p *Proxy) storeSessionLocked(clientAddrString string, conn *connection) {
+	p.connsMap[clientAddrString] = conn
+	atomic.AddUint64(&p.counters.sessions, 1)
+	p.notifyLocked(true, clientAddrString, conn)
+}
+
+func (p *Proxy) deleteSessionLocked(clientAddrString string) {
+	conn, found := p.connsMap[clientAddrString]
+	if !found {
+		return
+	}
+	delete(p.connsMap, clientAddrString)
+	if p.sessionsPerIP[conn.clientIP]--; p.sessionsPerIP[conn.clientIP] <= 0 {
+		delete(p.sessionsPerIP, conn.clientIP)
+	}
+	p.notifyLocked(false, clientAddrString, conn)
+	for _, index := range conn.indexes {
+		if p.indexes[index] == conn {
+			delete(p.indexes, index)
+		}
+	}
+	if conn.roamTo != nil && p.roams[conn.roamTo.String()] == conn {
+		delete(p.roams, conn.roamTo.String())
+	}
+}
+
+// reserveSession checks the ACL session limits for a new session of
+// clientIP and holds its place, so concurrent clients cannot get past the
+// limits. Its socket is only bound once admitted, a flood of denied sources
+// costs no socket. The place is taken by openSession or given back by
+// releaseSession.
+func (p *Proxy) reserveSession(clientIP string) error {
+	p.connectionsLock.Lock()
+	defer p.connectionsLock.Unlock()
+	if err := p.ACL.admit(len(p.connsMap)+p.reserved, p.sessionsPerIP[clientIP]); err != nil {
+		return err
+	}
+	p.reserved++
+	p.sessionsPerIP[clientIP]++
+	return nil
+}
+
+func (p *Proxy) releaseSession(clientIP string) {
+	p.connectionsLock.Lock()
+	defer p.connectionsLock.Unlock()
+	p.reserved--
+	if p.sessionsPerIP[clientIP]--; p.sessionsPerIP[clientIP] <= 0 {
+		delete(p.sessionsPerIP, clientIP)
+	}
+}
+
+// openSession stores a session reserved by reserveSession.
+func (p *Proxy) openSession(clientAddrString string, conn *connection) {
+	p.connectionsLock.Lock()
+	defer p.connectionsLock.Unlock()
+	p.reserved--
+	p.storeSessionLocked(clientAddrString, conn)
+}
+
 func (p *Proxy) updateClientLastActivity(clientAddrString string) {
 	p.Logger.Debug("updating client last activity", zap.String("client", clientAddrString))
 	p.connectionsLock.Lock()
-	if _, found := p.connsMap[clientAddrString]; found {
-		connWrapper := p.connsMap[clientAddrString]
-		connWrapper.lastActivity = time.Now()
-		p.connsMap[clientAddrString] = connWrapper
+	if conn, found := p.connsMap[clientAddrString]; found {
+		conn.lastActivity = time.Now()
 	}
 	p.connectionsLock.Unlock()
 }
 
-func (p *Proxy) clientConnectionReadLoop(clientAddr *net.UDPAddr, upstreamConn *net.UDPConn) {
-	clientAddrString := clientAddr.String()
+func (p *Proxy) clientConnectionReadLoop(conn *connection) {
+	upstreamConn := conn.udp
 	for {
 		buffer := make([]byte, p.BufferSize)
 		size, _, err := upstreamConn.ReadFromUDP(buffer)
+		if err == nil && p.WireguardAware && wireguardMessageType(buffer[:size]) == wgMessageResponse {
+			p.trackIndex(conn, wireguardIndex(buffer, 4))
+			p.confirmRoam(conn, wireguardIndex(buffer, 8))
+		}
+		// the client address changes when the session roams
+		p.connectionsLock.RLock()
+		clientAddr := conn.client
+		p.connectionsLock.RUnlock()
+		clientAddrString := clientAddr.String()
 		if err != nil {
 			p.connectionsLock.Lock()
 			upstreamConn.Close()
-			delete(p.connsMap, clientAddrString)
+			if p.connsMap[clientAddrString] == conn {
+				p.deleteSessionLocked(clientAddrString)
+			}
 			p.connectionsLock.Unlock()
 			return
 		}
 		p.updateClientLastActivity(clientAddrString)
+		p.count(conn, size)
 		p.upstreamMessageChannel <- packet{
 			src:  clientAddr,
 			data: buffer[:size],
@@ -93,7 +218,7 @@ func (p *Proxy) clientConnectionReadLoop(clientAddr *net.UDPAddr, upstreamConn *
 
 func (p *Proxy) handlerUpstreamPackets() {
 	for pa := range p.upstreamMessageChannel {
-		p.Logger.Debug("forwarded data from upstream", zap.Int("size", len(pa.data)), zap.String("data", string(pa.data)))
+		p.Logger.Debug("forwarded data from upstream", zap.Int("size", len(pa.data)))
 		p.listenerConn.WriteTo(pa.data, pa.src)
 	}
 }
@@ -104,35 +229,58 @@ func (p *Proxy) handleClientPackets() {
 		p.Logger.Debug("packet received",
 			zap.String("src address", packetSourceString),
 			zap.Int("src port", pa.src.Port),
-			zap.String("packet", string(pa.data)),
 			zap.Int("size", len(pa.data)),
 		)
 
+		if !p.ACL.Permit(pa.src.IP) {
+			atomic.AddUint64(&p.counters.denied, 1)
+			p.Logger.Debug("packet denied", zap.String("src address", packetSourceString))
+			continue
+		}
+
 		p.connectionsLock.RLock()
 		conn, found := p.connsMap[packetSourceString]
 		p.connectionsLock.RUnlock()
 
-		if !found {
-			conn, err := net.ListenUDP("udp", p.client)
-			p.Logger.Debug("new client connection",
-				zap.String("local port", conn.LocalAddr().String()),
-			)
+		if !found && p.WireguardAware {
+			conn, found = p.roamSession(pa.src, pa.data)
+		}
+
+		if p.WireguardAware && !p.acceptWireguardPacket(pa.data, found) {
+			atomic.AddUint64(&p.counters.dropped, 1)
+			p.Logger.Debug("dropped non wireguard packet", zap.String("src address", packetSourceString))
+			continue
+		}
 
+		if !found {
+			clientIP := pa.src.IP.String()
+			if err := p.reserveSession(clientIP); err != nil {
+				atomic.AddUint64(&p.counters.denied, 1)
+				p.Logger.Debug("session denied", zap.String("src address", packetSourceString), zap.Error(err))
+				continue
+			}
+			conn, err := p.SocketOptions.Ephemeral().ListenUDP("udp", p.client)
 			if err != nil {
+				p.releaseSession(clientIP)
 				p.Logger.Error("upd proxy failed to dial", zap.Error(err))
-				return
+				continue
 			}
-
-			p.connectionsLock.Lock()
-			p.connsMap[packetSourceString] = connection{
+			session := &connection{
 				udp:          conn,
+				client:       pa.src,
+				clientIP:     clientIP,
 				lastActivity: time.Now(),
 			}
-			p.connectionsLock.Unlock()
+			p.openSession(packetSourceString, session)
+			p.Logger.Debug("new client connection",
+				zap.String("local port", conn.LocalAddr().String()),
+			)
+			p.count(session, len(pa.data))
 
 			conn.WriteTo(pa.data, p.upstream)
-			go p.clientConnectionReadLoop(pa.src, conn)
+			go p.clientConnectionReadLoop(session)
 		} else {
+			p.count(conn, len(pa.data))
 			conn.udp.WriteTo(pa.data, p.upstream)
 			p.connectionsLock.RLock()
 			shouldUpdateLastActivity := false
@@ -150,10 +298,10 @@ func (p *Proxy) handleClientPackets() {
 	}
 }
 
-func (p *Proxy) readLoop() {
-	for !p.closed {
+func (p *Proxy) readLoop(listenerConn *net.UDPConn) {
+	for !p.isClosed() {
 		buffer := make([]byte, p.BufferSize)
-		size, srcAddress, err := p.listenerConn.ReadFromUDP(buffer)
+		size, srcAddress, err := listenerConn.ReadFromUDP(buffer)
 		if err != nil {
 			p.Logger.Error("error", zap.Error(err))
 			continue
@@ -166,9 +314,10 @@ func (p *Proxy) readLoop() {
 }
 
 func (p *Proxy) resolveUpstreamLoop() {
-	for !p.closed {
+	for !p.isClosed() {
 		time.Sleep(p.ResolveTTL)
 		upstreamAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.UpstreamAddress, p.UpstreamPort))
+		p.reportHealth(err)
 		if err != nil {
 			p.Logger.Error("resolve error", zap.Error(err))
 			continue
@@ -181,43 +330,59 @@ func (p *Proxy) resolveUpstreamLoop() {
 }
 
 func (p *Proxy) freeIdleSocketsLoop() {
-	for !p.closed {
+	for !p.isClosed() {
 		time.Sleep(p.ConnTimeout)
-		var clientsToTimeout []string
-
-		p.connectionsLock.RLock()
-		for client, conn := range p.connsMap {
-			if conn.lastActivity.Before(time.Now().Add(-p.ConnTimeout)) {
-				clientsToTimeout = append(clientsToTimeout, client)
-			}
-		}
-		p.connectionsLock.RUnlock()
+		p.freeIdleSockets(time.Now().Add(-p.ConnTimeout))
+	}
+}
 
-		p.connectionsLock.Lock()
-		for _, client := range clientsToTimeout {
+// freeIdleSockets closes the sessions idle since before. The check and the
+// delete happen under one lock, a session that roamed, failed or came back
+// to life in between is not touched.
+func (p *Proxy) freeIdleSockets(before time.Time) {
+	p.connectionsLock.Lock()
+	defer p.connectionsLock.Unlock()
+	for client, conn := range p.connsMap {
+		if conn.lastActivity.Before(before) {
 			p.Logger.Debug("client timeout", zap.String("client", client))
-			p.connsMap[client].udp.Close()
-			delete(p.connsMap, client)
+			conn.close()
+			p.deleteSessionLocked(client)
 		}
-		p.connectionsLock.Unlock()
 	}
 }
 
+func (p *Proxy) isClosed() bool {
+	p.connectionsLock.RLock()
+	defer p.connectionsLock.RUnlock()
+	return p.closed
+}
+
 func (p *Proxy) Close() {
 	p.Logger.Warn("Closing proxy")
 	p.connectionsLock.Lock()
+	if p.closed {
+		p.connectionsLock.Unlock()
+		return
+	}
+	for client, conn := range p.connsMap {
+		p.notifyLocked(false, client, conn)
+		conn.close()
+	}
 	p.closed = true
-	for _, conn := range p.connsMap {
-		conn.udp.Close()
+	close(p.sessionEvents)
+	for _, listenerConn := range p.listenerConns {
+		listenerConn.Close()
 	}
-	if p.listenerConn != nil {
-		p.listenerConn.Close()
+	if p.httpServer != nil {
+		p.httpServer.Close()
+	} else if p.streamListener != nil {
+		p.streamListener.Close()
 	}
 	p.connectionsLock.Unlock()
 }
 
 func (p *Proxy) Start() error {
-	p.Logger.Info("starting udp proxy")
+	p.Logger.Info("starting udp proxy", zap.String("transport", string(p.Transport)))
 
 	ProxyAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.BindAddress, p.BindPort))
 	if err != nil {
@@ -225,6 +390,7 @@ func (p *Proxy) Start() error {
 		return err
 	}
 	p.upstream, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.UpstreamAddress, p.UpstreamPort))
+	p.reportHealth(err)
 	if err != nil {
 		p.Logger.Error("error resolving upstream address", zap.Error(err))
 	}
@@ -233,12 +399,20 @@ func (p *Proxy) Start() error {
 		Port: 0,
 		Zone: ProxyAddr.Zone,
 	}
-	p.listenerConn, err = net.ListenUDP("udp", ProxyAddr)
+	if p.upstream != nil {
+		p.relayIP = outboundIP(p.upstream)
+	}
+	if p.Transport.isStream() {
+		err = p.startStream(ProxyAddr.String())
+	} else {
+		err = p.listen(ProxyAddr)
+	}
 	if err != nil {
 		p.Logger.Error("error listening on bind port", zap.Error(err))
 		return err
 	}
 	p.Logger.Info("udp proxy started")
+	go p.dispatchSessionEvents()
 	if p.ConnTimeout.Nanoseconds() > 0 {
 		go p.freeIdleSocketsLoop()
 	} else {
@@ -249,8 +423,41 @@ func (p *Proxy) Start() error {
 	} else {
 		p.Logger.Warn("not refreshing upstream addr")
 	}
+	if p.Transport.isStream() {
+		return nil
+	}
 	go p.handlerUpstreamPackets()
 	go p.handleClientPackets()
-	go p.readLoop()
+	for _, listenerConn := range p.listenerConns {
+		go p.readLoop(listenerConn)
+	}
+	return nil
+}
+
+// UseListener makes the proxy serve on an already bound socket instead of
+// binding BindPort itself. Extra SO_REUSEPORT listeners are bound next to
+// it, which needs conn to be bound with the same SocketOptions.
+func (p *Proxy) UseListener(conn *net.UDPConn) {
+	p.listenerConn = conn
+	p.listenerConns = []*net.UDPConn{conn}
+}
+
+// listen binds the listener sockets missing after UseListener. With
+// SO_REUSEPORT several sockets share the port and the kernel spreads
+// clients over them, replies can go out of any of them.
+func (p *Proxy) listen(addr *net.UDPAddr) error {
+	bound := len(p.listenerConns)
+	for len(p.listenerConns) < p.SocketOptions.ListenerCount() {
+		conn, err := p.SocketOptions.ListenUDP("udp", addr)
+		if err != nil {
+			for _, listenerConn := range p.listenerConns[bound:] {
+				listenerConn.Close()
+			}
+			p.listenerConns = p.listenerConns[:bound]
+			return err
+		}
+		p.listenerConns = append(p.listenerConns, conn)
+	}
+	p.listenerConn = p.listenerConns[0]
 	return nil
 }
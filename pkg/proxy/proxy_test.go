@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// startProxy starts a UDP proxy on the loopback in front of upstream.
+func startProxy(t *testing.T, upstream *net.UDPConn, configure func(p *Proxy)) *Proxy {
+	t.Helper()
+	addr := upstream.LocalAddr().(*net.UDPAddr)
+	p := NewProxy(false, zap.NewNop(), 0, "127.0.0.1", "127.0.0.1", addr.Port, 2048, time.Minute, 0)
+	if configure != nil {
+		configure(p)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receive returns the next datagram on conn, or nil after a short wait.
+func receive(conn *net.UDPConn) ([]byte, *net.UDPAddr) {
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	n, addr, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		return nil, nil
+	}
+	return buffer[:n], addr
+}
+
+func TestReserveSession(t *testing.T) {
+	p := NewProxy(false, zap.NewNop(), 0, "", "", 0, 0, 0, 0)
+	p.ACL.SetMaxSessions(2)
+	p.ACL.SetMaxSessionsPerIP(1)
+	steps := []struct {
+		name    string
+		do      func() error
+		wantErr error
+	}{
+		{name: "first source", do: func() error { return p.reserveSession("10.0.0.1") }},
+		{name: "same source again", do: func() error { return p.reserveSession("10.0.0.1") }, wantErr: errTooManySessionsForIP},
+		{name: "second source", do: func() error { return p.reserveSession("10.0.0.2") }},
+		{name: "over the total", do: func() error { return p.reserveSession("10.0.0.3") }, wantErr: errTooManySessions},
+		{name: "released", do: func() error { p.releaseSession("10.0.0.2"); return nil }},
+		{name: "place given back", do: func() error { return p.reserveSession("10.0.0.3") }},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != step.wantErr {
+			t.Fatalf("%s: error = %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+	if p.reserved != 2 || p.sessionsPerIP["10.0.0.1"] != 1 || p.sessionsPerIP["10.0.0.2"] != 0 {
+		t.Errorf("reserved %d, per source %v", p.reserved, p.sessionsPerIP)
+	}
+}
+
+func TestProxyDeniesBeforeBinding(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(p *Proxy)
+		clients   int
+		forwarded int
+		sessions  int
+		denied    uint64
+	}{
+		{name: "open", clients: 2, forwarded: 2, sessions: 2},
+		{
+			name:      "denied source",
+			configure: func(p *Proxy) { p.ACL.SetDeny([]string{"127.0.0.0/8"}) },
+			clients:   2,
+			denied:    2,
+		},
+		{
+			name:      "session limit",
+			configure: func(p *Proxy) { p.ACL.SetMaxSessions(1) },
+			clients:   3,
+			forwarded: 1,
+			sessions:  1,
+			denied:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := listenLoopback(t)
+			p := startProxy(t, upstream, tt.configure)
+			for i := 0; i < tt.clients; i++ {
+				client := listenLoopback(t)
+				client.WriteTo([]byte("hello"), p.listenerConn.LocalAddr())
+				data, _ := receive(upstream)
+				if forwarded := data != nil; forwarded != (i < tt.forwarded) {
+					t.Errorf("client %d forwarded = %v", i, forwarded)
+				}
+			}
+			p.connectionsLock.RLock()
+			reserved := p.reserved
+			p.connectionsLock.RUnlock()
+			if got := p.ActiveSessions(); got != tt.sessions || reserved != 0 {
+				t.Errorf("sessions = %d, reserved = %d, want %d, 0", got, reserved, tt.sessions)
+			}
+			if got := p.Stats().Denied; got != tt.denied {
+				t.Errorf("denied = %d, want %d", got, tt.denied)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"go.uber.org/zap"
+	"vpc/pkg/events"
+)
+
+// SessionEvent tells the control plane which real client is behind a relay
+// socket, so the upstream can attribute traffic it sees from the relay.
+type SessionEvent struct {
+	Open     bool   `json:"open"`
+	Client   string `json:"client"`
+	Relay    string `json:"relay"`
+	Upstream string `json:"upstream"`
+}
+
+const sessionEventBacklog = 1024
+
+// relayAddr is the address the upstream sees for a session socket. When the
+// proxy binds the unspecified address the outgoing interface address is
+// used instead.
+func (p *Proxy) relayAddr(conn *connection) string {
+	local := conn.udp.LocalAddr().(*net.UDPAddr)
+	ip := local.IP
+	if ip.IsUnspecified() && p.relayIP != nil {
+		ip = p.relayIP
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(local.Port))
+}
+
+// notifyLocked queues a session event, it must be called with
+// connectionsLock held so events keep the order of the session changes.
+func (p *Proxy) notifyLocked(open bool, client string, conn *connection) {
+	if (p.OnSession == nil && p.Events == nil) || p.closed {
+		return
+	}
+	ev := SessionEvent{
+		Open:     open,
+		Client:   client,
+		Relay:    p.relayAddr(conn),
+		Upstream: p.upstream.String(),
+	}
+	select {
+	case p.sessionEvents <- ev:
+	default:
+		p.Logger.Warn("session event dropped", zap.String("client", client))
+	}
+}
+
+func (p *Proxy) dispatchSessionEvents() {
+	for ev := range p.sessionEvents {
+		if p.OnSession != nil {
+			p.OnSession(ev)
+		}
+		typ := events.SessionClosed
+		if ev.Open {
+			typ = events.SessionOpened
+		}
+		pub := events.RelayEvent(typ, relayName(p.Name, p.BindPort))
+		pub.Client = ev.Client
+		pub.Upstream = ev.Upstream
+		p.Events.Publish(pub)
+	}
+}
+
+func (p *Proxy) reportHealth(err error) {
+	p.health.report(p.Events, relayName(p.Name, p.BindPort), fmt.Sprintf("%s:%d", p.UpstreamAddress, p.UpstreamPort), err)
+}
+
+// outboundIP finds the local address used to reach the upstream.
+func outboundIP(upstream *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, upstream)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
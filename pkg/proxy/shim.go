@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Shim is the client side of a stream transport. It listens on a local UDP
+// port that the Wireguard client uses as its endpoint and wraps every
+// datagram towards a relay Proxy.
+type Shim struct {
+	Logger        *zap.Logger
+	BindPort      int
+	BindAddress   string
+	RelayAddress  string
+	Transport     Transport
+	TLSConfig     *tls.Config
+	WebSocketPath string
+	BufferSize    int
+	listenerConn  *net.UDPConn
+	streams       map[string]packetStream
+	// dialing holds the clients whose stream is being dialed
+	dialing     map[string]bool
+	streamsLock *sync.Mutex
+	// closed is guarded by streamsLock
+	closed bool
+}
+
+func NewShim(logger *zap.Logger, bindPort int, bindAddress string, relayAddress string, transport Transport, tlsConfig *tls.Config) *Shim {
+	return &Shim{
+		Logger:       logger,
+		BindPort:     bindPort,
+		BindAddress:  bindAddress,
+		RelayAddress: relayAddress,
+		Transport:    transport,
+		TLSConfig:    tlsConfig,
+		BufferSize:   4096,
+		streams:      make(map[string]packetStream),
+		dialing:      make(map[string]bool),
+		streamsLock:  new(sync.Mutex),
+	}
+}
+
+func (s *Shim) dial() (packetStream, error) {
+	switch s.Transport {
+	case TransportTCP:
+		conn, err := net.Dial("tcp", s.RelayAddress)
+		if err != nil {
+			return nil, err
+		}
+		return newFramedConn(conn), nil
+	case TransportTLS:
+		conn, err := tls.Dial("tcp", s.RelayAddress, s.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		return newFramedConn(conn), nil
+	case TransportWebSocket:
+		u := url.URL{Scheme: "ws", Host: s.RelayAddress, Path: s.WebSocketPath}
+		if s.TLSConfig != nil {
+			u.Scheme = "wss"
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		dialer := websocket.Dialer{TLSClientConfig: s.TLSConfig}
+		conn, _, err := dialer.Dial(u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return &wsConn{Conn: conn}, nil
+	}
+	return nil, errUnknownTransport
+}
+
+// streamFor returns the stream of src. When there is none yet it is dialed
+// in the background with first as its first datagram, nil is returned and
+// the datagrams of src are dropped until it is up, Wireguard sends its
+// handshake again.
+func (s *Shim) streamFor(src *net.UDPAddr, first []byte) packetStream {
+	srcString := src.String()
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	if stream, found := s.streams[srcString]; found {
+		return stream
+	}
+	if !s.dialing[srcString] && !s.closed {
+		s.dialing[srcString] = true
+		go s.connect(src, first)
+	}
+	return nil
+}
+
+// connect dials the stream of src outside the lock, a slow relay only holds
+// up its own client.
+func (s *Shim) connect(src *net.UDPAddr, first []byte) {
+	srcString := src.String()
+	stream, err := s.dial()
+	s.streamsLock.Lock()
+	delete(s.dialing, srcString)
+	closed := s.closed
+	if err == nil && !closed {
+		s.streams[srcString] = stream
+	}
+	s.streamsLock.Unlock()
+	if err == nil && closed {
+		stream.Close()
+		return
+	}
+	if err != nil {
+		s.Logger.Error("failed to connect to relay", zap.String("relay", s.RelayAddress), zap.Error(err))
+		return
+	}
+	s.Logger.Debug("connected to relay",
+		zap.String("relay", s.RelayAddress),
+		zap.String("client", srcString),
+	)
+	go s.relayReadLoop(src, stream)
+	if err := stream.WritePacket(first); err != nil {
+		s.Logger.Warn("failed to write to relay", zap.Error(err))
+		s.dropStream(src, stream)
+	}
+}
+
+func (s *Shim) isClosed() bool {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	return s.closed
+}
+
+func (s *Shim) dropStream(src *net.UDPAddr, stream packetStream) {
+	s.streamsLock.Lock()
+	if s.streams[src.String()] == stream {
+		delete(s.streams, src.String())
+	}
+	s.streamsLock.Unlock()
+	stream.Close()
+}
+
+func (s *Shim) relayReadLoop(src *net.UDPAddr, stream packetStream) {
+	for {
+		data, err := stream.ReadPacket()
+		if err != nil {
+			if !s.isClosed() {
+				s.Logger.Warn("relay connection lost", zap.Error(err))
+			}
+			s.dropStream(src, stream)
+			return
+		}
+		s.listenerConn.WriteTo(data, src)
+	}
+}
+
+func (s *Shim) readLoop() {
+	for !s.isClosed() {
+		buffer := make([]byte, s.BufferSize)
+		size, srcAddress, err := s.listenerConn.ReadFromUDP(buffer)
+		if err != nil {
+			if !s.isClosed() {
+				s.Logger.Error("error", zap.Error(err))
+			}
+			continue
+		}
+		stream := s.streamFor(srcAddress, buffer[:size])
+		if stream == nil {
+			continue
+		}
+		if err := stream.WritePacket(buffer[:size]); err != nil {
+			s.Logger.Warn("failed to write to relay", zap.Error(err))
+			s.dropStream(srcAddress, stream)
+		}
+	}
+}
+
+func (s *Shim) Start() error {
+	s.Logger.Info("starting shim", zap.String("transport", string(s.Transport)), zap.String("relay", s.RelayAddress))
+	if !s.Transport.isStream() {
+		return errUnknownTransport
+	}
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", s.BindAddress, s.BindPort))
+	if err != nil {
+		return err
+	}
+	s.listenerConn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		s.Logger.Error("error listening on bind port", zap.Error(err))
+		return err
+	}
+	go s.readLoop()
+	return nil
+}
+
+func (s *Shim) Close() {
+	s.Logger.Warn("Closing shim")
+	s.streamsLock.Lock()
+	s.closed = true
+	for _, stream := range s.streams {
+		stream.Close()
+	}
+	s.streamsLock.Unlock()
+	if s.listenerConn != nil {
+		s.listenerConn.Close()
+	}
+}
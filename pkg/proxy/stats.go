@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the counters of a proxy since it was created, Sessions is the
+// number of sessions opened.
+type Stats struct {
+	Packets  uint64
+	Bytes    uint64
+	Sessions uint64
+	Denied   uint64
+	Dropped  uint64
+}
+
+type counters struct {
+	packets  uint64
+	bytes    uint64
+	sessions uint64
+	denied   uint64
+	dropped  uint64
+}
+
+// SessionStats are the counters of one client session.
+type SessionStats struct {
+	Client       string
+	Relay        string
+	Packets      uint64
+	Bytes        uint64
+	LastActivity time.Time
+}
+
+// count records a forwarded packet on the proxy and session counters.
+func (p *Proxy) count(conn *connection, size int) {
+	atomic.AddUint64(&p.counters.packets, 1)
+	atomic.AddUint64(&p.counters.bytes, uint64(size))
+	atomic.AddUint64(&conn.packets, 1)
+	atomic.AddUint64(&conn.bytes, uint64(size))
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Packets:  atomic.LoadUint64(&c.packets),
+		Bytes:    atomic.LoadUint64(&c.bytes),
+		Sessions: atomic.LoadUint64(&c.sessions),
+		Denied:   atomic.LoadUint64(&c.denied),
+		Dropped:  atomic.LoadUint64(&c.dropped),
+	}
+}
+
+// Stats returns a snapshot of the proxy counters.
+func (p *Proxy) Stats() Stats {
+	return p.counters.snapshot()
+}
+
+// ActiveSessions returns the number of open client sessions.
+func (p *Proxy) ActiveSessions() int {
+	p.connectionsLock.RLock()
+	defer p.connectionsLock.RUnlock()
+	return len(p.connsMap)
+}
+
+// Sessions returns the counters of every open client session.
+func (p *Proxy) Sessions() []SessionStats {
+	p.connectionsLock.RLock()
+	defer p.connectionsLock.RUnlock()
+	sessions := make([]SessionStats, 0, len(p.connsMap))
+	for client, conn := range p.connsMap {
+		sessions = append(sessions, SessionStats{
+			Client:       client,
+			Relay:        conn.udp.LocalAddr().String(),
+			Packets:      atomic.LoadUint64(&conn.packets),
+			Bytes:        atomic.LoadUint64(&conn.bytes),
+			LastActivity: conn.lastActivity,
+		})
+	}
+	return sessions
+}
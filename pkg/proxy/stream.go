@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Transport selects how clients reach the proxy. Stream transports carry
+// one Wireguard datagram per frame and are unwrapped to UDP towards the
+// upstream.
+type Transport string
+
+const (
+	TransportUDP       Transport = "udp"
+	TransportTCP       Transport = "tcp"
+	TransportTLS       Transport = "tls"
+	TransportWebSocket Transport = "ws"
+)
+
+const maxFrameSize = 0xffff
+
+var (
+	errFrameTooLarge    = errors.New("frame too large")
+	errNoTLSConfig      = errors.New("tls transport requires a tls config")
+	errUnknownTransport = errors.New("unknown transport")
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (t Transport) isStream() bool {
+	return t == TransportTCP || t == TransportTLS || t == TransportWebSocket
+}
+
+// packetStream is a connection oriented transport that preserves datagram
+// boundaries.
+type packetStream interface {
+	ReadPacket() ([]byte, error)
+	WritePacket(data []byte) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// framedConn prefixes every datagram with its length as a big endian uint16.
+type framedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex
+}
+
+func newFramedConn(conn net.Conn) *framedConn {
+	return &framedConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (f *framedConn) ReadPacket() ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(f.reader, header[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(f.reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (f *framedConn) WritePacket(data []byte) error {
+	if len(data) > maxFrameSize {
+		return errFrameTooLarge
+	}
+	buffer := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buffer, uint16(len(data)))
+	copy(buffer[2:], data)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, err := f.Conn.Write(buffer)
+	return err
+}
+
+// wsConn carries one datagram per binary websocket message.
+type wsConn struct {
+	*websocket.Conn
+	lock sync.Mutex
+}
+
+func (w *wsConn) ReadPacket() ([]byte, error) {
+	for {
+		messageType, data, err := w.Conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if messageType == websocket.BinaryMessage {
+			return data, nil
+		}
+	}
+}
+
+func (w *wsConn) WritePacket(data []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.Conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func streamIP(stream packetStream) net.IP {
+	if addr, ok := stream.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	host, _, _ := net.SplitHostPort(stream.RemoteAddr().String())
+	return net.ParseIP(host)
+}
+
+// UseStreamListener makes a stream proxy accept on an already bound listener.
+func (p *Proxy) UseStreamListener(ln net.Listener) {
+	p.streamListener = ln
+}
+
+func (p *Proxy) startStream(address string) error {
+	ln := p.streamListener
+	if ln == nil {
+		var err error
+		ln, err = p.SocketOptions.Ephemeral().Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+	}
+	// denied sources are turned away before any TLS or HTTP handshake
+	ln = &aclListener{Listener: ln, proxy: p}
+	if p.Transport == TransportTLS || (p.Transport == TransportWebSocket && p.TLSConfig != nil) {
+		if p.TLSConfig == nil {
+			ln.Close()
+			return errNoTLSConfig
+		}
+		ln = tls.NewListener(ln, p.TLSConfig)
+	}
+	p.streamListener = ln
+
+	if p.Transport == TransportWebSocket {
+		path := p.WebSocketPath
+		if path == "" {
+			path = "/"
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(path, p.handleWebSocket)
+		p.httpServer = &http.Server{Handler: mux}
+		go p.httpServer.Serve(ln)
+		return nil
+	}
+	go p.acceptLoop()
+	return nil
+}
+
+// aclListener closes the connections of sources the ACL does not permit
+// right after they are accepted.
+type aclListener struct {
+	net.Listener
+	proxy *Proxy
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || l.proxy.ACL.Permit(addr.IP) {
+			return conn, nil
+		}
+		atomic.AddUint64(&l.proxy.counters.denied, 1)
+		l.proxy.Logger.Debug("stream denied", zap.String("client", conn.RemoteAddr().String()))
+		conn.Close()
+	}
+}
+
+func (p *Proxy) acceptLoop() {
+	for !p.isClosed() {
+		conn, err := p.streamListener.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return
+			}
+			p.Logger.Error("accept error", zap.Error(err))
+			continue
+		}
+		go p.handleStream(newFramedConn(conn))
+	}
+}
+
+func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		p.Logger.Error("websocket upgrade failed", zap.Error(err))
+		return
+	}
+	p.handleStream(&wsConn{Conn: conn})
+}
+
+// handleStream opens an upstream socket for a stream client and pumps
+// datagrams between the two until either side fails. The ACL already
+// permitted the client when it was accepted.
+func (p *Proxy) handleStream(stream packetStream) {
+	clientAddrString := stream.RemoteAddr().String()
+	clientIP := streamIP(stream)
+	var initiation []byte
+	if p.WireguardAware {
+		data, err := stream.ReadPacket()
+		if err != nil || !p.acceptWireguardPacket(data, false) {
+			atomic.AddUint64(&p.counters.dropped, 1)
+			p.Logger.Debug("dropped non wireguard stream", zap.String("client", clientAddrString))
+			stream.Close()
+			return
+		}
+		initiation = data
+	}
+	if err := p.reserveSession(clientIP.String()); err != nil {
+		atomic.AddUint64(&p.counters.denied, 1)
+		p.Logger.Debug("session denied", zap.String("client", clientAddrString), zap.Error(err))
+		stream.Close()
+		return
+	}
+	upstreamConn, err := p.SocketOptions.Ephemeral().ListenUDP("udp", p.client)
+	if err != nil {
+		p.releaseSession(clientIP.String())
+		p.Logger.Error("upd proxy failed to dial", zap.Error(err))
+		stream.Close()
+		return
+	}
+	session := &connection{
+		udp:          upstreamConn,
+		stream:       stream,
+		clientIP:     clientIP.String(),
+		lastActivity: time.Now(),
+	}
+	p.openSession(clientAddrString, session)
+	p.Logger.Debug("new stream client connection",
+		zap.String("client", clientAddrString),
+		zap.String("local port", upstreamConn.LocalAddr().String()),
+	)
+
+	go p.streamUpstreamReadLoop(clientAddrString, session)
+	if initiation != nil {
+		p.count(session, len(initiation))
+		upstreamConn.WriteTo(initiation, p.upstream)
+	}
+	for {
+		data, err := stream.ReadPacket()
+		if err != nil {
+			p.closeStream(clientAddrString, stream, upstreamConn)
+			return
+		}
+		if p.WireguardAware && !p.acceptWireguardPacket(data, true) {
+			atomic.AddUint64(&p.counters.dropped, 1)
+			continue
+		}
+		p.count(session, len(data))
+		upstreamConn.WriteTo(data, p.upstream)
+		p.updateClientLastActivity(clientAddrString)
+	}
+}
+
+func (p *Proxy) streamUpstreamReadLoop(clientAddrString string, session *connection) {
+	stream, upstreamConn := session.stream, session.udp
+	for {
+		buffer := make([]byte, p.BufferSize)
+		size, _, err := upstreamConn.ReadFromUDP(buffer)
+		if err != nil {
+			p.closeStream(clientAddrString, stream, upstreamConn)
+			return
+		}
+		p.count(session, size)
+		if err := stream.WritePacket(buffer[:size]); err != nil {
+			p.closeStream(clientAddrString, stream, upstreamConn)
+			return
+		}
+		p.updateClientLastActivity(clientAddrString)
+	}
+}
+
+func (p *Proxy) closeStream(clientAddrString string, stream packetStream, upstreamConn *net.UDPConn) {
+	p.connectionsLock.Lock()
+	if conn, found := p.connsMap[clientAddrString]; found && conn.udp == upstreamConn {
+		p.deleteSessionLocked(clientAddrString)
+	}
+	p.connectionsLock.Unlock()
+	upstreamConn.Close()
+	stream.Close()
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// datagrams are what the framing tests send, down to the empty datagram and
+// up to the largest one a frame holds.
+var datagrams = [][]byte{
+	[]byte("handshake"),
+	{},
+	bytes.Repeat([]byte{0xab}, 1500),
+	bytes.Repeat([]byte{0xcd}, maxFrameSize),
+}
+
+// roundTrip writes datagrams on one end and checks they are read back one
+// by one on the other.
+func roundTrip(t *testing.T, w packetStream, r packetStream) {
+	t.Helper()
+	go func() {
+		for _, d := range datagrams {
+			if err := w.WritePacket(d); err != nil {
+				t.Errorf("WritePacket() error = %v", err)
+				return
+			}
+		}
+	}()
+	for i, want := range datagrams {
+		got, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket() %d error = %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("ReadPacket() %d = %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+}
+
+func TestFramedConnRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	roundTrip(t, newFramedConn(a), newFramedConn(b))
+}
+
+func TestFramedConnTLSRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	server := tls.Server(a, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	client := tls.Client(b, &tls.Config{InsecureSkipVerify: true})
+	defer server.Close()
+	defer client.Close()
+	roundTrip(t, newFramedConn(client), newFramedConn(server))
+}
+
+func TestFramedConnShortReads(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		want    []byte
+		wantErr error
+	}{
+		{name: "header split", chunks: [][]byte{{0}, {3}, []byte("abc")}, want: []byte("abc")},
+		{name: "payload split", chunks: [][]byte{{0, 3, 'a'}, {'b'}, {'c'}}, want: []byte("abc")},
+		{name: "byte by byte", chunks: [][]byte{{0}, {2}, {'x'}, {'y'}}, want: []byte("xy")},
+		{name: "truncated payload", chunks: [][]byte{{0, 3, 'a', 'b'}}, wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated header", chunks: [][]byte{{0}}, wantErr: io.ErrUnexpectedEOF},
+		{name: "closed", chunks: nil, wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			go func() {
+				for _, chunk := range tt.chunks {
+					a.Write(chunk)
+				}
+				a.Close()
+			}()
+			got, err := newFramedConn(b).ReadPacket()
+			if err != tt.wantErr || !bytes.Equal(got, tt.want) {
+				t.Errorf("ReadPacket() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFramedConnOversized(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := newFramedConn(a).WritePacket(make([]byte, maxFrameSize+1)); err != errFrameTooLarge {
+		t.Errorf("WritePacket() error = %v, want %v", err, errFrameTooLarge)
+	}
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	accepted := make(chan packetStream, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade() error = %v", err)
+			return
+		}
+		accepted <- &wsConn{Conn: conn}
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &wsConn{Conn: conn}
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+
+	// text messages are not datagrams and are skipped
+	conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	roundTrip(t, client, server)
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "relay"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/blake2s"
+)
+
+// Wireguard message types and sizes, see https://www.wireguard.com/protocol/
+const (
+	wgMessageInitiation  = 1
+	wgMessageResponse    = 2
+	wgMessageCookieReply = 3
+	wgMessageTransport   = 4
+
+	wgInitiationSize   = 148
+	wgResponseSize     = 92
+	wgCookieReplySize  = 64
+	wgTransportMinSize = 32
+
+	wgMac1Offset = 116
+	wgMacSize    = 16
+)
+
+const wgLabelMac1 = "mac1----"
+
+// maxTrackedIndexes bounds the receiver indexes remembered per session. The
+// server picks a new one on every rekey, so only the latest few matter.
+const maxTrackedIndexes = 3
+
+// wireguardMessageType returns the type of a well formed Wireguard message
+// or zero.
+func wireguardMessageType(data []byte) byte {
+	if len(data) < 4 || data[1] != 0 || data[2] != 0 || data[3] != 0 {
+		return 0
+	}
+	switch data[0] {
+	case wgMessageInitiation:
+		if len(data) == wgInitiationSize {
+			return wgMessageInitiation
+		}
+	case wgMessageResponse:
+		if len(data) == wgResponseSize {
+			return wgMessageResponse
+		}
+	case wgMessageCookieReply:
+		if len(data) == wgCookieReplySize {
+			return wgMessageCookieReply
+		}
+	case wgMessageTransport:
+		if len(data) >= wgTransportMinSize && len(data)%16 == 0 {
+			return wgMessageTransport
+		}
+	}
+	return 0
+}
+
+// wireguardIndex reads the little endian session index at offset.
+func wireguardIndex(data []byte, offset int) uint32 {
+	return binary.LittleEndian.Uint32(data[offset : offset+4])
+}
+
+// SetUpstreamPublicKey puts the proxy in Wireguard aware mode. Sessions are
+// then only created for handshake initiations whose MAC1 was computed for
+// the upstream server's public key, and packets that are not Wireguard
+// messages are dropped.
+func (p *Proxy) SetUpstreamPublicKey(publicKey [32]byte) {
+	h, _ := blake2s.New256(nil)
+	h.Write([]byte(wgLabelMac1))
+	h.Write(publicKey[:])
+	h.Sum(p.mac1Key[:0])
+	p.WireguardAware = true
+}
+
+// validInitiation checks the MAC1 of a handshake initiation.
+func (p *Proxy) validInitiation(data []byte) bool {
+	if wireguardMessageType(data) != wgMessageInitiation {
+		return false
+	}
+	mac, err := blake2s.New128(p.mac1Key[:])
+	if err != nil {
+		return false
+	}
+	mac.Write(data[:wgMac1Offset])
+	expected := mac.Sum(nil)
+	return subtle.ConstantTimeCompare(expected, data[wgMac1Offset:wgMac1Offset+wgMacSize]) == 1
+}
+
+// acceptWireguardPacket decides whether a packet may pass in Wireguard aware
+// mode. Only a valid initiation may open a session.
+func (p *Proxy) acceptWireguardPacket(data []byte, hasSession bool) bool {
+	if !hasSession {
+		return p.validInitiation(data)
+	}
+	return wireguardMessageType(data) != 0
+}
+
+// trackIndex remembers the sender index the upstream picked in a handshake
+// response. The client uses it as receiver index in its transport messages.
+func (p *Proxy) trackIndex(conn *connection, index uint32) {
+	p.connectionsLock.Lock()
+	defer p.connectionsLock.Unlock()
+	conn.indexes = append(conn.indexes, index)
+	if len(conn.indexes) > maxTrackedIndexes {
+		if p.indexes[conn.indexes[0]] == conn {
+			delete(p.indexes, conn.indexes[0])
+		}
+		conn.indexes = conn.indexes[1:]
+	}
+	p.indexes[index] = conn
+}
+
+// roamSession finds the session a packet from the unknown source src
+// belongs to. The relay cannot authenticate transport messages, so one
+// carrying a receiver index of a session is only a hint: it is forwarded
+// through the session socket, but the replies keep going to the old
+// address. The Wireguard client sends a new handshake initiation when it
+// gets no replies, one from the hinted source with a valid MAC1 goes
+// through the same socket, and the session moves once the upstream answers
+// it, see confirmRoam. A replayed packet does not get that answer.
+func (p *Proxy) roamSession(src *net.UDPAddr, data []byte) (*connection, bool) {
+	p.connectionsLock.Lock()
+	defer p.connectionsLock.Unlock()
+	srcString := src.String()
+	switch wireguardMessageType(data) {
+	case wgMessageTransport:
+		conn, found := p.indexes[wireguardIndex(data, 4)]
+		if !found || conn.stream != nil || p.connsMap[conn.client.String()] != conn {
+			return nil, false
+		}
+		if conn.roamTo != nil && p.roams[conn.roamTo.String()] == conn {
+			delete(p.roams, conn.roamTo.String())
+		}
+		conn.roamTo, conn.roaming = src, false
+		p.roams[srcString] = conn
+		return conn, true
+	case wgMessageInitiation:
+		conn, found := p.roams[srcString]
+		if !found || !p.validInitiation(data) {
+			return nil, false
+		}
+		conn.roamIndex, conn.roaming = wireguardIndex(data, 4), true
+		return conn, true
+	}
+	return nil, false
+}
+
+// confirmRoam moves conn to the source it is roaming to when the upstream
+// answered the initiation sent from there, receiver is the index of the
+// handshake response. A session moving to another source counts towards
+// the per source limit of that source.
+func (p *Proxy) confirmRoam(conn *connection, receiver uint32) {
+	p.connectionsLock.Lock()
+	defer p.connectionsLock.Unlock()
+	if !conn.roaming || conn.roamIndex != receiver {
+		return
+	}
+	src := conn.roamTo
+	conn.roamTo, conn.roaming = nil, false
+	delete(p.roams, src.String())
+	oldAddrString := conn.client.String()
+	if p.connsMap[oldAddrString] != conn {
+		return
+	}
+	newIP := src.IP.String()
+	if newIP != conn.clientIP {
+		if err := p.ACL.admitRoam(p.sessionsPerIP[newIP]); err != nil {
+			p.Logger.Debug("session roam denied", zap.String("to", src.String()), zap.Error(err))
+			return
+		}
+	}
+	p.Logger.Debug("session roamed",
+		zap.String("from", oldAddrString),
+		zap.String("to", src.String()),
+	)
+	delete(p.connsMap, oldAddrString)
+	if p.sessionsPerIP[conn.clientIP]--; p.sessionsPerIP[conn.clientIP] <= 0 {
+		delete(p.sessionsPerIP, conn.clientIP)
+	}
+	p.notifyLocked(false, oldAddrString, conn)
+	conn.client = src
+	conn.clientIP = newIP
+	p.connsMap[src.String()] = conn
+	p.sessionsPerIP[conn.clientIP]++
+	p.notifyLocked(true, src.String(), conn)
+}
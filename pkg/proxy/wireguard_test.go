@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// initiation returns a handshake initiation whose MAC1 is computed for the
+// server public key pub, as a Wireguard client does.
+func initiation(pub [32]byte) []byte {
+	data := make([]byte, wgInitiationSize)
+	data[0] = wgMessageInitiation
+	for i := 4; i < wgMac1Offset; i++ {
+		data[i] = byte(i)
+	}
+	return withMac1(data, pub)
+}
+
+// withMac1 sets the MAC1 of an initiation for the server public key pub.
+func withMac1(data []byte, pub [32]byte) []byte {
+	key := blake2s.Sum256(append([]byte(wgLabelMac1), pub[:]...))
+	mac, _ := blake2s.New128(key[:])
+	mac.Write(data[:wgMac1Offset])
+	copy(data[wgMac1Offset:], mac.Sum(nil))
+	return data
+}
+
+func TestValidInitiation(t *testing.T) {
+	var server, other [32]byte
+	server[0], other[0] = 1, 2
+	tampered := initiation(server)
+	tampered[8] ^= 0xff
+	badMac := initiation(server)
+	badMac[wgMac1Offset] ^= 0xff
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{name: "valid", data: initiation(server), want: true},
+		{name: "other server", data: initiation(other), want: false},
+		{name: "tampered message", data: tampered, want: false},
+		{name: "tampered mac", data: badMac, want: false},
+		{name: "truncated", data: initiation(server)[:wgInitiationSize-1], want: false},
+		{name: "response", data: append([]byte{wgMessageResponse, 0, 0, 0}, make([]byte, wgResponseSize-4)...), want: false},
+		{name: "empty", data: nil, want: false},
+	}
+	p := &Proxy{}
+	p.SetUpstreamPublicKey(server)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.validInitiation(tt.data); got != tt.want {
+				t.Errorf("validInitiation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWireguardMessageType(t *testing.T) {
+	message := func(typ byte, size int) []byte {
+		data := make([]byte, size)
+		data[0] = typ
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want byte
+	}{
+		{name: "initiation", data: message(wgMessageInitiation, wgInitiationSize), want: wgMessageInitiation},
+		{name: "response", data: message(wgMessageResponse, wgResponseSize), want: wgMessageResponse},
+		{name: "cookie reply", data: message(wgMessageCookieReply, wgCookieReplySize), want: wgMessageCookieReply},
+		{name: "keepalive", data: message(wgMessageTransport, wgTransportMinSize), want: wgMessageTransport},
+		{name: "transport", data: message(wgMessageTransport, 128), want: wgMessageTransport},
+		{name: "unpadded transport", data: message(wgMessageTransport, 100), want: 0},
+		{name: "short initiation", data: message(wgMessageInitiation, 100), want: 0},
+		{name: "reserved bytes set", data: append([]byte{wgMessageTransport, 1, 0, 0}, make([]byte, 28)...), want: 0},
+		{name: "unknown type", data: message(5, 64), want: 0},
+		{name: "too short", data: []byte{wgMessageTransport}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wireguardMessageType(tt.data); got != tt.want {
+				t.Errorf("wireguardMessageType() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// initiationWithIndex is an initiation for pub whose sender index is index.
+func initiationWithIndex(pub [32]byte, index uint32) []byte {
+	data := initiation(pub)
+	binary.LittleEndian.PutUint32(data[4:], index)
+	return withMac1(data, pub)
+}
+
+func response(sender uint32, receiver uint32) []byte {
+	data := make([]byte, wgResponseSize)
+	data[0] = wgMessageResponse
+	binary.LittleEndian.PutUint32(data[4:], sender)
+	binary.LittleEndian.PutUint32(data[8:], receiver)
+	return data
+}
+
+func transport(receiver uint32) []byte {
+	data := make([]byte, wgTransportMinSize)
+	data[0] = wgMessageTransport
+	binary.LittleEndian.PutUint32(data[4:], receiver)
+	return data
+}
+
+func TestRoamSession(t *testing.T) {
+	var server [32]byte
+	server[0] = 1
+	upstream := listenLoopback(t)
+	p := startProxy(t, upstream, func(p *Proxy) { p.SetUpstreamPublicKey(server) })
+	relay := p.listenerConn.LocalAddr()
+
+	// the client handshakes and the upstream answers through the session
+	client := listenLoopback(t)
+	client.WriteTo(initiationWithIndex(server, 1), relay)
+	_, socket := receive(upstream)
+	if socket == nil {
+		t.Fatal("initiation not forwarded")
+	}
+	upstream.WriteTo(response(100, 1), socket)
+	if data, _ := receive(client); data == nil {
+		t.Fatal("response not delivered")
+	}
+
+	// a transport message from another source is forwarded through the
+	// same socket, but does not get the replies
+	moved := listenLoopback(t)
+	moved.WriteTo(transport(100), relay)
+	if _, from := receive(upstream); from == nil || from.String() != socket.String() {
+		t.Fatalf("transport from the new source came from %v, want %v", from, socket)
+	}
+	upstream.WriteTo(transport(7), socket)
+	if data, _ := receive(moved); data != nil {
+		t.Fatal("the session moved on a transport message")
+	}
+	if data, _ := receive(client); data == nil {
+		t.Fatal("the old source lost the session")
+	}
+
+	// a handshake answered by the upstream moves the session
+	moved.WriteTo(initiationWithIndex(server, 2), relay)
+	if _, from := receive(upstream); from == nil || from.String() != socket.String() {
+		t.Fatalf("initiation from the new source came from %v, want %v", from, socket)
+	}
+	upstream.WriteTo(response(101, 2), socket)
+	if data, _ := receive(moved); data == nil {
+		t.Fatal("response not delivered to the new source")
+	}
+	upstream.WriteTo(transport(7), socket)
+	if data, _ := receive(moved); data == nil {
+		t.Fatal("the session did not move")
+	}
+	if data, _ := receive(client); data != nil {
+		t.Fatal("the old source still gets the replies")
+	}
+	if got := p.ActiveSessions(); got != 1 {
+		t.Errorf("sessions = %d, want 1", got)
+	}
+}
+
+func TestRoamSessionReplay(t *testing.T) {
+	var server [32]byte
+	server[0] = 1
+	upstream := listenLoopback(t)
+	p := startProxy(t, upstream, func(p *Proxy) { p.SetUpstreamPublicKey(server) })
+	relay := p.listenerConn.LocalAddr()
+
+	client := listenLoopback(t)
+	client.WriteTo(initiationWithIndex(server, 1), relay)
+	_, socket := receive(upstream)
+	upstream.WriteTo(response(100, 1), socket)
+	receive(client)
+
+	// a replayed transport message and initiation from an observer: the
+	// upstream drops the replayed initiation and does not answer
+	observer := listenLoopback(t)
+	observer.WriteTo(transport(100), relay)
+	receive(upstream)
+	observer.WriteTo(initiationWithIndex(server, 1), relay)
+	receive(upstream)
+	// an answer to another handshake does not move the session either
+	upstream.WriteTo(response(102, 9), socket)
+	receive(client)
+
+	upstream.WriteTo(transport(7), socket)
+	if data, _ := receive(observer); data != nil {
+		t.Fatal("the observer took the session")
+	}
+	if data, _ := receive(client); data == nil {
+		t.Fatal("the client lost the session")
+	}
+}
+
+func TestFreeIdleSockets(t *testing.T) {
+	upstream := listenLoopback(t)
+	p := startProxy(t, upstream, nil)
+	relay := p.listenerConn.LocalAddr()
+	idle, active := listenLoopback(t), listenLoopback(t)
+	idle.WriteTo([]byte("a"), relay)
+	receive(upstream)
+	active.WriteTo([]byte("b"), relay)
+	receive(upstream)
+
+	p.connectionsLock.Lock()
+	p.connsMap[idle.LocalAddr().String()].lastActivity = time.Now().Add(-time.Hour)
+	p.connectionsLock.Unlock()
+	p.freeIdleSockets(time.Now().Add(-time.Minute))
+
+	p.connectionsLock.RLock()
+	_, idleFound := p.connsMap[idle.LocalAddr().String()]
+	_, activeFound := p.connsMap[active.LocalAddr().String()]
+	p.connectionsLock.RUnlock()
+	if idleFound || !activeFound {
+		t.Errorf("idle session kept = %v, active session kept = %v", idleFound, activeFound)
+	}
+}
+
+func TestWireguardAwareProxy(t *testing.T) {
+	var server, other [32]byte
+	server[0], other[0] = 1, 2
+	tests := []struct {
+		name      string
+		packets   [][]byte
+		forwarded int
+		sessions  int
+		dropped   uint64
+	}{
+		{name: "valid initiation", packets: [][]byte{initiation(server)}, forwarded: 1, sessions: 1},
+		{name: "garbage", packets: [][]byte{[]byte("hello")}, dropped: 1},
+		{name: "initiation for another server", packets: [][]byte{initiation(other)}, dropped: 1},
+		{name: "transport without a session", packets: [][]byte{transport(100)}, dropped: 1},
+		{
+			name:      "session open",
+			packets:   [][]byte{initiation(server), transport(100), []byte("hello")},
+			forwarded: 2,
+			sessions:  1,
+			dropped:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := listenLoopback(t)
+			p := startProxy(t, upstream, func(p *Proxy) { p.SetUpstreamPublicKey(server) })
+			client := listenLoopback(t)
+			forwarded := 0
+			for _, data := range tt.packets {
+				client.WriteTo(data, p.listenerConn.LocalAddr())
+				if data, _ := receive(upstream); data != nil {
+					forwarded++
+				}
+			}
+			if forwarded != tt.forwarded {
+				t.Errorf("forwarded = %d, want %d", forwarded, tt.forwarded)
+			}
+			if got := p.ActiveSessions(); got != tt.sessions {
+				t.Errorf("sessions = %d, want %d", got, tt.sessions)
+			}
+			if got := p.Stats().Dropped; got != tt.dropped {
+				t.Errorf("dropped = %d, want %d", got, tt.dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"vpc/pkg/utils"
+)
+
+// PortAssignment is a port handed to a named Wireguard interface or relay.
+type PortAssignment struct {
+	Service  string `json:"service"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+// Peer is a Wireguard peer as it should be configured.
+type Peer struct {
+	PublicKey  string   `json:"public_key"`
+	AllowedIPs []string `json:"allowed_ips"`
+	// PrivateKey is set when the key pair was generated for the client.
+	PrivateKey string `json:"private_key,omitempty"`
+	// Profile is the split tunnel profile of the client when it is not the
+	// default one, ProfileCIDRs are its CIDRs.
+	Profile      string   `json:"profile,omitempty"`
+	ProfileCIDRs []string `json:"profile_cidrs,omitempty"`
+}
+
+// Interface is a Wireguard interface as it should exist in the kernel. The
+// reconcile loop recreates it from here when it drifts or disappears.
+type Interface struct {
+	Name         string `json:"name"`
+	Port         int    `json:"port"`
+	Address      string `json:"address"`
+	PrivateKey   string `json:"private_key"`
+	MTU          int    `json:"mtu"`
+	Firewall     string `json:"firewall"`
+	FirewallMark int    `json:"firewall_mark,omitempty"`
+	Endpoint     string `json:"endpoint"`
+	RateLimit    int64  `json:"rate_limit,omitempty"`
+	Peers        []Peer `json:"peers"`
+}
+
+// Data is everything the daemon persists between restarts.
+type Data struct {
+	Ports      map[string]PortAssignment `json:"ports"`
+	Interfaces map[string]Interface      `json:"interfaces"`
+}
+
+// Store keeps Data in a JSON file. A Store without a path only lives in
+// memory. The file holds the private keys of the interfaces and of the
+// clients they generated keys for, so client configs can be handed out
+// again, and it is only readable by its owner.
+type Store struct {
+	path string
+	lock sync.Mutex
+	data Data
+}
+
+func newData() Data {
+	return Data{
+		Ports:      map[string]PortAssignment{},
+		Interfaces: map[string]Interface{},
+	}
+}
+
+// Open loads the state file at path, a missing file is an empty state.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, data: newData()}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.data); err != nil {
+		return nil, err
+	}
+	s.data.fill()
+	return s, nil
+}
+
+func (d *Data) fill() {
+	if d.Ports == nil {
+		d.Ports = map[string]PortAssignment{}
+	}
+	if d.Interfaces == nil {
+		d.Interfaces = map[string]Interface{}
+	}
+}
+
+// View calls fn with the current state. fn must not keep references to it.
+func (s *Store) View(fn func(*Data)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fn(&s.data)
+}
+
+// Update calls fn with the current state and saves it when fn succeeds.
+func (s *Store) Update(fn func(*Data) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := fn(&s.data); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(&s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path, b, 0600)
+}
+
+// Export returns the state as written to the state file.
+func (s *Store) Export() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return json.MarshalIndent(&s.data, "", "  ")
+}
+
+// Import replaces the state with an exported one and saves it.
+func (s *Store) Import(b []byte) error {
+	data := newData()
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	data.fill()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data = data
+	return s.save()
+}
@@ -0,0 +1,796 @@
+package tenant
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"vpc/pkg/audit"
+	"vpc/pkg/control"
+
+	"go.uber.org/zap"
+)
+
+// Backend is the part of the control plane the manager works on.
+type Backend interface {
+	CallAgentContext(ctx context.Context, agent string, uri string, arg interface{}, result interface{}) error
+}
+
+// Manager keeps the tenants, their networks and peers, and makes the
+// changes on the agents. The lock is not held during the agent calls: a
+// change reserves what it works on under the lock, makes the call, and
+// commits or rolls back under the lock again, so the limits hold.
+type Manager struct {
+	Logger *zap.Logger
+	// Audit gets the removals of expired peers, the other changes are
+	// recorded by the callers.
+	Audit   *audit.Log
+	backend Backend
+	lock    sync.Mutex
+	store   *store
+	// pending has the networks being deleted, the interfaces being
+	// destroyed, the peers being added or removed and the subnets being
+	// created, calls counts the agent calls in flight per network and
+	// adding the peers being added per tenant.
+	pending map[string]bool
+	calls   map[string]int
+	adding  map[string]int
+	done    chan struct{}
+}
+
+// NewManager loads the tenants saved at path, an empty path keeps them in
+// memory only.
+func NewManager(logger *zap.Logger, backend Backend, path string) (*Manager, error) {
+	s, err := openStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		Logger:  logger,
+		backend: backend,
+		store:   s,
+		pending: map[string]bool{},
+		calls:   map[string]int{},
+		adding:  map[string]int{},
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func interfaceKey(network string, iface Interface) string {
+	return network + " iface " + iface.Agent + "/" + iface.Name
+}
+
+func subnetKey(network string, subnet string) string {
+	return network + " subnet " + subnet
+}
+
+// reserve marks keys of network as pending for an agent call made without
+// the lock. It fails when the network is being deleted or a key is already
+// pending.
+func (m *Manager) reserve(network string, keys ...string) error {
+	if m.pending[network] {
+		return fmt.Errorf("network %s is being deleted: %w", network, ErrInUse)
+	}
+	for _, key := range keys {
+		if m.pending[key] {
+			return fmt.Errorf("%s has a change in progress: %w", key, ErrInUse)
+		}
+	}
+	for _, key := range keys {
+		m.pending[key] = true
+	}
+	m.calls[network]++
+	return nil
+}
+
+// release undoes reserve once the call is done.
+func (m *Manager) release(network string, keys ...string) {
+	for _, key := range keys {
+		delete(m.pending, key)
+	}
+	if m.calls[network]--; m.calls[network] <= 0 {
+		delete(m.calls, network)
+	}
+}
+
+// Start removes expired peers every interval until Close.
+func (m *Manager) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case now := <-ticker.C:
+				m.expire(now)
+			}
+		}
+	}()
+}
+
+func (m *Manager) Close() {
+	close(m.done)
+}
+
+// Authenticate returns the tenant whose API token is token.
+func (m *Manager) Authenticate(token string) (string, bool) {
+	hash := []byte(hashToken(token))
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for name, t := range m.store.data.Tenants {
+		if subtle.ConstantTimeCompare(hash, []byte(t.TokenHash)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Owner returns the tenant whose network the interface iface of agent
+// serves.
+func (m *Manager) Owner(agent string, iface string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, n := range m.store.data.Networks {
+		for _, i := range n.Interfaces {
+			if i.Agent == agent && i.Name == iface {
+				return n.Tenant, true
+			}
+		}
+	}
+	return "", false
+}
+
+func public(t Tenant) Tenant {
+	t.TokenHash = ""
+	return t
+}
+
+// Tenants lists the tenants sorted by name.
+func (m *Manager) Tenants() []Tenant {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tenants := make([]Tenant, 0, len(m.store.data.Tenants))
+	for _, t := range m.store.data.Tenants {
+		tenants = append(tenants, public(t))
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants
+}
+
+func (m *Manager) Tenant(name string) (Tenant, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t, err := m.tenant(name)
+	return public(t), err
+}
+
+func (m *Manager) tenant(name string) (Tenant, error) {
+	t, found := m.store.data.Tenants[name]
+	if !found {
+		return Tenant{}, fmt.Errorf("tenant %s: %w", name, ErrNotFound)
+	}
+	return t, nil
+}
+
+// CreateTenant creates a tenant and returns it with its API token, which
+// is not kept and cannot be read again.
+func (m *Manager) CreateTenant(name string, limits Limits) (Tenant, string, error) {
+	if err := validName("tenant", name); err != nil {
+		return Tenant{}, "", err
+	}
+	if err := limits.validate(); err != nil {
+		return Tenant{}, "", err
+	}
+	token, err := newToken()
+	if err != nil {
+		return Tenant{}, "", err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.store.data.Tenants[name]; found {
+		return Tenant{}, "", fmt.Errorf("tenant %s: %w", name, ErrExists)
+	}
+	t := Tenant{Name: name, Limits: limits, Created: time.Now().UTC(), TokenHash: hashToken(token)}
+	m.store.data.Tenants[name] = t
+	if err := m.store.save(); err != nil {
+		delete(m.store.data.Tenants, name)
+		return Tenant{}, "", err
+	}
+	return public(t), token, nil
+}
+
+// SetLimits changes the limits of a tenant. What it already has is kept
+// when over the new limits, the interface bandwidth is applied to each of
+// its interfaces.
+func (m *Manager) SetLimits(ctx context.Context, name string, limits Limits) (Tenant, error) {
+	if err := limits.validate(); err != nil {
+		return Tenant{}, err
+	}
+	m.lock.Lock()
+	t, err := m.tenant(name)
+	if err != nil {
+		m.lock.Unlock()
+		return Tenant{}, err
+	}
+	old := t.Limits
+	t.Limits = limits
+	m.store.data.Tenants[name] = t
+	if err := m.store.save(); err != nil {
+		t.Limits = old
+		m.store.data.Tenants[name] = t
+		m.lock.Unlock()
+		return Tenant{}, err
+	}
+	var ifaces []Interface
+	if limits.InterfaceBandwidth != old.InterfaceBandwidth {
+		for _, n := range m.networks(name) {
+			ifaces = append(ifaces, n.Interfaces...)
+		}
+	}
+	m.lock.Unlock()
+
+	var errs []error
+	for _, iface := range ifaces {
+		if err := m.rateLimit(ctx, iface, limits.InterfaceBandwidth); err != nil {
+			errs = append(errs, fmt.Errorf("%s on %s: %v", iface.Name, iface.Agent, err))
+		}
+	}
+	if len(errs) > 0 {
+		return public(t), fmt.Errorf("failed to apply the bandwidth limit: %v", errs)
+	}
+	return public(t), nil
+}
+
+func (m *Manager) rateLimit(ctx context.Context, iface Interface, bandwidth int64) error {
+	arg := &control.RateLimitArgs{Name: iface.Name, RateLimit: bandwidth}
+	return m.backend.CallAgentContext(ctx, iface.Agent, "/node/wg_rate_limit", arg, new(control.WireguardInfo))
+}
+
+// DeleteTenant removes a tenant without networks.
+func (m *Manager) DeleteTenant(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t, err := m.tenant(name)
+	if err != nil {
+		return err
+	}
+	if len(m.networks(name)) > 0 {
+		return fmt.Errorf("tenant %s has networks: %w", name, ErrInUse)
+	}
+	delete(m.store.data.Tenants, name)
+	if err := m.store.save(); err != nil {
+		m.store.data.Tenants[name] = t
+		return err
+	}
+	return nil
+}
+
+// networks returns the networks of tenant sorted by name.
+func (m *Manager) networks(tenant string) []Network {
+	networks := []Network{}
+	for _, n := range m.store.data.Networks {
+		if n.Tenant == tenant {
+			networks = append(networks, n)
+		}
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return networks
+}
+
+// Networks lists the networks of a tenant sorted by name.
+func (m *Manager) Networks(tenant string) ([]Network, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, err := m.tenant(tenant); err != nil {
+		return nil, err
+	}
+	return m.networks(tenant), nil
+}
+
+func (m *Manager) Network(tenant string, name string) (Network, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.network(tenant, name)
+}
+
+func (m *Manager) network(tenant string, name string) (Network, error) {
+	if _, err := m.tenant(tenant); err != nil {
+		return Network{}, err
+	}
+	n, found := m.store.data.Networks[networkKey(tenant, name)]
+	if !found {
+		return Network{}, fmt.Errorf("network %s: %w", name, ErrNotFound)
+	}
+	return n, nil
+}
+
+// CreateNetwork creates a network with the IPv4 address space address, at
+// most a /24. Address spaces do not overlap, so the interfaces of any
+// tenants can share an agent.
+func (m *Manager) CreateNetwork(tenant string, name string, address string) (Network, error) {
+	if err := validName("network", name); err != nil {
+		return Network{}, err
+	}
+	_, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return Network{}, fmt.Errorf("address %q: %v: %w", address, err, ErrInvalid)
+	}
+	if ones, bits := ipnet.Mask.Size(); bits != 32 || ones > 24 {
+		return Network{}, fmt.Errorf("address %s must be an IPv4 network of at least a /24: %w", address, ErrInvalid)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return Network{}, err
+	}
+	key := networkKey(tenant, name)
+	if _, found := m.store.data.Networks[key]; found {
+		return Network{}, fmt.Errorf("network %s: %w", name, ErrExists)
+	}
+	if max := t.Limits.Networks; max > 0 && len(m.networks(tenant)) >= max {
+		return Network{}, &LimitError{Tenant: tenant, Limit: "networks", Max: max}
+	}
+	for _, other := range m.store.data.Networks {
+		_, o, err := net.ParseCIDR(other.Address)
+		if err == nil && (o.Contains(ipnet.IP) || ipnet.Contains(o.IP)) {
+			return Network{}, fmt.Errorf("address %s overlaps another network: %w", ipnet, ErrInUse)
+		}
+	}
+	n := Network{Tenant: tenant, Name: name, Address: ipnet.String(), Interfaces: []Interface{}, Created: time.Now().UTC()}
+	m.store.data.Networks[key] = n
+	if err := m.store.save(); err != nil {
+		delete(m.store.data.Networks, key)
+		return Network{}, err
+	}
+	return n, nil
+}
+
+// DeleteNetwork destroys the interfaces of a network on their agents, with
+// their peers, and removes it. It stops at the first interface that cannot
+// be destroyed, the ones already destroyed are forgotten. A network with
+// other changes in progress is not deleted.
+func (m *Manager) DeleteNetwork(ctx context.Context, tenant string, name string) error {
+	m.lock.Lock()
+	n, err := m.network(tenant, name)
+	if err != nil {
+		m.lock.Unlock()
+		return err
+	}
+	key := networkKey(tenant, name)
+	if m.calls[key] > 0 {
+		m.lock.Unlock()
+		return fmt.Errorf("network %s has changes in progress: %w", name, ErrInUse)
+	}
+	// marking the network refuses every other change to it until done
+	m.pending[key] = true
+	m.calls[key]++
+	m.lock.Unlock()
+
+	var destroyed []Interface
+	for _, iface := range n.Interfaces {
+		if err = m.destroy(ctx, iface); err != nil {
+			break
+		}
+		destroyed = append(destroyed, iface)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.release(key, key)
+	n, _ = m.network(tenant, name)
+	for _, iface := range destroyed {
+		m.forgetInterface(&n, iface)
+	}
+	if err != nil {
+		if serr := m.store.save(); serr != nil {
+			m.Logger.Error("failed to save tenants", zap.Error(serr))
+		}
+		return err
+	}
+	delete(m.store.data.Networks, key)
+	return m.store.save()
+}
+
+// freeSubnet returns the first /24 of n no interface of it uses or is
+// being created in.
+func (m *Manager) freeSubnet(n Network) (string, error) {
+	_, ipnet, err := net.ParseCIDR(n.Address)
+	if err != nil {
+		return "", err
+	}
+	used := map[string]bool{}
+	for _, iface := range n.Interfaces {
+		used[iface.Subnet] = true
+	}
+	key := networkKey(n.Tenant, n.Name)
+	ones, _ := ipnet.Mask.Size()
+	base := binary.BigEndian.Uint32(ipnet.IP.To4())
+	for i := uint32(0); i < 1<<uint(24-ones); i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+i<<8)
+		subnet := fmt.Sprintf("%s/24", ip)
+		if !used[subnet] && !m.pending[subnetKey(key, subnet)] {
+			return subnet, nil
+		}
+	}
+	return "", fmt.Errorf("network %s has no free /24 left: %w", n.Name, ErrInUse)
+}
+
+// AddInterface creates an interface for a network on agent, in the next
+// free /24 of its address space and shaped to the interface bandwidth.
+func (m *Manager) AddInterface(ctx context.Context, tenant string, network string, agent string) (Interface, error) {
+	m.lock.Lock()
+	t, err := m.tenant(tenant)
+	if err != nil {
+		m.lock.Unlock()
+		return Interface{}, err
+	}
+	n, err := m.network(tenant, network)
+	if err != nil {
+		m.lock.Unlock()
+		return Interface{}, err
+	}
+	key := networkKey(tenant, network)
+	subnet, err := m.freeSubnet(n)
+	if err == nil {
+		err = m.reserve(key, subnetKey(key, subnet))
+	}
+	m.lock.Unlock()
+	if err != nil {
+		return Interface{}, err
+	}
+
+	bandwidth := t.Limits.InterfaceBandwidth
+	var info control.WireguardInfo
+	arg := &control.WireguardArgs{Subnet: subnet, RateLimit: bandwidth}
+	err = m.backend.CallAgentContext(ctx, agent, "/node/wg_create", arg, &info)
+	iface := Interface{Agent: agent, Name: info.Name, Subnet: subnet, PublicKey: info.PublicKey, Endpoint: info.Endpoint}
+
+	m.lock.Lock()
+	m.release(key, subnetKey(key, subnet))
+	if err != nil {
+		m.lock.Unlock()
+		return Interface{}, err
+	}
+	// the network cannot be deleted while the call was in flight
+	n, _ = m.network(tenant, network)
+	n.Interfaces = append(n.Interfaces, iface)
+	m.store.data.Networks[key] = n
+	if err := m.store.save(); err != nil {
+		n.Interfaces = n.Interfaces[:len(n.Interfaces)-1]
+		m.store.data.Networks[key] = n
+		m.lock.Unlock()
+		m.destroy(ctx, iface)
+		return Interface{}, err
+	}
+	// the limits may have changed during the call
+	t, _ = m.tenant(tenant)
+	m.lock.Unlock()
+	if t.Limits.InterfaceBandwidth != bandwidth {
+		if err := m.rateLimit(ctx, iface, t.Limits.InterfaceBandwidth); err != nil {
+			return iface, fmt.Errorf("failed to apply the bandwidth limit: %v", err)
+		}
+	}
+	return iface, nil
+}
+
+// RemoveInterface destroys an interface of a network with its peers. An
+// interface is not removed while other changes to its network are in
+// progress.
+func (m *Manager) RemoveInterface(ctx context.Context, tenant string, network string, name string) error {
+	m.lock.Lock()
+	n, err := m.network(tenant, network)
+	if err != nil {
+		m.lock.Unlock()
+		return err
+	}
+	var iface *Interface
+	for i := range n.Interfaces {
+		if n.Interfaces[i].Name == name {
+			iface = &n.Interfaces[i]
+		}
+	}
+	key := networkKey(tenant, network)
+	switch {
+	case iface == nil:
+		err = fmt.Errorf("interface %s: %w", name, ErrNotFound)
+	case m.calls[key] > 0:
+		err = fmt.Errorf("network %s has changes in progress: %w", network, ErrInUse)
+	default:
+		err = m.reserve(key, interfaceKey(key, *iface))
+	}
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = m.destroy(ctx, *iface)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.release(key, interfaceKey(key, *iface))
+	if err != nil {
+		return err
+	}
+	n, _ = m.network(tenant, network)
+	m.forgetInterface(&n, *iface)
+	return m.store.save()
+}
+
+func (m *Manager) destroy(ctx context.Context, iface Interface) error {
+	return m.backend.CallAgentContext(ctx, iface.Agent, "/node/wg_destroy", &control.NameArgs{Name: iface.Name}, new(bool))
+}
+
+// forgetInterface removes iface and its peers from n, without saving.
+func (m *Manager) forgetInterface(n *Network, iface Interface) {
+	for key, p := range m.store.data.Peers {
+		if p.Tenant == n.Tenant && p.Network == n.Name && p.Agent == iface.Agent && p.Iface == iface.Name {
+			delete(m.store.data.Peers, key)
+		}
+	}
+	var kept []Interface
+	for _, i := range n.Interfaces {
+		if i != iface {
+			kept = append(kept, i)
+		}
+	}
+	n.Interfaces = append([]Interface{}, kept...)
+	m.store.data.Networks[networkKey(n.Tenant, n.Name)] = *n
+}
+
+// Peers lists the peers of a network sorted by name.
+func (m *Manager) Peers(tenant string, network string) ([]Peer, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, err := m.network(tenant, network); err != nil {
+		return nil, err
+	}
+	peers := []Peer{}
+	for _, p := range m.store.data.Peers {
+		if p.Tenant == tenant && p.Network == network {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers, nil
+}
+
+func (m *Manager) Peer(tenant string, network string, name string) (Peer, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.peer(tenant, network, name)
+}
+
+func (m *Manager) peer(tenant string, network string, name string) (Peer, error) {
+	if _, err := m.network(tenant, network); err != nil {
+		return Peer{}, err
+	}
+	p, found := m.store.data.Peers[peerKey(tenant, network, name)]
+	if !found {
+		return Peer{}, fmt.Errorf("peer %s: %w", name, ErrNotFound)
+	}
+	return p, nil
+}
+
+// AddPeer adds a peer to a network and returns it with its wg-quick config.
+func (m *Manager) AddPeer(ctx context.Context, tenant string, network string, spec PeerSpec) (Peer, string, error) {
+	if err := validName("peer", spec.Name); err != nil {
+		return Peer{}, "", err
+	}
+	m.lock.Lock()
+	iface, err := m.reservePeer(tenant, network, spec)
+	m.lock.Unlock()
+	if err != nil {
+		return Peer{}, "", err
+	}
+
+	var conf control.PeerConfig
+	err = m.backend.CallAgentContext(ctx, iface.Agent, "/node/peer_add", &control.PeerArgs{Iface: iface.Name}, &conf)
+
+	m.lock.Lock()
+	key := networkKey(tenant, network)
+	m.release(key, peerKey(tenant, network, spec.Name))
+	if m.adding[tenant]--; m.adding[tenant] <= 0 {
+		delete(m.adding, tenant)
+	}
+	if err != nil {
+		m.lock.Unlock()
+		return Peer{}, "", err
+	}
+	p := Peer{
+		Tenant:    tenant,
+		Network:   network,
+		Name:      spec.Name,
+		Owner:     spec.Owner,
+		Tags:      tags(spec.Tags),
+		Expires:   spec.Expires,
+		Agent:     iface.Agent,
+		Iface:     iface.Name,
+		PublicKey: conf.PublicKey,
+		Created:   time.Now().UTC(),
+	}
+	m.store.data.Peers[peerKey(tenant, network, spec.Name)] = p
+	err = m.store.save()
+	if err != nil {
+		delete(m.store.data.Peers, peerKey(tenant, network, spec.Name))
+	}
+	m.lock.Unlock()
+	if err != nil {
+		m.backend.CallAgentContext(ctx, iface.Agent, "/node/peer_remove", &control.PeerArgs{Iface: iface.Name, PublicKey: conf.PublicKey}, new(bool))
+		return Peer{}, "", err
+	}
+	return p, conf.Config, nil
+}
+
+// reservePeer checks a new peer against the limits and reserves its name
+// and the interface it goes to. The peers being added count to the limit.
+func (m *Manager) reservePeer(tenant string, network string, spec PeerSpec) (Interface, error) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return Interface{}, err
+	}
+	n, err := m.network(tenant, network)
+	if err != nil {
+		return Interface{}, err
+	}
+	key := peerKey(tenant, network, spec.Name)
+	if _, found := m.store.data.Peers[key]; found {
+		return Interface{}, fmt.Errorf("peer %s: %w", spec.Name, ErrExists)
+	}
+	count := m.adding[tenant]
+	for _, p := range m.store.data.Peers {
+		if p.Tenant == tenant {
+			count++
+		}
+	}
+	if max := t.Limits.Peers; max > 0 && count >= max {
+		return Interface{}, &LimitError{Tenant: tenant, Limit: "peers", Max: max}
+	}
+	iface, err := m.pickInterface(n, spec.Iface)
+	if err != nil {
+		return Interface{}, err
+	}
+	if err := m.reserve(networkKey(tenant, network), key); err != nil {
+		return Interface{}, err
+	}
+	m.adding[tenant]++
+	return iface, nil
+}
+
+func tags(t []string) []string {
+	if t == nil {
+		return []string{}
+	}
+	return t
+}
+
+// pickInterface returns the interface of n called name, or the one with the
+// fewest peers. Interfaces being destroyed are not picked.
+func (m *Manager) pickInterface(n Network, name string) (Interface, error) {
+	peers := map[string]int{}
+	for _, p := range m.store.data.Peers {
+		if p.Tenant == n.Tenant && p.Network == n.Name {
+			peers[p.Agent+"/"+p.Iface]++
+		}
+	}
+	key := networkKey(n.Tenant, n.Name)
+	var best *Interface
+	for i, iface := range n.Interfaces {
+		if m.pending[interfaceKey(key, iface)] {
+			if iface.Name == name {
+				return Interface{}, fmt.Errorf("interface %s is being removed: %w", name, ErrInUse)
+			}
+			continue
+		}
+		if name != "" && iface.Name == name {
+			return iface, nil
+		}
+		if best == nil || peers[iface.Agent+"/"+iface.Name] < peers[best.Agent+"/"+best.Name] {
+			best = &n.Interfaces[i]
+		}
+	}
+	if name != "" {
+		return Interface{}, fmt.Errorf("interface %s: %w", name, ErrNotFound)
+	}
+	if best == nil {
+		return Interface{}, fmt.Errorf("network %s has no interface: %w", n.Name, ErrInvalid)
+	}
+	return *best, nil
+}
+
+// UpdatePeer replaces the owner, tags and expiry of a peer.
+func (m *Manager) UpdatePeer(tenant string, network string, name string, spec PeerSpec) (Peer, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p, err := m.peer(tenant, network, name)
+	if err != nil {
+		return Peer{}, err
+	}
+	old := p
+	p.Owner, p.Tags, p.Expires = spec.Owner, tags(spec.Tags), spec.Expires
+	key := peerKey(tenant, network, name)
+	m.store.data.Peers[key] = p
+	if err := m.store.save(); err != nil {
+		m.store.data.Peers[key] = old
+		return Peer{}, err
+	}
+	return p, nil
+}
+
+// RemovePeer removes a peer from its interface and forgets it.
+func (m *Manager) RemovePeer(ctx context.Context, tenant string, network string, name string) error {
+	m.lock.Lock()
+	p, err := m.peer(tenant, network, name)
+	if err == nil {
+		err = m.reserve(networkKey(tenant, network), peerKey(tenant, network, name))
+	}
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return m.removePeer(ctx, p)
+}
+
+// removePeer removes a reserved peer from its interface and forgets it.
+func (m *Manager) removePeer(ctx context.Context, p Peer) error {
+	err := m.backend.CallAgentContext(ctx, p.Agent, "/node/peer_remove", &control.PeerArgs{Iface: p.Iface, PublicKey: p.PublicKey}, new(bool))
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := peerKey(p.Tenant, p.Network, p.Name)
+	m.release(networkKey(p.Tenant, p.Network), key)
+	if err != nil {
+		return err
+	}
+	delete(m.store.data.Peers, key)
+	return m.store.save()
+}
+
+// PeerConfig returns the wg-quick config of a peer.
+func (m *Manager) PeerConfig(ctx context.Context, tenant string, network string, name string) (string, error) {
+	m.lock.Lock()
+	p, err := m.peer(tenant, network, name)
+	m.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	var conf control.PeerConfig
+	if err := m.backend.CallAgentContext(ctx, p.Agent, "/node/peer_config", &control.PeerArgs{Iface: p.Iface, PublicKey: p.PublicKey}, &conf); err != nil {
+		return "", err
+	}
+	return conf.Config, nil
+}
+
+// expire removes the peers whose expiry is before now. Peers with another
+// change in progress are left to the next run.
+func (m *Manager) expire(now time.Time) {
+	var expired []Peer
+	m.lock.Lock()
+	for key, p := range m.store.data.Peers {
+		if p.Expires == nil || p.Expires.After(now) {
+			continue
+		}
+		if m.reserve(networkKey(p.Tenant, p.Network), key) == nil {
+			expired = append(expired, p)
+		}
+	}
+	m.lock.Unlock()
+
+	ctx := control.WithActor(context.Background(), "expiry")
+	for _, p := range expired {
+		err := m.removePeer(ctx, p)
+		if aerr := m.Audit.Change("expiry", "peer.expire", fmt.Sprintf("tenant/%s/network/%s/peer/%s", p.Tenant, p.Network, p.Name), p, nil, err); aerr != nil {
+			m.Logger.Error("failed to write audit record", zap.Error(aerr))
+		}
+		if err != nil {
+			m.Logger.Warn("failed to remove expired peer", zap.String("tenant", p.Tenant), zap.String("network", p.Network), zap.String("name", p.Name), zap.Error(err))
+			continue
+		}
+		m.Logger.Info("removed expired peer", zap.String("tenant", p.Tenant), zap.String("network", p.Network), zap.String("name", p.Name))
+	}
+}
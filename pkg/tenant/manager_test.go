@@ -0,0 +1,348 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"vpc/pkg/control"
+
+	"go.uber.org/zap"
+)
+
+// fakeBackend answers the agent calls of the manager. A call to a uri in
+// block waits for its channel to be closed, after telling started.
+type fakeBackend struct {
+	lock    sync.Mutex
+	calls   []string
+	fail    map[string]error
+	block   map[string]chan struct{}
+	started chan string
+	created int
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{fail: map[string]error{}, block: map[string]chan struct{}{}, started: make(chan string, 10)}
+}
+
+func (b *fakeBackend) CallAgentContext(ctx context.Context, agent string, uri string, arg interface{}, result interface{}) error {
+	b.lock.Lock()
+	b.calls = append(b.calls, agent+" "+uri)
+	wait := b.block[uri]
+	err := b.fail[uri]
+	b.lock.Unlock()
+	if wait != nil {
+		b.started <- uri
+		<-wait
+	}
+	if err != nil {
+		return err
+	}
+	switch r := result.(type) {
+	case *control.WireguardInfo:
+		b.lock.Lock()
+		b.created++
+		r.Name = fmt.Sprintf("wg%d", b.created)
+		b.lock.Unlock()
+		r.PublicKey = "iface-key"
+	case *control.PeerConfig:
+		r.PublicKey = "peer-key-" + arg.(*control.PeerArgs).Iface
+		r.Config = "[Interface]"
+	}
+	return nil
+}
+
+// hold makes the calls to uri wait until the returned function is called.
+func (b *fakeBackend) hold(uri string) func() {
+	ch := make(chan struct{})
+	b.lock.Lock()
+	b.block[uri] = ch
+	b.lock.Unlock()
+	return func() {
+		b.lock.Lock()
+		delete(b.block, uri)
+		b.lock.Unlock()
+		close(ch)
+	}
+}
+
+func (b *fakeBackend) count(call string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := 0
+	for _, c := range b.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+// newNetwork returns a manager with tenant t of limits and its network n
+// of address, served by one interface on agent a1.
+func newNetwork(t *testing.T, backend *fakeBackend, limits Limits, address string) *Manager {
+	t.Helper()
+	m, err := NewManager(zap.NewNop(), backend, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.CreateTenant("t", limits); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateNetwork("t", "n", address); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddInterface(context.Background(), "t", "n", "a1"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func isLimit(err error, limit string) bool {
+	var lerr *LimitError
+	return errors.As(err, &lerr) && lerr.Limit == limit
+}
+
+func TestCreateNetwork(t *testing.T) {
+	m, err := NewManager(zap.NewNop(), newFakeBackend(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.CreateTenant("t", Limits{Networks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.CreateTenant("u", Limits{}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		tenant  string
+		network string
+		address string
+		check   func(error) bool
+	}{
+		{name: "first", tenant: "t", network: "a", address: "10.1.0.0/16", check: func(err error) bool { return err == nil }},
+		{name: "same name", tenant: "t", network: "a", address: "10.2.0.0/16", check: func(err error) bool { return errors.Is(err, ErrExists) }},
+		{name: "too small", tenant: "t", network: "b", address: "10.2.0.0/25", check: func(err error) bool { return errors.Is(err, ErrInvalid) }},
+		{name: "overlap inside", tenant: "u", network: "a", address: "10.1.5.0/24", check: func(err error) bool { return errors.Is(err, ErrInUse) }},
+		{name: "overlap around", tenant: "u", network: "a", address: "10.0.0.0/8", check: func(err error) bool { return errors.Is(err, ErrInUse) }},
+		{name: "second", tenant: "t", network: "b", address: "10.2.0.0/24", check: func(err error) bool { return err == nil }},
+		{name: "over the limit", tenant: "t", network: "c", address: "10.3.0.0/24", check: func(err error) bool { return isLimit(err, "networks") }},
+		{name: "other tenant", tenant: "u", network: "c", address: "10.3.0.0/24", check: func(err error) bool { return err == nil }},
+		{name: "no tenant", tenant: "v", network: "a", address: "10.4.0.0/24", check: func(err error) bool { return errors.Is(err, ErrNotFound) }},
+	}
+	for _, step := range steps {
+		if _, err := m.CreateNetwork(step.tenant, step.network, step.address); !step.check(err) {
+			t.Fatalf("%s: CreateNetwork() error = %v", step.name, err)
+		}
+	}
+}
+
+func TestAddInterfaceSubnets(t *testing.T) {
+	backend := newFakeBackend()
+	m := newNetwork(t, backend, Limits{InterfaceBandwidth: 1000}, "10.1.0.0/23")
+
+	// a failed create leaves nothing behind
+	backend.fail["/node/wg_create"] = errors.New("agent down")
+	if _, err := m.AddInterface(context.Background(), "t", "n", "a2"); err == nil {
+		t.Fatal("AddInterface() with a failing agent succeeded")
+	}
+	if n, _ := m.Network("t", "n"); len(n.Interfaces) != 1 || len(m.pending) != 0 || len(m.calls) != 0 {
+		t.Fatalf("after a failed create: interfaces = %v, pending = %v, calls = %v", n.Interfaces, m.pending, m.calls)
+	}
+	delete(backend.fail, "/node/wg_create")
+
+	// a subnet being created is not handed out twice
+	done := backend.hold("/node/wg_create")
+	first := make(chan error, 1)
+	go func() {
+		_, err := m.AddInterface(context.Background(), "t", "n", "a2")
+		first <- err
+	}()
+	<-backend.started
+	if _, err := m.AddInterface(context.Background(), "t", "n", "a3"); !errors.Is(err, ErrInUse) {
+		t.Fatalf("AddInterface() with the last /24 in flight: error = %v, want %v", err, ErrInUse)
+	}
+	if err := m.DeleteNetwork(context.Background(), "t", "n"); !errors.Is(err, ErrInUse) {
+		t.Fatalf("DeleteNetwork() during a call: error = %v, want %v", err, ErrInUse)
+	}
+	done()
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.Network("t", "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.Interfaces) != 2 || n.Interfaces[0].Subnet != "10.1.0.0/24" || n.Interfaces[1].Subnet != "10.1.1.0/24" {
+		t.Fatalf("interfaces = %v", n.Interfaces)
+	}
+	if owner, ok := m.Owner("a2", n.Interfaces[1].Name); !ok || owner != "t" {
+		t.Errorf("Owner() = %q, %v", owner, ok)
+	}
+}
+
+func TestAddPeerLimit(t *testing.T) {
+	backend := newFakeBackend()
+	m := newNetwork(t, backend, Limits{Peers: 2}, "10.1.0.0/24")
+	ctx := context.Background()
+
+	// the peers being added count to the limit, their names are taken
+	done := backend.hold("/node/peer_add")
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p1"})
+		first <- err
+	}()
+	<-backend.started
+	if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p1"}); !errors.Is(err, ErrInUse) {
+		t.Fatalf("AddPeer() of a name in flight: error = %v, want %v", err, ErrInUse)
+	}
+	second := make(chan error, 1)
+	go func() {
+		_, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p2"})
+		second <- err
+	}()
+	<-backend.started
+	if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p3"}); !isLimit(err, "peers") {
+		t.Fatalf("AddPeer() over the limit in flight: error = %v", err)
+	}
+	done()
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p1"}); !errors.Is(err, ErrExists) {
+		t.Fatalf("AddPeer() of an existing name: error = %v, want %v", err, ErrExists)
+	}
+	if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p3"}); !isLimit(err, "peers") {
+		t.Fatalf("AddPeer() over the limit: error = %v", err)
+	}
+
+	// a failed add does not hold on to its place in the limit
+	if err := m.RemovePeer(ctx, "t", "n", "p2"); err != nil {
+		t.Fatal(err)
+	}
+	backend.fail["/node/peer_add"] = errors.New("agent down")
+	if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p3"}); err == nil {
+		t.Fatal("AddPeer() with a failing agent succeeded")
+	}
+	delete(backend.fail, "/node/peer_add")
+	p, conf, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p3"})
+	if err != nil || conf == "" || p.Iface == "" {
+		t.Fatalf("AddPeer() after a failed add = %v, %q, %v", p, conf, err)
+	}
+	if len(m.adding) != 0 || len(m.pending) != 0 || len(m.calls) != 0 {
+		t.Errorf("adding = %v, pending = %v, calls = %v", m.adding, m.pending, m.calls)
+	}
+}
+
+func TestRemoveInterfaceInFlight(t *testing.T) {
+	backend := newFakeBackend()
+	m := newNetwork(t, backend, Limits{}, "10.1.0.0/24")
+	ctx := context.Background()
+	n, _ := m.Network("t", "n")
+	iface := n.Interfaces[0].Name
+	if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// no peer goes to an interface being destroyed
+	done := backend.hold("/node/wg_destroy")
+	removed := make(chan error, 1)
+	go func() { removed <- m.RemoveInterface(ctx, "t", "n", iface) }()
+	<-backend.started
+	if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p2", Iface: iface}); !errors.Is(err, ErrInUse) {
+		t.Fatalf("AddPeer() on an interface being removed: error = %v, want %v", err, ErrInUse)
+	}
+	if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: "p2"}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("AddPeer() with only an interface being removed: error = %v, want %v", err, ErrInvalid)
+	}
+	done()
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	if peers, _ := m.Peers("t", "n"); len(peers) != 0 {
+		t.Errorf("peers of the removed interface = %v", peers)
+	}
+	if _, ok := m.Owner("a1", iface); ok {
+		t.Error("removed interface still has an owner")
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	backend := newFakeBackend()
+	m := newNetwork(t, backend, Limits{InterfaceBandwidth: 1000}, "10.1.0.0/23")
+	ctx := context.Background()
+	if _, err := m.AddInterface(ctx, "t", "n", "a2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.SetLimits(ctx, "t", Limits{InterfaceBandwidth: -1}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("SetLimits() negative: error = %v, want %v", err, ErrInvalid)
+	}
+	if _, err := m.SetLimits(ctx, "t", Limits{InterfaceBandwidth: 1000, Peers: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if backend.count("a1 /node/wg_rate_limit")+backend.count("a2 /node/wg_rate_limit") != 0 {
+		t.Error("SetLimits() without a bandwidth change shaped the interfaces")
+	}
+	if _, err := m.SetLimits(ctx, "t", Limits{InterfaceBandwidth: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if backend.count("a1 /node/wg_rate_limit") != 1 || backend.count("a2 /node/wg_rate_limit") != 1 {
+		t.Errorf("calls = %v, want one rate limit per interface", backend.calls)
+	}
+
+	// the limit is kept when an agent fails, and reported
+	backend.fail["/node/wg_rate_limit"] = errors.New("agent down")
+	tenant, err := m.SetLimits(ctx, "t", Limits{InterfaceBandwidth: 3000})
+	if err == nil || tenant.Limits.InterfaceBandwidth != 3000 {
+		t.Errorf("SetLimits() with a failing agent = %v, %v", tenant, err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	backend := newFakeBackend()
+	m := newNetwork(t, backend, Limits{}, "10.1.0.0/24")
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	for name, expires := range map[string]*time.Time{"old": &past, "new": &future, "kept": nil} {
+		if _, _, err := m.AddPeer(ctx, "t", "n", PeerSpec{Name: name, Expires: expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.expire(time.Now())
+	peers, _ := m.Peers("t", "n")
+	if len(peers) != 2 || peers[0].Name != "kept" || peers[1].Name != "new" {
+		t.Errorf("peers after expire = %v", peers)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	m, err := NewManager(zap.NewNop(), newFakeBackend(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, token, err := m.CreateTenant("t", Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.TokenHash != "" {
+		t.Error("CreateTenant() returned the token hash")
+	}
+	if name, ok := m.Authenticate(token); !ok || name != "t" {
+		t.Errorf("Authenticate() = %q, %v", name, ok)
+	}
+	if _, ok := m.Authenticate(token + "x"); ok {
+		t.Error("Authenticate() took a wrong token")
+	}
+}
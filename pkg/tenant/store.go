@@ -0,0 +1,67 @@
+package tenant
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"vpc/pkg/utils"
+)
+
+// data is everything the Manager persists. Networks are keyed by
+// "tenant/network", peers by "tenant/network/peer".
+type data struct {
+	Tenants  map[string]Tenant  `json:"tenants"`
+	Networks map[string]Network `json:"networks"`
+	Peers    map[string]Peer    `json:"peers"`
+}
+
+func networkKey(tenant string, network string) string {
+	return tenant + "/" + network
+}
+
+func peerKey(tenant string, network string, peer string) string {
+	return tenant + "/" + network + "/" + peer
+}
+
+// store keeps data in a JSON file, or in memory without a path. The Manager
+// serializes the access.
+type store struct {
+	path string
+	data data
+}
+
+func openStore(path string) (*store, error) {
+	s := &store{path: path}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, &s.data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.data.Tenants == nil {
+		s.data.Tenants = map[string]Tenant{}
+	}
+	if s.data.Networks == nil {
+		s.data.Networks = map[string]Network{}
+	}
+	if s.data.Peers == nil {
+		s.data.Peers = map[string]Peer{}
+	}
+	return s, nil
+}
+
+func (s *store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(&s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path, b, 0600)
+}
@@ -0,0 +1,127 @@
+// Package tenant is the tenancy model of the control plane. A tenant owns
+// networks, a network is an address space served by one or more Wireguard
+// interfaces on the agents, each in its own /24 of it, and peers belong to
+// a network. Every change goes through a Manager, which keeps the tenants
+// within their limits.
+package tenant
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+	ErrInUse    = errors.New("still in use")
+	ErrInvalid  = errors.New("invalid")
+)
+
+// LimitError is a change refused because the tenant would exceed Limit.
+type LimitError struct {
+	Tenant string
+	Limit  string
+	Max    int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("tenant %s is limited to %d %s", e.Tenant, e.Max, e.Limit)
+}
+
+// Limits bound what a tenant can create, zero means unlimited.
+// InterfaceBandwidth is the rate in bits per second the traffic to the
+// peers of an interface is shaped to. It applies to every interface on its
+// own, a tenant with N interfaces gets up to N times the rate.
+type Limits struct {
+	Networks           int   `json:"networks"`
+	Peers              int   `json:"peers"`
+	InterfaceBandwidth int64 `json:"interface_bandwidth"`
+}
+
+func (l Limits) validate() error {
+	if l.Networks < 0 || l.Peers < 0 || l.InterfaceBandwidth < 0 {
+		return fmt.Errorf("limits cannot be negative: %w", ErrInvalid)
+	}
+	return nil
+}
+
+// Tenant owns networks. Its API token is only kept as a hash.
+type Tenant struct {
+	Name      string    `json:"name"`
+	Limits    Limits    `json:"limits"`
+	Created   time.Time `json:"created"`
+	TokenHash string    `json:"token_hash,omitempty"`
+}
+
+// Interface is a Wireguard interface of a network, Subnet is its /24.
+type Interface struct {
+	Agent     string `json:"agent"`
+	Name      string `json:"name"`
+	Subnet    string `json:"subnet"`
+	PublicKey string `json:"public_key"`
+	Endpoint  string `json:"endpoint"`
+}
+
+// Network is an address space of a tenant and the interfaces serving it.
+type Network struct {
+	Tenant     string      `json:"tenant"`
+	Name       string      `json:"name"`
+	Address    string      `json:"address"`
+	Interfaces []Interface `json:"interfaces"`
+	Created    time.Time   `json:"created"`
+}
+
+// Peer is a client of a network, connected to the interface Iface of
+// Agent. It is removed once Expires has passed, when set.
+type Peer struct {
+	Tenant    string     `json:"tenant"`
+	Network   string     `json:"network"`
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Tags      []string   `json:"tags"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Agent     string     `json:"agent"`
+	Iface     string     `json:"iface"`
+	PublicKey string     `json:"public_key"`
+	Created   time.Time  `json:"created"`
+}
+
+// PeerSpec is what a peer is created or updated with. Iface picks the
+// interface of a new peer, the one with the fewest peers when empty, and
+// is ignored on update.
+type PeerSpec struct {
+	Name    string     `json:"name"`
+	Owner   string     `json:"owner"`
+	Tags    []string   `json:"tags"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Iface   string     `json:"iface,omitempty"`
+}
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// validName checks the name of a tenant, network or peer, which end up in
+// paths and keys.
+func validName(kind string, name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("%s name %q must be lower case letters, digits and dashes: %w", kind, name, ErrInvalid)
+	}
+	return nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
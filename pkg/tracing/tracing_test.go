@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var spans = tracetest.NewInMemoryExporter()
+
+func TestMain(m *testing.M) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+	otel.SetTextMapPropagator(propagator)
+	os.Exit(m.Run())
+}
+
+// ended returns the spans ended since the last call by name.
+func ended() map[string]tracetest.SpanStub {
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans.GetSpans() {
+		byName[s.Name] = s
+	}
+	spans.Reset()
+	return byName
+}
+
+func TestChild(t *testing.T) {
+	ctx, span := Child(context.Background(), "orphan")
+	span.End()
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		t.Error("Child() without a parent opened a span")
+	}
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Child(ctx, "child")
+	End(child, errors.New("failed"))
+	End(parent, nil)
+
+	got := ended()
+	if _, found := got["orphan"]; found || len(got) != 2 {
+		t.Fatalf("ended spans = %v", got)
+	}
+	if got["child"].Parent.SpanID() != got["parent"].SpanContext.SpanID() {
+		t.Error("child span is not under the parent")
+	}
+	if got["child"].Status.Code != codes.Error || got["parent"].Status.Code == codes.Error {
+		t.Errorf("status child = %v, parent = %v", got["child"].Status, got["parent"].Status)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	if traceparent := Inject(context.Background()); traceparent != "" {
+		t.Errorf("Inject() without a span = %q", traceparent)
+	}
+	if ctx := Extract(context.Background(), ""); trace.SpanContextFromContext(ctx).IsValid() {
+		t.Error("Extract() of an empty traceparent set a parent")
+	}
+
+	ctx, caller := Start(context.Background(), "caller")
+	traceparent := Inject(ctx)
+	caller.End()
+	_, callee := Start(Extract(context.Background(), traceparent), "callee")
+	callee.End()
+
+	got := ended()
+	if got["callee"].Parent.SpanID() != got["caller"].SpanContext.SpanID() || !got["callee"].Parent.IsRemote() {
+		t.Errorf("callee parent = %v, want remote %v", got["callee"].Parent, got["caller"].SpanContext)
+	}
+}
+
+func TestHTTPRequestContext(t *testing.T) {
+	handler := otelhttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := Child(r.Context(), "step")
+		span.End()
+	}), "api")
+
+	ctx, client := Start(context.Background(), "client")
+	req := httptest.NewRequest(http.MethodGet, "/v1/peers", nil)
+	req.Header.Set("traceparent", Inject(ctx))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	client.End()
+
+	got := ended()
+	server, found := got["api"]
+	if !found {
+		t.Fatalf("no server span, ended = %v", got)
+	}
+	if server.SpanKind != trace.SpanKindServer || server.Parent.SpanID() != got["client"].SpanContext.SpanID() {
+		t.Errorf("server span kind = %v, parent = %v", server.SpanKind, server.Parent)
+	}
+	if got["step"].Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("step of the handler is not under the server span")
+	}
+}
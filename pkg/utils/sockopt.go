@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"net"
+)
+
+// SocketOptions are applied to sockets before they are bound. The zero value
+// leaves the system defaults in place.
+//
+// All of them apply to the proxy listeners, the per client upstream sockets
+// and the relay ports. The Wireguard listen port is opened by the device,
+// not by this package: only Mark reaches it, as the device firewall mark.
+// Buffer sizes, SO_REUSEPORT, TOS, SO_BINDTODEVICE and the PMTU discovery
+// mode cannot be set on it, route or mark its traffic instead.
+type SocketOptions struct {
+	RecvBuffer   int    `yaml:"recv_buffer"`
+	SendBuffer   int    `yaml:"send_buffer"`
+	ReusePort    bool   `yaml:"reuse_port"`
+	Listeners    int    `yaml:"listeners"`
+	TOS          int    `yaml:"tos"`
+	Mark         int    `yaml:"mark"`
+	BindToDevice string `yaml:"bind_to_device"`
+	// PMTUDisc is one of "do", "dont", "want" or "probe".
+	PMTUDisc string `yaml:"pmtu_discovery"`
+}
+
+func (o *SocketOptions) listenConfig() *net.ListenConfig {
+	if o == nil {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: o.Control}
+}
+
+// ListenUDP is net.ListenUDP with the options applied.
+func (o *SocketOptions) ListenUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	address := ""
+	if laddr != nil {
+		address = laddr.String()
+	}
+	conn, err := o.listenConfig().ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Listen is net.Listen with the options applied.
+func (o *SocketOptions) Listen(network string, address string) (net.Listener, error) {
+	return o.listenConfig().Listen(context.Background(), network, address)
+}
+
+// ListenerCount is the number of sockets to bind to the same address. It is
+// only above one when SO_REUSEPORT is enabled.
+func (o *SocketOptions) ListenerCount() int {
+	if o == nil || !o.ReusePort || o.Listeners < 1 {
+		return 1
+	}
+	return o.Listeners
+}
+
+// Ephemeral returns the options for sockets bound to a random port, which
+// never share their port.
+func (o *SocketOptions) Ephemeral() *SocketOptions {
+	if o == nil {
+		return nil
+	}
+	e := *o
+	e.ReusePort = false
+	e.Listeners = 0
+	return &e
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var pmtuDiscModes = map[string][2]int{
+	"do":    {unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO},
+	"dont":  {unix.IP_PMTUDISC_DONT, unix.IPV6_PMTUDISC_DONT},
+	"want":  {unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT},
+	"probe": {unix.IP_PMTUDISC_PROBE, unix.IPV6_PMTUDISC_PROBE},
+}
+
+// Control sets the options on a raw socket, it is meant for
+// net.ListenConfig.
+func (o *SocketOptions) Control(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = o.apply(int(fd), network)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (o *SocketOptions) apply(fd int, network string) error {
+	ipv6 := network == "udp6" || network == "tcp6"
+	if o.RecvBuffer > 0 {
+		// the FORCE variant ignores rmem_max but needs CAP_NET_ADMIN
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, o.RecvBuffer); err != nil {
+			if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, o.RecvBuffer); err != nil {
+				return fmt.Errorf("SO_RCVBUF: %v", err)
+			}
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, o.SendBuffer); err != nil {
+			if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer); err != nil {
+				return fmt.Errorf("SO_SNDBUF: %v", err)
+			}
+		}
+	}
+	if o.ReusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fmt.Errorf("SO_REUSEPORT: %v", err)
+		}
+	}
+	if o.TOS > 0 {
+		// dual stack sockets carry both, so v6 sockets set the traffic class too
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, o.TOS); err != nil && !ipv6 {
+			return fmt.Errorf("IP_TOS: %v", err)
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, o.TOS); err != nil && ipv6 {
+			return fmt.Errorf("IPV6_TCLASS: %v", err)
+		}
+	}
+	if o.Mark > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, o.Mark); err != nil {
+			return fmt.Errorf("SO_MARK: %v", err)
+		}
+	}
+	if o.BindToDevice != "" {
+		if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, o.BindToDevice); err != nil {
+			return fmt.Errorf("SO_BINDTODEVICE: %v", err)
+		}
+	}
+	if o.PMTUDisc != "" {
+		mode, found := pmtuDiscModes[o.PMTUDisc]
+		if !found {
+			return fmt.Errorf("unknown pmtu discovery mode %q", o.PMTUDisc)
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, mode[0]); err != nil && !ipv6 {
+			return fmt.Errorf("IP_MTU_DISCOVER: %v", err)
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, mode[1]); err != nil && ipv6 {
+			return fmt.Errorf("IPV6_MTU_DISCOVER: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package utils
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errUnsupportedSocketOption = errors.New("socket options are not supported on this platform")
+
+// Control rejects any option other than the defaults.
+func (o *SocketOptions) Control(network, address string, c syscall.RawConn) error {
+	if *o != (SocketOptions{}) {
+		return errUnsupportedSocketOption
+	}
+	return nil
+}
@@ -30,7 +30,12 @@ func RandomString(length int) string {
 }
 
 func RandomPrivateNet() (iplib.Net, error) {
-	ipo, ipnet, err := net.ParseCIDR("10.0.0.0/8")
+	return RandomNet("10.0.0.0/8")
+}
+
+// RandomNet picks a random /24 inside pool.
+func RandomNet(pool string) (iplib.Net, error) {
+	ipo, ipnet, err := net.ParseCIDR(pool)
 	var ipne iplib.Net
 	if (err == nil) {
 		ip := ipo.To4()
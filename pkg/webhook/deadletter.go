@@ -0,0 +1,164 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+	"vpc/pkg/events"
+	"vpc/pkg/utils"
+)
+
+// maxDeadLetters bounds the store, the oldest letters go first.
+const maxDeadLetters = 10000
+
+// DeadLetter is a delivery that failed every attempt.
+type DeadLetter struct {
+	ID       string       `json:"id"`
+	Hook     string       `json:"hook"`
+	Event    events.Event `json:"event"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	Time     time.Time    `json:"time"`
+}
+
+// deadLetters keeps the letters in a file of JSON lines, or in memory
+// without a path. A letter is appended to the file, which is rewritten
+// when letters are taken or the dropped ones take as much room as the
+// kept ones.
+type deadLetters struct {
+	path    string
+	lock    sync.Mutex
+	letters []DeadLetter
+	// lines is the number of letters in the file
+	lines int
+}
+
+func openDeadLetters(path string) (*deadLetters, error) {
+	d := &deadLetters{path: path}
+	if path == "" {
+		return d, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(line, &letter); err != nil {
+			return nil, err
+		}
+		d.letters = append(d.letters, letter)
+		d.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(d.letters) > maxDeadLetters {
+		d.letters = d.letters[len(d.letters)-maxDeadLetters:]
+		if err := d.save(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *deadLetters) add(letter DeadLetter) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.letters = append(d.letters, letter)
+	if len(d.letters) > maxDeadLetters {
+		d.letters = d.letters[len(d.letters)-maxDeadLetters:]
+	}
+	if d.lines >= 2*maxDeadLetters {
+		return d.save()
+	}
+	return d.append(letter)
+}
+
+// append writes letter at the end of the file.
+func (d *deadLetters) append(letter DeadLetter) error {
+	if d.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		d.lines++
+	}
+	return err
+}
+
+func (d *deadLetters) list() []DeadLetter {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]DeadLetter(nil), d.letters...)
+}
+
+// take removes and returns the letters with the given IDs, or all of them
+// when none is given.
+func (d *deadLetters) take(ids ...string) ([]DeadLetter, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var taken, kept []DeadLetter
+	for _, letter := range d.letters {
+		if len(ids) == 0 || wanted[letter.ID] {
+			taken = append(taken, letter)
+		} else {
+			kept = append(kept, letter)
+		}
+	}
+	if len(taken) == 0 {
+		return nil, nil
+	}
+	d.letters = kept
+	return taken, d.save()
+}
+
+// save rewrites the file with the letters kept.
+func (d *deadLetters) save() error {
+	if d.path == "" {
+		return nil
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, letter := range d.letters {
+		if err := enc.Encode(letter); err != nil {
+			return err
+		}
+	}
+	if err := utils.WriteFileAtomic(d.path, b.Bytes(), 0600); err != nil {
+		return err
+	}
+	d.lines = len(d.letters)
+	return nil
+}
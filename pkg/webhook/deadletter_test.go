@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLettersReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letters.jsonl")
+	d, err := openDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := d.add(DeadLetter{ID: id, Hook: "hook", Attempts: 3, Time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 3 {
+		t.Fatalf("file has %d lines, want 3", lines)
+	}
+	if _, err := d.take("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, letter := range reopened.list() {
+		ids = append(ids, letter.ID)
+	}
+	if want := []string{"a", "c"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("reopened letters = %v, want %v", ids, want)
+	}
+	if reopened.lines != 2 {
+		t.Errorf("reopened lines = %d, want 2", reopened.lines)
+	}
+}
@@ -0,0 +1,65 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderSignature carries "t=<unix time>,v1=<hex HMAC-SHA256>", the
+	// HMAC is taken with the secret of the endpoint over "<unix time>." and
+	// the body.
+	HeaderSignature = "X-VPC-Signature"
+	// HeaderEvent is the event type, HeaderDelivery the event ID, which
+	// stays the same across retries and replays.
+	HeaderEvent    = "X-VPC-Event"
+	HeaderDelivery = "X-VPC-Delivery"
+)
+
+func mac(secret string, timestamp int64, body []byte) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	m.Write(body)
+	return m.Sum(nil)
+}
+
+// Sign returns the HeaderSignature value of body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac(secret, timestamp, body)))
+}
+
+// Verify checks a HeaderSignature value for receivers written in Go. A
+// signature older than tolerance is rejected so requests cannot be
+// replayed by someone who captured them.
+func Verify(secret string, header string, body []byte, tolerance time.Duration) error {
+	var timestamp int64
+	var sig []byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "v1":
+			sig, _ = hex.DecodeString(kv[1])
+		}
+	}
+	if timestamp == 0 || sig == nil {
+		return errors.New("malformed signature")
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature expired")
+	}
+	if !hmac.Equal(sig, mac(secret, timestamp, body)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"peer.added"}`)
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		body    []byte
+		wantErr string
+	}{
+		{name: "valid", secret: "s3cret", header: Sign("s3cret", now, body), body: body},
+		{name: "parts reordered", secret: "s3cret", header: reorder(Sign("s3cret", now, body)), body: body},
+		{name: "within tolerance", secret: "s3cret", header: Sign("s3cret", now-60, body), body: body},
+		{name: "wrong secret", secret: "other", header: Sign("s3cret", now, body), body: body, wantErr: "signature mismatch"},
+		{name: "tampered body", secret: "s3cret", header: Sign("s3cret", now, body), body: []byte(`{}`), wantErr: "signature mismatch"},
+		{name: "expired", secret: "s3cret", header: Sign("s3cret", now-600, body), body: body, wantErr: "signature expired"},
+		{name: "from the future", secret: "s3cret", header: Sign("s3cret", now+600, body), body: body, wantErr: "signature expired"},
+		{name: "no timestamp", secret: "s3cret", header: "v1=00ff", body: body, wantErr: "malformed signature"},
+		{name: "no signature", secret: "s3cret", header: fmt.Sprintf("t=%d", now), body: body, wantErr: "malformed signature"},
+		{name: "empty", secret: "s3cret", header: "", body: body, wantErr: "malformed signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.header, tt.body, 5*time.Minute)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.wantErr {
+				t.Errorf("Verify() = %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+// reorder puts the v1 part of a signature header before its timestamp.
+func reorder(header string) string {
+	parts := strings.SplitN(header, ",", 2)
+	return parts[1] + "," + parts[0]
+}
@@ -0,0 +1,294 @@
+// Package webhook posts events to the endpoints of the webhooks config
+// section. Deliveries of one subject are made in order, a failing one is
+// retried with exponential backoff and ends in the dead letters, from
+// where it can be replayed.
+package webhook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+	"vpc/pkg/config"
+	"vpc/pkg/events"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxQueued bounds the deliveries an endpoint keeps in memory, events
+	// beyond it go straight to the dead letters.
+	maxQueued = 10000
+	// maxConcurrent is how many subjects an endpoint gets at once.
+	maxConcurrent = 4
+)
+
+type delivery struct {
+	event    events.Event
+	attempts int
+	next     time.Time
+}
+
+// hook is one endpoint with a queue per subject, only the head of a queue
+// is in flight.
+type hook struct {
+	cfg      config.WebhookConfig
+	d        *Dispatcher
+	sub      *events.Subscription
+	lock     sync.Mutex
+	queues   map[string][]*delivery
+	inflight map[string]bool
+	queued   int
+	wake     chan struct{}
+}
+
+// Dispatcher delivers the events of a bus to the configured endpoints.
+type Dispatcher struct {
+	Logger *zap.Logger
+	cfg    config.WebhooksConfig
+	client *http.Client
+	hooks  map[string]*hook
+	dead   *deadLetters
+	done   chan struct{}
+}
+
+// NewDispatcher loads the dead letters of cfg, nothing is sent before
+// Start.
+func NewDispatcher(logger *zap.Logger, cfg config.WebhooksConfig) (*Dispatcher, error) {
+	dead, err := openDeadLetters(cfg.DeadLetterPath)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{
+		Logger: logger,
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		hooks:  map[string]*hook{},
+		dead:   dead,
+		done:   make(chan struct{}),
+	}
+	for _, c := range cfg.Endpoints {
+		d.hooks[c.Name] = &hook{
+			cfg:      c,
+			d:        d,
+			queues:   map[string][]*delivery{},
+			inflight: map[string]bool{},
+			wake:     make(chan struct{}, 1),
+		}
+	}
+	return d, nil
+}
+
+// Start subscribes every endpoint to its event types on bus.
+func (d *Dispatcher) Start(bus *events.Bus) {
+	for _, h := range d.hooks {
+		var types []events.Type
+		for _, t := range h.cfg.Events {
+			types = append(types, events.Type(t))
+		}
+		h.sub = bus.SubscribeOverflow("webhook "+h.cfg.Name, func(ev events.Event) {
+			h.enqueue(&delivery{event: ev})
+		}, h.overflow, types...)
+		go h.run()
+	}
+}
+
+// Close unsubscribes and stops delivering. Deliveries still queued are
+// lost, the events were published before the daemon stopped.
+func (d *Dispatcher) Close() {
+	for _, h := range d.hooks {
+		if h.sub != nil {
+			h.sub.Close()
+		}
+	}
+	close(d.done)
+}
+
+// DeadLetters lists the deliveries that failed every attempt.
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	return d.dead.list()
+}
+
+// Replay queues the dead letters with the given IDs again, or all of them
+// when none is given, and returns how many were queued. A replayed event is
+// delivered after the events of its subject queued meanwhile.
+func (d *Dispatcher) Replay(ids ...string) (int, error) {
+	letters, err := d.dead.take(ids...)
+	n := 0
+	for _, letter := range letters {
+		h, found := d.hooks[letter.Hook]
+		if !found {
+			d.Logger.Warn("dropping dead letter of removed webhook", zap.String("webhook", letter.Hook), zap.String("id", letter.ID))
+			continue
+		}
+		h.enqueue(&delivery{event: letter.Event})
+		n++
+	}
+	return n, err
+}
+
+func (d *Dispatcher) bury(h *hook, dl *delivery, reason string) {
+	// IDs sort in the order the letters were buried
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	letter := DeadLetter{
+		ID:       fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(suffix)),
+		Hook:     h.cfg.Name,
+		Event:    dl.event,
+		Attempts: dl.attempts,
+		Error:    reason,
+		Time:     time.Now(),
+	}
+	d.Logger.Warn("webhook delivery failed", zap.String("webhook", h.cfg.Name), zap.String("event", dl.event.ID), zap.String("type", string(dl.event.Type)), zap.Int("attempts", dl.attempts), zap.String("error", reason))
+	if err := d.dead.add(letter); err != nil {
+		d.Logger.Error("failed to save dead letter", zap.Error(err))
+	}
+}
+
+// backoff is the pause after the given number of failed attempts, doubled
+// every attempt with up to 20% jitter.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := float64(d.cfg.BackoffMin) * math.Pow(2, float64(attempts-1))
+	if wait > float64(d.cfg.BackoffMax) {
+		wait = float64(d.cfg.BackoffMax)
+	}
+	return time.Duration(wait * (0.8 + 0.2*mrand.Float64()))
+}
+
+func (d *Dispatcher) send(cfg config.WebhookConfig, ev events.Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(ev.Type))
+	req.Header.Set(HeaderDelivery, ev.ID)
+	if cfg.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(cfg.Secret, time.Now().Unix(), body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func (h *hook) enqueue(dl *delivery) {
+	h.lock.Lock()
+	if h.queued >= maxQueued {
+		h.lock.Unlock()
+		h.d.bury(h, dl, "queue full")
+		return
+	}
+	subject := dl.event.Subject
+	h.queues[subject] = append(h.queues[subject], dl)
+	h.queued++
+	h.lock.Unlock()
+	h.poke()
+}
+
+// overflow keeps an event the bus dropped in the dead letters, so it can
+// be replayed instead of being lost.
+func (h *hook) overflow(ev events.Event) {
+	h.d.bury(h, &delivery{event: ev}, "event bus backlog full")
+}
+
+func (h *hook) poke() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *hook) run() {
+	sem := make(chan struct{}, maxConcurrent)
+	for {
+		wait := time.Hour
+		if next := h.dispatch(sem); !next.IsZero() {
+			wait = time.Until(next)
+		}
+		select {
+		case <-h.d.done:
+			return
+		case <-h.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// dispatch sends the due heads of the queues and returns when the next
+// retry is due, zero when none is waiting.
+func (h *hook) dispatch(sem chan struct{}) time.Time {
+	now := time.Now()
+	var due []*delivery
+	var next time.Time
+	h.lock.Lock()
+	for subject, queue := range h.queues {
+		if h.inflight[subject] {
+			continue
+		}
+		head := queue[0]
+		if head.next.After(now) {
+			if next.IsZero() || head.next.Before(next) {
+				next = head.next
+			}
+			continue
+		}
+		h.inflight[subject] = true
+		due = append(due, head)
+	}
+	h.lock.Unlock()
+	for _, dl := range due {
+		sem <- struct{}{}
+		go func(dl *delivery) {
+			defer func() { <-sem }()
+			h.attempt(dl)
+		}(dl)
+	}
+	return next
+}
+
+func (h *hook) attempt(dl *delivery) {
+	err := h.d.send(h.cfg, dl.event)
+	subject := dl.event.Subject
+	h.lock.Lock()
+	dl.attempts++
+	delete(h.inflight, subject)
+	done := err == nil || dl.attempts >= h.d.cfg.MaxAttempts
+	if done {
+		if queue := h.queues[subject][1:]; len(queue) > 0 {
+			h.queues[subject] = queue
+		} else {
+			delete(h.queues, subject)
+		}
+		h.queued--
+	} else {
+		dl.next = time.Now().Add(h.d.backoff(dl.attempts))
+	}
+	h.lock.Unlock()
+	if err != nil {
+		if done {
+			h.d.bury(h, dl, err.Error())
+		} else {
+			h.d.Logger.Debug("webhook delivery failed, retrying", zap.String("webhook", h.cfg.Name), zap.String("event", dl.event.ID), zap.Int("attempts", dl.attempts), zap.Error(err))
+		}
+	}
+	h.poke()
+}
@@ -0,0 +1,31 @@
+package webhook
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"vpc/pkg/config"
+	"vpc/pkg/events"
+)
+
+func TestOverflowGoesToDeadLetters(t *testing.T) {
+	cfg := config.Default().Webhooks
+	cfg.Endpoints = []config.WebhookConfig{{Name: "audit", URL: "http://127.0.0.1:1/hook"}}
+	d, err := NewDispatcher(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := d.hooks["audit"]
+	h.overflow(events.Event{ID: "e1", Type: events.PeerAdded, Subject: "wg0"})
+
+	letters := d.DeadLetters()
+	if len(letters) != 1 || letters[0].Hook != "audit" || letters[0].Event.ID != "e1" {
+		t.Fatalf("DeadLetters() = %+v, want the dropped event", letters)
+	}
+	if n, err := d.Replay(); n != 1 || err != nil {
+		t.Fatalf("Replay() = %d, %v", n, err)
+	}
+	if got := h.queues["wg0"]; len(got) != 1 || got[0].event.ID != "e1" {
+		t.Errorf("queued after replay = %v", got)
+	}
+}
@@ -0,0 +1,61 @@
+package wireguard
+
+import (
+	"strconv"
+	"time"
+	"vpc/pkg/events"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// HandshakeTimeout is how long Wireguard keeps a session without a
+// handshake, a peer silent for longer has expired.
+const HandshakeTimeout = 180 * time.Second
+
+type peerActivity struct {
+	live      bool
+	overQuota bool
+}
+
+// ObservePeers compares the peers of the device with the previous call and
+// publishes their handshakes, expiries and quota crossings. Peers live at
+// the first call, after a restart, are reported as a handshake again.
+func (wg *Wireguard) ObservePeers() error {
+	dev, err := wg.Client.Device(wg.Iface)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	wg.activityLock.Lock()
+	defer wg.activityLock.Unlock()
+	activity := make(map[wgtypes.Key]peerActivity, len(dev.Peers))
+	for _, peer := range dev.Peers {
+		key := peer.PublicKey.String()
+		last := wg.activity[peer.PublicKey]
+		cur := peerActivity{
+			live:      !peer.LastHandshakeTime.IsZero() && now.Sub(peer.LastHandshakeTime) < HandshakeTimeout,
+			overQuota: wg.Quota > 0 && peer.ReceiveBytes+peer.TransmitBytes >= wg.Quota,
+		}
+		switch {
+		case cur.live && !last.live:
+			ev := events.PeerEvent(events.PeerHandshake, wg.Iface, key)
+			if peer.Endpoint != nil {
+				ev.Data = map[string]string{"endpoint": wg.Endpoints.Resolve(peer.Endpoint)}
+			}
+			wg.Events.Publish(ev)
+		case !cur.live && last.live:
+			wg.Events.Publish(events.PeerEvent(events.PeerExpired, wg.Iface, key))
+		}
+		if cur.overQuota && !last.overQuota {
+			ev := events.PeerEvent(events.QuotaCrossed, wg.Iface, key)
+			ev.Data = map[string]string{
+				"bytes": strconv.FormatInt(peer.ReceiveBytes+peer.TransmitBytes, 10),
+				"quota": strconv.FormatInt(wg.Quota, 10),
+			}
+			wg.Events.Publish(ev)
+		}
+		activity[peer.PublicKey] = cur
+	}
+	wg.activity = activity
+	return nil
+}
@@ -4,28 +4,205 @@ import (
 	"fmt"
 	"net"
 	"os/exec"
+	"strings"
+	"sync"
 	"vpc/pkg/utils"
 )
 
-var routedInterfaceName string
+const (
+	firewallIPTables = "iptables"
+	firewallNFTables = "nftables"
+)
+
+// routedInterfaceName is the interface NAT masquerades behind, looked up by
+// natInterface.
+var (
+	routedInterfaceLock sync.Mutex
+	routedInterfaceName string
+)
+
 func cmdDeleteDevLink(_interface string) *exec.Cmd {
 	return exec.Command("sh", "-c", fmt.Sprintf("ip link del dev %s", _interface))
 }
 
-func cmdSetNATRouting(_interface string) *exec.Cmd {
-	var err error
-	rifs, err := utils.RoutedInterface("IP", net.FlagUp|net.FlagBroadcast)
+// natInterface returns the routed interface. It is looked up again with
+// refresh, otherwise only when it is not known yet.
+func natInterface(refresh bool) (string, error) {
+	routedInterfaceLock.Lock()
+	defer routedInterfaceLock.Unlock()
+	if refresh || routedInterfaceName == "" {
+		rifs, err := utils.RoutedInterface("IP", net.FlagUp|net.FlagBroadcast)
+		if err != nil {
+			return "", fmt.Errorf("no routed interface to masquerade behind: %v", err)
+		}
+		routedInterfaceName = rifs.Name
+	}
+	return routedInterfaceName, nil
+}
+
+type iptablesRule struct {
+	table string
+	chain string
+	spec  string
+}
+
+func (r iptablesRule) command(op string) string {
+	cmd := fmt.Sprintf("iptables -t %s %s %s %s", r.table, op, r.chain, r.spec)
+	if op == "-C" {
+		// a missing rule is an expected answer, not an error to print
+		cmd += " 2>/dev/null"
+	}
+	return cmd
+}
+
+// iptablesRules carry a comment naming the interface, so every interface
+// has its own masquerade rule and leftovers can be found after a crash.
+func iptablesRules(_interface string, routed string) []iptablesRule {
+	comment := ruleComment(_interface)
+	return []iptablesRule{
+		{"filter", "FORWARD", fmt.Sprintf("-i %s -m comment --comment %s -j ACCEPT", _interface, comment)},
+		{"filter", "FORWARD", fmt.Sprintf("-o %s -m comment --comment %s -j ACCEPT", _interface, comment)},
+		{"nat", "POSTROUTING", fmt.Sprintf("-o %s -m comment --comment %s -j MASQUERADE", routed, comment)},
+	}
+}
+
+// cmdSetNATRouting can be run again on an interface that already has its
+// rules, nothing is added twice.
+func cmdSetNATRouting(_interface string, backend string) (*exec.Cmd, error) {
+	routed, err := natInterface(true)
+	if err != nil {
+		return nil, err
+	}
+	if backend == firewallNFTables {
+		// one table per interface so it can be dropped as a whole, the
+		// empty declaration makes the delete safe when it does not exist
+		nft := fmt.Sprintf(`nft -f - <<EOF
+table ip %[3]s
+delete table ip %[3]s
+table ip %[3]s {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		iifname "%[1]s" accept
+		oifname "%[1]s" accept
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		oifname "%[2]s" masquerade
+	}
+}
+EOF`, _interface, routed, nftTable(_interface))
+		return exec.Command("sh", "-c", nft), nil
+	}
+	var cmds []string
+	for _, rule := range iptablesRules(_interface, routed) {
+		cmds = append(cmds, rule.command("-C")+" || "+rule.command("-A"))
+	}
+	return exec.Command("sh", "-c", strings.Join(cmds, "; ")), nil
+}
+
+// cmdCheckNATRouting fails when any NAT rule of the interface is missing.
+func cmdCheckNATRouting(_interface string, backend string) (*exec.Cmd, error) {
+	if backend == firewallNFTables {
+		return exec.Command("sh", "-c", fmt.Sprintf("nft list table ip %s", nftTable(_interface))), nil
+	}
+	routed, err := natInterface(false)
+	if err != nil {
+		return nil, err
+	}
+	var cmds []string
+	for _, rule := range iptablesRules(_interface, routed) {
+		cmds = append(cmds, rule.command("-C"))
+	}
+	return exec.Command("sh", "-c", strings.Join(cmds, " && ")), nil
+}
+
+func cmdSetLinkAlias(_interface string) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("ip link set dev %s alias %s", _interface, Tag))
+}
+
+func cmdSetLinkUp(_interface string) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("ip link set up dev %s", _interface))
+}
+
+func cmdSetLinkMTU(_interface string, mtu int) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("ip link set dev %s mtu %d", _interface, mtu))
+}
+
+// cmdDelNATRouting removes the rules added by cmdSetNATRouting. Rules that
+// are already gone are skipped.
+func cmdDelNATRouting(_interface string, backend string) (*exec.Cmd, error) {
+	if backend == firewallNFTables {
+		return exec.Command("sh", "-c", fmt.Sprintf("nft delete table ip %s", nftTable(_interface))), nil
+	}
+	routed, err := natInterface(false)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	routedInterfaceName = rifs.Name
-	ipt := fmt.Sprintf(`iptables -A FORWARD -i %s -j ACCEPT; iptables -A FORWARD -o %s -j ACCEPT; iptables -t nat -A POSTROUTING -o %s -j MASQUERADE`,
-		_interface, _interface, routedInterfaceName)
-	return exec.Command("sh", "-c", ipt)
+	var cmds []string
+	for _, rule := range iptablesRules(_interface, routed) {
+		cmds = append(cmds, fmt.Sprintf("{ ! %s || %s; }", rule.command("-C"), rule.command("-D")))
+	}
+	return exec.Command("sh", "-c", strings.Join(cmds, " && ")), nil
+}
+
+// cmdSetRateLimit shapes the traffic leaving the interface, which is the
+// traffic sent to the peers, with a token bucket of 10ms worth of bytes.
+func cmdSetRateLimit(_interface string, rate int64) *exec.Cmd {
+	burst := rate / 8 / 100
+	if burst < 16*1024 {
+		burst = 16 * 1024
+	}
+	return exec.Command("sh", "-c", fmt.Sprintf("tc qdisc replace dev %s root tbf rate %dbit burst %d latency 50ms", _interface, rate, burst))
+}
+
+// cmdCheckRateLimit fails when the interface is not shaped.
+func cmdCheckRateLimit(_interface string) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("tc qdisc show dev %s root | grep -q tbf", _interface))
+}
+
+// cmdDelRateLimit removes the shaping, an interface without is left alone.
+func cmdDelRateLimit(_interface string) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("! tc qdisc show dev %[1]s root | grep -q tbf || tc qdisc del dev %[1]s root", _interface))
+}
+
+// cmdAddRoute routes prefix through the interface, an existing route is
+// replaced.
+func cmdAddRoute(_interface string, prefix string) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("ip route replace %s dev %s", prefix, _interface))
+}
+
+// cmdCheckRoute fails when prefix is not routed through the interface.
+func cmdCheckRoute(_interface string, prefix string) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("ip route show %s dev %s | grep -q .", prefix, _interface))
+}
+
+// cmdDelRoute removes the route of prefix through the interface, a missing
+// route is left alone.
+func cmdDelRoute(_interface string, prefix string) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("! ip route show %[1]s dev %[2]s | grep -q . || ip route del %[1]s dev %[2]s", prefix, _interface))
+}
+
+func run(cmd *exec.Cmd) error {
+	if o, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, o)
+	}
+	return nil
+}
+
+// SetLinkUp brings up an interface this package did not create, like the
+// one of the mesh.
+func SetLinkUp(_interface string) error {
+	return run(cmdSetLinkUp(_interface))
+}
+
+// AddRoute routes prefix through an interface this package did not create,
+// an existing route is replaced.
+func AddRoute(_interface string, prefix string) error {
+	return run(cmdAddRoute(_interface, prefix))
 }
 
-func cmdDelNATRouting(_interface string) *exec.Cmd {
-	ipt := fmt.Sprintf(`iptables -A FORWARD -i %s -j ACCEPT; iptables -A FORWARD -o %s -j ACCEPT; iptables -t nat -A POSTROUTING -o %s -j MASQUERADE`,
-		_interface, _interface, routedInterfaceName)
-	return exec.Command("sh", "-c", ipt)
+// DelRoute removes the route of prefix through an interface this package
+// did not create, a missing route is left alone.
+func DelRoute(_interface string, prefix string) error {
+	return run(cmdDelRoute(_interface, prefix))
 }
@@ -0,0 +1,30 @@
+package wireguard
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIptablesRules(t *testing.T) {
+	rules := iptablesRules("wg0", "eth1")
+	if len(rules) != 3 {
+		t.Fatalf("iptablesRules() = %d rules, want 3", len(rules))
+	}
+	masquerade := rules[2]
+	if masquerade.table != "nat" || !strings.HasPrefix(masquerade.spec, "-o eth1 ") {
+		t.Errorf("masquerade rule = %+v, want it on eth1", masquerade)
+	}
+	for _, rule := range rules {
+		if !strings.Contains(rule.spec, "--comment "+ruleComment("wg0")) {
+			t.Errorf("rule %+v does not name the interface", rule)
+		}
+	}
+}
+
+func TestReconcileStopped(t *testing.T) {
+	// a stopped interface has no client or link left to reconcile
+	wg := &Wireguard{Iface: "wgstopped", stopped: true}
+	if err := wg.Reconcile(); err != nil {
+		t.Errorf("Reconcile() after Stop = %v", err)
+	}
+}
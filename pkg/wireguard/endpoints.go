@@ -0,0 +1,44 @@
+package wireguard
+
+import (
+	"net"
+	"sync"
+)
+
+// EndpointMap records which real client address is behind a relay socket.
+// Relays report their sessions to it so peers that connect through a relay
+// can be shown with the client's own endpoint.
+type EndpointMap struct {
+	lock    sync.RWMutex
+	clients map[string]string
+}
+
+func NewEndpointMap() *EndpointMap {
+	return &EndpointMap{clients: make(map[string]string)}
+}
+
+func (m *EndpointMap) Set(relay string, client string) {
+	m.lock.Lock()
+	m.clients[relay] = client
+	m.lock.Unlock()
+}
+
+func (m *EndpointMap) Delete(relay string) {
+	m.lock.Lock()
+	delete(m.clients, relay)
+	m.lock.Unlock()
+}
+
+// Resolve returns the real client behind endpoint, or endpoint itself when
+// it is not a known relay socket.
+func (m *EndpointMap) Resolve(endpoint *net.UDPAddr) string {
+	if endpoint == nil {
+		return ""
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if client, found := m.clients[endpoint.String()]; found {
+		return client
+	}
+	return endpoint.String()
+}
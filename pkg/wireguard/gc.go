@@ -0,0 +1,147 @@
+package wireguard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Tag marks what the daemon creates in the kernel: it is the alias of its
+// interfaces, it starts the comment of its iptables rules and the name of
+// its nft tables.
+const Tag = "vpc"
+
+func ruleComment(_interface string) string {
+	return Tag + ":" + _interface
+}
+
+func nftTable(_interface string) string {
+	return Tag + "_" + _interface
+}
+
+// Leftover is a tagged interface, iptables rule or nft table found in the
+// kernel, Iface is the interface it belongs to.
+type Leftover struct {
+	Kind  string
+	Iface string
+	// table and rule are the iptables -S line, or the nft table name
+	table string
+	rule  []string
+}
+
+func (l Leftover) String() string {
+	switch l.Kind {
+	case "iptables":
+		return fmt.Sprintf("iptables %s: -t %s %s", l.Iface, l.table, strings.Join(l.rule, " "))
+	case "nftables":
+		return fmt.Sprintf("nftables %s: table ip %s", l.Iface, l.table)
+	}
+	return fmt.Sprintf("link %s", l.Iface)
+}
+
+// Remove deletes the leftover from the kernel.
+func (l Leftover) Remove() error {
+	var cmd *exec.Cmd
+	switch l.Kind {
+	case "iptables":
+		cmd = exec.Command("iptables", append([]string{"-t", l.table, "-D"}, l.rule[1:]...)...)
+	case "nftables":
+		cmd = exec.Command("nft", "delete", "table", "ip", l.table)
+	default:
+		cmd = cmdDeleteDevLink(l.Iface)
+	}
+	if o, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", l, err, bytes.TrimSpace(o))
+	}
+	return nil
+}
+
+// Leftovers lists everything tagged in the kernel. A missing iptables or nft
+// binary is not an error, there is simply nothing of that kind.
+func Leftovers() ([]Leftover, error) {
+	leftovers, err := taggedLinks()
+	if err != nil {
+		return nil, err
+	}
+	for _, chain := range [][2]string{{"filter", "FORWARD"}, {"nat", "POSTROUTING"}} {
+		o, err := exec.Command("iptables", "-t", chain[0], "-S", chain[1]).Output()
+		if err != nil {
+			continue
+		}
+		leftovers = append(leftovers, taggedRules(chain[0], o)...)
+	}
+	if o, err := exec.Command("nft", "list", "tables").Output(); err == nil {
+		leftovers = append(leftovers, taggedTables(o)...)
+	}
+	return leftovers, nil
+}
+
+func taggedLinks() ([]Leftover, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var leftovers []Leftover
+	for _, iface := range ifaces {
+		if linkTagged(iface.Name) {
+			leftovers = append(leftovers, Leftover{Kind: "link", Iface: iface.Name})
+		}
+	}
+	return leftovers, nil
+}
+
+func linkTagged(_interface string) bool {
+	alias, err := ioutil.ReadFile("/sys/class/net/" + _interface + "/ifalias")
+	return err == nil && strings.TrimSpace(string(alias)) == Tag
+}
+
+// taggedRules picks the rules commented with Tag out of iptables -S output.
+// iptables -S quotes some comments, the quotes are dropped from the rule so
+// it can be passed back to iptables -D.
+func taggedRules(table string, o []byte) []Leftover {
+	var leftovers []Leftover
+	scanner := bufio.NewScanner(bytes.NewReader(o))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		for i := 0; i < len(fields)-1; i++ {
+			comment := strings.Trim(fields[i+1], `"`)
+			if fields[i] == "--comment" && strings.HasPrefix(comment, Tag+":") {
+				fields[i+1] = comment
+				leftovers = append(leftovers, Leftover{
+					Kind:  "iptables",
+					Iface: strings.TrimPrefix(comment, Tag+":"),
+					table: table,
+					rule:  fields,
+				})
+				break
+			}
+		}
+	}
+	return leftovers
+}
+
+// taggedTables picks the interface tables out of nft list tables output.
+// Tables of kernel relays are left to the proxy package.
+func taggedTables(o []byte) []Leftover {
+	var leftovers []Leftover
+	scanner := bufio.NewScanner(bytes.NewReader(o))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "table" || fields[1] != "ip" {
+			continue
+		}
+		table := fields[2]
+		if !strings.HasPrefix(table, Tag+"_") || strings.HasPrefix(table, Tag+"_relay_") {
+			continue
+		}
+		leftovers = append(leftovers, Leftover{Kind: "nftables", Iface: strings.TrimPrefix(table, Tag+"_"), table: table})
+	}
+	return leftovers
+}
@@ -0,0 +1,51 @@
+package wireguard
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTaggedRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Leftover
+	}{
+		{
+			name:   "unquoted comment",
+			output: "-P FORWARD ACCEPT\n-A FORWARD -i wg0 -m comment --comment vpc:wg0 -j ACCEPT\n",
+			want: []Leftover{{
+				Kind:  "iptables",
+				Iface: "wg0",
+				table: "filter",
+				rule:  []string{"-A", "FORWARD", "-i", "wg0", "-m", "comment", "--comment", "vpc:wg0", "-j", "ACCEPT"},
+			}},
+		},
+		{
+			name:   "quoted comment",
+			output: "-A FORWARD -i wg1 -m comment --comment \"vpc:wg1\" -j ACCEPT\n",
+			want: []Leftover{{
+				Kind:  "iptables",
+				Iface: "wg1",
+				table: "filter",
+				rule:  []string{"-A", "FORWARD", "-i", "wg1", "-m", "comment", "--comment", "vpc:wg1", "-j", "ACCEPT"},
+			}},
+		},
+		{
+			name:   "other comments",
+			output: "-A FORWARD -i eth0 -m comment --comment mesh:wg2 -j ACCEPT\n-A FORWARD -i eth0 -j ACCEPT\n",
+		},
+		{
+			name:   "policy only",
+			output: "-P FORWARD DROP\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := taggedRules("filter", []byte(tt.output))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("taggedRules() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
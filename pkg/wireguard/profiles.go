@@ -0,0 +1,171 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"vpc/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Profiles choose what a client sends through the tunnel, the AllowedIPs of
+// its config.
+const (
+	// ProfileFull sends everything, the default of plain peers.
+	ProfileFull = "full"
+	// ProfileVPC sends the subnet of the interface and the routes of the
+	// site gateways, the default of gateways.
+	ProfileVPC = "vpc"
+	// ProfileCustom sends the CIDRs of the profile.
+	ProfileCustom = "custom"
+	// ProfileExclude sends everything but the CIDRs of the profile, the
+	// subnet of the interface is always sent.
+	ProfileExclude = "exclude"
+)
+
+// Profile is the split tunnel profile of a peer. The zero Profile is the
+// default of the peer.
+type Profile struct {
+	Mode  string
+	CIDRs []net.IPNet
+}
+
+// ParseProfile checks a profile, an empty mode is the default one.
+func ParseProfile(mode string, cidrs []string) (Profile, error) {
+	p := Profile{Mode: mode}
+	switch mode {
+	case "", ProfileFull, ProfileVPC:
+		if len(cidrs) > 0 {
+			return p, fmt.Errorf("profile %q takes no cidrs", mode)
+		}
+		return p, nil
+	case ProfileCustom, ProfileExclude:
+		if len(cidrs) == 0 {
+			return p, fmt.Errorf("profile %s needs cidrs", mode)
+		}
+	default:
+		return p, fmt.Errorf("unknown profile %q, want full, vpc, custom or exclude", mode)
+	}
+	for _, c := range cidrs {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return p, err
+		}
+		p.CIDRs = append(p.CIDRs, *cidr)
+	}
+	return p, nil
+}
+
+// profileLocked returns the profile of the peer key with its default mode
+// filled in.
+func (wg *Wireguard) profileLocked(key wgtypes.Key) Profile {
+	p := wg.profiles[key]
+	if p.Mode == "" {
+		p.Mode = ProfileFull
+		if len(wg.routesLocked(key)) > 0 {
+			p.Mode = ProfileVPC
+		}
+	}
+	return p
+}
+
+// Profile returns the profile of a peer.
+func (wg *Wireguard) Profile(key wgtypes.Key) Profile {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	return wg.profileLocked(key)
+}
+
+// tunneledLocked returns the AllowedIPs of the config of the peer key.
+func (wg *Wireguard) tunneledLocked(key wgtypes.Key) []string {
+	p := wg.profileLocked(key)
+	switch p.Mode {
+	case ProfileVPC:
+		return cidrs(append([]net.IPNet{wg.IPNet}, wg.siteRoutesLocked(key)...))
+	case ProfileCustom:
+		return cidrs(p.CIDRs)
+	case ProfileExclude:
+		tunneled := exclude(p.CIDRs)
+		// the subnet of the interface stays reachable whatever is excluded
+		for _, x := range p.CIDRs {
+			if overlaps(x, wg.IPNet) {
+				tunneled = append(tunneled, wg.IPNet)
+				break
+			}
+		}
+		return cidrs(tunneled)
+	}
+	return []string{"0.0.0.0/0", "::0/0"}
+}
+
+// exclude returns the CIDRs covering the whole IPv4 and IPv6 address
+// spaces but excluded.
+func exclude(excluded []net.IPNet) []net.IPNet {
+	nets := []net.IPNet{
+		{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+	}
+	for _, x := range excluded {
+		var kept []net.IPNet
+		for _, n := range nets {
+			kept = append(kept, subtract(n, x)...)
+		}
+		nets = kept
+	}
+	return nets
+}
+
+// subtract returns the CIDRs covering n but x.
+func subtract(n net.IPNet, x net.IPNet) []net.IPNet {
+	if len(n.IP) != len(x.IP) || !overlaps(n, x) {
+		return []net.IPNet{n}
+	}
+	nOnes, _ := n.Mask.Size()
+	xOnes, _ := x.Mask.Size()
+	if xOnes <= nOnes {
+		return nil
+	}
+	low, high := split(n)
+	return append(subtract(low, x), subtract(high, x)...)
+}
+
+// split halves n.
+func split(n net.IPNet) (net.IPNet, net.IPNet) {
+	ones, bits := n.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+	high := make(net.IP, len(n.IP))
+	copy(high, n.IP)
+	high[ones/8] |= 0x80 >> uint(ones%8)
+	return net.IPNet{IP: n.IP, Mask: mask}, net.IPNet{IP: high, Mask: mask}
+}
+
+// SetProfileContext changes the profile of a peer and returns its new
+// config.
+func (wg *Wireguard) SetProfileContext(ctx context.Context, pubkey string, profile Profile) ([]byte, error) {
+	publicKey, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := tracing.Child(ctx, "wireguard.set_profile", attribute.String("iface", wg.Iface), attribute.String("profile", profile.Mode))
+	defer span.End()
+	wg.lock.Lock()
+	if _, found := wg.peers[publicKey]; !found {
+		wg.lock.Unlock()
+		err := fmt.Errorf("no peer %s", pubkey)
+		tracing.Fail(span, err)
+		return nil, err
+	}
+	if profile.Mode == "" {
+		delete(wg.profiles, publicKey)
+	} else {
+		wg.profiles[publicKey] = profile
+	}
+	wg.lock.Unlock()
+	wg.Logger.Info("profile changed", zap.String("peer", pubkey), zap.String("profile", profile.Mode))
+	wg.saveState(ctx)
+	return wg.ClientConfig(pubkey)
+}
@@ -0,0 +1,78 @@
+package wireguard
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func parseNets(t *testing.T, cidrs ...string) []net.IPNet {
+	var nets []net.IPNet
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, *ipnet)
+	}
+	return nets
+}
+
+func TestSubtract(t *testing.T) {
+	tests := []struct {
+		name string
+		n    string
+		x    string
+		want []string
+	}{
+		{name: "disjoint", n: "10.0.0.0/8", x: "192.168.0.0/16", want: []string{"10.0.0.0/8"}},
+		{name: "same", n: "10.0.0.0/8", x: "10.0.0.0/8", want: []string{}},
+		{name: "larger", n: "10.0.0.0/8", x: "0.0.0.0/0", want: []string{}},
+		{name: "half", n: "10.0.0.0/8", x: "10.0.0.0/9", want: []string{"10.128.0.0/9"}},
+		{name: "quarter", n: "10.0.0.0/8", x: "10.0.0.0/10", want: []string{"10.128.0.0/9", "10.64.0.0/10"}},
+		{name: "inside", n: "192.168.0.0/24", x: "192.168.0.128/26", want: []string{"192.168.0.0/25", "192.168.0.192/26"}},
+		{name: "other family", n: "10.0.0.0/8", x: "fd00::/8", want: []string{"10.0.0.0/8"}},
+		{name: "IPv6", n: "fd00::/8", x: "fd00::/9", want: []string{"fd80::/9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, x := parseNets(t, tt.n)[0], parseNets(t, tt.x)[0]
+			if got := cidrs(subtract(n, x)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("subtract(%s, %s) = %v, want %v", tt.n, tt.x, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExclude(t *testing.T) {
+	tests := []struct {
+		name     string
+		excluded []string
+		want     []string
+	}{
+		{name: "nothing", want: []string{"0.0.0.0/0", "::/0"}},
+		{name: "upper half", excluded: []string{"128.0.0.0/1"}, want: []string{"0.0.0.0/1", "::/0"}},
+		{name: "all of IPv4", excluded: []string{"0.0.0.0/1", "128.0.0.0/1"}, want: []string{"::/0"}},
+		{name: "IPv6 half", excluded: []string{"::/1"}, want: []string{"0.0.0.0/0", "8000::/1"}},
+		{
+			name:     "private network",
+			excluded: []string{"10.0.0.0/8"},
+			want: []string{
+				"0.0.0.0/5", "11.0.0.0/8", "12.0.0.0/6", "128.0.0.0/1", "16.0.0.0/4",
+				"32.0.0.0/3", "64.0.0.0/2", "8.0.0.0/7", "::/0",
+			},
+		},
+		{
+			name:     "overlapping exclusions",
+			excluded: []string{"0.0.0.0/1", "10.0.0.0/8"},
+			want:     []string{"128.0.0.0/1", "::/0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cidrs(exclude(parseNets(t, tt.excluded...))); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("exclude(%v) = %v, want %v", tt.excluded, got, tt.want)
+			}
+		})
+	}
+}
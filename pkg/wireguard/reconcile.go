@@ -0,0 +1,347 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"github.com/my-network/wgcreate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"sort"
+	"sync/atomic"
+	"vpc/pkg/events"
+	"vpc/pkg/state"
+	"vpc/pkg/tracing"
+	"vpc/pkg/utils"
+)
+
+// NewWireguardFromSpec rebuilds an interface saved by Spec. The kernel is
+// not touched until Reconcile.
+func NewWireguardFromSpec(logger *zap.Logger, spec state.Interface) (*Wireguard, error) {
+	ip, ipnet, err := net.ParseCIDR(spec.Address)
+	if err != nil {
+		return nil, err
+	}
+	key, err := wgtypes.ParseKey(spec.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	wg, err := NewWireguard(logger, spec.Name, spec.Port, ip, *ipnet)
+	if err != nil {
+		return nil, err
+	}
+	wg.privateKey = &key
+	wg.MTU = spec.MTU
+	wg.Firewall = spec.Firewall
+	wg.endpoint = spec.Endpoint
+	wg.RateLimit = spec.RateLimit
+	if spec.FirewallMark > 0 {
+		wg.SocketOptions = &utils.SocketOptions{Mark: spec.FirewallMark}
+	}
+	for _, p := range spec.Peers {
+		publicKey, err := wgtypes.ParseKey(p.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		var allowedIPs []net.IPNet
+		for _, cidr := range p.AllowedIPs {
+			_, allowed, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			allowedIPs = append(allowedIPs, *allowed)
+		}
+		wg.peers[publicKey] = allowedIPs
+		if p.PrivateKey != "" {
+			privateKey, err := wgtypes.ParseKey(p.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			wg.clientKeys[publicKey] = privateKey
+		}
+		if p.Profile != "" {
+			profile, err := ParseProfile(p.Profile, p.ProfileCIDRs)
+			if err != nil {
+				return nil, err
+			}
+			wg.profiles[publicKey] = profile
+		}
+	}
+	return wg, nil
+}
+
+// Spec returns the desired state of the interface.
+func (wg *Wireguard) Spec() state.Interface {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	return wg.specLocked()
+}
+
+func (wg *Wireguard) specLocked() state.Interface {
+	ones, _ := wg.IPNet.Mask.Size()
+	spec := state.Interface{
+		Name:      wg.Iface,
+		Port:      wg.Port,
+		Address:   fmt.Sprintf("%s/%d", wg.IP, ones),
+		MTU:       wg.MTU,
+		Firewall:  wg.Firewall,
+		Endpoint:  wg.endpoint,
+		RateLimit: wg.RateLimit,
+		Peers:     []state.Peer{},
+	}
+	if wg.privateKey != nil {
+		spec.PrivateKey = wg.privateKey.String()
+	}
+	if mark := wg.firewallMark(); mark != nil {
+		spec.FirewallMark = *mark
+	}
+	for key, allowedIPs := range wg.peers {
+		// not sorted, the address of the peer comes before its routes
+		peer := state.Peer{PublicKey: key.String(), AllowedIPs: []string{}}
+		for _, allowed := range allowedIPs {
+			peer.AllowedIPs = append(peer.AllowedIPs, allowed.String())
+		}
+		if privateKey, found := wg.clientKeys[key]; found {
+			peer.PrivateKey = privateKey.String()
+		}
+		if profile, found := wg.profiles[key]; found {
+			peer.Profile, peer.ProfileCIDRs = profile.Mode, cidrs(profile.CIDRs)
+		}
+		spec.Peers = append(spec.Peers, peer)
+	}
+	sort.Slice(spec.Peers, func(i, j int) bool {
+		return spec.Peers[i].PublicKey < spec.Peers[j].PublicKey
+	})
+	return spec
+}
+
+func (wg *Wireguard) changed() {
+	if wg.OnChange != nil {
+		wg.OnChange(wg.Spec())
+	}
+}
+
+func (wg *Wireguard) firewallMark() *int {
+	if wg.SocketOptions != nil && wg.SocketOptions.Mark > 0 {
+		return &wg.SocketOptions.Mark
+	}
+	return nil
+}
+
+func cidrs(nets []net.IPNet) []string {
+	s := make([]string, 0, len(nets))
+	for _, n := range nets {
+		s = append(s, n.String())
+	}
+	sort.Strings(s)
+	return s
+}
+
+func sameCIDRs(a []net.IPNet, b []net.IPNet) bool {
+	ca, cb := cidrs(a), cidrs(b)
+	if len(ca) != len(cb) {
+		return false
+	}
+	for i := range ca {
+		if ca[i] != cb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reconcile brings the kernel in line with the desired state: it recreates
+// the link when it is gone, restores its address, MTU and up state, puts
+// back the key, listen port, peers and the routes of the site gateways, and
+// re-applies the NAT rules and the rate limit.
+// Changes made behind its back with wg or ip are undone. After Stop it does
+// nothing, a pass racing with the removal must not recreate the link.
+func (wg *Wireguard) Reconcile() error {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	if wg.stopped {
+		return nil
+	}
+
+	if err := wg.reconcileLink(); err != nil {
+		return err
+	}
+	if err := wg.reconcileDevice(); err != nil {
+		return err
+	}
+	if err := wg.ensureRoutes(); err != nil {
+		return err
+	}
+	if err := wg.ensureNATRouting(context.Background()); err != nil {
+		return err
+	}
+	return wg.ensureRateLimit()
+}
+
+// ensureNATRouting re-applies the NAT rules when they are missing.
+func (wg *Wireguard) ensureNATRouting(ctx context.Context) error {
+	_, span := tracing.Child(ctx, "wireguard.firewall", attribute.String("iface", wg.Iface), attribute.String("backend", wg.Firewall))
+	defer span.End()
+	check, err := cmdCheckNATRouting(wg.Iface, wg.Firewall)
+	if err != nil {
+		atomic.AddUint64(&wg.firewallErrors, 1)
+		tracing.Fail(span, err)
+		return err
+	}
+	if err := check.Run(); err == nil {
+		return nil
+	}
+	wg.Logger.Warn("nat rules missing, re-applying")
+	if err := wg.setNATRouting(); err != nil {
+		atomic.AddUint64(&wg.firewallErrors, 1)
+		tracing.Fail(span, err)
+		return err
+	}
+	return nil
+}
+
+// ensureRateLimit shapes the interface to RateLimit when it is not.
+func (wg *Wireguard) ensureRateLimit() error {
+	if wg.RateLimit <= 0 || cmdCheckRateLimit(wg.Iface).Run() == nil {
+		return nil
+	}
+	wg.Logger.Warn("rate limit missing, re-applying", zap.Int64("rate", wg.RateLimit))
+	if o, err := cmdSetRateLimit(wg.Iface, wg.RateLimit).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, o)
+	}
+	return nil
+}
+
+// SetRateLimit shapes the traffic sent to the peers to rate bits per
+// second, zero removes the limit.
+func (wg *Wireguard) SetRateLimit(rate int64) error {
+	wg.lock.Lock()
+	cmd := cmdDelRateLimit(wg.Iface)
+	if rate > 0 {
+		cmd = cmdSetRateLimit(wg.Iface, rate)
+	}
+	o, err := cmd.CombinedOutput()
+	if err == nil {
+		wg.RateLimit = rate
+	}
+	wg.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, o)
+	}
+	wg.Logger.Info("rate limit changed", zap.Int64("rate", rate))
+	wg.changed()
+	return nil
+}
+
+// FirewallErrors is the number of times the NAT rules could not be
+// re-applied.
+func (wg *Wireguard) FirewallErrors() uint64 {
+	return atomic.LoadUint64(&wg.firewallErrors)
+}
+
+func (wg *Wireguard) reconcileLink() error {
+	iface, err := net.InterfaceByName(wg.Iface)
+	down := err != nil
+	if down {
+		wg.Logger.Warn("interface missing, recreating")
+		wg.Events.Publish(events.InterfaceEvent(events.InterfaceDown, wg.Iface))
+		if err := wg.addWireGuardDevice(); err != nil {
+			return err
+		}
+		if iface, err = net.InterfaceByName(wg.Iface); err != nil {
+			return err
+		}
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(wg.IP) {
+			found = true
+		}
+	}
+	if !found {
+		wg.Logger.Warn("address missing, restoring", zap.String("ip", wg.IP.String()))
+		if err := wgcreate.AddIP(wg.Iface, wg.IP, wg.IPNet); err != nil {
+			return err
+		}
+	}
+	if iface.MTU != wg.MTU {
+		wg.Logger.Warn("mtu drifted, restoring", zap.Int("mtu", iface.MTU), zap.Int("want", wg.MTU))
+		if o, err := cmdSetLinkMTU(wg.Iface, wg.MTU).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, o)
+		}
+	}
+	if !linkTagged(wg.Iface) {
+		if o, err := cmdSetLinkAlias(wg.Iface).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, o)
+		}
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		wg.Logger.Warn("interface down, bringing it up")
+		if !down {
+			down = true
+			wg.Events.Publish(events.InterfaceEvent(events.InterfaceDown, wg.Iface))
+		}
+		if o, err := cmdSetLinkUp(wg.Iface).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, o)
+		}
+	}
+	if down {
+		wg.Events.Publish(events.InterfaceEvent(events.InterfaceUp, wg.Iface))
+	}
+	return nil
+}
+
+func (wg *Wireguard) reconcileDevice() error {
+	dev, err := wg.Client.Device(wg.Iface)
+	if err != nil {
+		return err
+	}
+	cfg := wgtypes.Config{}
+	drifted := false
+	newKey := wg.privateKey == nil
+	if newKey || dev.PrivateKey != *wg.privateKey || dev.ListenPort != wg.Port {
+		wg.Logger.Warn("key or listen port drifted, restoring", zap.Int("port", dev.ListenPort))
+		if cfg, err = wg.generateConfig(); err != nil {
+			return err
+		}
+		drifted = true
+	}
+	if mark := wg.firewallMark(); mark != nil && dev.FirewallMark != *mark {
+		cfg.FirewallMark = mark
+		drifted = true
+	}
+
+	existing := map[wgtypes.Key]bool{}
+	for _, peer := range dev.Peers {
+		existing[peer.PublicKey] = true
+		allowedIPs, wanted := wg.peers[peer.PublicKey]
+		if !wanted {
+			wg.Logger.Warn("removing unknown peer", zap.String("peer", peer.PublicKey.String()))
+			cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		} else if !sameCIDRs(peer.AllowedIPs, allowedIPs) {
+			wg.Logger.Warn("allowed ips drifted, restoring", zap.String("peer", peer.PublicKey.String()))
+			cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: peer.PublicKey, ReplaceAllowedIPs: true, AllowedIPs: allowedIPs})
+		}
+	}
+	for key, allowedIPs := range wg.peers {
+		if !existing[key] {
+			wg.Logger.Warn("peer missing, adding", zap.String("peer", key.String()))
+			cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: key, AllowedIPs: allowedIPs})
+		}
+	}
+	if !drifted && len(cfg.Peers) == 0 {
+		return nil
+	}
+	if err := wg.Client.ConfigureDevice(wg.Iface, cfg); err != nil {
+		return err
+	}
+	if newKey && wg.OnChange != nil {
+		wg.OnChange(wg.specLocked())
+	}
+	return nil
+}
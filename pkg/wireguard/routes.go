@@ -0,0 +1,175 @@
+package wireguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"vpc/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A site gateway is a peer with LAN prefixes behind it. The prefixes are
+// its routes: they follow its address in the allowed IPs of the peer, get a
+// kernel route through the interface, and are sent to the other gateways in
+// their config so sites reach each other through the server.
+
+// ParseRoutes parses the LAN prefixes of a site gateway.
+func ParseRoutes(prefixes []string) ([]net.IPNet, error) {
+	var routes []net.IPNet
+	for _, p := range prefixes {
+		_, route, err := net.ParseCIDR(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, *route)
+	}
+	return routes, nil
+}
+
+// ErrRouteConflict is a route overlapping the subnet of the interface or
+// another route.
+var ErrRouteConflict = errors.New("route conflict")
+
+func overlaps(a net.IPNet, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// checkRoutesLocked refuses routes overlapping the subnet of the interface
+// or the routes of another peer than key, Wireguard would silently move
+// them from one peer to the other.
+func (wg *Wireguard) checkRoutesLocked(key wgtypes.Key, routes []net.IPNet) error {
+	for i, route := range routes {
+		if overlaps(route, wg.IPNet) {
+			return fmt.Errorf("%w: %s overlaps the subnet %s of the interface", ErrRouteConflict, route.String(), wg.IPNet.String())
+		}
+		for _, other := range routes[:i] {
+			if overlaps(route, other) {
+				return fmt.Errorf("%w: %s overlaps %s", ErrRouteConflict, route.String(), other.String())
+			}
+		}
+		for peer, allowedIPs := range wg.peers {
+			if peer == key || len(allowedIPs) < 2 {
+				continue
+			}
+			for _, other := range allowedIPs[1:] {
+				if overlaps(route, other) {
+					return fmt.Errorf("%w: %s overlaps %s of peer %s", ErrRouteConflict, route.String(), other.String(), peer.String())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// routesLocked returns the routes of the peer key, nil when it is no
+// gateway.
+func (wg *Wireguard) routesLocked(key wgtypes.Key) []net.IPNet {
+	allowedIPs := wg.peers[key]
+	if len(allowedIPs) < 2 {
+		return nil
+	}
+	return allowedIPs[1:]
+}
+
+// siteRoutesLocked returns the routes of every gateway but key.
+func (wg *Wireguard) siteRoutesLocked(key wgtypes.Key) []net.IPNet {
+	var routes []net.IPNet
+	for peer := range wg.peers {
+		if peer != key {
+			routes = append(routes, wg.routesLocked(peer)...)
+		}
+	}
+	return routes
+}
+
+func (wg *Wireguard) addRoutes(routes []net.IPNet) error {
+	for _, route := range routes {
+		if o, err := cmdAddRoute(wg.Iface, route.String()).CombinedOutput(); err != nil {
+			return fmt.Errorf("route %s: %v: %s", route.String(), err, o)
+		}
+	}
+	return nil
+}
+
+func (wg *Wireguard) delRoutes(routes []net.IPNet) {
+	for _, route := range routes {
+		if o, err := cmdDelRoute(wg.Iface, route.String()).CombinedOutput(); err != nil {
+			wg.Logger.Warn("failed to delete route", zap.String("route", route.String()), zap.Error(err), zap.ByteString("output", o))
+		}
+	}
+}
+
+// ensureRoutes puts back the kernel routes of the gateways that are
+// missing. It is called with the lock held.
+func (wg *Wireguard) ensureRoutes() error {
+	for key := range wg.peers {
+		for _, route := range wg.routesLocked(key) {
+			if cmdCheckRoute(wg.Iface, route.String()).Run() == nil {
+				continue
+			}
+			wg.Logger.Warn("route missing, restoring", zap.String("route", route.String()), zap.String("peer", key.String()))
+			if err := wg.addRoutes([]net.IPNet{route}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetRoutesContext replaces the routes of a peer, no routes makes it a plain
+// client again. The configs of the other gateways change with it, they
+// have to be fetched again. When only the kernel routes fail the peer keeps
+// its new routes and the error says so.
+func (wg *Wireguard) SetRoutesContext(ctx context.Context, pubkey string, routes []net.IPNet) error {
+	publicKey, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return err
+	}
+	ctx, span := tracing.Child(ctx, "wireguard.set_routes", attribute.String("iface", wg.Iface), attribute.Int("routes", len(routes)))
+	defer span.End()
+	wg.lock.Lock()
+	allowedIPs, found := wg.peers[publicKey]
+	if !found || len(allowedIPs) == 0 {
+		wg.lock.Unlock()
+		err := fmt.Errorf("no peer %s", pubkey)
+		tracing.Fail(span, err)
+		return err
+	}
+	if err := wg.checkRoutesLocked(publicKey, routes); err != nil {
+		wg.lock.Unlock()
+		tracing.Fail(span, err)
+		return err
+	}
+	old := wg.routesLocked(publicKey)
+	allowedIPs = append([]net.IPNet{allowedIPs[0]}, routes...)
+	cfg := wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: publicKey, UpdateOnly: true, ReplaceAllowedIPs: true, AllowedIPs: allowedIPs}},
+	}
+	err = wg.configureDevice(ctx, cfg)
+	var routeErr error
+	if err == nil {
+		wg.peers[publicKey] = allowedIPs
+		wg.delRoutes(old)
+		routeErr = wg.addRoutes(routes)
+	}
+	wg.lock.Unlock()
+	if err != nil {
+		wg.Logger.Error("failed to set routes", zap.String("peer", pubkey), zap.Error(err))
+		tracing.Fail(span, err)
+		return err
+	}
+	wg.Logger.Info("routes changed", zap.String("peer", pubkey), zap.Strings("routes", cidrs(routes)))
+	wg.saveState(ctx)
+	if routeErr != nil {
+		// the peer has its routes, Reconcile retries the kernel ones
+		wg.Logger.Warn("failed to add routes", zap.String("peer", pubkey), zap.Error(routeErr))
+		tracing.Fail(span, routeErr)
+		return fmt.Errorf("routes set on the peer but not in the kernel: %w", routeErr)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package wireguard
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustCIDRs(t *testing.T, cidrs ...string) []net.IPNet {
+	t.Helper()
+	routes, err := ParseRoutes(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
+
+func newKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey()
+}
+
+// gatewayInterface returns an interface on 10.8.0.0/24 with gateway a
+// routing 192.168.1.0/24 and client b.
+func gatewayInterface(t *testing.T) (*Wireguard, wgtypes.Key, wgtypes.Key) {
+	a, b := newKey(t), newKey(t)
+	wg := &Wireguard{
+		Iface: "wg0",
+		IPNet: mustCIDRs(t, "10.8.0.0/24")[0],
+		peers: map[wgtypes.Key][]net.IPNet{
+			a: mustCIDRs(t, "10.8.0.2/32", "192.168.1.0/24"),
+			b: mustCIDRs(t, "10.8.0.3/32"),
+		},
+	}
+	return wg, a, b
+}
+
+func TestCheckRoutes(t *testing.T) {
+	wg, a, b := gatewayInterface(t)
+	tests := []struct {
+		name     string
+		peer     wgtypes.Key
+		routes   []string
+		conflict bool
+	}{
+		{name: "no routes", peer: b},
+		{name: "new prefix", peer: b, routes: []string{"192.168.2.0/24"}},
+		{name: "same peer", peer: a, routes: []string{"192.168.1.0/24"}},
+		{name: "same peer wider", peer: a, routes: []string{"192.168.0.0/16"}},
+		{name: "other peer", peer: b, routes: []string{"192.168.1.0/24"}, conflict: true},
+		{name: "other peer inside", peer: b, routes: []string{"192.168.1.128/25"}, conflict: true},
+		{name: "other peer around", peer: b, routes: []string{"192.168.0.0/16"}, conflict: true},
+		{name: "interface subnet", peer: b, routes: []string{"10.8.0.0/24"}, conflict: true},
+		{name: "inside interface subnet", peer: a, routes: []string{"10.8.0.128/25"}, conflict: true},
+		{name: "around interface subnet", peer: b, routes: []string{"10.0.0.0/8"}, conflict: true},
+		{name: "each other", peer: b, routes: []string{"172.16.0.0/16", "172.16.1.0/24"}, conflict: true},
+	}
+	for _, tt := range tests {
+		err := wg.checkRoutesLocked(tt.peer, mustCIDRs(t, tt.routes...))
+		if got := errors.Is(err, ErrRouteConflict); got != tt.conflict || (err != nil && !got) {
+			t.Errorf("%s: checkRoutesLocked() = %v, want conflict %v", tt.name, err, tt.conflict)
+		}
+	}
+}
+
+func TestSetRoutesRefused(t *testing.T) {
+	wg, _, b := gatewayInterface(t)
+	before := append([]net.IPNet(nil), wg.peers[b]...)
+
+	err := wg.SetRoutesContext(context.Background(), b.String(), mustCIDRs(t, "192.168.1.0/24"))
+	if !errors.Is(err, ErrRouteConflict) {
+		t.Errorf("SetRoutesContext() over another gateway = %v, want %v", err, ErrRouteConflict)
+	}
+	if err := wg.SetRoutesContext(context.Background(), newKey(t).String(), nil); err == nil {
+		t.Error("SetRoutesContext() of an unknown peer succeeded")
+	}
+	if got := wg.peers[b]; len(got) != len(before) {
+		t.Errorf("allowed IPs after a refused change = %v, want %v", got, before)
+	}
+}
@@ -7,4 +7,4 @@ Address = %s/24
 [Peer]
 PublicKey = %s
 EndPoint = %s
-AllowedIPs=0.0.0.0/0, ::0/0`
+AllowedIPs=%s`
@@ -1,10 +1,12 @@
 package wireguard
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/my-network/wgcreate"
 	hub "github.com/sentinel-official/hub/types"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.zx2c4.com/wireguard/device"
@@ -14,11 +16,26 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vpc/pkg/events"
+	"vpc/pkg/state"
+	"vpc/pkg/tracing"
+	"vpc/pkg/utils"
 )
 
 var (
 	serverKeysPath = os.TempDir()
-	endPoint       string
+)
+
+const (
+	DefaultMTU         = 1420
+	DefaultPublicIPURL = "https://api.ipify.org/?format=json"
+	// MaxPeers is how many addresses generateAllowedIP hands out, .2 to
+	// .254 of the /24 of the interface.
+	MaxPeers = 253
 )
 
 // Bandwidth ...
@@ -43,6 +60,46 @@ Wireguard struct {
 	IP         net.IP
 	IPNet      net.IPNet
 	PeerConfig string
+	Endpoints  *EndpointMap
+	// SocketOptions of the listen port. Only Mark can be applied, the socket
+	// itself is owned by the kernel module or wireguard-go.
+	SocketOptions *utils.SocketOptions
+	MTU           int
+	// PublicHost is the server address put in client configs. It is looked
+	// up at PublicIPURL when empty.
+	PublicHost  string
+	PublicIPURL string
+	// Firewall is the NAT backend, "iptables" or "nftables".
+	Firewall string
+	// OnChange is called with the desired state after keys or peers change,
+	// so it can be persisted and restored by Reconcile.
+	OnChange func(state.Interface)
+	// Events gets the interface and peer events, it may be nil.
+	Events *events.Bus
+	// Quota is the traffic in bytes after which a peer is reported by
+	// ObservePeers, zero means none.
+	Quota int64
+	// RateLimit is the rate in bits per second the traffic sent to the
+	// peers is shaped to, zero means none.
+	RateLimit  int64
+	endpoint   string
+	privateKey *wgtypes.Key
+	// lock serializes peer changes with Reconcile, peers is what the
+	// device should have.
+	lock  sync.Mutex
+	peers map[wgtypes.Key][]net.IPNet
+	// clientKeys are the private keys generated for peers, so their
+	// config can be handed out again
+	clientKeys map[wgtypes.Key]wgtypes.Key
+	// profiles are the profiles of the peers not using the default one
+	profiles map[wgtypes.Key]Profile
+	// activity is what ObservePeers saw last
+	activityLock sync.Mutex
+	activity     map[wgtypes.Key]peerActivity
+	// firewallErrors counts the failures to restore the NAT rules
+	firewallErrors uint64
+	// stopped is set by Stop, guarded by lock
+	stopped bool
 }
 
 type PublicIP struct {
@@ -54,16 +111,22 @@ func NewWireguard(logger *zap.Logger, iface string, port int, ip net.IP, ipnet n
 	//func NewWireguard() (*Wireguard, error) {
 	client, err := wgctrl.New()
 	if err != nil {
-		log.Println(err)
 		return &Wireguard{}, err
 	}
 	return &Wireguard{
-		Logger: logger.With(zap.String("iface", iface)),
-		Client: client,
-		Iface:  iface,
-		Port:   port,
-		IP:     ip,
-		IPNet:  ipnet,
+		Logger:      logger.With(zap.String("iface", iface)),
+		Client:      client,
+		Iface:       iface,
+		Port:        port,
+		IP:          ip,
+		IPNet:       ipnet,
+		Endpoints:   NewEndpointMap(),
+		MTU:         DefaultMTU,
+		PublicIPURL: DefaultPublicIPURL,
+		Firewall:    firewallIPTables,
+		peers:       map[wgtypes.Key][]net.IPNet{},
+		clientKeys:  map[wgtypes.Key]wgtypes.Key{},
+		profiles:    map[wgtypes.Key]Profile{},
 	}, nil
 }
 
@@ -100,31 +163,44 @@ func (wg *Wireguard) generateKeys() (Keys, error) {
 }
 
 func (wg *Wireguard) setNATRouting() error {
-	cmd := cmdSetNATRouting(wg.Iface)
-	o, e := cmd.CombinedOutput()
-	fmt.Printf("%s", o)
-	return e
+	cmd, err := cmdSetNATRouting(wg.Iface, wg.Firewall)
+	if err != nil {
+		return err
+	}
+	if o, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, o)
+	}
+	return nil
 }
 
-func (wg *Wireguard) addInterface(mtu uint32) error {
+// DeviceLogger writes the logs of a Wireguard device to logger.
+func DeviceLogger(logger *zap.Logger) *device.Logger {
 	getLogger := func(level zapcore.Level) *log.Logger {
-		l, _ := zap.NewStdLogAt(wg.Logger, level)
+		l, _ := zap.NewStdLogAt(logger, level)
 		return l
 	}
-	_, err := wgcreate.Create(wg.Iface, mtu, true, &device.Logger{
+	return &device.Logger{
 		Debug: getLogger(zap.DebugLevel),
 		Info:  getLogger(zap.InfoLevel),
 		Error: getLogger(zap.ErrorLevel),
-	})
+	}
+}
+
+func (wg *Wireguard) addInterface(mtu uint32) error {
+	_, err := wgcreate.Create(wg.Iface, mtu, true, DeviceLogger(wg.Logger))
 	if err != nil {
 		return err
 	}
+	// the alias tells leftovers of a crashed daemon apart from foreign links
+	if o, err := cmdSetLinkAlias(wg.Iface).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, o)
+	}
 	return wgcreate.AddIP(wg.Iface, wg.IP, wg.IPNet);
 }
 
 func (wg *Wireguard) addWireGuardDevice() error {
 	wg.Logger.Debug("adding wireguard device.")
-	err := wg.addInterface(1420)
+	err := wg.addInterface(uint32(wg.MTU))
 	if err != nil {
 		wg.Logger.Error("error creating interface", zap.Error(err))
 	}
@@ -139,82 +215,127 @@ func (wg *Wireguard) Init() error {
 		return err
 	}
 
-	resp, err := http.Get("https://api.ipify.org/?format=json")
-	if err != nil {
-		return err
+	host := wg.PublicHost
+	if host == "" {
+		resp, err := http.Get(wg.PublicIPURL)
+		if err != nil {
+			return err
+		}
+		var res PublicIP
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		host = res.IP
 	}
-	var res PublicIP
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+	wg.endpoint = net.JoinHostPort(host, strconv.Itoa(wg.Port))
+	if err := wg.setNATRouting(); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	endPoint = fmt.Sprintf("%s:%d", res.IP, wg.Port)
-	return wg.setNATRouting()
-	//return err
+	return wg.ensureRateLimit()
 }
 
 func (wg *Wireguard) generateConfig() (wgtypes.Config, error) {
-	keys, err := wg.generateKeys()
-	if err != nil {
-		return wgtypes.Config{}, err
+	if wg.privateKey == nil {
+		keys, err := wg.generateKeys()
+		if err != nil {
+			return wgtypes.Config{}, err
+		}
+		wg.privateKey = &keys.PrivateKey
 	}
 	//if err := wg.saveKeys(keys.PublicKey, keys.PrivateKey); err != nil {
 	//	return wgtypes.Config{}, err
 	//}
-	return wgtypes.Config{
-		PrivateKey:   &keys.PrivateKey,
+	cfg := wgtypes.Config{
+		PrivateKey:   wg.privateKey,
 		ListenPort:   &wg.Port,
 		ReplacePeers: false,
 		Peers:        []wgtypes.PeerConfig{},
-	}, nil
+	}
+	if o := wg.SocketOptions; o != nil && o.Mark > 0 {
+		// the config only allows the mark, see config.WireguardConfig
+		cfg.FirewallMark = &o.Mark
+	}
+	return cfg, nil
+}
+
+// SetPort changes the listen port before Start, the endpoint handed to
+// peers follows.
+func (wg *Wireguard) SetPort(port int) {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	wg.Port = port
+	if host, _, err := net.SplitHostPort(wg.endpoint); err == nil {
+		wg.endpoint = net.JoinHostPort(host, strconv.Itoa(port))
+	}
 }
 
 // Start ...
 func (wg *Wireguard) Start() error {
 	wg.Logger.Info("starting wireguard device")
+	wg.lock.Lock()
 	cfg, err := wg.generateConfig()
+	if err == nil {
+		err = wg.Client.ConfigureDevice(wg.Iface, cfg)
+	}
+	wg.lock.Unlock()
 	if err != nil {
 		return err
 	}
-	return wg.Client.ConfigureDevice(wg.Iface, cfg)
+	wg.changed()
+	wg.Events.Publish(events.InterfaceEvent(events.InterfaceUp, wg.Iface))
+	return nil
 }
 
-// Stop ...
+// Stop removes the interface and its NAT rules. A stopped interface is not
+// brought back by Reconcile.
 func (wg *Wireguard) Stop() error {
 	wg.Logger.Info("stopping wireguard device")
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	wg.stopped = true
 	wg.Client.Close()
 	var err error
 	cmd := cmdDeleteDevLink(wg.Iface)
 	o, err := cmd.CombinedOutput();
-	//fmt.Printf("%s", o)
 	if err != nil {
-		wg.Logger.Error("failed to remove interface", zap.Error(err))
+		wg.Logger.Error("failed to remove interface", zap.Error(err), zap.ByteString("output", o))
 	} else {
 		wg.Logger.Debug("removed inferface")
+		wg.Events.Publish(events.InterfaceEvent(events.InterfaceDown, wg.Iface))
+	}
+	cmd, err = cmdDelNATRouting(wg.Iface, wg.Firewall)
+	if err == nil {
+		o, err = cmd.CombinedOutput()
 	}
-	cmd = cmdDelNATRouting(wg.Iface)
-	o, err = cmd.CombinedOutput();
-	fmt.Printf("%s", o)
 	if err != nil {
-		wg.Logger.Error("failed to reset iptables", zap.Error(err))
+		wg.Logger.Error("failed to reset iptables", zap.Error(err), zap.ByteString("output", o))
 	} else {
 		wg.Logger.Debug("reset iptables")
 	}
 	return err
 }
 
+// generateAllowedIP picks the first free address of the subnet of the
+// interface, so the peers of interfaces sharing an address space do not
+// collide. It is called with the lock held.
 func (wg *Wireguard) generateAllowedIP() ([]net.IPNet, error) {
 	var allowedIPs []net.IP
-	dev, err := wg.Client.Device(wg.Iface)
-	if err != nil {
-		return []net.IPNet{}, err
+	for _, peerIPs := range wg.peers {
+		if len(peerIPs) > 0 {
+			allowedIPs = append(allowedIPs, peerIPs[0].IP)
+		}
 	}
-	for _, peer := range dev.Peers {
-		allowedIPs = append(allowedIPs, peer.AllowedIPs[0].IP)
+	base := wg.IPNet.IP.To4()
+	if base == nil {
+		return []net.IPNet{}, fmt.Errorf("interface %s has no IPv4 subnet", wg.Iface)
 	}
-	for i := 2; i < 255; i++ {
-		ip := net.IPv4(byte(10), byte(7), byte(0), byte(i))
-		if !contains(allowedIPs, ip) {
+	for i := 2; i < 2+MaxPeers; i++ {
+		ip := net.IPv4(base[0], base[1], base[2], byte(i))
+		if !wg.IPNet.Contains(ip) {
+			break
+		}
+		if !ip.Equal(wg.IP) && !contains(allowedIPs, ip) {
 			ipMask := net.IPv4Mask(byte(255), byte(255), byte(255), byte(255))
 			return []net.IPNet{{IP: ip, Mask: ipMask}}, nil
 		}
@@ -224,15 +345,43 @@ func (wg *Wireguard) generateAllowedIP() ([]net.IPNet, error) {
 
 // GenerateClientKey ...
 func (wg *Wireguard) GenerateClientKey() ([]byte, error) {
-	wg.Logger.Info("adding peer")
+	_, clientConfig, err := wg.AddClient()
+	return clientConfig, err
+}
+
+// AddClient adds a peer with a generated key pair and returns its public key
+// and config.
+func (wg *Wireguard) AddClient() (string, []byte, error) {
+	return wg.AddClientContext(context.Background())
+}
+
+// AddClientContext is AddClient tracing the address allocation, the device
+// change, the firewall check and the state save under the span of ctx.
+func (wg *Wireguard) AddClientContext(ctx context.Context) (string, []byte, error) {
+	return wg.AddPeerContext(ctx, nil, Profile{})
+}
+
+// AddPeerContext is AddClientContext for a peer with a profile, and a site
+// gateway routing routes to it when there are any.
+func (wg *Wireguard) AddPeerContext(ctx context.Context, routes []net.IPNet, profile Profile) (string, []byte, error) {
+	wg.Logger.Info("adding peer", zap.Strings("routes", cidrs(routes)), zap.String("profile", profile.Mode))
 	keys, err := wg.generateKeys()
 	if err != nil {
-		return []byte{}, err
+		return "", []byte{}, err
 	}
+	wg.lock.Lock()
+	if err := wg.checkRoutesLocked(keys.PublicKey, routes); err != nil {
+		wg.lock.Unlock()
+		return "", []byte{}, err
+	}
+	_, span := tracing.Child(ctx, "wireguard.allocate_address", attribute.String("iface", wg.Iface))
 	availableIP, err := wg.generateAllowedIP()
+	tracing.End(span, err)
 	if err != nil {
-		return []byte{}, err
+		wg.lock.Unlock()
+		return "", []byte{}, err
 	}
+	availableIP = append(availableIP, routes...)
 	peer := wgtypes.PeerConfig{
 		PublicKey:  keys.PublicKey,
 		AllowedIPs: availableIP,
@@ -241,23 +390,77 @@ func (wg *Wireguard) GenerateClientKey() ([]byte, error) {
 		ReplacePeers: false,
 		Peers:        []wgtypes.PeerConfig{peer},
 	}
-	err = wg.Client.ConfigureDevice(wg.Iface, cfg)
+	err = wg.configureDevice(ctx, cfg)
+	if err == nil {
+		wg.peers[keys.PublicKey] = availableIP
+		wg.clientKeys[keys.PublicKey] = keys.PrivateKey
+		if profile.Mode != "" {
+			wg.profiles[keys.PublicKey] = profile
+		}
+		// the routes stay under the lock so a concurrent removal of the
+		// peer cannot delete them before they are added
+		if err := wg.addRoutes(routes); err != nil {
+			wg.Logger.Warn("failed to add routes", zap.Error(err))
+		}
+	}
+	wg.lock.Unlock()
 	if err != nil {
-		log.Println("err:", err)
-		return []byte(""), err
+		wg.Logger.Error("failed to add peer", zap.Error(err))
+		return "", []byte(""), err
+	}
+	// the peer is useless without them, Reconcile retries on failure. The
+	// rules only depend on the interface, the lock is not needed.
+	if err := wg.ensureNATRouting(ctx); err != nil {
+		wg.Logger.Warn("failed to restore nat rules", zap.Error(err))
 	}
-	dev, _ := wg.Client.Device(wg.Iface)
+	wg.saveState(ctx)
+	wg.Events.Publish(events.PeerEvent(events.PeerAdded, wg.Iface, keys.PublicKey.String()))
+	clientConfig, err := wg.ClientConfig(keys.PublicKey.String())
+	return keys.PublicKey.String(), clientConfig, err
+}
 
-	allowedIP := fmt.Sprint(peer.AllowedIPs[0].IP)
-	clientConfig := fmt.Sprintf(clientConfigTemplate, keys.PrivateKey.String(), allowedIP,
-		dev.PublicKey.String(), endPoint)
+func (wg *Wireguard) configureDevice(ctx context.Context, cfg wgtypes.Config) error {
+	_, span := tracing.Child(ctx, "wireguard.configure_device", attribute.String("iface", wg.Iface), attribute.Int("peers", len(cfg.Peers)))
+	err := wg.Client.ConfigureDevice(wg.Iface, cfg)
+	tracing.End(span, err)
+	return err
+}
+
+// saveState hands the desired state to OnChange.
+func (wg *Wireguard) saveState(ctx context.Context) {
+	_, span := tracing.Child(ctx, "wireguard.save_state", attribute.String("iface", wg.Iface))
+	wg.changed()
+	span.End()
+}
+
+// ClientConfig returns the config of a peer added by GenerateClientKey.
+func (wg *Wireguard) ClientConfig(pubkey string) ([]byte, error) {
+	publicKey, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	wg.lock.Lock()
+	privateKey, found := wg.clientKeys[publicKey]
+	allowedIPs := wg.peers[publicKey]
+	tunneled := strings.Join(wg.tunneledLocked(publicKey), ", ")
+	wg.lock.Unlock()
+	if !found || len(allowedIPs) == 0 {
+		return nil, fmt.Errorf("no generated key for peer %s", pubkey)
+	}
+	dev, err := wg.Client.Device(wg.Iface)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedIP := fmt.Sprint(allowedIPs[0].IP)
+	clientConfig := fmt.Sprintf(clientConfigTemplate, privateKey.String(), allowedIP,
+		dev.PublicKey.String(), wg.endpoint, tunneled)
 	//wg.Logger.Info(clientConfig)
 	return []byte(clientConfig), nil
 }
 
 // ClientsList ...
 func (wg *Wireguard) ClientsList() (map[string]hub.Bandwidth, error) {
-	// fmt.Print("\nGetting clients usage list ...\n")
 	clientsUsageMap := map[string]hub.Bandwidth{}
 	wgData, err := wg.Client.Device(wg.Iface)
 	if err != nil {
@@ -276,9 +479,46 @@ func (wg *Wireguard) ClientsList() (map[string]hub.Bandwidth, error) {
 	return clientsUsageMap, nil
 }
 
+// PeerUsage is the traffic of a peer, Upload is what the server received
+// from it.
+type PeerUsage struct {
+	Upload        int64
+	Download      int64
+	LastHandshake time.Time
+}
+
+// Usage reports the same counters as ClientsList without disconnecting
+// idle peers.
+func (wg *Wireguard) Usage() (map[string]PeerUsage, error) {
+	usage := map[string]PeerUsage{}
+	dev, err := wg.Client.Device(wg.Iface)
+	if err != nil {
+		return usage, err
+	}
+	for _, peer := range dev.Peers {
+		usage[peer.PublicKey.String()] = PeerUsage{
+			Upload:        peer.ReceiveBytes,
+			Download:      peer.TransmitBytes,
+			LastHandshake: peer.LastHandshakeTime,
+		}
+	}
+	return usage, nil
+}
+
+// Endpoint is the server address put in client configs.
+func (wg *Wireguard) Endpoint() string {
+	return wg.endpoint
+}
+
 // DisconnectClient ...
 func (wg *Wireguard) DisconnectClient(pubkey string) error {
-	fmt.Print("Disconnecting client")
+	return wg.DisconnectClientContext(context.Background(), pubkey)
+}
+
+// DisconnectClientContext is DisconnectClient tracing the device change
+// and the state save under the span of ctx.
+func (wg *Wireguard) DisconnectClientContext(ctx context.Context, pubkey string) error {
+	wg.Logger.Info("removing peer", zap.String("peer", pubkey))
 	publicKey, err := wgtypes.ParseKey(pubkey)
 	if err != nil {
 		return err
@@ -291,11 +531,21 @@ func (wg *Wireguard) DisconnectClient(pubkey string) error {
 		ReplacePeers: false,
 		Peers:        []wgtypes.PeerConfig{peer},
 	}
-	err = wg.Client.ConfigureDevice(wg.Iface, cfg)
+	wg.lock.Lock()
+	err = wg.configureDevice(ctx, cfg)
+	if err == nil {
+		wg.delRoutes(wg.routesLocked(publicKey))
+		delete(wg.peers, publicKey)
+		delete(wg.clientKeys, publicKey)
+		delete(wg.profiles, publicKey)
+	}
+	wg.lock.Unlock()
 	if err != nil {
-		log.Println("err:", err)
+		wg.Logger.Error("failed to remove peer", zap.String("peer", pubkey), zap.Error(err))
 		return err
 	}
+	wg.saveState(ctx)
+	wg.Events.Publish(events.PeerEvent(events.PeerRemoved, wg.Iface, pubkey))
 	return nil
 }
 